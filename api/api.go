@@ -0,0 +1,888 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/dgellow/nanogit/auth"
+	"github.com/dgellow/nanogit/config"
+	"github.com/dgellow/nanogit/identity"
+	"github.com/dgellow/nanogit/log"
+	"github.com/dgellow/nanogit/settings"
+	"github.com/dgellow/nanogit/token"
+)
+
+// Prefix of every route of the admin API
+const Prefix = "/api/v1/"
+
+// Separates an org path from its teams, repos and sub-orgs, as org paths
+// can be nested, e.g. /api/v1/orgs/fixme/infra/-/repos
+const subSeparator = "/-/"
+
+// IsRequest returns whether r is a request to the admin API.
+func IsRequest(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, Prefix)
+}
+
+// Handler serves the admin API, managing orgs, teams, repos and users of the
+// config file. Clients authenticate with an admin token, or org admins with
+// an API token of their own.
+func Handler() http.Handler {
+	return http.HandlerFunc(serve)
+}
+
+type apiError struct {
+	status  int
+	message string
+}
+
+func (e *apiError) Error() string {
+	return e.message
+}
+
+func notFound(format string, args ...interface{}) *apiError {
+	return &apiError{http.StatusNotFound, fmt.Sprintf(format, args...)}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Error("api: cannot write response: %v", err)
+	}
+}
+
+func decode(r *http.Request, v interface{}) error {
+	decoder := json.NewDecoder(io.LimitReader(r.Body, 1<<20))
+	if err := decoder.Decode(v); err != nil {
+		return &apiError{http.StatusBadRequest, fmt.Sprintf("Invalid request body: %v", err)}
+	}
+	return nil
+}
+
+func serve(w http.ResponseWriter, r *http.Request) {
+	log.Trace("api: %s %s", r.Method, r.URL.Path)
+	route := strings.TrimPrefix(r.URL.Path, Prefix)
+	if route == "openapi.json" && r.Method == "GET" {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, openAPI)
+		return
+	}
+
+	var err error
+	header := r.Header.Get("Authorization")
+	value := strings.TrimPrefix(header, "Bearer ")
+	if !strings.HasPrefix(header, "Bearer ") {
+		err = &apiError{http.StatusUnauthorized, "Admin token needed"}
+	} else if t, authErr := token.AuthenticateAdmin(value); authErr == nil {
+		log.Info("api: %s %s by %s", r.Method, r.URL.Path, t.User)
+		err = dispatch(w, r, route, true)
+	} else if userConfig, userErr := authenticateUser(value); userErr != nil {
+		if _, ok := userErr.(*apiError); !ok {
+			userErr = &apiError{http.StatusUnauthorized, authErr.Error()}
+		}
+		err = userErr
+	} else if err = authorize(userConfig, r, route); err == nil {
+		log.Info("api: %s %s by user %s", r.Method, r.URL.Path, userConfig.Name)
+		err = dispatch(w, r, route, false)
+	}
+
+	if err == nil {
+		return
+	}
+	status := http.StatusInternalServerError
+	switch e := err.(type) {
+	case *apiError:
+		status = e.status
+	case *config.ValidationError:
+		status = http.StatusUnprocessableEntity
+	}
+	if status == http.StatusInternalServerError {
+		log.Error("api: %s %s: %v", r.Method, r.URL.Path, err)
+	}
+	writeJSON(w, status, map[string]string{"message": err.Error()})
+}
+
+// Admin is false for org admins, authorized by authorize
+func dispatch(w http.ResponseWriter, r *http.Request, route string, admin bool) error {
+	switch {
+	case route == "orgs":
+		return serveOrgs(w, r, "")
+	case strings.HasPrefix(route, "orgs/"):
+		return serveOrg(w, r, strings.TrimPrefix(route, "orgs/"), admin)
+	case route == "users":
+		return serveUsers(w, r)
+	case strings.HasPrefix(route, "users/"):
+		return serveUser(w, r, strings.TrimPrefix(route, "users/"))
+	}
+	return notFound("Not found")
+}
+
+// Returns the user of an API token. Access tokens to repositories and web
+// tokens are not accepted.
+func authenticateUser(value string) (config.UserConfig, error) {
+	t, err := token.AuthenticateAPI(value)
+	if err != nil {
+		return config.UserConfig{}, err
+	}
+	return identity.Get().UserByName(t.User)
+}
+
+// Org admins can list, create and delete repos of their orgs, and manage
+// the members of their teams
+func authorize(userConfig config.UserConfig, r *http.Request, route string) error {
+	forbidden := &apiError{http.StatusForbidden, "Admin token or admin role of the org needed"}
+	i := strings.Index(route, subSeparator)
+	if !strings.HasPrefix(route, "orgs/") || i < 0 {
+		return forbidden
+	}
+	path := strings.ToLower(strings.Trim(strings.TrimPrefix(route[:i], "orgs/"), "/"))
+	sub := strings.Split(route[i+len(subSeparator):], "/")
+
+	var capability auth.Capability
+	switch {
+	case len(sub) == 1 && sub[0] == "repos" && (r.Method == "GET" || r.Method == "POST"),
+		len(sub) == 2 && sub[0] == "repos" && (r.Method == "GET" || r.Method == "DELETE"):
+		capability = auth.CapManageRepos
+	case len(sub) >= 3 && sub[0] == "teams" && sub[2] == "members":
+		capability = auth.CapManageTeams
+	default:
+		return forbidden
+	}
+	if !auth.Can(userConfig, path, "", capability) {
+		return forbidden
+	}
+	return nil
+}
+
+func methodNotAllowed(r *http.Request) error {
+	return &apiError{http.StatusMethodNotAllowed, "Method not allowed: " + r.Method}
+}
+
+// Names in paths and bodies must agree, renaming isn't supported as the
+// name is the directory of repos on disk
+func checkName(name *string, expected string) error {
+	if *name == "" {
+		*name = expected
+	}
+	if !strings.EqualFold(*name, expected) {
+		return &apiError{http.StatusUnprocessableEntity, fmt.Sprintf("Renaming is not supported: %s", expected)}
+	}
+	return nil
+}
+
+// Returns the org at path in orgs, nil if not found
+func findOrg(orgs []config.OrgConfig, path string) *config.OrgConfig {
+	ids := strings.SplitN(path, "/", 2)
+	for i := range orgs {
+		if !strings.EqualFold(orgs[i].Id, ids[0]) {
+			continue
+		}
+		if len(ids) == 1 {
+			return &orgs[i]
+		}
+		return findOrg(orgs[i].Orgs, ids[1])
+	}
+	return nil
+}
+
+// Returns the list the org at path belongs to, with its index
+func findOrgList(c *config.Config, path string) (*[]config.OrgConfig, int) {
+	list := &c.Orgs
+	if i := strings.LastIndex(path, "/"); i >= 0 {
+		parent := findOrg(c.Orgs, path[:i])
+		if parent == nil {
+			return nil, -1
+		}
+		list, path = &parent.Orgs, path[i+1:]
+	}
+	for i := range *list {
+		if strings.EqualFold((*list)[i].Id, path) {
+			return list, i
+		}
+	}
+	return list, -1
+}
+
+// Serves the orgs under parent, top-level orgs if empty
+func serveOrgs(w http.ResponseWriter, r *http.Request, parent string) error {
+	switch r.Method {
+	case "GET":
+		conf := settings.ConfInfo.Get()
+		orgs := conf.Orgs
+		if parent != "" {
+			org := findOrg(conf.Orgs, parent)
+			if org == nil {
+				return notFound("Org not found: %s", parent)
+			}
+			orgs = org.Orgs
+		}
+		writeJSON(w, http.StatusOK, nonNil(orgs))
+		return nil
+	case "POST":
+		org := config.OrgConfig{}
+		if err := decode(r, &org); err != nil {
+			return err
+		}
+		err := settings.ConfInfo.Update(func(c *config.Config) error {
+			list := &c.Orgs
+			if parent != "" {
+				parentOrg := findOrg(c.Orgs, parent)
+				if parentOrg == nil {
+					return notFound("Org not found: %s", parent)
+				}
+				list = &parentOrg.Orgs
+			}
+			for _, o := range *list {
+				if strings.EqualFold(o.Id, org.Id) {
+					return &apiError{http.StatusConflict, fmt.Sprintf("Org already exists: %s", org.Id)}
+				}
+			}
+			*list = append(*list, org)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		writeJSON(w, http.StatusCreated, org)
+		return nil
+	}
+	return methodNotAllowed(r)
+}
+
+func serveOrg(w http.ResponseWriter, r *http.Request, route string, admin bool) error {
+	path, sub := route, ""
+	if i := strings.Index(route, subSeparator); i >= 0 {
+		path, sub = route[:i], route[i+len(subSeparator):]
+	}
+	path = strings.ToLower(strings.Trim(path, "/"))
+	switch {
+	case sub == "orgs":
+		return serveOrgs(w, r, path)
+	case sub == "teams":
+		return serveTeams(w, r, path)
+	case strings.HasPrefix(sub, "teams/"):
+		return serveTeam(w, r, path, strings.TrimPrefix(sub, "teams/"))
+	case sub == "repos":
+		return serveRepos(w, r, path, admin)
+	case strings.HasPrefix(sub, "repos/"):
+		return serveRepo(w, r, path, strings.TrimPrefix(sub, "repos/"), admin)
+	case sub != "":
+		return notFound("Not found")
+	}
+
+	switch r.Method {
+	case "GET":
+		org := findOrg(settings.ConfInfo.Get().Orgs, path)
+		if org == nil {
+			return notFound("Org not found: %s", path)
+		}
+		writeJSON(w, http.StatusOK, org)
+		return nil
+	case "PUT":
+		org := config.OrgConfig{}
+		if err := decode(r, &org); err != nil {
+			return err
+		}
+		if err := checkName(&org.Id, path[strings.LastIndex(path, "/")+1:]); err != nil {
+			return err
+		}
+		err := settings.ConfInfo.Update(func(c *config.Config) error {
+			list, i := findOrgList(c, path)
+			if i < 0 {
+				return notFound("Org not found: %s", path)
+			}
+			(*list)[i] = org
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		writeJSON(w, http.StatusOK, org)
+		return nil
+	case "DELETE":
+		err := settings.ConfInfo.Update(func(c *config.Config) error {
+			list, i := findOrgList(c, path)
+			if i < 0 {
+				return notFound("Org not found: %s", path)
+			}
+			*list = append((*list)[:i], (*list)[i+1:]...)
+			// Members of the org and its sub-orgs lose their membership
+			for u := range c.Users {
+				orgs := []config.UserOrgConfig{}
+				for _, userOrg := range c.Users[u].Orgs {
+					id := strings.ToLower(userOrg.Id)
+					if id != path && !strings.HasPrefix(id, path+"/") {
+						orgs = append(orgs, userOrg)
+					}
+				}
+				c.Users[u].Orgs = orgs
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+	return methodNotAllowed(r)
+}
+
+// Applies fn to the org at path of the config being updated
+func updateOrg(path string, fn func(org *config.OrgConfig) error) error {
+	return settings.ConfInfo.Update(func(c *config.Config) error {
+		org := findOrg(c.Orgs, path)
+		if org == nil {
+			return notFound("Org not found: %s", path)
+		}
+		return fn(org)
+	})
+}
+
+func serveTeams(w http.ResponseWriter, r *http.Request, path string) error {
+	switch r.Method {
+	case "GET":
+		org := findOrg(settings.ConfInfo.Get().Orgs, path)
+		if org == nil {
+			return notFound("Org not found: %s", path)
+		}
+		writeJSON(w, http.StatusOK, nonNil(org.Teams))
+		return nil
+	case "POST":
+		team := config.TeamConfig{}
+		if err := decode(r, &team); err != nil {
+			return err
+		}
+		err := updateOrg(path, func(org *config.OrgConfig) error {
+			for _, t := range org.Teams {
+				if t.Name == team.Name {
+					return &apiError{http.StatusConflict, fmt.Sprintf("Team already exists: %s", team.Name)}
+				}
+			}
+			org.Teams = append(org.Teams, team)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		writeJSON(w, http.StatusCreated, team)
+		return nil
+	}
+	return methodNotAllowed(r)
+}
+
+func findTeam(org *config.OrgConfig, name string) int {
+	for i, team := range org.Teams {
+		if team.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func serveTeam(w http.ResponseWriter, r *http.Request, path string, route string) error {
+	name, sub := route, ""
+	if i := strings.Index(route, "/"); i >= 0 {
+		name, sub = route[:i], route[i+1:]
+	}
+	switch {
+	case sub == "":
+	case sub == "members":
+		return serveMembers(w, r, path, name)
+	case strings.HasPrefix(sub, "members/"):
+		return serveMember(w, r, path, name, strings.TrimPrefix(sub, "members/"))
+	default:
+		return notFound("Not found")
+	}
+
+	switch r.Method {
+	case "GET":
+		org := findOrg(settings.ConfInfo.Get().Orgs, path)
+		if org == nil {
+			return notFound("Org not found: %s", path)
+		}
+		i := findTeam(org, name)
+		if i < 0 {
+			return notFound("Team not found: %s", name)
+		}
+		writeJSON(w, http.StatusOK, org.Teams[i])
+		return nil
+	case "PUT":
+		team := config.TeamConfig{}
+		if err := decode(r, &team); err != nil {
+			return err
+		}
+		if team.Name == "" {
+			team.Name = name
+		}
+		if team.Name != name {
+			return &apiError{http.StatusUnprocessableEntity, fmt.Sprintf("Renaming is not supported: %s", name)}
+		}
+		err := updateOrg(path, func(org *config.OrgConfig) error {
+			i := findTeam(org, name)
+			if i < 0 {
+				return notFound("Team not found: %s", name)
+			}
+			org.Teams[i] = team
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		writeJSON(w, http.StatusOK, team)
+		return nil
+	case "DELETE":
+		err := settings.ConfInfo.Update(func(c *config.Config) error {
+			org := findOrg(c.Orgs, path)
+			if org == nil {
+				return notFound("Org not found: %s", path)
+			}
+			i := findTeam(org, name)
+			if i < 0 {
+				return notFound("Team not found: %s", name)
+			}
+			org.Teams = append(org.Teams[:i], org.Teams[i+1:]...)
+			// Members of the org leave the team
+			for u := range c.Users {
+				for o, userOrg := range c.Users[u].Orgs {
+					if strings.ToLower(userOrg.Id) == path {
+						c.Users[u].Orgs[o].Teams = without(userOrg.Teams, name)
+					}
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+	return methodNotAllowed(r)
+}
+
+// Returns an error if the org at path has no team with the given name,
+// inherited teams included
+func checkTeam(c *config.Config, path string, name string) error {
+	ci := config.ConfigInfo{Conf: *c}
+	org, err := ci.LookupOrgById(path)
+	if err != nil {
+		return notFound("Org not found: %s", path)
+	}
+	for _, team := range org.Teams {
+		if team.Name == name {
+			return nil
+		}
+	}
+	return notFound("Team not found: %s", name)
+}
+
+// Members of the default team are the members of the org
+func isMember(userOrg config.UserOrgConfig, path string, team string) bool {
+	if strings.ToLower(userOrg.Id) != path {
+		return false
+	}
+	if team == config.DefaultTeam {
+		return true
+	}
+	for _, t := range userOrg.Teams {
+		if t == team {
+			return true
+		}
+	}
+	return false
+}
+
+// Lists the names of the members of a team, as given by the config file
+func serveMembers(w http.ResponseWriter, r *http.Request, path string, team string) error {
+	if r.Method != "GET" {
+		return methodNotAllowed(r)
+	}
+	conf := settings.ConfInfo.Get()
+	if err := checkTeam(&conf, path, team); err != nil {
+		return err
+	}
+	members := []string{}
+	for _, user := range conf.Users {
+		for _, userOrg := range user.Orgs {
+			if isMember(userOrg, path, team) {
+				members = append(members, user.Name)
+				break
+			}
+		}
+	}
+	writeJSON(w, http.StatusOK, members)
+	return nil
+}
+
+// Adds a user to a team, or removes them from it. The memberships of the org
+// itself are changed, not the ones of its parents.
+func serveMember(w http.ResponseWriter, r *http.Request, path string, team string, name string) error {
+	if team == config.DefaultTeam {
+		return &apiError{http.StatusUnprocessableEntity, "Members of the default team are the members of the org"}
+	}
+	if r.Method != "PUT" && r.Method != "DELETE" {
+		return methodNotAllowed(r)
+	}
+	err := settings.ConfInfo.Update(func(c *config.Config) error {
+		if err := checkTeam(c, path, team); err != nil {
+			return err
+		}
+		i := findUser(c, name)
+		if i < 0 {
+			return notFound("User not found: %s", name)
+		}
+		user := &c.Users[i]
+		for o := range user.Orgs {
+			userOrg := &user.Orgs[o]
+			if strings.ToLower(userOrg.Id) != path {
+				continue
+			}
+			member := isMember(*userOrg, path, team)
+			switch {
+			case r.Method == "PUT" && !member:
+				userOrg.Teams = append(userOrg.Teams, team)
+			case r.Method == "DELETE" && member:
+				userOrg.Teams = without(userOrg.Teams, team)
+			case r.Method == "DELETE":
+				return notFound("User %s is not a member of team %s", name, team)
+			}
+			return nil
+		}
+		if r.Method == "DELETE" {
+			return notFound("User %s is not a member of team %s", name, team)
+		}
+		user.Orgs = append(user.Orgs, config.UserOrgConfig{Id: path, Teams: []string{team}})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// Fields of repos only admin tokens can set: they give access to the repo
+// without a user, reach other hosts with credentials of the server, or lift
+// limits set by admins
+func restrictedFields(repo config.RepoConfig) []string {
+	fields := []string{}
+	if len(repo.DeployKeys) > 0 {
+		fields = append(fields, "deploykeys")
+	}
+	if repo.Mirror != (config.MirrorConfig{}) {
+		fields = append(fields, "mirror")
+	}
+	if len(repo.PushMirrors) > 0 {
+		fields = append(fields, "pushmirrors")
+	}
+	if repo.Quota != 0 {
+		fields = append(fields, "quota")
+	}
+	if len(repo.Network.Allow) > 0 || len(repo.Network.Deny) > 0 {
+		fields = append(fields, "network")
+	}
+	return fields
+}
+
+func checkRestrictedFields(repo config.RepoConfig, admin bool) error {
+	if fields := restrictedFields(repo); !admin && len(fields) > 0 {
+		return &apiError{http.StatusForbidden, "Admin token needed to set " + strings.Join(fields, ", ")}
+	}
+	return nil
+}
+
+// Org admins don't see the credentials of mirrors
+func redactRepo(repo config.RepoConfig, admin bool) config.RepoConfig {
+	if admin {
+		return repo
+	}
+	repo.Mirror.SSHKey, repo.Mirror.Username, repo.Mirror.Password = "", "", ""
+	if repo.PushMirrors != nil {
+		pushMirrors := make([]config.PushMirrorConfig, len(repo.PushMirrors))
+		for i, pm := range repo.PushMirrors {
+			pm.SSHKey, pm.Username, pm.Password = "", "", ""
+			pushMirrors[i] = pm
+		}
+		repo.PushMirrors = pushMirrors
+	}
+	return repo
+}
+
+func serveRepos(w http.ResponseWriter, r *http.Request, path string, admin bool) error {
+	switch r.Method {
+	case "GET":
+		org := findOrg(settings.ConfInfo.Get().Orgs, path)
+		if org == nil {
+			return notFound("Org not found: %s", path)
+		}
+		repos := make([]config.RepoConfig, len(org.Repos))
+		for i, repo := range org.Repos {
+			repos[i] = redactRepo(repo, admin)
+		}
+		writeJSON(w, http.StatusOK, repos)
+		return nil
+	case "POST":
+		repo := config.RepoConfig{}
+		if err := decode(r, &repo); err != nil {
+			return err
+		}
+		if err := checkRestrictedFields(repo, admin); err != nil {
+			return err
+		}
+		err := updateOrg(path, func(org *config.OrgConfig) error {
+			if findRepo(org, repo.Name) >= 0 {
+				return &apiError{http.StatusConflict, fmt.Sprintf("Repo already exists: %s/%s", path, repo.Name)}
+			}
+			org.Repos = append(org.Repos, repo)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		writeJSON(w, http.StatusCreated, repo)
+		return nil
+	}
+	return methodNotAllowed(r)
+}
+
+func findRepo(org *config.OrgConfig, name string) int {
+	for i, repo := range org.Repos {
+		if strings.EqualFold(repo.Name, name) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Repositories on disk are left as is, only their config is changed
+func serveRepo(w http.ResponseWriter, r *http.Request, path string, name string, admin bool) error {
+	switch r.Method {
+	case "GET":
+		org := findOrg(settings.ConfInfo.Get().Orgs, path)
+		if org == nil {
+			return notFound("Org not found: %s", path)
+		}
+		i := findRepo(org, name)
+		if i < 0 {
+			return notFound("Repo not found: %s/%s", path, name)
+		}
+		writeJSON(w, http.StatusOK, redactRepo(org.Repos[i], admin))
+		return nil
+	case "PUT":
+		repo := config.RepoConfig{}
+		if err := decode(r, &repo); err != nil {
+			return err
+		}
+		if err := checkName(&repo.Name, name); err != nil {
+			return err
+		}
+		if err := checkRestrictedFields(repo, admin); err != nil {
+			return err
+		}
+		err := updateOrg(path, func(org *config.OrgConfig) error {
+			i := findRepo(org, name)
+			if i < 0 {
+				return notFound("Repo not found: %s/%s", path, name)
+			}
+			org.Repos[i] = repo
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		writeJSON(w, http.StatusOK, repo)
+		return nil
+	case "DELETE":
+		err := updateOrg(path, func(org *config.OrgConfig) error {
+			i := findRepo(org, name)
+			if i < 0 {
+				return notFound("Repo not found: %s/%s", path, name)
+			}
+			org.Repos = append(org.Repos[:i], org.Repos[i+1:]...)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+	return methodNotAllowed(r)
+}
+
+func findUser(c *config.Config, name string) int {
+	for i, user := range c.Users {
+		if strings.EqualFold(user.Name, name) {
+			return i
+		}
+	}
+	return -1
+}
+
+func serveUsers(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case "GET":
+		writeJSON(w, http.StatusOK, nonNil(settings.ConfInfo.Get().Users))
+		return nil
+	case "POST":
+		user := config.UserConfig{}
+		if err := decode(r, &user); err != nil {
+			return err
+		}
+		err := settings.ConfInfo.Update(func(c *config.Config) error {
+			if findUser(c, user.Name) >= 0 {
+				return &apiError{http.StatusConflict, fmt.Sprintf("User already exists: %s", user.Name)}
+			}
+			c.Users = append(c.Users, user)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		writeJSON(w, http.StatusCreated, user)
+		return nil
+	}
+	return methodNotAllowed(r)
+}
+
+func serveUser(w http.ResponseWriter, r *http.Request, route string) error {
+	name, sub := route, ""
+	if i := strings.Index(route, "/"); i >= 0 {
+		name, sub = route[:i], route[i+1:]
+	}
+	switch sub {
+	case "":
+	case "sshkeys":
+		return serveSSHKeys(w, r, name)
+	default:
+		return notFound("Not found")
+	}
+
+	switch r.Method {
+	case "GET":
+		conf := settings.ConfInfo.Get()
+		i := findUser(&conf, name)
+		if i < 0 {
+			return notFound("User not found: %s", name)
+		}
+		writeJSON(w, http.StatusOK, conf.Users[i])
+		return nil
+	case "PUT":
+		user := config.UserConfig{}
+		if err := decode(r, &user); err != nil {
+			return err
+		}
+		if err := checkName(&user.Name, name); err != nil {
+			return err
+		}
+		err := settings.ConfInfo.Update(func(c *config.Config) error {
+			i := findUser(c, name)
+			if i < 0 {
+				return notFound("User not found: %s", name)
+			}
+			c.Users[i] = user
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		writeJSON(w, http.StatusOK, user)
+		return nil
+	case "DELETE":
+		err := settings.ConfInfo.Update(func(c *config.Config) error {
+			i := findUser(c, name)
+			if i < 0 {
+				return notFound("User not found: %s", name)
+			}
+			c.Users = append(c.Users[:i], c.Users[i+1:]...)
+			// Repos shared with the user aren't anymore
+			for u := range c.Users {
+				for s, share := range c.Users[u].Shares {
+					c.Users[u].Shares[s].Users = without(share.Users, name)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+	return methodNotAllowed(r)
+}
+
+func serveSSHKeys(w http.ResponseWriter, r *http.Request, name string) error {
+	switch r.Method {
+	case "GET":
+		conf := settings.ConfInfo.Get()
+		i := findUser(&conf, name)
+		if i < 0 {
+			return notFound("User not found: %s", name)
+		}
+		writeJSON(w, http.StatusOK, nonNil(conf.Users[i].SSHKeys))
+		return nil
+	case "POST":
+		key := config.PubKeyConfig{}
+		if err := decode(r, &key); err != nil {
+			return err
+		}
+		err := settings.ConfInfo.Update(func(c *config.Config) error {
+			i := findUser(c, name)
+			if i < 0 {
+				return notFound("User not found: %s", name)
+			}
+			c.Users[i].SSHKeys = append(c.Users[i].SSHKeys, key)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		writeJSON(w, http.StatusCreated, key)
+		return nil
+	}
+	return methodNotAllowed(r)
+}
+
+// Returns list without name, names being compared case insensitively
+func without(list []string, name string) []string {
+	result := []string{}
+	for _, item := range list {
+		if !strings.EqualFold(item, name) {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+// Empty lists are sent as [] rather than null
+func nonNil(list interface{}) interface{} {
+	switch l := list.(type) {
+	case []config.OrgConfig:
+		if l == nil {
+			return []config.OrgConfig{}
+		}
+	case []config.TeamConfig:
+		if l == nil {
+			return []config.TeamConfig{}
+		}
+	case []config.RepoConfig:
+		if l == nil {
+			return []config.RepoConfig{}
+		}
+	case []config.UserConfig:
+		if l == nil {
+			return []config.UserConfig{}
+		}
+	case []config.PubKeyConfig:
+		if l == nil {
+			return []config.PubKeyConfig{}
+		}
+	}
+	return list
+}
@@ -0,0 +1,265 @@
+package api
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgellow/nanogit/config"
+	"github.com/dgellow/nanogit/settings"
+	"github.com/dgellow/nanogit/token"
+)
+
+const initialConfig = `# Hand written config
+server:
+  dataroot: %s
+orgs:
+  - id: fixme
+    teams:
+      - name: dev
+        read: yes
+      - name: owners
+        role: admin
+users:
+  - name: alice
+    orgs:
+      - id: fixme
+        teams: [dev]
+  - name: olivia
+    orgs:
+      - id: fixme
+        teams: [owners]
+`
+
+func request(t *testing.T, server *httptest.Server, auth string, method string, path string, body string) (int, string) {
+	req, err := http.NewRequest(method, server.URL+Prefix+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("Cannot create request: %v", err)
+	}
+	if auth != "" {
+		req.Header.Set("Authorization", "Bearer "+auth)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("%s %s: cannot read body: %v", method, path, err)
+	}
+	return resp.StatusCode, string(data)
+}
+
+func TestAPI(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "nanogit-api")
+	if err != nil {
+		t.Fatalf("Cannot create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	configFile := filepath.Join(tmpDir, "config.yml")
+	initial := strings.Replace(initialConfig, "%s", filepath.Join(tmpDir, "dataroot"), 1)
+	if err := ioutil.WriteFile(configFile, []byte(initial), 0640); err != nil {
+		t.Fatalf("Cannot write config: %v", err)
+	}
+	settings.ConfInfo = config.ConfigInfo{ConfigFile: configFile}
+	settings.ConfInfo.ReadFile()
+	defer func() { settings.ConfInfo = config.ConfigInfo{} }()
+
+	admin, _, err := token.CreateAdmin("hr-sync", time.Time{})
+	if err != nil {
+		t.Fatalf("token.CreateAdmin() == %v", err)
+	}
+	userToken, _, err := token.CreateAPI("alice", time.Time{})
+	if err != nil {
+		t.Fatalf("token.CreateAPI() == %v", err)
+	}
+	ownerToken, _, err := token.CreateAPI("olivia", time.Time{})
+	if err != nil {
+		t.Fatalf("token.CreateAPI() == %v", err)
+	}
+	accessToken, _, err := token.Create("olivia", "fixme", "foo", true, time.Time{})
+	if err != nil {
+		t.Fatalf("token.Create() == %v", err)
+	}
+	webToken, _, err := token.CreateWeb("olivia", time.Time{})
+	if err != nil {
+		t.Fatalf("token.CreateWeb() == %v", err)
+	}
+	server := httptest.NewServer(Handler())
+	defer server.Close()
+
+	var spec map[string]interface{}
+	if status, body := request(t, server, "", "GET", "openapi.json", ""); status != http.StatusOK || json.Unmarshal([]byte(body), &spec) != nil {
+		t.Errorf("GET openapi.json == %d, expected %d with a JSON description", status, http.StatusOK)
+	}
+
+	tests := []struct {
+		auth     string
+		method   string
+		path     string
+		body     string
+		status   int
+		contains string
+	}{
+		{"", "GET", "orgs", "", http.StatusUnauthorized, ""},
+		{"invalid.token", "GET", "orgs", "", http.StatusUnauthorized, ""},
+		{userToken, "GET", "orgs", "", http.StatusForbidden, "admin role"},
+		{admin, "GET", "orgs", "", http.StatusOK, `"id":"fixme"`},
+		{admin, "GET", "unknown", "", http.StatusNotFound, ""},
+
+		// Orgs
+		{admin, "POST", "orgs", `{"id": "qrclabs", "description": "QRC Labs", "quota": "10G"}`, http.StatusCreated, `"quota":"10G"`},
+		{admin, "POST", "orgs", `{"id": "QRCLabs"}`, http.StatusConflict, ""},
+		{admin, "POST", "orgs", `{"id": "bad name"}`, http.StatusUnprocessableEntity, "Invalid name"},
+		{admin, "POST", "orgs", `{"id": "x", "quota": "-1G"}`, http.StatusBadRequest, "Invalid size"},
+		{admin, "POST", "orgs", `{"id": `, http.StatusBadRequest, ""},
+		{admin, "POST", "orgs/qrclabs/-/orgs", `{"id": "infra"}`, http.StatusCreated, ""},
+		{admin, "POST", "orgs/missing/-/orgs", `{"id": "infra"}`, http.StatusNotFound, ""},
+		{admin, "GET", "orgs/qrclabs/infra", "", http.StatusOK, `"id":"infra"`},
+		{admin, "GET", "orgs/qrclabs/-/orgs", "", http.StatusOK, `"id":"infra"`},
+		{admin, "PUT", "orgs/qrclabs/infra", `{"description": "Infrastructure"}`, http.StatusOK, `"id":"infra"`},
+		{admin, "PUT", "orgs/qrclabs/infra", `{"id": "ops"}`, http.StatusUnprocessableEntity, "Renaming"},
+		{admin, "PATCH", "orgs/qrclabs", `{}`, http.StatusMethodNotAllowed, ""},
+
+		// Teams
+		{admin, "POST", "orgs/qrclabs/-/teams", `{"name": "dev", "read": true, "write": true}`, http.StatusCreated, ""},
+		{admin, "POST", "orgs/qrclabs/-/teams", `{"name": "dev"}`, http.StatusConflict, ""},
+		{admin, "POST", "orgs/qrclabs/-/teams", `{"read": true}`, http.StatusUnprocessableEntity, "Team without name"},
+		{admin, "POST", "orgs/qrclabs/-/teams", `{"name": "ops", "read": true}`, http.StatusCreated, ""},
+		{admin, "PUT", "orgs/qrclabs/-/teams/ops", `{"read": true, "write": true}`, http.StatusOK, `"write":true`},
+		// Read and write are migrated to roles
+		{admin, "GET", "orgs/qrclabs/-/teams/ops", "", http.StatusOK, `"role":"maintainer"`},
+		{admin, "PUT", "orgs/qrclabs/-/teams/ops", `{"role": "writer"}`, http.StatusOK, `"role":"writer"`},
+		{admin, "PUT", "orgs/qrclabs/-/teams/ops", `{"role": "boss"}`, http.StatusUnprocessableEntity, "Unknown role boss"},
+		{admin, "PUT", "orgs/qrclabs/-/teams/ops", `{"role": "reader", "write": true}`, http.StatusUnprocessableEntity, "both a role and read or write"},
+		{admin, "GET", "orgs/qrclabs/-/teams/missing", "", http.StatusNotFound, ""},
+
+		// Repos
+		{admin, "POST", "orgs/qrclabs/infra/-/repos", `{"name": "terraform", "deploykeys": [{"name": "ci", "key": "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIJy3dGq8YXe/SMhgWlBZTYSoWsaBS7XE7OXFa5AusxMK"}]}`, http.StatusCreated, ""},
+		{admin, "POST", "orgs/qrclabs/infra/-/repos", `{"name": "Terraform"}`, http.StatusConflict, ""},
+		{admin, "POST", "orgs/qrclabs/infra/-/repos", `{"name": "x.git"}`, http.StatusUnprocessableEntity, "Reserved name"},
+		{admin, "POST", "orgs/qrclabs/infra/-/repos", `{"name": "y", "deploykeys": [{"name": "ci"}]}`, http.StatusUnprocessableEntity, "needs a name and a key"},
+		{admin, "POST", "orgs/qrclabs/infra/-/repos", `{"name": "y", "deploykeys": [{"name": "ci", "key": "ssh-ed25519 AAAA"}]}`, http.StatusUnprocessableEntity, "Invalid deploy key ci"},
+		{admin, "PUT", "orgs/qrclabs/infra/-/repos/terraform", `{"quota": 1024}`, http.StatusOK, `"quota":"1K"`},
+		{admin, "GET", "orgs/qrclabs/infra/-/repos", "", http.StatusOK, `"name":"terraform"`},
+		{admin, "POST", "orgs/qrclabs/infra/-/repos", `{"name": "old"}`, http.StatusCreated, ""},
+		{admin, "DELETE", "orgs/qrclabs/infra/-/repos/old", "", http.StatusNoContent, ""},
+		{admin, "GET", "orgs/qrclabs/infra/-/repos/old", "", http.StatusNotFound, ""},
+
+		// Users
+		{admin, "POST", "users", `{"name": "bob", "orgs": [{"id": "qrclabs", "teams": ["dev", "ops"]}, {"id": "qrclabs/infra"}]}`, http.StatusCreated, ""},
+		{admin, "POST", "users", `{"name": "Bob"}`, http.StatusConflict, ""},
+		{admin, "POST", "users", `{"name": "carol", "orgs": [{"id": "unknown"}]}`, http.StatusUnprocessableEntity, "Unknown org"},
+		{admin, "POST", "users", `{"name": "carol", "shares": [{"repo": "*", "users": ["dave"]}]}`, http.StatusUnprocessableEntity, "Unknown user dave"},
+		{admin, "POST", "users", `{"name": "carol", "shares": [{"repo": "*", "users": ["bob"]}]}`, http.StatusCreated, ""},
+		{admin, "POST", "users/bob/sshkeys", `{"type": "hardcoded", "val": "ssh-ed25519 AAAAbob"}`, http.StatusCreated, ""},
+		{admin, "POST", "users/bob/sshkeys", `{"type": "hardcoded"}`, http.StatusUnprocessableEntity, "SSH key without value"},
+		{admin, "GET", "users/bob/sshkeys", "", http.StatusOK, "AAAAbob"},
+		{admin, "GET", "users/bob", "", http.StatusOK, `"teams":["dev","ops"]`},
+		{admin, "PUT", "users/alice", `{"name": "alicia"}`, http.StatusUnprocessableEntity, "Renaming"},
+		{admin, "GET", "users/missing", "", http.StatusNotFound, ""},
+
+		// Org admins manage repos and team members of their orgs only
+		{ownerToken, "GET", "orgs", "", http.StatusForbidden, ""},
+		{ownerToken, "POST", "orgs/fixme/-/repos", `{"name": "tools"}`, http.StatusCreated, ""},
+		{ownerToken, "GET", "orgs/fixme/-/repos/tools", "", http.StatusOK, `"name":"tools"`},
+		{ownerToken, "PUT", "orgs/fixme/-/repos/tools", `{"quota": "1G"}`, http.StatusForbidden, ""},
+		// Only admins give access without a user, to other hosts, or lift limits
+		{ownerToken, "POST", "orgs/fixme/-/repos", `{"name": "keyed", "deploykeys": [{"name": "ci", "key": "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIJy3dGq8YXe/SMhgWlBZTYSoWsaBS7XE7OXFa5AusxMK"}]}`, http.StatusForbidden, "Admin token needed to set deploykeys"},
+		{ownerToken, "POST", "orgs/fixme/-/repos", `{"name": "mirrored", "mirror": {"url": "https://example.com/a.git"}}`, http.StatusForbidden, "Admin token needed to set mirror"},
+		{ownerToken, "POST", "orgs/fixme/-/repos", `{"name": "mirrored", "mirror": {"url": "https://example.com/a.git", "password": "secret"}}`, http.StatusForbidden, "mirror"},
+		{ownerToken, "POST", "orgs/fixme/-/repos", `{"name": "pushed", "pushmirrors": [{"name": "backup", "url": "https://example.com/a.git"}]}`, http.StatusForbidden, "pushmirrors"},
+		{ownerToken, "POST", "orgs/fixme/-/repos", `{"name": "big", "quota": "1T"}`, http.StatusForbidden, "quota"},
+		{ownerToken, "POST", "orgs/fixme/-/repos", `{"name": "open", "network": {"allow": ["0.0.0.0/0"]}}`, http.StatusForbidden, "network"},
+		{ownerToken, "GET", "orgs/fixme/-/repos/mirrored", "", http.StatusNotFound, ""},
+		{admin, "POST", "orgs/fixme/-/repos", `{"name": "mirrored", "mirror": {"url": "https://example.com/a.git", "username": "bot", "password": "secret"}, "pushmirrors": [{"name": "backup", "url": "https://example.com/b.git", "password": "other"}]}`, http.StatusCreated, "secret"},
+		// Credentials of mirrors are hidden from org admins
+		{ownerToken, "GET", "orgs/fixme/-/repos/mirrored", "", http.StatusOK, `"url":"https://example.com/a.git","interval":0,"sshkey":"","username":"","password":""`},
+		{ownerToken, "GET", "orgs/fixme/-/repos", "", http.StatusOK, `"name":"backup","url":"https://example.com/b.git","sshkey":"","username":"","password":""`},
+		{admin, "GET", "orgs/fixme/-/repos/mirrored", "", http.StatusOK, `"password":"other"`},
+		{ownerToken, "DELETE", "orgs/fixme/-/repos/mirrored", "", http.StatusNoContent, ""},
+		{ownerToken, "DELETE", "orgs/fixme/-/repos/tools", "", http.StatusNoContent, ""},
+		{ownerToken, "POST", "orgs/qrclabs/-/repos", `{"name": "tools"}`, http.StatusForbidden, ""},
+		{ownerToken, "PUT", "orgs/fixme/-/teams/dev", `{"role": "admin"}`, http.StatusForbidden, ""},
+		{accessToken, "GET", "orgs/fixme/-/repos", "", http.StatusUnauthorized, ""},
+		{webToken, "GET", "orgs/fixme/-/repos", "", http.StatusUnauthorized, ""},
+		{userToken, "POST", "orgs/fixme/-/repos", `{"name": "tools"}`, http.StatusForbidden, ""},
+		{ownerToken, "GET", "orgs/fixme/-/teams/dev/members", "", http.StatusOK, `["alice"]`},
+		{ownerToken, "GET", "orgs/fixme/-/teams/default/members", "", http.StatusNotFound, ""},
+		{ownerToken, "DELETE", "orgs/fixme/-/teams/dev/members/alice", "", http.StatusNoContent, ""},
+		{ownerToken, "DELETE", "orgs/fixme/-/teams/dev/members/alice", "", http.StatusNotFound, "not a member"},
+		{ownerToken, "GET", "orgs/fixme/-/teams/dev/members", "", http.StatusOK, `[]`},
+		{ownerToken, "PUT", "orgs/fixme/-/teams/dev/members/alice", "", http.StatusNoContent, ""},
+		{ownerToken, "PUT", "orgs/fixme/-/teams/dev/members/alice", "", http.StatusNoContent, ""},
+		{admin, "GET", "users/alice", "", http.StatusOK, `"teams":["dev"]`},
+		{ownerToken, "PUT", "orgs/fixme/-/teams/missing/members/alice", "", http.StatusNotFound, "Team not found"},
+		{ownerToken, "PUT", "orgs/fixme/-/teams/dev/members/missing", "", http.StatusNotFound, "User not found"},
+		{ownerToken, "PUT", "orgs/qrclabs/-/teams/dev/members/alice", "", http.StatusForbidden, ""},
+		{admin, "PUT", "orgs/qrclabs/-/teams/dev/members/alice", "", http.StatusNoContent, ""},
+		{admin, "GET", "users/alice", "", http.StatusOK, `{"id":"qrclabs","teams":["dev"]}`},
+
+		// Deletions remove references
+		{admin, "DELETE", "orgs/qrclabs/-/teams/ops", "", http.StatusNoContent, ""},
+		{admin, "GET", "users/bob", "", http.StatusOK, `"teams":["dev"]`},
+		{admin, "DELETE", "orgs/qrclabs/infra", "", http.StatusNoContent, ""},
+		{admin, "GET", "users/bob", "", http.StatusOK, `"orgs":[{"id":"qrclabs","teams":["dev"]}]`},
+		{admin, "DELETE", "users/bob", "", http.StatusNoContent, ""},
+		{admin, "GET", "users/carol", "", http.StatusOK, `"users":null`},
+		{admin, "DELETE", "users/bob", "", http.StatusNotFound, ""},
+	}
+	for i, test := range tests {
+		status, body := request(t, server, test.auth, test.method, test.path, test.body)
+		if status != test.status || !strings.Contains(body, test.contains) {
+			t.Errorf("#%d: %s %s == %d %s, expected %d containing %q", i, test.method, test.path, status, body, test.status, test.contains)
+		}
+	}
+
+	// Changes are saved in the config file, the previous version is kept
+	saved := config.ConfigInfo{ConfigFile: configFile}
+	saved.ReadFile()
+	if _, err := saved.LookupRepo("qrclabs", "terraform"); err == nil {
+		t.Errorf("Repos of deleted orgs should be removed from the config file")
+	}
+	if org, err := saved.LookupOrgById("qrclabs"); err != nil || org.Quota != 10*config.GiB || len(org.Teams) != 1 {
+		t.Errorf("Saved org qrclabs == %+v, %v", org, err)
+	}
+	if org, err := saved.LookupOrgById("fixme"); err != nil || org.Teams[0].Role != config.RoleReader || org.Teams[0].Read {
+		t.Errorf("Saved org fixme == %+v, %v, expected team dev to be migrated to the reader role", org, err)
+	}
+	if _, err := saved.LookupUserByName("carol"); err != nil {
+		t.Errorf("Saved user carol: %v", err)
+	}
+	if _, err := settings.ConfInfo.LookupUserByName("carol"); err != nil {
+		t.Errorf("The running config should be updated: %v", err)
+	}
+	if info, err := os.Stat(configFile); err != nil || info.Mode().Perm() != 0640 {
+		t.Errorf("The config file should keep its mode: %v, %v", info, err)
+	}
+	if _, err := os.Stat(configFile + ".bak"); err != nil {
+		t.Errorf("The previous config should be kept: %v", err)
+	}
+
+	// Changes made by hand since the config was loaded are kept
+	data, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		t.Fatalf("Cannot read config: %v", err)
+	}
+	// Users are the last section of the saved file
+	data = append(data, []byte("- name: edited-by-hand\n")...)
+	if err := ioutil.WriteFile(configFile, data, 0640); err != nil {
+		t.Fatalf("Cannot write config: %v", err)
+	}
+	if status, body := request(t, server, admin, "POST", "users", `{"name": "erin"}`); status != http.StatusCreated {
+		t.Fatalf("POST users == %d %s", status, body)
+	}
+	if _, err := settings.ConfInfo.LookupUserByName("edited-by-hand"); err != nil {
+		t.Errorf("Users added by hand should be kept: %v", err)
+	}
+}
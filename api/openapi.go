@@ -0,0 +1,169 @@
+package api
+
+// OpenAPI description of the admin API, served at /api/v1/openapi.json
+const openAPI = `{
+  "openapi": "3.0.3",
+  "info": {
+    "title": "nanogit admin API",
+    "version": "1",
+    "description": "Manages orgs, teams, repos and users of the config file. Every change is validated like the config file at startup, then the file is rewritten atomically. Durations are in nanoseconds, sizes are strings with an optional unit (512K, 10G) or numbers of bytes. Org paths of sub-orgs are given as parent/child."
+  },
+  "servers": [{"url": "/api/v1"}],
+  "security": [{"adminToken": []}],
+  "paths": {
+    "/orgs": {
+      "get": {"summary": "List top-level orgs, with their sub-orgs", "responses": {"200": {"$ref": "#/components/responses/Orgs"}}},
+      "post": {"summary": "Create a top-level org", "requestBody": {"$ref": "#/components/requestBodies/Org"}, "responses": {"201": {"$ref": "#/components/responses/Org"}, "409": {"$ref": "#/components/responses/Error"}, "422": {"$ref": "#/components/responses/Error"}}}
+    },
+    "/orgs/{org}": {
+      "parameters": [{"$ref": "#/components/parameters/org"}],
+      "get": {"summary": "Get an org", "responses": {"200": {"$ref": "#/components/responses/Org"}, "404": {"$ref": "#/components/responses/Error"}}},
+      "put": {"summary": "Replace an org, including its teams, repos and sub-orgs", "requestBody": {"$ref": "#/components/requestBodies/Org"}, "responses": {"200": {"$ref": "#/components/responses/Org"}, "404": {"$ref": "#/components/responses/Error"}, "422": {"$ref": "#/components/responses/Error"}}},
+      "delete": {"summary": "Delete an org and the memberships of its users, repositories on disk are kept", "responses": {"204": {"description": "Deleted"}, "404": {"$ref": "#/components/responses/Error"}}}
+    },
+    "/orgs/{org}/-/orgs": {
+      "parameters": [{"$ref": "#/components/parameters/org"}],
+      "get": {"summary": "List sub-orgs", "responses": {"200": {"$ref": "#/components/responses/Orgs"}, "404": {"$ref": "#/components/responses/Error"}}},
+      "post": {"summary": "Create a sub-org", "requestBody": {"$ref": "#/components/requestBodies/Org"}, "responses": {"201": {"$ref": "#/components/responses/Org"}, "404": {"$ref": "#/components/responses/Error"}, "409": {"$ref": "#/components/responses/Error"}, "422": {"$ref": "#/components/responses/Error"}}}
+    },
+    "/orgs/{org}/-/teams": {
+      "parameters": [{"$ref": "#/components/parameters/org"}],
+      "get": {"summary": "List teams of an org, without inherited ones", "responses": {"200": {"description": "Teams", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/Team"}}}}}, "404": {"$ref": "#/components/responses/Error"}}},
+      "post": {"summary": "Create a team", "requestBody": {"$ref": "#/components/requestBodies/Team"}, "responses": {"201": {"$ref": "#/components/responses/Team"}, "404": {"$ref": "#/components/responses/Error"}, "409": {"$ref": "#/components/responses/Error"}, "422": {"$ref": "#/components/responses/Error"}}}
+    },
+    "/orgs/{org}/-/teams/{team}": {
+      "parameters": [{"$ref": "#/components/parameters/org"}, {"name": "team", "in": "path", "required": true, "schema": {"type": "string"}}],
+      "get": {"summary": "Get a team", "responses": {"200": {"$ref": "#/components/responses/Team"}, "404": {"$ref": "#/components/responses/Error"}}},
+      "put": {"summary": "Replace a team", "requestBody": {"$ref": "#/components/requestBodies/Team"}, "responses": {"200": {"$ref": "#/components/responses/Team"}, "404": {"$ref": "#/components/responses/Error"}, "422": {"$ref": "#/components/responses/Error"}}},
+      "delete": {"summary": "Delete a team, its members leave it", "responses": {"204": {"description": "Deleted"}, "404": {"$ref": "#/components/responses/Error"}}}
+    },
+    "/orgs/{org}/-/teams/{team}/members": {
+      "parameters": [{"$ref": "#/components/parameters/org"}, {"name": "team", "in": "path", "required": true, "schema": {"type": "string"}}],
+      "get": {"summary": "List the names of the members of a team, the members of the org for the default team", "security": [{"adminToken": []}, {"apiToken": []}], "responses": {"200": {"description": "User names", "content": {"application/json": {"schema": {"type": "array", "items": {"type": "string"}}}}}, "404": {"$ref": "#/components/responses/Error"}}}
+    },
+    "/orgs/{org}/-/teams/{team}/members/{user}": {
+      "parameters": [{"$ref": "#/components/parameters/org"}, {"name": "team", "in": "path", "required": true, "schema": {"type": "string"}}, {"$ref": "#/components/parameters/user"}],
+      "put": {"summary": "Add a user to a team of the org", "security": [{"adminToken": []}, {"apiToken": []}], "responses": {"204": {"description": "Added"}, "404": {"$ref": "#/components/responses/Error"}, "422": {"$ref": "#/components/responses/Error"}}},
+      "delete": {"summary": "Remove a user from a team of the org", "security": [{"adminToken": []}, {"apiToken": []}], "responses": {"204": {"description": "Removed"}, "404": {"$ref": "#/components/responses/Error"}, "422": {"$ref": "#/components/responses/Error"}}}
+    },
+    "/orgs/{org}/-/repos": {
+      "parameters": [{"$ref": "#/components/parameters/org"}],
+      "get": {"summary": "List repos configured in an org", "security": [{"adminToken": []}, {"apiToken": []}], "responses": {"200": {"description": "Repos", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/Repo"}}}}}, "404": {"$ref": "#/components/responses/Error"}}},
+      "post": {"summary": "Configure a repo, it is created on disk by the first push. Org admins can't set deploykeys, mirror, pushmirrors, quota or network, and don't see credentials of mirrors", "security": [{"adminToken": []}, {"apiToken": []}], "requestBody": {"$ref": "#/components/requestBodies/Repo"}, "responses": {"201": {"$ref": "#/components/responses/Repo"}, "404": {"$ref": "#/components/responses/Error"}, "409": {"$ref": "#/components/responses/Error"}, "422": {"$ref": "#/components/responses/Error"}}}
+    },
+    "/orgs/{org}/-/repos/{repo}": {
+      "parameters": [{"$ref": "#/components/parameters/org"}, {"name": "repo", "in": "path", "required": true, "schema": {"type": "string"}}],
+      "get": {"summary": "Get the config of a repo", "security": [{"adminToken": []}, {"apiToken": []}], "responses": {"200": {"$ref": "#/components/responses/Repo"}, "404": {"$ref": "#/components/responses/Error"}}},
+      "put": {"summary": "Replace the config of a repo", "requestBody": {"$ref": "#/components/requestBodies/Repo"}, "responses": {"200": {"$ref": "#/components/responses/Repo"}, "404": {"$ref": "#/components/responses/Error"}, "422": {"$ref": "#/components/responses/Error"}}},
+      "delete": {"summary": "Delete the config of a repo, the repository on disk is kept", "security": [{"adminToken": []}, {"apiToken": []}], "responses": {"204": {"description": "Deleted"}, "404": {"$ref": "#/components/responses/Error"}}}
+    },
+    "/users": {
+      "get": {"summary": "List users", "responses": {"200": {"description": "Users", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/User"}}}}}}},
+      "post": {"summary": "Create a user", "requestBody": {"$ref": "#/components/requestBodies/User"}, "responses": {"201": {"$ref": "#/components/responses/User"}, "409": {"$ref": "#/components/responses/Error"}, "422": {"$ref": "#/components/responses/Error"}}}
+    },
+    "/users/{user}": {
+      "parameters": [{"$ref": "#/components/parameters/user"}],
+      "get": {"summary": "Get a user", "responses": {"200": {"$ref": "#/components/responses/User"}, "404": {"$ref": "#/components/responses/Error"}}},
+      "put": {"summary": "Replace a user, including SSH keys and memberships", "requestBody": {"$ref": "#/components/requestBodies/User"}, "responses": {"200": {"$ref": "#/components/responses/User"}, "404": {"$ref": "#/components/responses/Error"}, "422": {"$ref": "#/components/responses/Error"}}},
+      "delete": {"summary": "Delete a user, repos shared with them aren't anymore", "responses": {"204": {"description": "Deleted"}, "404": {"$ref": "#/components/responses/Error"}}}
+    },
+    "/users/{user}/sshkeys": {
+      "parameters": [{"$ref": "#/components/parameters/user"}],
+      "get": {"summary": "List SSH keys of a user", "responses": {"200": {"description": "SSH keys", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/SSHKey"}}}}}, "404": {"$ref": "#/components/responses/Error"}}},
+      "post": {"summary": "Add an SSH key to a user", "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/SSHKey"}}}}, "responses": {"201": {"description": "Added key", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/SSHKey"}}}}, "404": {"$ref": "#/components/responses/Error"}, "422": {"$ref": "#/components/responses/Error"}}}
+    }
+  },
+  "components": {
+    "securitySchemes": {
+      "adminToken": {"type": "http", "scheme": "bearer", "description": "Token created with nanogit token create-admin"},
+      "apiToken": {"type": "http", "scheme": "bearer", "description": "API token of an org admin, created with nanogit token create-api"}
+    },
+    "parameters": {
+      "org": {"name": "org", "in": "path", "required": true, "description": "Org path, e.g. fixme or fixme/infra", "schema": {"type": "string"}},
+      "user": {"name": "user", "in": "path", "required": true, "schema": {"type": "string"}}
+    },
+    "requestBodies": {
+      "Org": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Org"}}}},
+      "Team": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Team"}}}},
+      "Repo": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Repo"}}}},
+      "User": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/User"}}}}
+    },
+    "responses": {
+      "Orgs": {"description": "Orgs", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/Org"}}}}},
+      "Org": {"description": "Org", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Org"}}}},
+      "Team": {"description": "Team", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Team"}}}},
+      "Repo": {"description": "Repo", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Repo"}}}},
+      "User": {"description": "User", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/User"}}}},
+      "Error": {"description": "Error", "content": {"application/json": {"schema": {"type": "object", "properties": {"message": {"type": "string"}}}}}}
+    },
+    "schemas": {
+      "Size": {"oneOf": [{"type": "string", "example": "10G"}, {"type": "integer"}]},
+      "Maintenance": {"type": "object", "properties": {
+        "interval": {"type": "integer", "description": "Nanoseconds"},
+        "pushes": {"type": "integer"},
+        "tasks": {"type": "array", "items": {"type": "string", "enum": ["gc", "repack", "commit-graph", "pack-refs"]}},
+        "concurrency": {"type": "integer"}
+      }},
+      "PushMirror": {"type": "object", "required": ["name", "url"], "properties": {
+        "name": {"type": "string"},
+        "url": {"type": "string"},
+        "sshkey": {"type": "string"},
+        "username": {"type": "string"},
+        "password": {"type": "string"}
+      }},
+      "Team": {"type": "object", "required": ["name"], "properties": {
+        "name": {"type": "string"},
+        "role": {"type": "string", "enum": ["reader", "writer", "maintainer", "admin"]},
+        "read": {"type": "boolean", "deprecated": true, "description": "Migrated to the reader role"},
+        "write": {"type": "boolean", "deprecated": true, "description": "Migrated to the maintainer role"}
+      }},
+      "Repo": {"type": "object", "required": ["name"], "properties": {
+        "name": {"type": "string"},
+        "deploykeys": {"type": "array", "items": {"type": "object", "required": ["name", "key"], "properties": {
+          "name": {"type": "string"},
+          "key": {"type": "string"},
+          "write": {"type": "boolean"}
+        }}},
+        "mirror": {"type": "object", "properties": {
+          "url": {"type": "string"},
+          "interval": {"type": "integer", "description": "Nanoseconds"},
+          "sshkey": {"type": "string"},
+          "username": {"type": "string"},
+          "password": {"type": "string"}
+        }},
+        "pushmirrors": {"type": "array", "items": {"$ref": "#/components/schemas/PushMirror"}},
+        "quota": {"$ref": "#/components/schemas/Size"},
+        "protected": {"type": "array", "items": {"type": "string"}, "description": "Patterns of refs only maintainers can push to"}
+      }},
+      "Org": {"type": "object", "required": ["id"], "properties": {
+        "id": {"type": "string"},
+        "description": {"type": "string"},
+        "teams": {"type": "array", "items": {"$ref": "#/components/schemas/Team"}},
+        "repos": {"type": "array", "items": {"$ref": "#/components/schemas/Repo"}},
+        "pushmirrors": {"type": "array", "items": {"$ref": "#/components/schemas/PushMirror"}},
+        "quota": {"$ref": "#/components/schemas/Size"},
+        "maintenance": {"$ref": "#/components/schemas/Maintenance"},
+        "protected": {"type": "array", "items": {"type": "string"}},
+        "orgs": {"type": "array", "items": {"$ref": "#/components/schemas/Org"}}
+      }},
+      "SSHKey": {"type": "object", "required": ["val"], "properties": {
+        "type": {"type": "string", "description": "hardcoded, url or file"},
+        "val": {"type": "string"}
+      }},
+      "User": {"type": "object", "required": ["name"], "properties": {
+        "name": {"type": "string"},
+        "sshkeys": {"type": "array", "items": {"$ref": "#/components/schemas/SSHKey"}},
+        "orgs": {"type": "array", "items": {"type": "object", "required": ["id"], "properties": {
+          "id": {"type": "string"},
+          "teams": {"type": "array", "items": {"type": "string"}}
+        }}},
+        "shares": {"type": "array", "items": {"type": "object", "properties": {
+          "repo": {"type": "string"},
+          "users": {"type": "array", "items": {"type": "string"}},
+          "write": {"type": "boolean"}
+        }}}
+      }}
+    }
+  }
+}
+`
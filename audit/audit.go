@@ -0,0 +1,47 @@
+package audit
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/dgellow/nanogit/log"
+	"github.com/dgellow/nanogit/store"
+)
+
+// Name of the audit log file, under the store directory of the data root.
+const fileName = "audit.log"
+
+var mutex sync.Mutex
+
+// Record appends an entry for the given event to the audit log. Entries are
+// also sent to the logger as warnings.
+func Record(event string, format string, v ...interface{}) {
+	msg := fmt.Sprintf(format, v...)
+	log.Warn("audit: %s: %s", event, msg)
+
+	path, err := store.Path(fileName)
+	if err != nil {
+		log.Error("audit: %v", err)
+		return
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		log.Error("audit: %v", err)
+		return
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		log.Error("audit: %v", err)
+		return
+	}
+	defer f.Close()
+	line := fmt.Sprintf("%s\t%s\t%s\n", time.Now().UTC().Format(time.RFC3339), event, msg)
+	if _, err := f.WriteString(line); err != nil {
+		log.Error("audit: %v", err)
+	}
+}
@@ -1,52 +1,206 @@
 package auth
 
 import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/dgellow/nanogit/audit"
+	"github.com/dgellow/nanogit/config"
+	"github.com/dgellow/nanogit/dir"
+	"github.com/dgellow/nanogit/identity"
+	"github.com/dgellow/nanogit/keys"
 	"github.com/dgellow/nanogit/log"
 	"github.com/dgellow/nanogit/settings"
+	"github.com/dgellow/nanogit/token"
 )
 
-func CheckAuth(key string, org string, repo string) (read bool, write bool) {
-	log.Trace("auth: CheckAuth, org: %s, repo: %s", org, repo)
-	orgRead, orgWrite := authOrg(key, org)
-	repoRead, repoWrite := authRepo(key, repo)
-	return orgRead || repoRead, orgWrite || repoWrite
+// CheckAuth returns the access policy of the given key connecting from
+// remoteAddr on org/repo. Clients connecting from an address denied by the
+// network lists of the server, the org or the repo get no access.
+func CheckAuth(key string, remoteAddr string, org string, repo string) (read bool, write bool) {
+	log.Trace("auth: CheckAuth, address: %s, org: %s, repo: %s", remoteAddr, org, repo)
+	if allowed, _ := CheckAddress(remoteAddr, org, repo); !allowed {
+		return false, false
+	}
+	if _, _, _, err := settings.ConfInfo.LookupDeployKey(key); err == nil {
+		return checkDeployKeyAuth(key, org, repo)
+	}
+	userConfig, err := LookupUser(key, remoteAddr)
+	if err != nil {
+		log.Error("auth: %v", err)
+		return false, false
+	}
+	return CheckUserAuth(userConfig, org, repo)
 }
 
-func authOrg(key string, orgPath string) (read bool, write bool) {
-	log.Trace("auth: authOrg, org: %s", orgPath)
-	orgConfig, err := settings.ConfInfo.LookupOrgById(orgPath)
+// LookupUser returns the user identified by the given key, either one of
+// the user keys or a certificate signed by a trusted CA, for a client
+// connecting from remoteAddr.
+func LookupUser(key string, remoteAddr string) (config.UserConfig, error) {
+	userConfig, err := keys.LookupUser(key)
+	if err == nil {
+		return userConfig, nil
+	}
+	pubKey, _, _, _, parseErr := ssh.ParseAuthorizedKey([]byte(key))
+	if parseErr != nil {
+		return config.UserConfig{}, err
+	}
+	if cert, ok := pubKey.(*ssh.Certificate); ok {
+		return CheckCertificate(cert, remoteAddr)
+	}
+	return config.UserConfig{}, err
+}
+
+// KeyOwner returns the name of the user or deploy key the key of a client
+// connecting from remoteAddr belongs to, empty if unknown.
+func KeyOwner(key string, remoteAddr string) string {
+	if _, _, deployKey, err := settings.ConfInfo.LookupDeployKey(key); err == nil {
+		return "deploy key " + deployKey.Name
+	}
+	if userConfig, err := LookupUser(key, remoteAddr); err == nil {
+		return userConfig.Name
+	}
+	return ""
+}
+
+// CheckUserAuth returns the access policy of the given user on org/repo.
+func CheckUserAuth(userConfig config.UserConfig, org string, repo string) (read bool, write bool) {
+	log.Trace("auth: CheckUserAuth, user: %s, org: %s, repo: %s", userConfig.Name, org, repo)
+	e := Explain(userConfig, org, repo, "")
+	return e.Read, e.Write
+}
+
+// Capabilities given by ownership, shares or teams, before deny rules
+func grants(userConfig config.UserConfig, org string, repo string) Access {
+	if dir.IsUserNamespace(org) {
+		return authUserNamespace(userConfig, org, repo)
+	}
+	return authOrg(userConfig, org)
+}
+
+// CheckTokenAuth returns the access policy of an access token on org/repo:
+// the policy of the token owner, restricted to the scope of the token, for
+// clients connecting from remoteAddr.
+func CheckTokenAuth(t token.Token, remoteAddr string, org string, repo string) (read bool, write bool) {
+	log.Trace("auth: CheckTokenAuth, token: %s, address: %s, org: %s, repo: %s", t.Id, remoteAddr, org, repo)
+	if allowed, _ := CheckAddress(remoteAddr, org, repo); !allowed {
+		return false, false
+	}
+	if !t.InScope(org, repo) {
+		log.Error("auth: token %s is not scoped to %s/%s", t.Id, org, repo)
+		return false, false
+	}
+	userConfig, err := identity.Get().UserByName(t.User)
 	if err != nil {
 		log.Error("auth: %v", err)
 		return false, false
 	}
-	userConfig, err := settings.ConfInfo.LookupUserByKey(key)
+	read, write = CheckUserAuth(userConfig, org, repo)
+	return read, write && t.Write
+}
+
+// A deploy key only gives access to the repository it is declared in, in
+// read only mode unless write is explicitly enabled.
+func checkDeployKeyAuth(key string, org string, repo string) (read bool, write bool) {
+	keyOrg, keyRepo, deployKey, err := settings.ConfInfo.LookupDeployKey(key)
 	if err != nil {
 		log.Error("auth: %v", err)
 		return false, false
 	}
+	log.Trace("auth: checkDeployKeyAuth, deploy key: %s, org: %s, repo: %s", deployKey.Name, org, repo)
+	if !strings.EqualFold(keyOrg.Id, org) || !strings.EqualFold(keyRepo.Name, repo) {
+		audit.Record("deploykey-denied", "deploy key %s is bound to %s/%s, denied access to %s/%s",
+			deployKey.Name, keyOrg.Id, keyRepo.Name, org, repo)
+		return false, false
+	}
+	return true, deployKey.Write
+}
 
-	log.Trace("auth: authOrg, orgConfig.Id: %s", orgConfig.Id)
-	// Loop on user orgs to compare teams access policy
-	for _, userOrg := range userConfig.Orgs {
-		// Only interested by org given in parameter
-		if userOrg.Id == orgConfig.Id {
-			// Loop on user teams
-			for _, userTeam := range userOrg.Teams {
-				// Loop on org teams
-				for _, orgTeam := range orgConfig.Teams {
-					// If we find a corresponding team,
-					// return write and read policy
-					if userTeam == orgTeam.Name {
-						return orgTeam.Read, orgTeam.Write
-					}
-				}
+// The owner of a personal namespace has every capability on it, other users
+// only get the access shared with them: the maintainer role if shared with
+// write access, the reader role otherwise.
+func authUserNamespace(userConfig config.UserConfig, org string, repo string) Access {
+	log.Trace("auth: authUserNamespace, org: %s, repo: %s", org, repo)
+	a := Access{}
+	owner, err := identity.Get().UserByName(dir.UserNamespaceOwner(org))
+	if err != nil {
+		log.Error("auth: %v", err)
+		return a
+	}
+	if owner.Name == userConfig.Name {
+		a.giveRole(config.RoleAdmin, "owner of the personal namespace "+org)
+		return a
+	}
+	for _, share := range owner.Shares {
+		if share.Repo != "*" && !strings.EqualFold(share.Repo, repo) {
+			continue
+		}
+		for _, user := range share.Users {
+			if user != userConfig.Name {
+				continue
+			}
+			rule := fmt.Sprintf("share of %s by %s", share.Repo, owner.Name)
+			if share.Write {
+				a.giveRole(config.RoleMaintainer, rule)
+			} else {
+				a.giveRole(config.RoleReader, rule)
 			}
 		}
 	}
-	return false, false
+	return a
 }
 
-func authRepo(key string, repoPath string) (read bool, write bool) {
-	log.Trace("auth: authRepo, repo: %s", repoPath)
-	return true, true
+// Capabilities given by the teams of the user in the org: the union of the
+// capabilities of their roles. The rule explaining a capability is the
+// first team giving it, in the order of the org teams.
+func authOrg(userConfig config.UserConfig, orgPath string) Access {
+	log.Trace("auth: authOrg, org: %s", orgPath)
+	a := Access{}
+	store := identity.Get()
+	orgTeams, err := store.Teams(orgPath)
+	if err != nil {
+		log.Error("auth: %v", err)
+		return a
+	}
+	memberships, err := store.Memberships(userConfig.Name)
+	if err != nil {
+		log.Error("auth: %v", err)
+		return a
+	}
+
+	for _, orgTeam := range orgTeams {
+		if !isInTeam(memberships, orgPath, orgTeam.Name) {
+			continue
+		}
+		role := orgTeam.GetRole()
+		a.giveRole(role, fmt.Sprintf("team %s of org %s, role %s", orgTeam.Name, orgPath, role))
+	}
+	return a
+}
+
+// Membership of an org applies to its sub-orgs
+func isMemberOf(userOrgId string, orgPath string) bool {
+	userOrgId = strings.ToLower(userOrgId)
+	return userOrgId == orgPath || strings.HasPrefix(orgPath, userOrgId+"/")
+}
+
+// Returns whether the memberships put the user in the given team of the org,
+// every member of the org being in its default team
+func isInTeam(memberships []config.UserOrgConfig, orgPath string, team string) bool {
+	for _, userOrg := range memberships {
+		if !isMemberOf(userOrg.Id, strings.ToLower(orgPath)) {
+			continue
+		}
+		if team == config.DefaultTeam {
+			return true
+		}
+		for _, userTeam := range userOrg.Teams {
+			if userTeam == team {
+				return true
+			}
+		}
+	}
+	return false
 }
@@ -0,0 +1,294 @@
+package auth
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/dgellow/nanogit/config"
+	"github.com/dgellow/nanogit/settings"
+	"github.com/dgellow/nanogit/store"
+	"github.com/dgellow/nanogit/token"
+)
+
+// Access of every combination of read and write flags of the teams dev,
+// admin and default, for every subset of dev and admin the user is in,
+// listed in both orders
+func TestTeamCombinations(t *testing.T) {
+	defer func() { settings.ConfInfo.Set(config.Config{}) }()
+
+	// Flags of a team: 0 none, 1 read, 2 write, 3 read and write
+	flags := func(n int) (bool, bool) { return n&1 != 0, n&2 != 0 }
+	memberships := [][]string{{}, {"dev"}, {"admin"}, {"dev", "admin"}, {"admin", "dev"}}
+
+	for dev := 0; dev < 4; dev++ {
+		for admin := 0; admin < 4; admin++ {
+			for def := -1; def < 4; def++ {
+				teams := []config.TeamConfig{}
+				for _, team := range []struct {
+					name  string
+					flags int
+				}{{"dev", dev}, {"admin", admin}, {config.DefaultTeam, def}} {
+					// -1: the org has no default team
+					if team.flags < 0 {
+						continue
+					}
+					read, write := flags(team.flags)
+					teams = append(teams, config.TeamConfig{Name: team.name, Read: read, Write: write})
+				}
+
+				for _, userTeams := range memberships {
+					settings.ConfInfo.Set(config.Config{
+						Orgs:  []config.OrgConfig{{Id: "qrclabs", Teams: teams}},
+						Users: []config.UserConfig{{Name: "alice", Orgs: []config.UserOrgConfig{{Id: "qrclabs", Teams: userTeams}}}},
+					})
+					// A team giving write also gives read, access is the
+					// union of the access of all the teams of the user
+					expectedRead, expectedWrite := false, false
+					for _, team := range teams {
+						in := team.Name == config.DefaultTeam
+						for _, name := range userTeams {
+							in = in || name == team.Name
+						}
+						if in {
+							expectedRead = expectedRead || team.Read || team.Write
+							expectedWrite = expectedWrite || team.Write
+						}
+					}
+
+					userConfig := settings.ConfInfo.Conf.Users[0]
+					read, write := CheckUserAuth(userConfig, "qrclabs", "website")
+					if read != expectedRead || write != expectedWrite {
+						t.Errorf("teams %+v, member of %v: CheckUserAuth() == %v, %v, expected %v, %v",
+							teams, userTeams, read, write, expectedRead, expectedWrite)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestAuthOrg(t *testing.T) {
+	settings.ConfInfo.Set(config.Config{
+		Orgs: []config.OrgConfig{
+			{
+				Id: "qrclabs",
+				Teams: []config.TeamConfig{
+					{Name: "default", Read: true},
+					{Name: "dev", Read: true, Write: true},
+					{Name: "admin", Read: true},
+				},
+				Orgs: []config.OrgConfig{
+					// Overrides the inherited teams
+					{Id: "infra", Teams: []config.TeamConfig{{Name: "dev", Read: true}, {Name: "default"}}},
+					{Id: "ops", Teams: []config.TeamConfig{{Name: "ops", Write: true}, {Name: "default"}}},
+				},
+			},
+			{Id: "fixme", Teams: []config.TeamConfig{{Name: "ctf", Read: true, Write: true}}},
+		},
+		Users: []config.UserConfig{
+			{Name: "dgellow", Orgs: []config.UserOrgConfig{{Id: "qrclabs", Teams: []string{"admin", "dev"}}}},
+			{Name: "boss", Orgs: []config.UserOrgConfig{{Id: "qrclabs", Teams: []string{"admin"}}}},
+			{Name: "newcomer", Orgs: []config.UserOrgConfig{{Id: "qrclabs"}}},
+			{Name: "operator", Orgs: []config.UserOrgConfig{{Id: "qrclabs/ops", Teams: []string{"ops"}}}},
+			// Teams of unrelated orgs and unknown teams give nothing
+			{Name: "gcmalloc", Orgs: []config.UserOrgConfig{{Id: "fixme", Teams: []string{"ctf", "dev"}}, {Id: "qrclabs", Teams: []string{"ctf"}}}},
+			{Name: "stranger", Orgs: []config.UserOrgConfig{{Id: "fixme", Teams: []string{"dev"}}}},
+			{Name: "nobody"},
+			{Name: "notgcmalloc", Shares: []config.ShareConfig{{Repo: "scratch", Users: []string{"dgellow"}, Write: true}, {Repo: "*", Users: []string{"boss"}}}},
+		},
+	})
+	defer func() { settings.ConfInfo.Set(config.Config{}) }()
+
+	tests := []struct {
+		user      string
+		org       string
+		read      bool
+		write     bool
+		readRule  string
+		writeRule string
+	}{
+		// Write of dev isn't hidden by admin, though admin is listed first
+		{"dgellow", "qrclabs", true, true, "team default of org qrclabs", "team dev of org qrclabs"},
+		{"boss", "qrclabs", true, false, "team default of org qrclabs", ""},
+		// The default team applies to every member, even without teams
+		{"newcomer", "qrclabs", true, false, "team default of org qrclabs", ""},
+		// Inherited and overridden teams of sub-orgs
+		{"dgellow", "qrclabs/infra", true, false, "team dev of org qrclabs/infra", ""},
+		{"boss", "qrclabs/infra", true, false, "team admin of org qrclabs/infra", ""},
+		{"newcomer", "qrclabs/infra", false, false, "", ""},
+		// Write implies read
+		{"operator", "qrclabs/ops", true, true, "team ops of org qrclabs/ops", "team ops of org qrclabs/ops"},
+		// Membership of a sub-org doesn't give access to its parent
+		{"operator", "qrclabs", false, false, "", ""},
+		{"gcmalloc", "fixme", true, true, "team ctf of org fixme", "team ctf of org fixme"},
+		{"gcmalloc", "qrclabs", true, false, "team default of org qrclabs", ""},
+		{"stranger", "qrclabs", false, false, "", ""},
+		{"nobody", "fixme", false, false, "", ""},
+		{"nobody", "unknown", false, false, "", ""},
+		// Personal namespaces only depend on ownership and shares
+		{"notgcmalloc", "~notgcmalloc", true, true, "owner of the personal namespace", "owner of the personal namespace"},
+		{"dgellow", "~notgcmalloc", true, true, "share of scratch by notgcmalloc", "share of scratch by notgcmalloc"},
+		{"boss", "~notgcmalloc", true, false, "share of * by notgcmalloc", ""},
+		{"newcomer", "~notgcmalloc", false, false, "", ""},
+	}
+	for i, test := range tests {
+		userConfig, err := settings.ConfInfo.LookupUserByName(test.user)
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		e := Explain(userConfig, test.org, "scratch", "")
+		if e.Read != test.read || e.Write != test.write ||
+			!strings.Contains(e.ReadRule, test.readRule) || !strings.Contains(e.WriteRule, test.writeRule) {
+			t.Errorf("#%d: Explain(%s, %s/scratch) == %+v, expected read %v by %q, write %v by %q",
+				i, test.user, test.org, e, test.read, test.readRule, test.write, test.writeRule)
+		}
+		if !test.read && e.Rule("read") != "no ownership, share or team gives access" {
+			t.Errorf("#%d: Rule(read) == %q", i, e.Rule("read"))
+		}
+	}
+}
+
+func TestDeployKeyAuth(t *testing.T) {
+	const (
+		ciKey      = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIIvG863zzsAWqcjtjnFkH9QbuHavffRrupt6WNEompIh"
+		releaseKey = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOZX6ypROWV6JWWLz370Sm9a5LyqNH1Mqnmg5I5FpPrz"
+		userKey    = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIMTProz75BHLHlyIIHLkemK7+aX2RGuFBkPDheb8zXLX"
+	)
+	settings.ConfInfo.Set(config.Config{
+		Orgs: []config.OrgConfig{{
+			Id:    "qrclabs",
+			Teams: []config.TeamConfig{{Name: "default", Role: config.RoleMaintainer}},
+			Repos: []config.RepoConfig{{Name: "website", DeployKeys: []config.DeployKeyConfig{{Name: "ci", Key: ciKey + " ci@build"}}}},
+			Orgs: []config.OrgConfig{{
+				Id:    "infra",
+				Repos: []config.RepoConfig{{Name: "terraform", DeployKeys: []config.DeployKeyConfig{{Name: "release", Key: releaseKey, Write: true}}}},
+			}},
+		}},
+		Users: []config.UserConfig{{
+			Name:    "alice",
+			SSHKeys: []config.PubKeyConfig{{Type: "hardcoded", Val: userKey}},
+			Orgs:    []config.UserOrgConfig{{Id: "qrclabs"}},
+		}},
+	})
+	defer func() { settings.ConfInfo.Set(config.Config{}) }()
+
+	tests := []struct {
+		key   string
+		org   string
+		repo  string
+		read  bool
+		write bool
+	}{
+		// Read only unless write is enabled, whatever the comment of the key
+		{ciKey, "qrclabs", "website", true, false},
+		{ciKey + " other@host", "qrclabs", "Website", true, false},
+		{releaseKey, "qrclabs/infra", "terraform", true, true},
+		// Only the repo the key is declared in, not the other repos of
+		// the org nor the ones of the same name in other orgs
+		{ciKey, "qrclabs", "blog", false, false},
+		{ciKey, "qrclabs/infra", "website", false, false},
+		{releaseKey, "qrclabs", "terraform", false, false},
+		{releaseKey, "qrclabs", "website", false, false},
+		// Deploy keys don't get the access of the teams of the org
+		{ciKey, "~alice", "scratch", false, false},
+		{userKey, "qrclabs", "website", true, true},
+	}
+	for i, test := range tests {
+		read, write := CheckAuth(test.key, "127.0.0.1:52100", test.org, test.repo)
+		if read != test.read || write != test.write {
+			t.Errorf("#%d: CheckAuth(%.30s..., %s/%s) == %v, %v, expected %v, %v",
+				i, test.key, test.org, test.repo, read, write, test.read, test.write)
+		}
+	}
+	if owner := KeyOwner(ciKey+" other@host", "127.0.0.1:52100"); owner != "deploy key ci" {
+		t.Errorf("KeyOwner() == %q, expected deploy key ci", owner)
+	}
+}
+
+// Each access refused to a deploy key outside its repo is recorded in the
+// audit log
+func TestDeployKeyAudit(t *testing.T) {
+	const ciKey = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIIvG863zzsAWqcjtjnFkH9QbuHavffRrupt6WNEompIh"
+	dataRoot, err := ioutil.TempDir("", "nanogit-auth")
+	if err != nil {
+		t.Fatalf("Cannot create temp directory: %v", err)
+	}
+	defer os.RemoveAll(dataRoot)
+	settings.ConfInfo.Set(config.Config{
+		Server: config.ServerConfig{DataRoot: dataRoot},
+		Orgs: []config.OrgConfig{{
+			Id:    "qrclabs",
+			Repos: []config.RepoConfig{{Name: "website", DeployKeys: []config.DeployKeyConfig{{Name: "ci", Key: ciKey}}}},
+		}},
+	})
+	defer func() { settings.ConfInfo.Set(config.Config{}) }()
+
+	CheckAuth(ciKey, "127.0.0.1:52100", "qrclabs", "website")
+	CheckAuth(ciKey, "127.0.0.1:52100", "qrclabs", "blog")
+	CheckAuth(ciKey, "127.0.0.1:52100", "fixme", "website")
+
+	path, err := store.Path("audit.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Cannot read the audit log: %v", err)
+	}
+	logged := string(data)
+	if strings.Count(logged, "deploykey-denied") != 2 ||
+		!strings.Contains(logged, "deploy key ci is bound to qrclabs/website, denied access to qrclabs/blog") ||
+		!strings.Contains(logged, "denied access to fixme/website") {
+		t.Errorf("Audit log doesn't record the two denied accesses:\n%s", logged)
+	}
+}
+
+// An access token gives the access of its user, restricted to its repo and
+// to reads unless it was created with write
+func TestCheckTokenAuth(t *testing.T) {
+	settings.ConfInfo.Set(config.Config{
+		Orgs: []config.OrgConfig{{
+			Id:      "qrclabs",
+			Teams:   []config.TeamConfig{{Name: "default", Read: true}, {Name: "dev", Read: true, Write: true}},
+			Network: config.NetworkConfig{Deny: []string{"203.0.113.0/24"}},
+		}},
+		Users: []config.UserConfig{
+			{Name: "alice", Orgs: []config.UserOrgConfig{{Id: "qrclabs", Teams: []string{"dev"}}}},
+			{Name: "bob", Orgs: []config.UserOrgConfig{{Id: "qrclabs"}}},
+		},
+	})
+	defer func() { settings.ConfInfo.Set(config.Config{}) }()
+
+	tests := []struct {
+		token  token.Token
+		remote string
+		org    string
+		repo   string
+		read   bool
+		write  bool
+	}{
+		{token.Token{User: "alice", Org: "qrclabs", Repo: "website", Write: true}, "127.0.0.1:52100", "qrclabs", "website", true, true},
+		{token.Token{User: "alice", Org: "qrclabs", Repo: "website", Write: true}, "127.0.0.1:52100", "QRCLabs", "Website", true, true},
+		{token.Token{User: "alice", Org: "qrclabs", Repo: "website"}, "127.0.0.1:52100", "qrclabs", "website", true, false},
+		// The token can't give more than its user has
+		{token.Token{User: "bob", Org: "qrclabs", Repo: "website", Write: true}, "127.0.0.1:52100", "qrclabs", "website", true, false},
+		// Nothing outside its scope, even where its user has access
+		{token.Token{User: "alice", Org: "qrclabs", Repo: "website", Write: true}, "127.0.0.1:52100", "qrclabs", "blog", false, false},
+		// Web tokens read every repo of their user, API and admin tokens none
+		{token.Token{User: "alice", Web: true}, "127.0.0.1:52100", "qrclabs", "website", true, false},
+		{token.Token{User: "alice", API: true}, "127.0.0.1:52100", "qrclabs", "website", false, false},
+		{token.Token{User: "alice", Admin: true}, "127.0.0.1:52100", "qrclabs", "website", false, false},
+		// Users removed from the config lose the access of their tokens
+		{token.Token{User: "carol", Org: "qrclabs", Repo: "website", Write: true}, "127.0.0.1:52100", "qrclabs", "website", false, false},
+		{token.Token{User: "alice", Org: "qrclabs", Repo: "website", Write: true}, "203.0.113.5:52100", "qrclabs", "website", false, false},
+	}
+	for i, test := range tests {
+		read, write := CheckTokenAuth(test.token, test.remote, test.org, test.repo)
+		if read != test.read || write != test.write {
+			t.Errorf("#%d: CheckTokenAuth(%+v, %s, %s/%s) == %v, %v, expected %v, %v",
+				i, test.token, test.remote, test.org, test.repo, read, write, test.read, test.write)
+		}
+	}
+}
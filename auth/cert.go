@@ -0,0 +1,129 @@
+package auth
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/dgellow/nanogit/config"
+	"github.com/dgellow/nanogit/identity"
+	"github.com/dgellow/nanogit/log"
+	"github.com/dgellow/nanogit/settings"
+)
+
+const sourceAddressOption = "source-address"
+
+// AuthenticateCertificate checks a user certificate presented on the given
+// connection and returns the user matching its principal.
+func AuthenticateCertificate(conn ssh.ConnMetadata, cert *ssh.Certificate) (config.UserConfig, error) {
+	log.Trace("auth: AuthenticateCertificate, key id: %s", cert.KeyId)
+	return CheckCertificate(cert, conn.RemoteAddr().String())
+}
+
+// CheckCertificate validates a user certificate presented by a client
+// connecting from remoteAddr against the trusted CAs: signature, validity
+// window, critical options and revocation list. The first principal
+// matching a user name in config gives the identity.
+func CheckCertificate(cert *ssh.Certificate, remoteAddr string) (config.UserConfig, error) {
+	if cert.CertType != ssh.UserCert {
+		return config.UserConfig{}, fmt.Errorf("Certificate is not a user certificate: %s", cert.KeyId)
+	}
+	ca, err := lookupCertAuthority(cert.SignatureKey)
+	if err != nil {
+		return config.UserConfig{}, err
+	}
+
+	checker := &ssh.CertChecker{
+		// source-address is checked against remoteAddr below
+		SupportedCriticalOptions: []string{sourceAddressOption},
+		IsAuthority: func(auth ssh.PublicKey) bool {
+			return bytes.Equal(auth.Marshal(), cert.SignatureKey.Marshal())
+		},
+		IsRevoked: func(cert *ssh.Certificate) bool {
+			return isRevoked(ca, cert)
+		},
+	}
+	for _, principal := range cert.ValidPrincipals {
+		userConfig, err := identity.Get().UserByName(principal)
+		if err != nil {
+			continue
+		}
+		if err := checker.CheckCert(principal, cert); err != nil {
+			return config.UserConfig{}, fmt.Errorf("Invalid certificate %s signed by %s: %v", cert.KeyId, ca.Name, err)
+		}
+		if addrs, ok := cert.CriticalOptions[sourceAddressOption]; ok {
+			if err := checkSourceAddress(remoteAddr, addrs); err != nil {
+				return config.UserConfig{}, err
+			}
+		}
+		return userConfig, nil
+	}
+	return config.UserConfig{}, fmt.Errorf("No principal of certificate %s matches a user: %v", cert.KeyId, cert.ValidPrincipals)
+}
+
+func lookupCertAuthority(key ssh.PublicKey) (config.CertAuthorityConfig, error) {
+	for _, ca := range settings.ConfInfo.Get().Server.UserCAs {
+		caKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(ca.Key))
+		if err != nil {
+			log.Error("auth: cannot parse key of certificate authority %s: %v", ca.Name, err)
+			continue
+		}
+		if bytes.Equal(caKey.Marshal(), key.Marshal()) {
+			return ca, nil
+		}
+	}
+	return config.CertAuthorityConfig{}, fmt.Errorf("Certificate signed by an untrusted authority: %s", ssh.FingerprintSHA256(key))
+}
+
+func isRevoked(ca config.CertAuthorityConfig, cert *ssh.Certificate) bool {
+	for _, serial := range ca.RevokedSerials {
+		if serial == cert.Serial {
+			return true
+		}
+	}
+	for _, keyId := range ca.RevokedKeyIds {
+		if keyId == cert.KeyId {
+			return true
+		}
+	}
+	fingerprint := ssh.FingerprintSHA256(cert.Key)
+	for _, revoked := range ca.RevokedKeys {
+		if revoked == fingerprint {
+			return true
+		}
+	}
+	return false
+}
+
+// source-address is a comma separated list of CIDR or single addresses,
+// remoteAddr is an address with or without a port
+func checkSourceAddress(remoteAddr string, sourceAddrs string) error {
+	host := remoteAddr
+	if h, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		host = h
+	}
+	remoteIP := net.ParseIP(host)
+	if remoteIP == nil {
+		return fmt.Errorf("Cannot check source-address of certificate against address: %q", remoteAddr)
+	}
+	for _, sourceAddr := range strings.Split(sourceAddrs, ",") {
+		sourceAddr = strings.TrimSpace(sourceAddr)
+		if ip := net.ParseIP(sourceAddr); ip != nil {
+			if ip.Equal(remoteIP) {
+				return nil
+			}
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(sourceAddr)
+		if err != nil {
+			return fmt.Errorf("Invalid source-address in certificate: %s", sourceAddr)
+		}
+		if ipNet.Contains(remoteIP) {
+			return nil
+		}
+	}
+	return fmt.Errorf("Source address %v not allowed by certificate: %s", remoteIP, sourceAddrs)
+}
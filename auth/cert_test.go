@@ -0,0 +1,110 @@
+package auth
+
+import (
+	"crypto/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/dgellow/nanogit/config"
+	"github.com/dgellow/nanogit/settings"
+)
+
+func newSigner(t *testing.T) ssh.Signer {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func authorizedKey(key ssh.PublicKey) string {
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+}
+
+func TestCheckCertificate(t *testing.T) {
+	ca, otherCA, revokedKey := newSigner(t), newSigner(t), newSigner(t)
+	userKey := newSigner(t)
+	settings.ConfInfo.Set(config.Config{
+		Server: config.ServerConfig{UserCAs: []config.CertAuthorityConfig{{
+			Name:           "corp",
+			Key:            authorizedKey(ca.PublicKey()),
+			RevokedSerials: []uint64{13},
+			RevokedKeyIds:  []string{"stolen-laptop"},
+			RevokedKeys:    []string{ssh.FingerprintSHA256(revokedKey.PublicKey())},
+		}}},
+		Users: []config.UserConfig{{Name: "alice"}, {Name: "bob"}},
+	})
+	defer func() { settings.ConfInfo.Set(config.Config{}) }()
+
+	now := time.Now()
+	tests := []struct {
+		cert   ssh.Certificate
+		signer ssh.Signer
+		remote string
+		user   string
+		err    string
+	}{
+		{ssh.Certificate{KeyId: "alice", ValidPrincipals: []string{"alice"}}, ca, "10.0.0.1:52100", "alice", ""},
+		// The first principal matching a user gives the identity
+		{ssh.Certificate{KeyId: "ops", ValidPrincipals: []string{"root", "Bob", "alice"}}, ca, "10.0.0.1:52100", "bob", ""},
+		{ssh.Certificate{KeyId: "ops", ValidPrincipals: []string{"root"}}, ca, "10.0.0.1:52100", "", "No principal of certificate ops matches a user"},
+		{ssh.Certificate{KeyId: "any"}, ca, "10.0.0.1:52100", "", "No principal"},
+		{ssh.Certificate{KeyId: "alice", ValidPrincipals: []string{"alice"}}, otherCA, "10.0.0.1:52100", "", "untrusted authority"},
+		{ssh.Certificate{KeyId: "host", CertType: ssh.HostCert, ValidPrincipals: []string{"alice"}}, ca, "10.0.0.1:52100", "", "not a user certificate"},
+		// Validity window
+		{ssh.Certificate{KeyId: "expired", ValidPrincipals: []string{"alice"}, ValidAfter: uint64(now.Add(-2 * time.Hour).Unix()), ValidBefore: uint64(now.Add(-time.Hour).Unix())}, ca, "10.0.0.1:52100", "", "expired"},
+		{ssh.Certificate{KeyId: "future", ValidPrincipals: []string{"alice"}, ValidAfter: uint64(now.Add(time.Hour).Unix())}, ca, "10.0.0.1:52100", "", "not yet valid"},
+		{ssh.Certificate{KeyId: "valid", ValidPrincipals: []string{"alice"}, ValidAfter: uint64(now.Add(-time.Hour).Unix()), ValidBefore: uint64(now.Add(time.Hour).Unix())}, ca, "10.0.0.1:52100", "alice", ""},
+		// Revocation by serial, key id and fingerprint of the key
+		{ssh.Certificate{KeyId: "alice", Serial: 13, ValidPrincipals: []string{"alice"}}, ca, "10.0.0.1:52100", "", "revoked"},
+		{ssh.Certificate{KeyId: "stolen-laptop", ValidPrincipals: []string{"alice"}}, ca, "10.0.0.1:52100", "", "revoked"},
+		{ssh.Certificate{KeyId: "alice", Key: revokedKey.PublicKey(), ValidPrincipals: []string{"alice"}}, ca, "10.0.0.1:52100", "", "revoked"},
+		// source-address
+		{ssh.Certificate{KeyId: "office", ValidPrincipals: []string{"alice"}, Permissions: ssh.Permissions{CriticalOptions: map[string]string{"source-address": "10.0.0.0/8, 192.168.1.5"}}}, ca, "10.0.0.1:52100", "alice", ""},
+		{ssh.Certificate{KeyId: "office", ValidPrincipals: []string{"alice"}, Permissions: ssh.Permissions{CriticalOptions: map[string]string{"source-address": "10.0.0.0/8, 192.168.1.5"}}}, ca, "192.168.1.5", "alice", ""},
+		{ssh.Certificate{KeyId: "office", ValidPrincipals: []string{"alice"}, Permissions: ssh.Permissions{CriticalOptions: map[string]string{"source-address": "10.0.0.0/8, 192.168.1.5"}}}, ca, "192.168.1.6:52100", "", "Source address 192.168.1.6 not allowed"},
+		{ssh.Certificate{KeyId: "office", ValidPrincipals: []string{"alice"}, Permissions: ssh.Permissions{CriticalOptions: map[string]string{"source-address": "10.0.0.0/8"}}}, ca, "", "", "Cannot check source-address"},
+		{ssh.Certificate{KeyId: "office", ValidPrincipals: []string{"alice"}, Permissions: ssh.Permissions{CriticalOptions: map[string]string{"source-address": "office"}}}, ca, "10.0.0.1:52100", "", "Invalid source-address"},
+		// Unknown critical options are refused
+		{ssh.Certificate{KeyId: "alice", ValidPrincipals: []string{"alice"}, Permissions: ssh.Permissions{CriticalOptions: map[string]string{"force-command": "ls"}}}, ca, "10.0.0.1:52100", "", "unsupported critical option"},
+	}
+	for i, test := range tests {
+		cert := test.cert
+		if cert.Key == nil {
+			cert.Key = userKey.PublicKey()
+		}
+		if cert.CertType == 0 {
+			cert.CertType = ssh.UserCert
+		}
+		if cert.ValidBefore == 0 {
+			cert.ValidBefore = ssh.CertTimeInfinity
+		}
+		if err := cert.SignCert(rand.Reader, test.signer); err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+
+		// Certificates are checked the same way by the server and by
+		// the commands given the key
+		user, err := CheckCertificate(&cert, test.remote)
+		lookedUp, lookupErr := LookupUser(authorizedKey(&cert), test.remote)
+		for _, result := range []struct {
+			name string
+			user config.UserConfig
+			err  error
+		}{{"CheckCertificate", user, err}, {"LookupUser", lookedUp, lookupErr}} {
+			if result.user.Name != test.user || (result.err == nil) != (test.err == "") ||
+				(result.err != nil && !strings.Contains(result.err.Error(), test.err)) {
+				t.Errorf("#%d: %s(%s, %s) == %s, %v, expected %q, %q",
+					i, result.name, cert.KeyId, test.remote, result.user.Name, result.err, test.user, test.err)
+			}
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package auth
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/dgellow/nanogit/config"
+	"github.com/dgellow/nanogit/dir"
+	"github.com/dgellow/nanogit/identity"
+	"github.com/dgellow/nanogit/log"
+	"github.com/dgellow/nanogit/settings"
+)
+
+// Environment variables giving the pushing user or deploy key to the
+// pre-receive hook
+const (
+	UserEnv      = "NANOGIT_USER"
+	DeployKeyEnv = "NANOGIT_DEPLOY_KEY"
+)
+
+// Explanation is the access of a user on a repository, with the rule
+// deciding each access.
+type Explanation struct {
+	Read      bool
+	ReadRule  string
+	Write     bool
+	WriteRule string
+}
+
+// Rule returns the rule deciding the given access: read or write.
+func (e Explanation) Rule(access string) string {
+	rule := e.ReadRule
+	if access == "write" {
+		rule = e.WriteRule
+	}
+	return reason(rule)
+}
+
+func reason(rule string) string {
+	if rule == "" {
+		return "no ownership, share or team gives access"
+	}
+	return rule
+}
+
+// Explain returns the access of the user on org/repo: read is the read
+// capability, write the capability needed to push ref, or push if ref is
+// empty.
+func Explain(userConfig config.UserConfig, org string, repo string, ref string) Explanation {
+	log.Trace("auth: Explain, user: %s, org: %s, repo: %s, ref: %s", userConfig.Name, org, repo, ref)
+	a := access(userConfig, org, repo, ref)
+	needed, reason := CapPush, ""
+	if ref != "" {
+		needed, reason = refCapability(org, repo, ref)
+	}
+	e := Explanation{a.Can(CapRead), a[CapRead].Rule, a.Can(needed), a[needed].Rule}
+	// Not given the capability of the ref, while allowed to push
+	if !e.Write && e.WriteRule == "" && needed != CapPush {
+		e.WriteRule = a[CapPush].Rule
+		if a.Can(CapPush) {
+			e.WriteRule = reason
+		}
+	}
+	return e
+}
+
+// Returns the capabilities of the user on org/repo. They are first given by
+// ownership of a personal namespace, shares, then the roles of teams. Deny
+// rules are then applied, in order: the rules of the repo, then the ones of
+// its org and of each parent org up to the top level one, each in the order
+// they are listed. A rule denying read removes all capabilities, a rule
+// denying write all but read, and rules restricted to refs only apply when
+// ref is given, i.e. when a push updates it. The first rule removing a
+// capability is the one explaining it.
+func access(userConfig config.UserConfig, org string, repo string, ref string) Access {
+	a := grants(userConfig, org, repo)
+	rules := denyRules(org, repo)
+	if len(rules) == 0 {
+		return a
+	}
+	memberships, err := identity.Get().Memberships(userConfig.Name)
+	if err != nil {
+		log.Error("auth: %v", err)
+	}
+	for _, rule := range rules {
+		if !rule.appliesTo(userConfig, memberships, ref) {
+			continue
+		}
+		for c := range a {
+			if c != CapRead || rule.Denied() == "read" {
+				a.take(c, rule.String())
+			}
+		}
+	}
+	return a
+}
+
+// CheckRefAuth returns whether the user can update ref of org/repo, with
+// the rule deciding it.
+func CheckRefAuth(user string, org string, repo string, ref string) (bool, string) {
+	log.Trace("auth: CheckRefAuth, user: %s, org: %s, repo: %s, ref: %s", user, org, repo, ref)
+	userConfig, err := identity.Get().UserByName(user)
+	if err != nil {
+		return false, err.Error()
+	}
+	e := Explain(userConfig, org, repo, ref)
+	return e.Write, e.Rule("write")
+}
+
+// HasRefRules returns whether deny rules restricted to refs or protected
+// refs apply to org/repo, which are then checked for each pushed ref.
+func HasRefRules(org string, repo string) bool {
+	for _, rule := range denyRules(org, repo) {
+		if rule.Refs != "" {
+			return true
+		}
+	}
+	return len(protectedRefs(org, repo)) > 0
+}
+
+type denyRule struct {
+	config.DenyConfig
+	// Org the rule or its repo belongs to
+	org string
+	// Where the rule is declared, e.g. repo fixme/website
+	where string
+	index int
+}
+
+func (r denyRule) String() string {
+	who := "user " + r.User
+	if r.Team != "" {
+		who = "team " + r.Team
+	}
+	s := fmt.Sprintf("deny rule %d of %s (%s, %s access", r.index+1, r.where, who, r.Denied())
+	if r.Refs != "" {
+		s += ", refs " + r.Refs
+	}
+	return s + ")"
+}
+
+// Returns the deny rules applying to org/repo, in evaluation order
+func denyRules(org string, repo string) []denyRule {
+	rules := []denyRule{}
+	if dir.IsUserNamespace(org) {
+		return rules
+	}
+	if repoConfig, err := settings.ConfInfo.LookupRepo(org, repo); err == nil {
+		for i, rule := range repoConfig.Deny {
+			rules = append(rules, denyRule{rule, org, fmt.Sprintf("repo %s/%s", org, repoConfig.Name), i})
+		}
+	}
+	segments := strings.Split(org, "/")
+	for i := len(segments); i > 0; i-- {
+		orgPath := strings.Join(segments[:i], "/")
+		orgConfig, err := identity.Get().Org(orgPath)
+		if err != nil {
+			continue
+		}
+		for j, rule := range orgConfig.Deny {
+			rules = append(rules, denyRule{rule, orgPath, "org " + orgPath, j})
+		}
+	}
+	return rules
+}
+
+func (r denyRule) appliesTo(userConfig config.UserConfig, memberships []config.UserOrgConfig, ref string) bool {
+	if r.Refs != "" {
+		if ref == "" {
+			return false
+		}
+		if matched, _ := path.Match(r.Refs, ref); !matched {
+			return false
+		}
+	}
+	if r.User != "" {
+		return strings.EqualFold(r.User, userConfig.Name)
+	}
+	return isInTeam(memberships, r.org, r.Team)
+}
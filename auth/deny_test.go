@@ -0,0 +1,100 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/dgellow/nanogit/config"
+	"github.com/dgellow/nanogit/settings"
+)
+
+func TestExplain(t *testing.T) {
+	settings.ConfInfo.Set(config.Config{
+		Orgs: []config.OrgConfig{
+			{
+				Id:    "fixme",
+				Teams: []config.TeamConfig{{Name: "dev", Read: true, Write: true}, {Name: "contractors", Read: true, Write: true}},
+				Repos: []config.RepoConfig{
+					{Name: "website", Deny: []config.DenyConfig{{User: "mallory", Access: "write"}}},
+					{Name: "secret", Deny: []config.DenyConfig{{Team: "contractors", Refs: "refs/heads/release/*"}}},
+				},
+				Deny: []config.DenyConfig{{Team: "contractors", Refs: "refs/heads/release/*"}},
+				Orgs: []config.OrgConfig{
+					{Id: "infra", Deny: []config.DenyConfig{{Team: "contractors"}}},
+				},
+			},
+			{Id: "qrclabs"},
+		},
+		Users: []config.UserConfig{
+			{Name: "alice", Orgs: []config.UserOrgConfig{{Id: "fixme", Teams: []string{"dev"}}}},
+			{Name: "mallory", Orgs: []config.UserOrgConfig{{Id: "fixme", Teams: []string{"dev"}}}},
+			{Name: "bob", Orgs: []config.UserOrgConfig{{Id: "fixme", Teams: []string{"contractors"}}}},
+		},
+	})
+	defer func() { settings.ConfInfo.Set(config.Config{}) }()
+
+	tests := []struct {
+		user      string
+		org       string
+		repo      string
+		ref       string
+		read      bool
+		write     bool
+		readRule  string
+		writeRule string
+	}{
+		{"alice", "fixme", "website", "", true, true, "team dev of org fixme", "team dev of org fixme"},
+		{"mallory", "fixme", "website", "", true, false, "team dev of org fixme", "deny rule 1 of repo fixme/website (user mallory, write access)"},
+		{"mallory", "fixme", "secret", "", true, true, "team dev", "team dev"},
+		{"bob", "fixme", "website", "", true, true, "team contractors of org fixme", "team contractors of org fixme"},
+		{"bob", "fixme", "website", "refs/heads/master", true, true, "team contractors", "team contractors"},
+		{"bob", "fixme", "website", "refs/heads/release/1.0", true, false, "team contractors", "deny rule 1 of org fixme (team contractors, write access, refs refs/heads/release/*)"},
+		// * doesn't match /
+		{"bob", "fixme", "website", "refs/heads/release/1.0/fix", true, true, "team contractors", "team contractors"},
+		// Rules of the repo come first
+		{"bob", "fixme", "secret", "refs/heads/release/1.0", true, false, "team contractors", "deny rule 1 of repo fixme/secret (team contractors, write access, refs refs/heads/release/*)"},
+		{"bob", "fixme", "secret", "refs/tags/v1", true, true, "team contractors", "team contractors"},
+		// Rules of sub-orgs come before the ones of their parents
+		{"bob", "fixme/infra", "terraform", "", false, false, "deny rule 1 of org fixme/infra (team contractors, read access)", "deny rule 1 of org fixme/infra (team contractors, read access)"},
+		{"bob", "fixme/infra", "terraform", "refs/heads/release/1.0", false, false, "deny rule 1 of org fixme/infra", "deny rule 1 of org fixme/infra"},
+		{"alice", "fixme/infra", "terraform", "", true, true, "team dev of org fixme/infra", "team dev of org fixme/infra"},
+		// Users get no access to orgs they aren't members of
+		{"bob", "qrclabs", "website", "refs/heads/release/1.0", false, false, "", ""},
+	}
+	for i, test := range tests {
+		userConfig, err := settings.ConfInfo.LookupUserByName(test.user)
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		e := Explain(userConfig, test.org, test.repo, test.ref)
+		if e.Read != test.read || e.Write != test.write ||
+			!strings.Contains(e.ReadRule, test.readRule) || !strings.Contains(e.WriteRule, test.writeRule) {
+			t.Errorf("#%d: Explain(%s, %s/%s, %q) == %+v, expected read %v by %q, write %v by %q",
+				i, test.user, test.org, test.repo, test.ref, e, test.read, test.readRule, test.write, test.writeRule)
+		}
+		if read, write := CheckUserAuth(userConfig, test.org, test.repo); test.ref == "" && (read != test.read || write != test.write) {
+			t.Errorf("#%d: CheckUserAuth(%s, %s/%s) == %v, %v", i, test.user, test.org, test.repo, read, write)
+		}
+	}
+
+	if allowed, rule := CheckRefAuth("bob", "fixme", "website", "refs/heads/release/2.0"); allowed || !strings.Contains(rule, "deny rule 1 of org fixme") {
+		t.Errorf("CheckRefAuth(bob, release/2.0) == %v, %q", allowed, rule)
+	}
+	if allowed, rule := CheckRefAuth("unknown", "fixme", "website", "refs/heads/master"); allowed {
+		t.Errorf("CheckRefAuth(unknown) == %v, %q, expected unknown users to be denied", allowed, rule)
+	}
+	for i, test := range []struct {
+		org      string
+		repo     string
+		expected bool
+	}{
+		{"fixme", "website", true},
+		{"fixme/infra", "terraform", true},
+		{"qrclabs", "website", false},
+		{"~alice", "scratch", false},
+	} {
+		if actual := HasRefRules(test.org, test.repo); actual != test.expected {
+			t.Errorf("#%d: HasRefRules(%s/%s) == %v, expected %v", i, test.org, test.repo, actual, test.expected)
+		}
+	}
+}
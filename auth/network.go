@@ -0,0 +1,112 @@
+package auth
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/dgellow/nanogit/audit"
+	"github.com/dgellow/nanogit/config"
+	"github.com/dgellow/nanogit/dir"
+	"github.com/dgellow/nanogit/identity"
+	"github.com/dgellow/nanogit/log"
+	"github.com/dgellow/nanogit/settings"
+)
+
+// CheckAddress returns whether clients can connect to org/repo from
+// remoteAddr, an address with or without a port, with the rule denying it.
+// The allow and deny lists of the server apply first, then the ones of the
+// org and each of its sub-orgs down to the org of the repo, then the ones of
+// the repo. Only the lists of the server apply when org is empty, and to
+// personal namespaces. A deny list takes precedence over an allow list of
+// the same level, and an address must be allowed by every level with an
+// allow list. Denials are recorded in the audit log.
+func CheckAddress(remoteAddr string, org string, repo string) (bool, string) {
+	log.Trace("auth: CheckAddress, address: %s, org: %s, repo: %s", remoteAddr, org, repo)
+	allowed, rule := AddressAllowed(remoteAddr, org, repo)
+	if !allowed {
+		target := "the server"
+		if org != "" {
+			target = strings.TrimSuffix(org+"/"+repo, "/")
+		}
+		audit.Record("network-denied", "connection from %s to %s denied by %s", remoteAddr, target, rule)
+	}
+	return allowed, rule
+}
+
+// AddressAllowed is CheckAddress without recording denials, for listings
+// hiding the repositories clients can't connect to.
+func AddressAllowed(remoteAddr string, org string, repo string) (bool, string) {
+	for _, level := range networkLevels(org, repo) {
+		if rule := level.check(remoteAddr); rule != "" {
+			return false, rule
+		}
+	}
+	return true, ""
+}
+
+type networkLevel struct {
+	config.NetworkConfig
+	// Where the lists are declared, e.g. org qrclabs
+	where string
+}
+
+// Returns the rule denying remoteAddr, or an empty string
+func (l networkLevel) check(remoteAddr string) string {
+	if len(l.Allow) == 0 && len(l.Deny) == 0 {
+		return ""
+	}
+	host := remoteAddr
+	if h, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		host = h
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Sprintf("invalid address, restricted by the %s", l.where)
+	}
+	for _, network := range l.Deny {
+		if contains(network, ip) {
+			return fmt.Sprintf("deny %s of the %s", network, l.where)
+		}
+	}
+	if len(l.Allow) == 0 {
+		return ""
+	}
+	for _, network := range l.Allow {
+		if contains(network, ip) {
+			return ""
+		}
+	}
+	return fmt.Sprintf("not in the allow list of the %s", l.where)
+}
+
+func contains(network string, ip net.IP) bool {
+	n, err := config.ParseNetwork(network)
+	if err != nil {
+		log.Error("auth: %v", err)
+		return false
+	}
+	return n.Contains(ip)
+}
+
+// Returns the allow and deny lists applying to org/repo, in evaluation order
+func networkLevels(org string, repo string) []networkLevel {
+	levels := []networkLevel{{settings.ConfInfo.Get().Server.Network, "server"}}
+	if org == "" || dir.IsUserNamespace(org) {
+		return levels
+	}
+	segments := strings.Split(org, "/")
+	for i := 1; i <= len(segments); i++ {
+		orgPath := strings.Join(segments[:i], "/")
+		if orgConfig, err := identity.Get().Org(orgPath); err == nil {
+			levels = append(levels, networkLevel{orgConfig.Network, "org " + orgPath})
+		}
+	}
+	if repo == "" {
+		return levels
+	}
+	if repoConfig, err := settings.ConfInfo.LookupRepo(org, repo); err == nil {
+		levels = append(levels, networkLevel{repoConfig.Network, fmt.Sprintf("repo %s/%s", org, repoConfig.Name)})
+	}
+	return levels
+}
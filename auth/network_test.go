@@ -0,0 +1,72 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/dgellow/nanogit/config"
+	"github.com/dgellow/nanogit/settings"
+)
+
+func TestCheckAddress(t *testing.T) {
+	settings.ConfInfo.Set(config.Config{
+		Server: config.ServerConfig{Network: config.NetworkConfig{Deny: []string{"203.0.113.0/24"}}},
+		Orgs: []config.OrgConfig{
+			{
+				Id:      "qrclabs",
+				Network: config.NetworkConfig{Allow: []string{"10.1.0.0/16", "10.8.0.0/16", "fd00::/8"}, Deny: []string{"10.8.0.66"}},
+				Repos: []config.RepoConfig{
+					{Name: "secrets", Network: config.NetworkConfig{Allow: []string{"10.1.2.0/24"}}},
+				},
+				Orgs: []config.OrgConfig{
+					{Id: "infra", Network: config.NetworkConfig{Deny: []string{"10.8.0.0/16"}}},
+				},
+			},
+			{Id: "fixme"},
+		},
+	})
+	defer func() { settings.ConfInfo.Set(config.Config{}) }()
+
+	tests := []struct {
+		remote  string
+		org     string
+		repo    string
+		allowed bool
+		rule    string
+	}{
+		{"198.51.100.7:52100", "", "", true, ""},
+		{"203.0.113.5:52100", "", "", false, "deny 203.0.113.0/24 of the server"},
+		{"198.51.100.7:52100", "fixme", "website", true, ""},
+		// The lists of the server apply to every org
+		{"203.0.113.5:52100", "fixme", "website", false, "deny 203.0.113.0/24 of the server"},
+		{"10.1.0.4:52100", "qrclabs", "website", true, ""},
+		{"10.8.3.4", "qrclabs", "website", true, ""},
+		{"[fd00::1]:52100", "qrclabs", "website", true, ""},
+		{"198.51.100.7:52100", "qrclabs", "website", false, "not in the allow list of the org qrclabs"},
+		{"10.8.0.66:52100", "qrclabs", "website", false, "deny 10.8.0.66 of the org qrclabs"},
+		// Each level with an allow list must allow the address
+		{"10.1.2.3:52100", "qrclabs", "secrets", true, ""},
+		{"10.1.0.4:52100", "qrclabs", "secrets", false, "not in the allow list of the repo qrclabs/secrets"},
+		{"198.51.100.7:52100", "qrclabs", "secrets", false, "not in the allow list of the org qrclabs"},
+		// Lists of parent orgs apply to their sub-orgs
+		{"10.1.0.4:52100", "qrclabs/infra", "terraform", true, ""},
+		{"10.8.0.4:52100", "qrclabs/infra", "terraform", false, "deny 10.8.0.0/16 of the org qrclabs/infra"},
+		{"198.51.100.7:52100", "qrclabs/infra", "terraform", false, "not in the allow list of the org qrclabs"},
+		// Addresses that can't be parsed are denied where lists apply
+		{"invalid", "fixme", "website", false, "invalid address, restricted by the server"},
+		// Personal namespaces only get the lists of the server
+		{"198.51.100.7:52100", "~alice", "scratch", true, ""},
+	}
+	for i, test := range tests {
+		allowed, rule := AddressAllowed(test.remote, test.org, test.repo)
+		if allowed != test.allowed || !strings.Contains(rule, test.rule) {
+			t.Errorf("#%d: AddressAllowed(%s, %s/%s) == %v, %q, expected %v, %q",
+				i, test.remote, test.org, test.repo, allowed, rule, test.allowed, test.rule)
+		}
+	}
+
+	settings.ConfInfo.Conf.Server.Network = config.NetworkConfig{}
+	if allowed, rule := CheckAddress("invalid", "fixme", "website"); !allowed {
+		t.Errorf("CheckAddress(invalid, fixme/website) == %v, %q, expected no lists to allow every address", allowed, rule)
+	}
+}
@@ -0,0 +1,162 @@
+package auth
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/dgellow/nanogit/config"
+	"github.com/dgellow/nanogit/dir"
+	"github.com/dgellow/nanogit/identity"
+	"github.com/dgellow/nanogit/log"
+	"github.com/dgellow/nanogit/settings"
+)
+
+// Capability is an action a user can take on a repository or an org.
+type Capability string
+
+const (
+	// Clone and fetch
+	CapRead Capability = "read"
+	// Push to branches, and refs other than tags, that aren't protected
+	CapPush Capability = "push"
+	// Push to protected refs
+	CapPushProtected Capability = "push-protected"
+	// Push and delete tags
+	CapPushTags Capability = "push-tags"
+	// Create and delete repos of the org
+	CapManageRepos Capability = "manage-repos"
+	// Add and remove members of the teams of the org
+	CapManageTeams Capability = "manage-teams"
+)
+
+// Capabilities lists every capability.
+var Capabilities = []Capability{CapRead, CapPush, CapPushProtected, CapPushTags, CapManageRepos, CapManageTeams}
+
+var roleCapabilities = map[string][]Capability{
+	config.RoleReader:     {CapRead},
+	config.RoleWriter:     {CapRead, CapPush},
+	config.RoleMaintainer: {CapRead, CapPush, CapPushProtected, CapPushTags},
+	config.RoleAdmin:      Capabilities,
+}
+
+// RoleCapabilities returns the capabilities given by a role of a team.
+func RoleCapabilities(role string) []Capability {
+	return roleCapabilities[role]
+}
+
+// Decision is whether a capability is given, with the rule deciding it.
+type Decision struct {
+	Allowed bool
+	Rule    string
+}
+
+// Reason returns the rule deciding the capability.
+func (d Decision) Reason() string {
+	return reason(d.Rule)
+}
+
+// Access is the capabilities of a user on a repository.
+type Access map[Capability]Decision
+
+func (a Access) Can(c Capability) bool {
+	return a[c].Allowed
+}
+
+// Keeps the first rule giving c
+func (a Access) give(c Capability, rule string) {
+	if !a[c].Allowed {
+		a[c] = Decision{true, rule}
+	}
+}
+
+// Keeps the first rule taking c away
+func (a Access) take(c Capability, rule string) {
+	if a[c].Allowed {
+		a[c] = Decision{false, rule}
+	}
+}
+
+func (a Access) giveRole(role string, rule string) {
+	for _, c := range RoleCapabilities(role) {
+		a.give(c, rule)
+	}
+}
+
+// Can returns whether the user has the capability on org/repo, repo being
+// empty for capabilities on the org itself, e.g. creating repos.
+func Can(userConfig config.UserConfig, org string, repo string, c Capability) bool {
+	log.Trace("auth: Can, user: %s, org: %s, repo: %s, capability: %s", userConfig.Name, org, repo, c)
+	return UserAccess(userConfig, org, repo).Can(c)
+}
+
+// UserAccess returns the capabilities of the user on org/repo, with the
+// rule deciding each of them.
+func UserAccess(userConfig config.UserConfig, org string, repo string) Access {
+	return access(userConfig, org, repo, "")
+}
+
+// Returns the capability needed to push ref to org/repo, with the reason
+// it is needed if it isn't CapPush
+func refCapability(org string, repo string, ref string) (Capability, string) {
+	if strings.HasPrefix(ref, "refs/tags/") {
+		return CapPushTags, fmt.Sprintf("pushing tags needs the %s capability", CapPushTags)
+	}
+	for _, protected := range protectedRefs(org, repo) {
+		if matched, _ := path.Match(protected.pattern, ref); matched {
+			return CapPushProtected, fmt.Sprintf("%s is protected by %s, pushing needs the %s capability",
+				ref, protected.where, CapPushProtected)
+		}
+	}
+	return CapPush, ""
+}
+
+// HasProtectedRefs returns whether protected refs apply to org/repo.
+func HasProtectedRefs(org string, repo string) bool {
+	return len(protectedRefs(org, repo)) > 0
+}
+
+// CheckDeployKeyRefAuth returns whether the deploy key can update ref of
+// org/repo, with the rule deciding it. Deploy keys have no role, they can't
+// push to protected refs.
+func CheckDeployKeyRefAuth(name string, org string, repo string, ref string) (bool, string) {
+	log.Trace("auth: CheckDeployKeyRefAuth, deploy key: %s, org: %s, repo: %s, ref: %s", name, org, repo, ref)
+	for _, protected := range protectedRefs(org, repo) {
+		if matched, _ := path.Match(protected.pattern, ref); matched {
+			return false, fmt.Sprintf("%s is protected by %s, deploy keys cannot push to protected refs", ref, protected.where)
+		}
+	}
+	return true, "deploy key " + name
+}
+
+type protectedRef struct {
+	pattern string
+	// Where the pattern is declared, e.g. repo fixme/website
+	where string
+}
+
+// Returns the protected refs of org/repo, the ones of the repo first, then
+// the ones of its org and of each parent org
+func protectedRefs(org string, repo string) []protectedRef {
+	refs := []protectedRef{}
+	if dir.IsUserNamespace(org) {
+		return refs
+	}
+	if repoConfig, err := settings.ConfInfo.LookupRepo(org, repo); err == nil {
+		for _, pattern := range repoConfig.Protected {
+			refs = append(refs, protectedRef{pattern, fmt.Sprintf("repo %s/%s", org, repoConfig.Name)})
+		}
+	}
+	segments := strings.Split(org, "/")
+	for i := len(segments); i > 0; i-- {
+		orgPath := strings.Join(segments[:i], "/")
+		orgConfig, err := identity.Get().Org(orgPath)
+		if err != nil {
+			continue
+		}
+		for _, pattern := range orgConfig.Protected {
+			refs = append(refs, protectedRef{pattern, "org " + orgPath})
+		}
+	}
+	return refs
+}
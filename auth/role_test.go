@@ -0,0 +1,174 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/dgellow/nanogit/config"
+	"github.com/dgellow/nanogit/settings"
+)
+
+func TestRoleCapabilities(t *testing.T) {
+	// Each role has the capabilities of the previous ones
+	previous := []Capability{}
+	for _, role := range config.Roles {
+		capabilities := RoleCapabilities(role)
+		for _, c := range previous {
+			found := false
+			for _, other := range capabilities {
+				found = found || c == other
+			}
+			if !found {
+				t.Errorf("Role %s doesn't have the capability %s of the previous roles", role, c)
+			}
+		}
+		previous = capabilities
+	}
+	if len(previous) != len(Capabilities) {
+		t.Errorf("Role %s has %v, expected every capability", config.RoleAdmin, previous)
+	}
+	if capabilities := RoleCapabilities(""); len(capabilities) != 0 {
+		t.Errorf("RoleCapabilities(\"\") == %v, expected none", capabilities)
+	}
+}
+
+func TestRoles(t *testing.T) {
+	settings.ConfInfo.Set(config.Config{
+		Orgs: []config.OrgConfig{
+			{
+				Id: "qrclabs",
+				Teams: []config.TeamConfig{
+					{Name: "default", Role: config.RoleReader},
+					{Name: "dev", Role: config.RoleWriter},
+					{Name: "release", Role: config.RoleMaintainer},
+					{Name: "owners", Role: config.RoleAdmin},
+					// Migrated to the maintainer role
+					{Name: "legacy", Read: true, Write: true},
+				},
+				Protected: []string{"refs/heads/master"},
+				Repos: []config.RepoConfig{
+					{
+						Name:      "website",
+						Protected: []string{"refs/heads/release/*"},
+						Deny:      []config.DenyConfig{{User: "dave", Access: "write"}},
+					},
+				},
+			},
+		},
+		Users: []config.UserConfig{
+			{Name: "rita", Orgs: []config.UserOrgConfig{{Id: "qrclabs"}}},
+			{Name: "wendy", Orgs: []config.UserOrgConfig{{Id: "qrclabs", Teams: []string{"dev"}}}},
+			{Name: "max", Orgs: []config.UserOrgConfig{{Id: "qrclabs", Teams: []string{"release"}}}},
+			{Name: "ada", Orgs: []config.UserOrgConfig{{Id: "qrclabs", Teams: []string{"owners"}}}},
+			{Name: "lea", Orgs: []config.UserOrgConfig{{Id: "qrclabs", Teams: []string{"legacy"}}}},
+			{Name: "dave", Orgs: []config.UserOrgConfig{{Id: "qrclabs", Teams: []string{"release"}}}},
+			{Name: "sam", Shares: []config.ShareConfig{{Repo: "*", Users: []string{"wendy"}, Write: true}, {Repo: "*", Users: []string{"rita"}}}},
+		},
+	})
+	defer func() { settings.ConfInfo.Set(config.Config{}) }()
+
+	tests := []struct {
+		user  string
+		org   string
+		repo  string
+		ref   string
+		write bool
+		rule  string
+	}{
+		{"rita", "qrclabs", "website", "", false, "no ownership, share or team gives access"},
+		{"rita", "qrclabs", "website", "refs/heads/feature", false, "no ownership, share or team gives access"},
+		{"wendy", "qrclabs", "website", "", true, "team dev of org qrclabs, role writer"},
+		{"wendy", "qrclabs", "website", "refs/heads/feature", true, "team dev of org qrclabs, role writer"},
+		{"wendy", "qrclabs", "website", "refs/heads/master", false, "refs/heads/master is protected by org qrclabs, pushing needs the push-protected capability"},
+		{"wendy", "qrclabs", "website", "refs/heads/release/1.0", false, "protected by repo qrclabs/website"},
+		{"wendy", "qrclabs", "blog", "refs/heads/release/1.0", true, "role writer"},
+		{"wendy", "qrclabs", "website", "refs/tags/v1", false, "pushing tags needs the push-tags capability"},
+		{"max", "qrclabs", "website", "refs/heads/master", true, "team release of org qrclabs, role maintainer"},
+		{"max", "qrclabs", "website", "refs/tags/v1", true, "role maintainer"},
+		{"lea", "qrclabs", "website", "refs/heads/master", true, "team legacy of org qrclabs, role maintainer"},
+		{"lea", "qrclabs", "website", "refs/tags/v1", true, "role maintainer"},
+		{"ada", "qrclabs", "website", "refs/heads/release/1.0", true, "role admin"},
+		// Denying write takes away every push capability
+		{"dave", "qrclabs", "website", "refs/heads/master", false, "deny rule 1 of repo qrclabs/website"},
+		{"dave", "qrclabs", "website", "refs/tags/v1", false, "deny rule 1 of repo qrclabs/website"},
+		{"dave", "qrclabs", "blog", "refs/tags/v1", true, "role maintainer"},
+		// Personal namespaces have no protected refs
+		{"sam", "~sam", "scratch", "refs/tags/v1", true, "owner of the personal namespace ~sam"},
+		{"wendy", "~sam", "scratch", "refs/tags/v1", true, "share of * by sam"},
+		{"rita", "~sam", "scratch", "refs/heads/master", false, "no ownership, share or team gives access"},
+	}
+	for i, test := range tests {
+		userConfig, err := settings.ConfInfo.LookupUserByName(test.user)
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		e := Explain(userConfig, test.org, test.repo, test.ref)
+		if !e.Read || e.Write != test.write || !strings.Contains(e.Rule("write"), test.rule) {
+			t.Errorf("#%d: Explain(%s, %s/%s, %q) == %+v, expected write %v by %q",
+				i, test.user, test.org, test.repo, test.ref, e, test.write, test.rule)
+		}
+	}
+
+	for i, test := range []struct {
+		user       string
+		org        string
+		repo       string
+		capability Capability
+		expected   bool
+	}{
+		{"ada", "qrclabs", "", CapManageRepos, true},
+		{"ada", "qrclabs", "", CapManageTeams, true},
+		{"max", "qrclabs", "", CapManageRepos, false},
+		{"max", "qrclabs", "", CapPushTags, true},
+		{"rita", "qrclabs", "", CapRead, true},
+		{"rita", "qrclabs", "", CapPush, false},
+		{"dave", "qrclabs", "website", CapRead, true},
+		{"dave", "qrclabs", "website", CapPush, false},
+		{"sam", "~sam", "", CapManageRepos, true},
+		{"wendy", "~sam", "scratch", CapManageRepos, false},
+		{"wendy", "~sam", "scratch", CapPushTags, true},
+		{"rita", "~sam", "scratch", CapPush, false},
+	} {
+		userConfig, _ := settings.ConfInfo.LookupUserByName(test.user)
+		if actual := Can(userConfig, test.org, test.repo, test.capability); actual != test.expected {
+			t.Errorf("#%d: Can(%s, %s/%s, %s) == %v, expected %v", i, test.user, test.org, test.repo, test.capability, actual, test.expected)
+		}
+	}
+
+	for i, test := range []struct {
+		org      string
+		repo     string
+		expected bool
+	}{
+		{"qrclabs", "website", true},
+		{"qrclabs", "blog", true},
+		{"~sam", "scratch", false},
+	} {
+		if actual := HasRefRules(test.org, test.repo); actual != test.expected {
+			t.Errorf("#%d: HasRefRules(%s/%s) == %v, expected %v", i, test.org, test.repo, actual, test.expected)
+		}
+	}
+
+	// Deploy keys can push anything but protected refs
+	for i, test := range []struct {
+		org     string
+		repo    string
+		ref     string
+		allowed bool
+		rule    string
+	}{
+		{"qrclabs", "website", "refs/heads/feature", true, "deploy key ci"},
+		{"qrclabs", "website", "refs/tags/v1", true, "deploy key ci"},
+		{"qrclabs", "website", "refs/heads/master", false, "refs/heads/master is protected by org qrclabs, deploy keys cannot push to protected refs"},
+		{"qrclabs", "website", "refs/heads/release/1.0", false, "protected by repo qrclabs/website"},
+		{"qrclabs", "blog", "refs/heads/release/1.0", true, "deploy key ci"},
+	} {
+		allowed, rule := CheckDeployKeyRefAuth("ci", test.org, test.repo, test.ref)
+		if allowed != test.allowed || !strings.Contains(rule, test.rule) {
+			t.Errorf("#%d: CheckDeployKeyRefAuth(%s/%s, %s) == %v, %q, expected %v, %q", i, test.org, test.repo, test.ref, allowed, rule, test.allowed, test.rule)
+		}
+	}
+	if HasProtectedRefs("~sam", "scratch") || !HasProtectedRefs("qrclabs", "blog") {
+		t.Errorf("HasProtectedRefs() == true for a personal namespace or false for qrclabs/blog")
+	}
+}
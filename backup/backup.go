@@ -0,0 +1,399 @@
+package backup
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/dgellow/nanogit/dir"
+	"github.com/dgellow/nanogit/git"
+	"github.com/dgellow/nanogit/log"
+	"github.com/dgellow/nanogit/settings"
+	"github.com/dgellow/nanogit/store"
+)
+
+const (
+	manifestName = "manifest.yml"
+	configName   = "config.yml"
+	reposDir     = "repos"
+	storeDir     = "store"
+	// Snapshot names sort in creation order
+	nameFormat = "20060102T150405.000Z"
+)
+
+// How long to wait for running pushes before capturing the refs of a repo
+var LockTimeout = 5 * time.Minute
+
+// Manifest describes a snapshot. An incremental snapshot only holds the
+// objects added since its base, the previous snapshot.
+type Manifest struct {
+	Created time.Time
+	Base    string
+	Repos   map[string]RepoSnapshot
+}
+
+// RepoSnapshot is the state of a repository when its refs were captured.
+type RepoSnapshot struct {
+	// Target of the symbolic HEAD
+	Head string
+	// Object ids keyed by ref name
+	Refs map[string]string
+	// Bundle file relative to the snapshot, empty if no objects were added
+	// since the base snapshot
+	Bundle string
+}
+
+func readManifest(snapshotDir string) (Manifest, error) {
+	m := Manifest{}
+	data, err := ioutil.ReadFile(filepath.Join(snapshotDir, manifestName))
+	if err != nil {
+		return m, err
+	}
+	return m, yaml.Unmarshal(data, &m)
+}
+
+// Latest returns the name of the most recent complete snapshot in dest,
+// empty if there is none.
+func Latest(dest string) (string, error) {
+	entries, err := ioutil.ReadDir(dest)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	names := []string{}
+	for _, entry := range entries {
+		if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(dest, entry.Name(), manifestName)); err == nil {
+			names = append(names, entry.Name())
+		}
+	}
+	if len(names) == 0 {
+		return "", nil
+	}
+	sort.Strings(names)
+	return names[len(names)-1], nil
+}
+
+// Create writes a snapshot of every repository, the config file and the
+// stores into a new directory of dest, and returns its name. Incremental
+// snapshots only bundle the objects added since the latest snapshot.
+func Create(dest string, incremental bool) (string, error) {
+	log.Trace("backup: Create, dest: %s, incremental: %t", dest, incremental)
+	manifest := Manifest{Created: time.Now().UTC(), Repos: map[string]RepoSnapshot{}}
+	base := Manifest{}
+	if incremental {
+		name, err := Latest(dest)
+		if err != nil {
+			return "", err
+		}
+		if name == "" {
+			return "", fmt.Errorf("No previous snapshot in %s", dest)
+		}
+		if base, err = readManifest(filepath.Join(dest, name)); err != nil {
+			return "", err
+		}
+		manifest.Base = name
+	}
+
+	name := manifest.Created.Format(nameFormat)
+	tmpDir := filepath.Join(dest, "."+name+".tmp")
+	if err := os.MkdirAll(tmpDir, 0700); err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	repos, err := dir.ListRepos()
+	if err != nil {
+		return "", err
+	}
+	for _, repo := range repos {
+		snapshot, err := snapshotRepo(tmpDir, repo, base.Repos[repo.String()].Refs)
+		if err != nil {
+			return "", fmt.Errorf("Cannot back up %s: %v", repo, err)
+		}
+		manifest.Repos[repo.String()] = snapshot
+	}
+
+	if err := copyFile(settings.ConfInfo.ConfigFile, filepath.Join(tmpDir, configName)); err != nil {
+		return "", err
+	}
+	if err := copyStores(tmpDir); err != nil {
+		return "", err
+	}
+	data, err := yaml.Marshal(manifest)
+	if err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(filepath.Join(tmpDir, manifestName), data, 0600); err != nil {
+		return "", err
+	}
+	return name, os.Rename(tmpDir, filepath.Join(dest, name))
+}
+
+// Captures the refs of repo and bundles the objects missing from the base
+// snapshot
+func snapshotRepo(snapshotDir string, repo dir.RepoPath, baseRefs map[string]string) (RepoSnapshot, error) {
+	log.Trace("backup: snapshotRepo, repo: %s", repo)
+	repoPath, err := dir.GetRepoDir(repo.Org, repo.Repo)
+	if err != nil {
+		return RepoSnapshot{}, err
+	}
+	snapshot, err := captureRefs(repo, repoPath)
+	if err != nil {
+		return snapshot, err
+	}
+	if len(snapshot.Refs) == 0 {
+		return snapshot, nil
+	}
+
+	// The captured refs are bundled from a shadow repo borrowing the
+	// objects of the repo, pushes received meanwhile are left out
+	shadow, err := ioutil.TempDir("", "nanogit-backup")
+	if err != nil {
+		return snapshot, err
+	}
+	defer os.RemoveAll(shadow)
+	if _, err := git.Run("", nil, "init", "--bare", "--quiet", shadow); err != nil {
+		return snapshot, err
+	}
+	objects, err := filepath.Abs(filepath.Join(repoPath, "objects"))
+	if err != nil {
+		return snapshot, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(shadow, "objects", "info", "alternates"), []byte(objects+"\n"), 0644); err != nil {
+		return snapshot, err
+	}
+	if err := writeRefs(shadow, snapshot.Refs); err != nil {
+		return snapshot, err
+	}
+
+	revs := []string{"--all"}
+	excluded := map[string]bool{}
+	for _, id := range baseRefs {
+		if excluded[id] {
+			continue
+		}
+		excluded[id] = true
+		// Objects of the base may have been pruned since
+		if _, err := git.Run(shadow, nil, "cat-file", "-e", id); err == nil {
+			revs = append(revs, "^"+id)
+		}
+	}
+	count, err := git.Run(shadow, nil, append([]string{"rev-list", "--count"}, revs...)...)
+	if err != nil {
+		return snapshot, err
+	}
+	if strings.TrimSpace(count) == "0" {
+		return snapshot, nil
+	}
+
+	snapshot.Bundle = filepath.Join(reposDir, repo.String()+".bundle")
+	bundlePath := filepath.Join(snapshotDir, snapshot.Bundle)
+	if err := os.MkdirAll(filepath.Dir(bundlePath), 0700); err != nil {
+		return snapshot, err
+	}
+	_, err = git.Run(shadow, nil, append([]string{"bundle", "create", bundlePath}, revs...)...)
+	return snapshot, err
+}
+
+// Reads the refs of repo, new pushes wait until they are captured
+func captureRefs(repo dir.RepoPath, repoPath string) (RepoSnapshot, error) {
+	snapshot := RepoSnapshot{Refs: map[string]string{}}
+	lock, err := dir.LockRepo(repo.Org, repo.Repo, true, LockTimeout)
+	if err != nil {
+		return snapshot, err
+	}
+	defer lock.Unlock()
+
+	out, err := git.Run(repoPath, nil, "for-each-ref", "--format=%(objectname) %(refname)")
+	if err != nil {
+		return snapshot, err
+	}
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 {
+			snapshot.Refs[fields[1]] = fields[0]
+		}
+	}
+	if head, err := git.Run(repoPath, nil, "symbolic-ref", "HEAD"); err == nil {
+		snapshot.Head = strings.TrimSpace(head)
+	}
+	return snapshot, nil
+}
+
+// Writes refs to the packed-refs file of a new repo
+func writeRefs(repoPath string, refs map[string]string) error {
+	packedRefs := ""
+	for _, ref := range sortedRefs(refs) {
+		packedRefs += refs[ref] + " " + ref + "\n"
+	}
+	return ioutil.WriteFile(filepath.Join(repoPath, "packed-refs"), []byte(packedRefs), 0644)
+}
+
+func sortedRefs(refs map[string]string) []string {
+	names := []string{}
+	for name := range refs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Copies the files of the store directory, directories only hold state
+// recreated by the server
+func copyStores(snapshotDir string) error {
+	src, err := dir.GetStoreDir()
+	if err != nil {
+		return err
+	}
+	entries, err := ioutil.ReadDir(src)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.Mode().IsRegular() && !strings.HasPrefix(entry.Name(), ".") {
+			if err := copyFile(filepath.Join(src, entry.Name()), filepath.Join(snapshotDir, storeDir, entry.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func copyFile(src string, dst string) error {
+	data, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(dst, data, 0600)
+}
+
+// Restore rebuilds the data root from given snapshot and the snapshots it
+// is based on. The data root must not contain any repository.
+func Restore(snapshotDir string) error {
+	log.Trace("backup: Restore, snapshot: %s", snapshotDir)
+	chain, err := snapshotChain(snapshotDir)
+	if err != nil {
+		return err
+	}
+	if repos, err := dir.ListRepos(); err == nil && len(repos) > 0 {
+		return fmt.Errorf("Data root already contains repositories")
+	}
+
+	target := chain[len(chain)-1].manifest
+	for _, path := range sortedRepos(target.Repos) {
+		if err := restoreRepo(chain, path); err != nil {
+			return fmt.Errorf("Cannot restore %s: %v", path, err)
+		}
+	}
+
+	storePath, err := dir.GetStoreDir()
+	if err != nil {
+		return err
+	}
+	entries, err := ioutil.ReadDir(filepath.Join(snapshotDir, storeDir))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, entry := range entries {
+		data, err := ioutil.ReadFile(filepath.Join(snapshotDir, storeDir, entry.Name()))
+		if err != nil {
+			return err
+		}
+		if err := store.WriteFile(filepath.Join(storePath, entry.Name()), data, 0600); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type snapshot struct {
+	dir      string
+	manifest Manifest
+}
+
+// Returns given snapshot and its bases, oldest first
+func snapshotChain(snapshotDir string) ([]snapshot, error) {
+	chain := []snapshot{}
+	for {
+		m, err := readManifest(snapshotDir)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot read snapshot %s: %v", snapshotDir, err)
+		}
+		chain = append([]snapshot{{snapshotDir, m}}, chain...)
+		if m.Base == "" {
+			return chain, nil
+		}
+		if len(chain) > 10000 {
+			return nil, fmt.Errorf("Snapshot chain is too long")
+		}
+		snapshotDir = filepath.Join(filepath.Dir(snapshotDir), m.Base)
+	}
+}
+
+func sortedRepos(repos map[string]RepoSnapshot) []string {
+	paths := []string{}
+	for path := range repos {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// Unbundles the objects of every snapshot of the chain, then sets the refs
+// of the last one
+func restoreRepo(chain []snapshot, path string) error {
+	log.Trace("backup: restoreRepo, repo: %s", path)
+	org, repo, err := dir.SplitPath(path)
+	if err != nil {
+		return err
+	}
+	repoPath, err := dir.GetRepoDir(org, repo)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(repoPath), 0755); err != nil {
+		return err
+	}
+	if _, err := git.Run("", nil, "init", "--bare", "--quiet", repoPath); err != nil {
+		return err
+	}
+	for _, s := range chain {
+		if rs, ok := s.manifest.Repos[path]; ok && rs.Bundle != "" {
+			bundle, err := filepath.Abs(filepath.Join(s.dir, rs.Bundle))
+			if err != nil {
+				return err
+			}
+			if _, err := git.Run(repoPath, nil, "bundle", "unbundle", bundle); err != nil {
+				return err
+			}
+		}
+	}
+
+	target := chain[len(chain)-1].manifest.Repos[path]
+	if err := writeRefs(repoPath, target.Refs); err != nil {
+		return err
+	}
+	if target.Head != "" {
+		if _, err := git.Run(repoPath, nil, "symbolic-ref", "HEAD", target.Head); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package backup
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgellow/nanogit/config"
+	"github.com/dgellow/nanogit/dir"
+	"github.com/dgellow/nanogit/git"
+	"github.com/dgellow/nanogit/settings"
+)
+
+func refs(t *testing.T, repoPath string) string {
+	out, err := git.Run(repoPath, nil, "for-each-ref", "--format=%(objectname) %(refname)")
+	if err != nil {
+		t.Fatalf("Cannot list refs of %s: %v", repoPath, err)
+	}
+	return strings.TrimSpace(out)
+}
+
+func TestBackupRestore(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "nanogit-backup")
+	if err != nil {
+		t.Fatalf("Cannot create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	dataRoot := filepath.Join(tmpDir, "dataroot")
+	configFile := filepath.Join(tmpDir, "config.yml")
+	if err := ioutil.WriteFile(configFile, []byte("server:\n  dataroot: "+dataRoot+"\n"), 0644); err != nil {
+		t.Fatalf("Cannot write config: %v", err)
+	}
+	settings.ConfInfo = config.ConfigInfo{ConfigFile: configFile}
+	settings.ConfInfo.ReadFile()
+	defer func() { settings.ConfInfo = config.ConfigInfo{} }()
+
+	repoPath := filepath.Join(dataRoot, "fixme", "foo")
+	workPath := filepath.Join(tmpDir, "work")
+	for _, path := range []string{repoPath, filepath.Join(dataRoot, "~", "dgellow", "empty")} {
+		if _, err := git.Run("", nil, "init", "--bare", "--quiet", path); err != nil {
+			t.Fatalf("Cannot init repo: %v", err)
+		}
+	}
+	if _, err := git.Run("", nil, "init", "--quiet", workPath); err != nil {
+		t.Fatalf("Cannot init work tree: %v", err)
+	}
+	push := func(ref string) {
+		_, err := git.Run(workPath, nil, "-c", "user.name=nanogit", "-c", "user.email=nanogit@localhost",
+			"commit", "--allow-empty", "--quiet", "-m", "commit")
+		if err != nil {
+			t.Fatalf("Cannot commit: %v", err)
+		}
+		if _, err := git.Run(workPath, nil, "push", "--quiet", repoPath, "HEAD:"+ref); err != nil {
+			t.Fatalf("Cannot push to repo: %v", err)
+		}
+	}
+	git.Run(repoPath, nil, "symbolic-ref", "HEAD", "refs/heads/main")
+	storeDir, _ := dir.GetStoreDir()
+	os.MkdirAll(storeDir, 0700)
+	ioutil.WriteFile(filepath.Join(storeDir, "keys.yml"), []byte("keys: []\n"), 0600)
+
+	dest := filepath.Join(tmpDir, "backups")
+	if _, err := Create(dest, true); err == nil {
+		t.Errorf("Create() incremental without previous snapshot == nil; expected error")
+	}
+
+	push("refs/heads/main")
+	full, err := Create(dest, false)
+	if err != nil {
+		t.Fatalf("Create() == %v", err)
+	}
+	fullRefs := refs(t, repoPath)
+
+	// Pushes wait for refs to be captured
+	lock, err := dir.LockRepo("fixme", "foo", false, time.Second)
+	if err != nil {
+		t.Fatalf("LockRepo() == %v", err)
+	}
+	defer func(timeout time.Duration) { LockTimeout = timeout }(LockTimeout)
+	LockTimeout = 100 * time.Millisecond
+	if _, err := Create(dest, true); err == nil {
+		t.Errorf("Create() while pushing == nil; expected error")
+	}
+	lock.Unlock()
+
+	push("refs/heads/main")
+	push("refs/heads/feature")
+	incremental, err := Create(dest, true)
+	if err != nil {
+		t.Fatalf("Create() incremental == %v", err)
+	}
+	if latest, _ := Latest(dest); latest != incremental || incremental == full {
+		t.Errorf("Latest() == %s; expected %s after %s", latest, incremental, full)
+	}
+	m, err := readManifest(filepath.Join(dest, incremental))
+	if err != nil {
+		t.Fatalf("Cannot read manifest: %v", err)
+	}
+	if m.Base != full || m.Repos["fixme/foo"].Bundle == "" || m.Repos["~dgellow/empty"].Bundle != "" {
+		t.Errorf("Incremental manifest == %+v", m)
+	}
+	// The incremental bundle requires the objects of the full one
+	verify, err := git.Run(repoPath, nil, "bundle", "list-heads", filepath.Join(dest, incremental, m.Repos["fixme/foo"].Bundle))
+	if err != nil || !strings.Contains(verify, "refs/heads/feature") {
+		t.Errorf("Incremental bundle heads == %s, %v", verify, err)
+	}
+
+	// Unchanged repos are not bundled again
+	unchanged, err := Create(dest, true)
+	if err != nil {
+		t.Fatalf("Create() unchanged == %v", err)
+	}
+	if m, _ := readManifest(filepath.Join(dest, unchanged)); m.Repos["fixme/foo"].Bundle != "" {
+		t.Errorf("Unchanged manifest == %+v", m)
+	}
+
+	restoreRoot := filepath.Join(tmpDir, "restored")
+	settings.ConfInfo.Conf.Server.DataRoot = restoreRoot
+	if err := Restore(filepath.Join(dest, unchanged)); err != nil {
+		t.Fatalf("Restore() == %v", err)
+	}
+	restoredPath := filepath.Join(restoreRoot, "fixme", "foo")
+	if actual, expected := refs(t, restoredPath), refs(t, repoPath); actual != expected || actual == fullRefs {
+		t.Errorf("Restored refs == %q; expected %q", actual, expected)
+	}
+	if _, err := git.Run(restoredPath, nil, "fsck", "--no-dangling"); err != nil {
+		t.Errorf("Restored repo is corrupt: %v", err)
+	}
+	if head, _ := git.Run(restoredPath, nil, "symbolic-ref", "HEAD"); strings.TrimSpace(head) != "refs/heads/main" {
+		t.Errorf("Restored HEAD == %s; expected refs/heads/main", head)
+	}
+	if !dir.IsBareRepo(filepath.Join(restoreRoot, "~", "dgellow", "empty")) {
+		t.Errorf("Empty repo wasn't restored")
+	}
+	if _, err := os.Stat(filepath.Join(restoreRoot, ".nanogit", "keys.yml")); err != nil {
+		t.Errorf("Key store wasn't restored: %v", err)
+	}
+	if err := Restore(filepath.Join(dest, unchanged)); err == nil {
+		t.Errorf("Restore() to a data root with repositories == nil; expected error")
+	}
+}
@@ -0,0 +1,79 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/urfave/cli"
+
+	"github.com/dgellow/nanogit/auth"
+	"github.com/dgellow/nanogit/dir"
+	"github.com/dgellow/nanogit/identity"
+)
+
+var CmdAuth = cli.Command{
+	Name:  "auth",
+	Usage: "Inspect access rules",
+	Subcommands: []cli.Command{
+		{
+			Name:      "explain",
+			Usage:     "Show whether a user can read, write, push a ref to a repository or has a capability, and the rule deciding it",
+			ArgsUsage: "<user> <org/repo> <read|write|refs/...|capability>",
+			Action:    runAuthExplain,
+			Flags: []cli.Flag{
+				configFlag,
+				logLevelFlag,
+			},
+		},
+	},
+}
+
+func runAuthExplain(c *cli.Context) error {
+	setup(c)
+	if c.NArg() != 3 {
+		return cli.NewExitError("nanogit: usage: nanogit auth explain <user> <org/repo> <read|write|refs/...|capability>", 1)
+	}
+	userConfig, err := identity.Get().UserByName(c.Args().Get(0))
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("nanogit: %v", err), 1)
+	}
+	org, repo, err := dir.ParseRepoPath(c.Args().Get(1))
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("nanogit: %v", err), 1)
+	}
+
+	op, access, ref := c.Args().Get(2), "write", ""
+	switch {
+	case op == "read":
+		access = "read"
+	case op == "write":
+	case strings.HasPrefix(op, "refs/"):
+		ref = op
+		op = "push to " + ref
+	default:
+		for _, capability := range auth.Capabilities {
+			if op == string(capability) {
+				d := auth.UserAccess(userConfig, org, repo)[capability]
+				printDecision(userConfig.Name, op, org, repo, d.Allowed, d.Reason())
+				return nil
+			}
+		}
+		return cli.NewExitError(fmt.Sprintf("nanogit: unknown operation %s, expected read, write, a ref or a capability", op), 1)
+	}
+	e := auth.Explain(userConfig, org, repo, ref)
+	allowed := e.Read
+	if access == "write" {
+		allowed = e.Write
+	}
+	printDecision(userConfig.Name, op, org, repo, allowed, e.Rule(access))
+	return nil
+}
+
+func printDecision(user string, op string, org string, repo string, allowed bool, rule string) {
+	outcome := "denied"
+	if allowed {
+		outcome = "allowed"
+	}
+	fmt.Printf("%s: %s of %s/%s %s\n", user, op, org, repo, outcome)
+	fmt.Printf("  decided by %s\n", rule)
+}
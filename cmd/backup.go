@@ -0,0 +1,87 @@
+package cmd
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/urfave/cli"
+
+	"github.com/dgellow/nanogit/backup"
+	"github.com/dgellow/nanogit/log"
+	"github.com/dgellow/nanogit/settings"
+)
+
+var CmdBackup = cli.Command{
+	Name:      "backup",
+	Usage:     "Write a snapshot of every repository, the config file and the stores",
+	ArgsUsage: "<destination>",
+	Action:    runBackup,
+	Flags: []cli.Flag{
+		configFlag,
+		logLevelFlag,
+		cli.BoolFlag{
+			Name:  "incremental, i",
+			Usage: "Only bundle objects added since the latest snapshot of the destination",
+		},
+	},
+}
+
+var CmdRestore = cli.Command{
+	Name:      "restore",
+	Usage:     "Rebuild the data root from a snapshot written by nanogit backup",
+	ArgsUsage: "<snapshot>",
+	Action:    runRestore,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "config, c",
+			Usage: "Configuration file giving the data root, the one of the snapshot by default",
+		},
+		cli.StringFlag{
+			Name:  "dataroot",
+			Usage: "Data root to restore to, overrides the configuration file",
+		},
+		logLevelFlag,
+	},
+}
+
+func runBackup(c *cli.Context) error {
+	setup(c)
+	if c.NArg() != 1 {
+		return cli.NewExitError("nanogit: usage: nanogit backup [--incremental] <destination>", 1)
+	}
+	dest := c.Args().First()
+	name, err := backup.Create(dest, c.Bool("incremental"))
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("nanogit: backup failed: %v", err), 1)
+	}
+	fmt.Printf("Snapshot written to %s\n", filepath.Join(dest, name))
+	return nil
+}
+
+func runRestore(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return cli.NewExitError("nanogit: usage: nanogit restore [--dataroot <path>] <snapshot>", 1)
+	}
+	snapshot := c.Args().First()
+	log.Log.LogLevel = c.Int("loglevel")
+	settings.ConfInfo.ConfigFile = c.String("config")
+	if settings.ConfInfo.ConfigFile == "" {
+		settings.ConfInfo.ConfigFile = filepath.Join(snapshot, "config.yml")
+	}
+	settings.ConfInfo.ReadFile()
+	if dataRoot := c.String("dataroot"); dataRoot != "" {
+		absDataRoot, err := filepath.Abs(dataRoot)
+		if err != nil {
+			return cli.NewExitError(fmt.Sprintf("nanogit: %v", err), 1)
+		}
+		conf := settings.ConfInfo.Get()
+		conf.Server.DataRoot = absDataRoot
+		settings.ConfInfo.Set(conf)
+	}
+
+	if err := backup.Restore(snapshot); err != nil {
+		return cli.NewExitError(fmt.Sprintf("nanogit: restore failed: %v", err), 1)
+	}
+	fmt.Printf("Restored %s to %s\n", snapshot, settings.ConfInfo.Get().Server.DataRoot)
+	return nil
+}
@@ -1 +1,28 @@
 package cmd
+
+import (
+	"github.com/urfave/cli"
+
+	"github.com/dgellow/nanogit/log"
+	"github.com/dgellow/nanogit/settings"
+)
+
+var configFlag = cli.StringFlag{
+	Name:  "config, c",
+	Value: "config.yml",
+	Usage: "Custom configuration file path",
+}
+
+var logLevelFlag = cli.IntFlag{
+	Name:  "loglevel",
+	Value: 3,
+	Usage: "0=Trace, 1=Debug, 2=Info, 3=Warn, 4=Error, 5=Critical, 6=Fatal",
+}
+
+// Set log level and read config file from the command flags
+func setup(c *cli.Context) {
+	log.Log.LogLevel = c.Int("loglevel")
+	settings.ConfInfo.ConfigFile = c.String("config")
+	settings.ConfInfo.ReadFile()
+	log.Trace("cmd: ConfigFile: %s", settings.ConfInfo.ConfigFile)
+}
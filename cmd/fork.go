@@ -0,0 +1,82 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/urfave/cli"
+
+	"github.com/dgellow/nanogit/dir"
+	"github.com/dgellow/nanogit/fork"
+)
+
+var CmdFork = cli.Command{
+	Name:  "fork",
+	Usage: "Fork repositories, forks share the objects of their source",
+	Subcommands: []cli.Command{
+		{
+			Name:      "create",
+			Usage:     "Fork a repository into an org, keeping its name if none is given",
+			ArgsUsage: "<org/repo> <org>[/<repo>]",
+			Action:    runForkCreate,
+			Flags: []cli.Flag{
+				configFlag,
+				logLevelFlag,
+			},
+		},
+		{
+			Name:   "list",
+			Usage:  "List forks and their source",
+			Action: runForkList,
+			Flags: []cli.Flag{
+				configFlag,
+				logLevelFlag,
+			},
+		},
+	},
+}
+
+// Parse the source and target of a fork, the target repo name defaults to
+// the source one.
+func parseForkArgs(src string, dst string) (dir.RepoPath, dir.RepoPath, error) {
+	srcOrg, srcRepo, err := dir.ParseRepoPath(src)
+	if err != nil {
+		return dir.RepoPath{}, dir.RepoPath{}, err
+	}
+	if !strings.Contains(dst, "/") {
+		dst = dst + "/" + srcRepo
+	}
+	dstOrg, dstRepo, err := dir.ParseRepoPath(dst)
+	if err != nil {
+		return dir.RepoPath{}, dir.RepoPath{}, err
+	}
+	return dir.RepoPath{Org: srcOrg, Repo: srcRepo}, dir.RepoPath{Org: dstOrg, Repo: dstRepo}, nil
+}
+
+func runForkCreate(c *cli.Context) error {
+	setup(c)
+	if c.NArg() != 2 {
+		return cli.NewExitError("nanogit: usage: nanogit fork create <org/repo> <org>[/<repo>]", 1)
+	}
+	src, dst, err := parseForkArgs(c.Args().Get(0), c.Args().Get(1))
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("nanogit: %v", err), 1)
+	}
+	if err := fork.Create(src.Org, src.Repo, dst.Org, dst.Repo); err != nil {
+		return cli.NewExitError(fmt.Sprintf("nanogit: cannot fork %s: %v", src, err), 1)
+	}
+	fmt.Printf("Forked %s into %s\n", src, dst)
+	return nil
+}
+
+func runForkList(c *cli.Context) error {
+	setup(c)
+	relations, err := fork.List()
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("nanogit: cannot list forks: %v", err), 1)
+	}
+	for _, rel := range relations {
+		fmt.Printf("%s\tforked from %s\n", rel.Fork, rel.Source)
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/urfave/cli"
+
+	"github.com/dgellow/nanogit/dir"
+	"github.com/dgellow/nanogit/fsck"
+)
+
+var CmdFsck = cli.Command{
+	Name:      "fsck",
+	Usage:     "Check the integrity of repositories, all of them if none is given",
+	ArgsUsage: "[org/repo]",
+	Action:    runFsck,
+	Flags: []cli.Flag{
+		configFlag,
+		logLevelFlag,
+	},
+}
+
+// Summary printed as JSON once every repository is checked
+type fsckSummary struct {
+	Checked  int           `json:"checked"`
+	Failed   int           `json:"failed"`
+	Failures []fsckFailure `json:"failures"`
+}
+
+type fsckFailure struct {
+	Repo  string `json:"repo"`
+	Error string `json:"error"`
+}
+
+func runFsck(c *cli.Context) error {
+	setup(c)
+	repos, err := dir.ListRepos()
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("nanogit: cannot list repositories: %v", err), 1)
+	}
+	if c.NArg() > 0 {
+		org, repo, err := dir.ParseRepoPath(c.Args().First())
+		if err != nil {
+			return cli.NewExitError(fmt.Sprintf("nanogit: %v", err), 1)
+		}
+		if exists, _ := dir.IsRepoExist(org, repo); !exists {
+			return cli.NewExitError(fmt.Sprintf("nanogit: repository not found: %s/%s", org, repo), 1)
+		}
+		repos = []dir.RepoPath{{Org: org, Repo: repo}}
+	}
+
+	summary := fsckSummary{Failures: []fsckFailure{}}
+	for _, repo := range repos {
+		result := fsck.Check(repo.Org, repo.Repo)
+		summary.Checked++
+		if !result.Ok {
+			fmt.Fprintf(os.Stderr, "%s: corrupt: %s\n", repo, result.Error)
+			summary.Failed++
+			summary.Failures = append(summary.Failures, fsckFailure{repo.String(), result.Error})
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "%s: ok in %v\n", repo, result.Duration/time.Millisecond*time.Millisecond)
+	}
+
+	if err := json.NewEncoder(os.Stdout).Encode(summary); err != nil {
+		return err
+	}
+	if summary.Failed > 0 {
+		return cli.NewExitError(fmt.Sprintf("nanogit: %d repositories failed fsck", summary.Failed), 1)
+	}
+	return nil
+}
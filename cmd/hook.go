@@ -0,0 +1,103 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/urfave/cli"
+
+	"github.com/dgellow/nanogit/auth"
+	"github.com/dgellow/nanogit/dir"
+	"github.com/dgellow/nanogit/hooks"
+	"github.com/dgellow/nanogit/log"
+	"github.com/dgellow/nanogit/quota"
+	"github.com/dgellow/nanogit/settings"
+)
+
+// CmdHook runs the git hooks installed by the server. Its output is shown
+// to the pusher.
+var CmdHook = cli.Command{
+	Name:      "hook",
+	Usage:     "Run a git hook, for internal use",
+	ArgsUsage: "<hook>",
+	Hidden:    true,
+	Action:    runHook,
+	Flags: []cli.Flag{
+		configFlag,
+	},
+}
+
+func runHook(c *cli.Context) error {
+	log.Log.Adapter = "stderr"
+	log.Log.LogLevel = log.ERROR
+	settings.ConfInfo.ConfigFile = c.String("config")
+	settings.ConfInfo.ReadFile()
+
+	if c.Args().First() != "pre-receive" {
+		return cli.NewExitError(fmt.Sprintf("nanogit: unknown hook: %s", c.Args().First()), 1)
+	}
+	if err := preReceive(os.Getenv(hooks.RepoEnv), os.Getenv(auth.UserEnv), os.Getenv(auth.DeployKeyEnv), os.Getenv("GIT_QUARANTINE_PATH")); err != nil {
+		return cli.NewExitError(fmt.Sprintf("nanogit: push rejected: %v", err), 1)
+	}
+	return nil
+}
+
+// Rejects pushes updating refs the user or deploy key is denied, or
+// exceeding a quota. The pushed objects are kept in a quarantine directory
+// until the hook accepts them.
+func preReceive(path string, user string, deployKey string, quarantine string) error {
+	org, repo, err := dir.SplitPath(path)
+	if err != nil {
+		return err
+	}
+	// Lines of the updated refs: <old> <new> <ref>
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 {
+			continue
+		}
+		allowed, rule := true, ""
+		if user != "" {
+			allowed, rule = auth.CheckRefAuth(user, org, repo, fields[2])
+		} else if deployKey != "" {
+			allowed, rule = auth.CheckDeployKeyRefAuth(deployKey, org, repo, fields[2])
+		}
+		if !allowed {
+			return fmt.Errorf("Unauthorized push to %s: %s", fields[2], rule)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if len(quota.Limits(org, repo)) == 0 {
+		return nil
+	}
+	var incoming int64
+	if quarantine != "" {
+		incoming, err = dir.DiskUsage(quarantine)
+	} else {
+		// Git older than 2.11 writes pushed objects to the repo directly
+		incoming, err = growth(org, repo)
+	}
+	if err != nil {
+		return err
+	}
+	return quota.Check(org, repo, incoming)
+}
+
+// Returns how much the repo grew since its size was last cached
+func growth(org string, repo string) (int64, error) {
+	path := dir.RepoPath{Org: org, Repo: repo}
+	sizes, err := quota.Sizes([]dir.RepoPath{path})
+	if err != nil {
+		return 0, err
+	}
+	size, err := quota.Refresh(org, repo)
+	if err != nil {
+		return 0, err
+	}
+	return size - sizes[path.String()], nil
+}
@@ -0,0 +1,100 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/urfave/cli"
+
+	"github.com/dgellow/nanogit/dir"
+	"github.com/dgellow/nanogit/maintenance"
+)
+
+var CmdMaintenance = cli.Command{
+	Name:  "maintenance",
+	Usage: "Run gc, repack and commit-graph tasks on repositories",
+	Subcommands: []cli.Command{
+		{
+			Name:      "run",
+			Usage:     "Maintain repositories now, all of them if none is given",
+			ArgsUsage: "[org/repo]",
+			Action:    runMaintenanceRun,
+			Flags: []cli.Flag{
+				configFlag,
+				logLevelFlag,
+			},
+		},
+		{
+			Name:   "status",
+			Usage:  "Show the last maintenance run of every repository",
+			Action: runMaintenanceStatus,
+			Flags: []cli.Flag{
+				configFlag,
+				logLevelFlag,
+			},
+		},
+	},
+}
+
+func runMaintenanceRun(c *cli.Context) error {
+	setup(c)
+	repos, err := dir.ListRepos()
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("nanogit: cannot list repositories: %v", err), 1)
+	}
+	if c.NArg() > 0 {
+		org, repo, err := dir.ParseRepoPath(c.Args().First())
+		if err != nil {
+			return cli.NewExitError(fmt.Sprintf("nanogit: %v", err), 1)
+		}
+		if exists, _ := dir.IsRepoExist(org, repo); !exists {
+			return cli.NewExitError(fmt.Sprintf("nanogit: repository not found: %s/%s", org, repo), 1)
+		}
+		repos = []dir.RepoPath{{Org: org, Repo: repo}}
+	}
+
+	failed := 0
+	for _, repo := range repos {
+		start := time.Now()
+		if err := maintenance.Run(repo.Org, repo.Repo, "manual"); err != nil {
+			fmt.Printf("%s: failed: %v\n", repo, err)
+			failed++
+			continue
+		}
+		fmt.Printf("%s: done in %v\n", repo, time.Since(start)/time.Millisecond*time.Millisecond)
+	}
+	fmt.Printf("\n%d repositories maintained, %d failed\n", len(repos)-failed, failed)
+	if failed > 0 {
+		return cli.NewExitError(fmt.Sprintf("nanogit: %d repositories failed maintenance", failed), 1)
+	}
+	return nil
+}
+
+func runMaintenanceStatus(c *cli.Context) error {
+	setup(c)
+	repos, err := dir.ListRepos()
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("nanogit: cannot list repositories: %v", err), 1)
+	}
+	statuses, err := maintenance.Statuses()
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("nanogit: cannot read maintenance status: %v", err), 1)
+	}
+
+	now := time.Now()
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "REPO\tLAST RUN\tLAST SUCCESS\tDURATION\tTRIGGER\tNEXT RUN\tERROR\n")
+	for _, repo := range repos {
+		status := statuses[repo.String()]
+		next := "now"
+		if due := status.LastRun.Add(maintenance.Config(repo.Org).Interval); due.After(now) {
+			next = formatTime(due)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%v\t%s\t%s\t%s\n", repo, formatTime(status.LastRun),
+			formatTime(status.LastSuccess), status.Duration/time.Millisecond*time.Millisecond,
+			status.Trigger, next, status.Error)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,115 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/urfave/cli"
+
+	"github.com/dgellow/nanogit/dir"
+	"github.com/dgellow/nanogit/mirror"
+)
+
+var CmdMirror = cli.Command{
+	Name:  "mirror",
+	Usage: "Manage read-only pull mirrors of upstream repositories",
+	Subcommands: []cli.Command{
+		{
+			Name:      "sync",
+			Usage:     "Fetch upstreams now, all mirrors if no repository is given",
+			ArgsUsage: "[org/repo]",
+			Action:    runMirrorSync,
+			Flags: []cli.Flag{
+				configFlag,
+				logLevelFlag,
+			},
+		},
+		{
+			Name:   "status",
+			Usage:  "Show the status of pull mirrors and the lag of push mirrors",
+			Action: runMirrorStatus,
+			Flags: []cli.Flag{
+				configFlag,
+				logLevelFlag,
+			},
+		},
+	},
+}
+
+func runMirrorSync(c *cli.Context) error {
+	setup(c)
+	mirrors := mirror.List()
+	if c.NArg() > 0 {
+		org, repo, err := dir.ParseRepoPath(c.Args().First())
+		if err != nil {
+			return cli.NewExitError(fmt.Sprintf("nanogit: %v", err), 1)
+		}
+		m, err := mirror.Lookup(org, repo)
+		if err != nil {
+			return cli.NewExitError(fmt.Sprintf("nanogit: %v", err), 1)
+		}
+		mirrors = []mirror.Mirror{m}
+	}
+
+	failed := 0
+	for _, m := range mirrors {
+		if err := mirror.Sync(m); err != nil {
+			fmt.Printf("%s: failed: %v\n", m.Path(), err)
+			failed++
+			continue
+		}
+		fmt.Printf("%s: synced\n", m.Path())
+	}
+	if failed > 0 {
+		return cli.NewExitError(fmt.Sprintf("nanogit: %d mirror(s) failed to sync", failed), 1)
+	}
+	return nil
+}
+
+func runMirrorStatus(c *cli.Context) error {
+	setup(c)
+	statuses, err := mirror.Statuses()
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("nanogit: cannot read mirror status: %v", err), 1)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "REPO\tUPSTREAM\tLAST SYNC\tLAST SUCCESS\tERROR\n")
+	for _, m := range mirror.List() {
+		status := statuses[m.Path()]
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", m.Path(), m.Config.Url,
+			formatTime(status.LastSync), formatTime(status.LastSuccess), status.Error)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	pushStatuses, err := mirror.PushStatuses()
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("nanogit: cannot read push mirror status: %v", err), 1)
+	}
+	keys := []string{}
+	for key := range pushStatuses {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	now := time.Now()
+	fmt.Println()
+	fmt.Fprintf(w, "REPO\tPUSH MIRROR\tLAG\tLAST SUCCESS\tFAILURES\tERROR\n")
+	for _, key := range keys {
+		ps := pushStatuses[key]
+		fmt.Fprintf(w, "%s\t%s\t%v\t%s\t%d\t%s\n", ps.Repo, ps.Name,
+			ps.Lag(now)/time.Second*time.Second, formatTime(ps.LastSuccess), ps.Failures, ps.Error)
+	}
+	return w.Flush()
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return t.Format(time.RFC3339)
+}
@@ -0,0 +1,70 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/urfave/cli"
+
+	"github.com/dgellow/nanogit/config"
+	"github.com/dgellow/nanogit/quota"
+)
+
+var CmdQuota = cli.Command{
+	Name:  "quota",
+	Usage: "Show and refresh the storage used by orgs and repositories",
+	Subcommands: []cli.Command{
+		{
+			Name:      "show",
+			Usage:     "Show the usage of quotas, all of them if no org or repository is given",
+			ArgsUsage: "[org|org/repo]",
+			Action:    runQuotaShow,
+			Flags: []cli.Flag{
+				configFlag,
+				logLevelFlag,
+			},
+		},
+		{
+			Name:   "refresh",
+			Usage:  "Compute the size of all repositories again",
+			Action: runQuotaRefresh,
+			Flags: []cli.Flag{
+				configFlag,
+				logLevelFlag,
+			},
+		},
+	},
+}
+
+func runQuotaShow(c *cli.Context) error {
+	setup(c)
+	filter := strings.ToLower(strings.Trim(c.Args().First(), "/"))
+	limits := []quota.Limit{}
+	for _, limit := range quota.All() {
+		if filter == "" || limit.Path == filter || strings.HasPrefix(limit.Path, filter+"/") {
+			limits = append(limits, limit)
+		}
+	}
+	limits, err := quota.Usage(limits)
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("nanogit: cannot compute usage: %v", err), 1)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "PATH\tUSED\tQUOTA\tUSE%%\n")
+	for _, limit := range limits {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d%%\n", limit.Path, config.ByteSize(limit.Used), limit.Quota,
+			limit.Used*100/int64(limit.Quota))
+	}
+	return w.Flush()
+}
+
+func runQuotaRefresh(c *cli.Context) error {
+	setup(c)
+	if err := quota.RefreshAll(); err != nil {
+		return cli.NewExitError(fmt.Sprintf("nanogit: cannot compute sizes: %v", err), 1)
+	}
+	return nil
+}
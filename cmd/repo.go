@@ -0,0 +1,43 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/urfave/cli"
+
+	"github.com/dgellow/nanogit/dir"
+	"github.com/dgellow/nanogit/fork"
+)
+
+var CmdRepo = cli.Command{
+	Name:  "repo",
+	Usage: "Manage repositories",
+	Subcommands: []cli.Command{
+		{
+			Name:      "delete",
+			Usage:     "Delete a repository, its forks get their own copy of the objects",
+			ArgsUsage: "<org/repo>",
+			Action:    runRepoDelete,
+			Flags: []cli.Flag{
+				configFlag,
+				logLevelFlag,
+			},
+		},
+	},
+}
+
+func runRepoDelete(c *cli.Context) error {
+	setup(c)
+	if c.NArg() != 1 {
+		return cli.NewExitError("nanogit: usage: nanogit repo delete <org/repo>", 1)
+	}
+	org, repo, err := dir.ParseRepoPath(c.Args().First())
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("nanogit: %v", err), 1)
+	}
+	if err := fork.DeleteRepo(org, repo); err != nil {
+		return cli.NewExitError(fmt.Sprintf("nanogit: cannot delete %s/%s: %v", org, repo, err), 1)
+	}
+	fmt.Printf("Deleted %s/%s\n", org, repo)
+	return nil
+}
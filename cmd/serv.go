@@ -0,0 +1,236 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/urfave/cli"
+
+	"github.com/dgellow/nanogit/auth"
+	"github.com/dgellow/nanogit/dir"
+	"github.com/dgellow/nanogit/fork"
+	"github.com/dgellow/nanogit/keys"
+	"github.com/dgellow/nanogit/lfs"
+	"github.com/dgellow/nanogit/log"
+	"github.com/dgellow/nanogit/settings"
+)
+
+// CmdServ runs the built-in SSH commands. It is executed by the server for
+// each of them, with the key and the address of the client, stdin and stdout
+// being connected to the SSH channel.
+var CmdServ = cli.Command{
+	Name:      "serv",
+	Usage:     "Run a built-in SSH command, for internal use",
+	ArgsUsage: "<command> [args...]",
+	Hidden:    true,
+	Action:    runServ,
+	Flags: []cli.Flag{
+		configFlag,
+		cli.StringFlag{
+			Name:  "key",
+			Usage: "Key used by the client",
+		},
+		cli.StringFlag{
+			Name:  "remote",
+			Usage: "Address of the client",
+		},
+	},
+}
+
+var servCommands = map[string]func(key string, remote string, args []string) error{
+	"info":                 servInfo,
+	"keys":                 servKeys,
+	"fork":                 servFork,
+	"git-lfs-authenticate": servLFSAuthenticate,
+}
+
+// Returns the command running given built-in SSH command for key, used by a
+// client connecting from remote
+func builtinCommand(key string, remote net.Addr, args ...string) *exec.Cmd {
+	servArgs := []string{"serv", "--config", settings.ConfInfo.ConfigFile, "--key", key, "--remote", remote.String()}
+	return exec.Command(settings.ExecPath, append(servArgs, args...)...)
+}
+
+func handleBuiltin(keyId string, remote net.Addr, cmd string, args string) (*exec.Cmd, error) {
+	log.Trace("server: Handle built-in command: %s", cmd)
+	return builtinCommand(keyId, remote, strings.Fields(cmd)...), nil
+}
+
+func runServ(c *cli.Context) error {
+	// stdout is the SSH channel
+	log.Log.Adapter = "stderr"
+	log.Log.LogLevel = log.ERROR
+	settings.ConfInfo.ConfigFile = c.String("config")
+	settings.ConfInfo.ReadFile()
+
+	servCmd, present := servCommands[c.Args().First()]
+	if !present {
+		return cli.NewExitError(fmt.Sprintf("nanogit: unknown command: %s", c.Args().First()), 1)
+	}
+	if err := servCmd(c.String("key"), c.String("remote"), c.Args().Tail()); err != nil {
+		return cli.NewExitError(fmt.Sprintf("nanogit: %v", err), 1)
+	}
+	return nil
+}
+
+func servInfo(key string, remote string, args []string) error {
+	if org, repo, deployKey, err := settings.ConfInfo.LookupDeployKey(key); err == nil {
+		fmt.Printf("hello deploy key %s, this is nanogit\n\n", deployKey.Name)
+		fmt.Printf("repositories:\n")
+		fmt.Printf("  R %s  %s/%s\n", writeFlag(deployKey.Write), org.Id, repo.Name)
+		return nil
+	}
+
+	userConfig, err := auth.LookupUser(key, remote)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("hello %s, this is nanogit\n\n", userConfig.Name)
+
+	fmt.Printf("orgs:\n")
+	for _, userOrg := range userConfig.Orgs {
+		fmt.Printf("  %s", userOrg.Id)
+		if len(userOrg.Teams) > 0 {
+			fmt.Printf(" (teams: %s)", strings.Join(userOrg.Teams, ", "))
+		}
+		fmt.Printf("\n")
+	}
+
+	repos, err := dir.ListRepos()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("\nrepositories:\n")
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, repo := range repos {
+		if allowed, _ := auth.AddressAllowed(remote, repo.Org, repo.Repo); !allowed {
+			continue
+		}
+		read, write := auth.CheckUserAuth(userConfig, repo.Org, repo.Repo)
+		if !read {
+			continue
+		}
+		fmt.Fprintf(w, "  R %s\t%s\n", writeFlag(write), repo)
+	}
+	return w.Flush()
+}
+
+func writeFlag(write bool) string {
+	if write {
+		return "W"
+	}
+	return " "
+}
+
+// Maximum size of a public key read on stdin by keys add
+const maxKeySize = 16 * 1024
+
+func servKeys(key string, remote string, args []string) error {
+	if _, _, _, err := settings.ConfInfo.LookupDeployKey(key); err == nil {
+		return fmt.Errorf("deploy keys cannot manage keys")
+	}
+	userConfig, err := auth.LookupUser(key, remote)
+	if err != nil {
+		return err
+	}
+
+	usage := fmt.Errorf("usage: keys add < id_ed25519.pub | keys list | keys rm <fingerprint>")
+	if len(args) == 0 {
+		return usage
+	}
+	switch args[0] {
+	case "add":
+		data, err := ioutil.ReadAll(io.LimitReader(os.Stdin, maxKeySize))
+		if err != nil {
+			return err
+		}
+		k, err := keys.Add(userConfig.Name, string(data))
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Added key %s\n", k.Fingerprint)
+	case "list":
+		userKeys, err := keys.List(userConfig.Name)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		for _, k := range userKeys {
+			source := "added " + k.Added.Format("2006-01-02")
+			if k.FromConfig {
+				source = "config"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\n", k.Fingerprint, strings.Fields(k.Key)[0], source)
+		}
+		return w.Flush()
+	case "rm":
+		if len(args) != 2 {
+			return usage
+		}
+		if err := keys.Remove(userConfig.Name, args[1]); err != nil {
+			return err
+		}
+		fmt.Printf("Removed key %s\n", args[1])
+	default:
+		return usage
+	}
+	return nil
+}
+
+func servFork(key string, remote string, args []string) error {
+	if _, _, _, err := settings.ConfInfo.LookupDeployKey(key); err == nil {
+		return fmt.Errorf("deploy keys cannot fork repositories")
+	}
+	userConfig, err := auth.LookupUser(key, remote)
+	if err != nil {
+		return err
+	}
+	if len(args) != 2 {
+		return fmt.Errorf("usage: fork <org/repo> <org>[/<repo>]")
+	}
+	src, dst, err := parseForkArgs(args[0], args[1])
+	if err != nil {
+		return err
+	}
+
+	for _, repo := range []dir.RepoPath{src, dst} {
+		if allowed, rule := auth.CheckAddress(remote, repo.Org, repo.Repo); !allowed {
+			return fmt.Errorf("Connection from %s to %s denied by %s", remote, repo, rule)
+		}
+	}
+	if read, _ := auth.CheckUserAuth(userConfig, src.Org, src.Repo); !read {
+		return fmt.Errorf("Unauthorized read access: %s", src)
+	}
+	// Rules of the target namespace apply to the fork
+	if _, write := auth.CheckUserAuth(userConfig, dst.Org, dst.Repo); !write {
+		return fmt.Errorf("Unauthorized write access: %s", dst)
+	}
+	if err := fork.Create(src.Org, src.Repo, dst.Org, dst.Repo); err != nil {
+		return err
+	}
+	fmt.Printf("Forked %s into %s\n", src, dst)
+	return nil
+}
+
+// Prints the credentials for the LFS API, access was checked by the server
+func servLFSAuthenticate(key string, remote string, args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("usage: git-lfs-authenticate <org/repo> <download|upload>")
+	}
+	org, repo, err := dir.SplitPath(args[0])
+	if err != nil {
+		return err
+	}
+	authentication, err := lfs.Authenticate(key, org, repo, args[1])
+	if err != nil {
+		return err
+	}
+	return json.NewEncoder(os.Stdout).Encode(authentication)
+}
@@ -2,17 +2,34 @@ package cmd
 
 import (
 	"fmt"
+	"net"
+	"net/http"
+	"os"
 	"os/exec"
 	"strings"
+	"sync"
+	"time"
 
-	"github.com/dgellow/sshooks"
 	"github.com/urfave/cli"
 	"golang.org/x/crypto/ssh"
 
+	"github.com/dgellow/nanogit/api"
 	"github.com/dgellow/nanogit/auth"
 	"github.com/dgellow/nanogit/dir"
+	"github.com/dgellow/nanogit/fsck"
+	"github.com/dgellow/nanogit/git"
+	"github.com/dgellow/nanogit/hooks"
+	"github.com/dgellow/nanogit/keys"
+	"github.com/dgellow/nanogit/lfs"
+	"github.com/dgellow/nanogit/limit"
 	"github.com/dgellow/nanogit/log"
+	"github.com/dgellow/nanogit/maintenance"
+	"github.com/dgellow/nanogit/metrics"
+	"github.com/dgellow/nanogit/mirror"
+	"github.com/dgellow/nanogit/quota"
 	"github.com/dgellow/nanogit/settings"
+	"github.com/dgellow/nanogit/sshooks"
+	"github.com/dgellow/nanogit/web"
 )
 
 var CmdServer = cli.Command{
@@ -20,16 +37,8 @@ var CmdServer = cli.Command{
 	Usage:  "Run the nanogit server",
 	Action: runServer,
 	Flags: []cli.Flag{
-		cli.StringFlag{
-			Name:  "config, c",
-			Value: "config.yml",
-			Usage: "Custom configuration file path",
-		},
-		cli.IntFlag{
-			Name:  "loglevel",
-			Value: 3,
-			Usage: "0=Trace, 1=Debug, 2=Info, 3=Warn, 4=Error, 5=Critical, 6=Fatal",
-		},
+		configFlag,
+		logLevelFlag,
 	},
 }
 
@@ -39,66 +48,279 @@ func pubKeyHandler(conn ssh.ConnMetadata, key ssh.PublicKey) (string, error) {
 	keystr := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
 	log.Trace("server: key: %s", keystr)
 
-	_, err := settings.ConfInfo.LookupUserByKey(keystr)
+	if limit.AuthBlocked(conn.RemoteAddr()) {
+		return "", fmt.Errorf("Too many failed authentications from %s", conn.RemoteAddr())
+	}
+
+	if cert, ok := key.(*ssh.Certificate); ok {
+		userConfig, err := auth.AuthenticateCertificate(conn, cert)
+		if err != nil {
+			log.Error("server: unauthorized access: %v", err)
+			authFailures.reject(conn.RemoteAddr())
+			return "", err
+		}
+		log.Trace("server: certificate %s for user: %s", cert.KeyId, userConfig.Name)
+		authFailures.accept(conn.RemoteAddr())
+		return keystr, nil
+	}
+
+	_, err := keys.LookupUser(keystr)
+	if err == nil {
+		authFailures.accept(conn.RemoteAddr())
+		return keystr, nil
+	}
+	_, _, deployKey, deployErr := settings.ConfInfo.LookupDeployKey(keystr)
+	if deployErr == nil {
+		log.Trace("server: deploy key: %s", deployKey.Name)
+		authFailures.accept(conn.RemoteAddr())
+		return keystr, nil
+	}
+	log.Error("server: unauthorized access: %v", err)
+	authFailures.reject(conn.RemoteAddr())
+	return "", err
+}
+
+// Connections with a rejected key and none accepted yet, by address of the
+// client. Clients try each of their keys in turn, a connection is counted
+// as a single failed authentication when it is closed without any key
+// accepted.
+var authFailures = rejectedConns{conns: map[string]bool{}}
+
+type rejectedConns struct {
+	mutex sync.Mutex
+	conns map[string]bool
+}
+
+func (rc *rejectedConns) reject(remote net.Addr) {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+	rc.conns[remote.String()] = true
+}
+
+func (rc *rejectedConns) accept(remote net.Addr) {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+	delete(rc.conns, remote.String())
+}
+
+func (rc *rejectedConns) closed(remote net.Addr) {
+	rc.mutex.Lock()
+	rejected := rc.conns[remote.String()]
+	delete(rc.conns, remote.String())
+	rc.mutex.Unlock()
+	if rejected {
+		limit.AuthFailed(remote)
+	}
+}
+
+func connHandler(remote net.Addr) (func(), error) {
+	// Allow and deny lists of the server are checked once per connection,
+	// before the client tries its keys, the ones of orgs and repos by each
+	// command
+	if allowed, rule := auth.CheckAddress(remote.String(), "", ""); !allowed {
+		return nil, fmt.Errorf("Connection from %s denied by %s", remote, rule)
+	}
+	release, err := limit.Accept(remote)
 	if err != nil {
-		log.Error("server: unauthorized access: %v", err)
-		return "", err
+		return nil, err
+	}
+	return func() {
+		authFailures.closed(remote)
+		release()
+	}, nil
+}
+
+func sessionHandler(keyId string, remote net.Addr) (func(), error) {
+	return limit.StartSession(auth.KeyOwner(keyId, remote.String()))
+}
+
+// Slots of running commands, released when they exit, by key and address
+// of the client
+var processes = processSlots{releases: map[string][]func(){}}
+
+type processSlots struct {
+	mutex    sync.Mutex
+	releases map[string][]func()
+}
+
+func (ps *processSlots) add(keyId string, remote net.Addr, release func()) {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	key := keyId + " " + remote.String()
+	ps.releases[key] = append(ps.releases[key], release)
+}
+
+func (ps *processSlots) release(keyId string, remote net.Addr) {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	key := keyId + " " + remote.String()
+	releases := ps.releases[key]
+	if len(releases) == 0 {
+		return
+	}
+	releases[len(releases)-1]()
+	if len(releases) == 1 {
+		delete(ps.releases, key)
+	} else {
+		ps.releases[key] = releases[:len(releases)-1]
+	}
+}
+
+// Runs handler once a process slot is free, the slot is released when the
+// command exits or if handler fails
+func limited(handler func(string, net.Addr, string, string) (*exec.Cmd, error)) func(string, net.Addr, string, string) (*exec.Cmd, error) {
+	return func(keyId string, remote net.Addr, cmd string, args string) (*exec.Cmd, error) {
+		release, err := limit.StartProcess(auth.KeyOwner(keyId, remote.String()), remote)
+		if err != nil {
+			return nil, err
+		}
+		c, err := handler(keyId, remote, cmd, args)
+		if err != nil || c == nil {
+			release()
+			return c, err
+		}
+		processes.add(keyId, remote, release)
+		return c, nil
+	}
+}
+
+// Replicates pushed repositories to their push mirrors
+var pusher *mirror.Pusher
+
+// Maintains repositories in the background
+var maintainer *maintenance.Scheduler
+
+// How long a push waits for a backup to capture the refs of the repo
+const pushLockTimeout = 30 * time.Second
+
+// Locks held by running pushes, backups wait for them to be released
+var pushLocks = repoLocks{locks: map[string][]*dir.RepoLock{}}
+
+type repoLocks struct {
+	mutex sync.Mutex
+	locks map[string][]*dir.RepoLock
+}
+
+func (rl *repoLocks) add(org string, repo string, lock *dir.RepoLock) {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	key := dir.RepoPath{Org: org, Repo: repo}.String()
+	rl.locks[key] = append(rl.locks[key], lock)
+}
+
+func (rl *repoLocks) release(org string, repo string) {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	key := dir.RepoPath{Org: org, Repo: repo}.String()
+	locks := rl.locks[key]
+	if len(locks) == 0 {
+		return
+	}
+	locks[len(locks)-1].Unlock()
+	if len(locks) == 1 {
+		delete(rl.locks, key)
+	} else {
+		rl.locks[key] = locks[:len(locks)-1]
+	}
+}
+
+func exitHandler(keyId string, remote net.Addr, cmd string, args string, err error) {
+	log.Trace("server: exitHandler, cmd: %s, args: %s, err: %v", cmd, args, err)
+	processes.release(keyId, remote)
+	if cmd != "git-receive-pack" {
+		return
+	}
+	org, repo, parseErr := dir.ParseRepoPath(args)
+	if parseErr != nil {
+		log.Error("server: %v", parseErr)
+		return
+	}
+	maintainer.PushDone(org, repo)
+	pushLocks.release(org, repo)
+	if err != nil {
+		return
+	}
+	pusher.Enqueue(org, repo)
+	if _, err := quota.Refresh(org, repo); err != nil {
+		log.Error("server: cannot compute size of %s/%s: %v", org, repo, err)
 	}
-	return keystr, nil
 }
 
+// Directory of the hooks enforcing quotas and deny rules on refs
+var hooksDir string
+
 func runServer(c *cli.Context) error {
-	log.Log.LogLevel = c.Int("loglevel")
+	setup(c)
 	log.Trace("server: runServer")
 
-	log.Trace("server: read config file")
-	settings.ConfInfo.ConfigFile = c.String("config")
-	settings.ConfInfo.ReadFile()
-
-	log.Trace("server: ConfigFile: %s", settings.ConfInfo.ConfigFile)
+	commandsHandlers := map[string]func(string, net.Addr, string, string) (*exec.Cmd, error){
+		"git-upload-pack":      limited(handleUploadPack),
+		"git-upload-archive":   limited(handleUploadArchive),
+		"git-receive-pack":     limited(handleReceivePack),
+		"info":                 limited(handleBuiltin),
+		"keys":                 limited(handleBuiltin),
+		"fork":                 limited(handleBuiltin),
+		"git-lfs-authenticate": limited(handleLFSAuthenticate),
+	}
 
-	commandsHandlers := map[string]func(string, string, string) (*exec.Cmd, error){
-		"git-upload-pack":    handleUploadPack,
-		"git-upload-archive": handleUploadArchive,
-		"git-receive-pack":   handleReceivePack,
+	pusher = mirror.StartPusher()
+	maintainer = maintenance.Start()
+	var err error
+	hooksDir, err = hooks.Install()
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("nanogit: cannot install hooks: %v", err), 1)
 	}
 
 	sshooksConfig := &sshooks.ServerConfig{
 		Host:              "localhost",
 		Port:              1337,
 		PrivatekeyPath:    "key.rsa",
-		KeygenConfig:      sshooks.SSHKeygenConfig{"rsa", ""},
+		KeygenConfig:      sshooks.SSHKeygenConfig{Type: "rsa", Passphrase: ""},
 		PublicKeyCallback: pubKeyHandler,
 		CommandsCallbacks: commandsHandlers,
+		ShellCommand:      "info",
+		ExitCallback:      exitHandler,
+		ConnCallback:      connHandler,
+		SessionCallback:   sessionHandler,
 		Log:               log.Log,
 	}
 
-	err := sshooks.Listen(sshooksConfig)
+	err = sshooks.Listen(sshooksConfig)
 	if err != nil {
 		return err
-	} else {
-		// Keep the program running
-		for {
+	}
+
+	mirror.Start()
+	if interval := settings.ConfInfo.Get().Server.Fsck.Interval; interval > 0 {
+		fsck.Start(interval)
+	}
+	if address := settings.ConfInfo.Get().Server.HTTP.Address; address != "" {
+		if err := listenHTTP(address); err != nil {
+			return cli.NewExitError(fmt.Sprintf("nanogit: cannot serve HTTP: %v", err), 1)
+		}
+	}
+	if address := settings.ConfInfo.Get().Server.Metrics.Address; address != "" {
+		if err := metrics.Listen(address); err != nil {
+			return cli.NewExitError(fmt.Sprintf("nanogit: cannot serve metrics: %v", err), 1)
 		}
 	}
+
+	// Keep the program running
+	select {}
 }
 
-func handleUploadPack(keyId string, cmd string, args string) (*exec.Cmd, error) {
+func handleUploadPack(keyId string, remote net.Addr, cmd string, args string) (*exec.Cmd, error) {
 	log.Trace("server: Handle git-upload-pack: args: %s", args)
-	org, repo, err := dir.SplitPath(dir.CleanPath(args))
+	org, repo, err := dir.ParseRepoPath(args)
 	if err != nil {
-		return nil, fmt.Errorf("Error when splitting path: %v", err)
+		return nil, fmt.Errorf("Invalid repository path: %v", err)
 	}
 
-	read, write := auth.CheckAuth(keyId, org, repo)
-
+	read, write := auth.CheckAuth(keyId, remote.String(), org, repo)
 	log.Trace("server: Rights policy: read: %t, write: %t", read, write)
 	if !read {
 		return nil, fmt.Errorf("Unauthorized read access: %s", args)
 	}
-	if !write {
-		return nil, fmt.Errorf("Unauthorized write access: %s", args)
-	}
 
 	repoPath, err := dir.GetRepoDir(org, repo)
 	if err != nil {
@@ -109,32 +331,36 @@ func handleUploadPack(keyId string, cmd string, args string) (*exec.Cmd, error)
 	return exec.Command("git-upload-pack", repoPath), nil
 }
 
-func handleUploadArchive(keyId string, cmd string, args string) (*exec.Cmd, error) {
+func handleUploadArchive(keyId string, remote net.Addr, cmd string, args string) (*exec.Cmd, error) {
 	log.Trace("server: Handle git-upload-archive: args: %s", args)
-	org, repo, err := dir.SplitPath(dir.CleanPath(args))
+	org, repo, err := dir.ParseRepoPath(args)
 	if err != nil {
-		return nil, fmt.Errorf("Error when splitting path: %v", err)
+		return nil, fmt.Errorf("Invalid repository path: %v", err)
 	}
 
-	read, write := auth.CheckAuth(keyId, org, repo)
+	read, write := auth.CheckAuth(keyId, remote.String(), org, repo)
 	log.Trace("server: Rights policy: read: %t, write: %t", read, write)
 	if !read {
 		return nil, fmt.Errorf("Unauthorized read access: %s", args)
 	}
-	if !write {
-		return nil, fmt.Errorf("Unauthorized write access: %s", args)
+
+	repoPath, err := dir.GetRepoDir(org, repo)
+	if err != nil {
+		return nil, fmt.Errorf("Error when constructing repo path: %v", err)
 	}
-	return &exec.Cmd{}, nil
+	log.Debug("repoPath: %s", repoPath)
+
+	return exec.Command("git-upload-archive", repoPath), nil
 }
 
-func handleReceivePack(keyId string, cmd string, args string) (*exec.Cmd, error) {
+func handleReceivePack(keyId string, remote net.Addr, cmd string, args string) (*exec.Cmd, error) {
 	log.Trace("server: Handle git-receive-pack: args: %s", args)
-	org, repo, err := dir.SplitPath(dir.CleanPath(args))
+	org, repo, err := dir.ParseRepoPath(args)
 	if err != nil {
-		return nil, fmt.Errorf("Error when splitting path: %v", err)
+		return nil, fmt.Errorf("Invalid repository path: %v", err)
 	}
 
-	read, write := auth.CheckAuth(keyId, org, repo)
+	read, write := auth.CheckAuth(keyId, remote.String(), org, repo)
 	log.Trace("server: Rights policy: read: %t, write: %t", read, write)
 	if !read {
 		return nil, fmt.Errorf("Unauthorized read access: %s", args)
@@ -142,6 +368,9 @@ func handleReceivePack(keyId string, cmd string, args string) (*exec.Cmd, error)
 	if !write {
 		return nil, fmt.Errorf("Unauthorized write access: %s", args)
 	}
+	if mirror.IsMirror(org, repo) {
+		return nil, fmt.Errorf("Repository is a read-only mirror: %s", args)
+	}
 
 	repoPath, err := dir.GetRepoDir(org, repo)
 	if err != nil {
@@ -149,5 +378,131 @@ func handleReceivePack(keyId string, cmd string, args string) (*exec.Cmd, error)
 	}
 	log.Debug("repoPath: %s", repoPath)
 
-	return exec.Command("git-receive-pack", repoPath), nil
+	// Repos of personal namespaces are created on first push
+	if exists, _ := dir.IsRepoExist(org, repo); !exists && dir.IsUserNamespace(org) {
+		log.Info("server: creating personal repository: %s/%s", org, repo)
+		if _, err := git.Run("", nil, "init", "--bare", "--quiet", repoPath); err != nil {
+			return nil, fmt.Errorf("Error when creating repo: %v", err)
+		}
+	}
+
+	// Backups capture refs between pushes
+	lock, err := dir.LockRepo(org, repo, false, pushLockTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("Repository is being backed up, try again later: %s", args)
+	}
+	pushLocks.add(org, repo, lock)
+	// Maintenance of the repo waits for the end of the push
+	maintainer.PushStarted(org, repo)
+
+	limits := quota.Limits(org, repo)
+	// Refs are checked for users, pushes of users allowed to push tags and
+	// protected refs are only checked against deny rules and protected refs.
+	// Deploy keys have no user, their pushes are checked against protected
+	// refs.
+	userConfig, err := auth.LookupUser(keyId, remote.String())
+	refChecks := err == nil && (auth.HasRefRules(org, repo) ||
+		!auth.Can(userConfig, org, repo, auth.CapPushTags) ||
+		!auth.Can(userConfig, org, repo, auth.CapPushProtected))
+	_, _, deployKey, deployKeyErr := settings.ConfInfo.LookupDeployKey(keyId)
+	deployKeyChecks := deployKeyErr == nil && auth.HasProtectedRefs(org, repo)
+	if len(limits) == 0 && !refChecks && !deployKeyChecks {
+		return exec.Command("git-receive-pack", repoPath), nil
+	}
+
+	// The pre-receive hook checks the pushed refs against the capabilities
+	// of the user and deny rules, and quotas against the pushed objects,
+	// before they are moved into the repo. A pack bigger than a whole quota
+	// is refused while being received. The hooks of the repo are run by
+	// the installed ones.
+	gitArgs := []string{"-c", "core.hooksPath=" + hooksDir}
+	if len(limits) > 0 {
+		maxInputSize := limits[0].Quota
+		for _, limit := range limits {
+			if limit.Quota < maxInputSize {
+				maxInputSize = limit.Quota
+			}
+		}
+		gitArgs = append(gitArgs, "-c", fmt.Sprintf("receive.maxInputSize=%d", maxInputSize))
+	}
+	receivePack := exec.Command("git", append(gitArgs, "receive-pack", repoPath)...)
+	receivePack.Env = append(os.Environ(), fmt.Sprintf("%s=%s/%s", hooks.RepoEnv, org, repo))
+	if refChecks {
+		receivePack.Env = append(receivePack.Env, fmt.Sprintf("%s=%s", auth.UserEnv, userConfig.Name))
+	} else if deployKeyChecks {
+		receivePack.Env = append(receivePack.Env, fmt.Sprintf("%s=%s", auth.DeployKeyEnv, deployKey.Name))
+	}
+	return receivePack, nil
+}
+
+// Gives the client credentials for the LFS API of a repository, used by
+// git-lfs when the remote is an SSH url
+func handleLFSAuthenticate(keyId string, remote net.Addr, cmd string, args string) (*exec.Cmd, error) {
+	log.Trace("server: Handle git-lfs-authenticate: args: %s", args)
+	fields := strings.Fields(args)
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("Usage: git-lfs-authenticate <org/repo> <download|upload>")
+	}
+	operation := fields[len(fields)-1]
+	org, repo, err := dir.ParseRepoPath(strings.Join(fields[:len(fields)-1], " "))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid repository path: %v", err)
+	}
+	if settings.ConfInfo.Get().Server.HTTP.Address == "" {
+		return nil, fmt.Errorf("Git LFS is not enabled on this server")
+	}
+
+	read, write := auth.CheckAuth(keyId, remote.String(), org, repo)
+	log.Trace("server: Rights policy: read: %t, write: %t", read, write)
+	switch operation {
+	case lfs.Download:
+		if !read {
+			return nil, fmt.Errorf("Unauthorized read access: %s/%s", org, repo)
+		}
+	case lfs.Upload:
+		if !write {
+			return nil, fmt.Errorf("Unauthorized write access: %s/%s", org, repo)
+		}
+	default:
+		return nil, fmt.Errorf("Unknown LFS operation: %s", operation)
+	}
+	if exists, _ := dir.IsRepoExist(org, repo); !exists {
+		return nil, fmt.Errorf("Repository not found: %s/%s", org, repo)
+	}
+
+	return builtinCommand(keyId, remote, "git-lfs-authenticate", org+"/"+repo, operation), nil
+}
+
+// Serves the Git LFS API and the web UI in the background
+func listenHTTP(address string) error {
+	log.Trace("server: listenHTTP, address: %s", address)
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	httpConfig := settings.ConfInfo.Get().Server.HTTP
+	lfsHandler := lfs.Handler()
+	webHandler := web.Handler()
+	apiHandler := api.Handler()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if allowed, _ := auth.CheckAddress(r.RemoteAddr, "", ""); !allowed {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		switch {
+		case httpConfig.Admin && api.IsRequest(r):
+			apiHandler.ServeHTTP(w, r)
+		case lfs.IsRequest(r) || !httpConfig.Web:
+			lfsHandler.ServeHTTP(w, r)
+		default:
+			webHandler.ServeHTTP(w, r)
+		}
+	})
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			log.Error("server: HTTP: %v", err)
+		}
+	}()
+	return nil
 }
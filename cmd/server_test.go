@@ -0,0 +1,380 @@
+package cmd
+
+import (
+	"crypto/rand"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/dgellow/nanogit/auth"
+	"github.com/dgellow/nanogit/config"
+	"github.com/dgellow/nanogit/git"
+	"github.com/dgellow/nanogit/limit"
+	"github.com/dgellow/nanogit/log"
+	"github.com/dgellow/nanogit/maintenance"
+	"github.com/dgellow/nanogit/mirror"
+	"github.com/dgellow/nanogit/settings"
+	"github.com/dgellow/nanogit/sshooks"
+	"github.com/dgellow/nanogit/store"
+)
+
+type connMetadata struct {
+	ssh.ConnMetadata
+	remote net.Addr
+}
+
+func (c connMetadata) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func newSigner(t *testing.T) ssh.Signer {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func newKey(t *testing.T) ssh.PublicKey {
+	return newSigner(t).PublicKey()
+}
+
+// Keys refused by pubKeyHandler fail the SSH handshake, sshooks used to log
+// the error and accept the key anyway
+func TestSSHAuthentication(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "nanogit-server")
+	if err != nil {
+		t.Fatalf("Cannot create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	alice, unknown := newSigner(t), newSigner(t)
+	settings.ConfInfo.Set(config.Config{
+		Server: config.ServerConfig{DataRoot: filepath.Join(tmpDir, "dataroot")},
+		Users: []config.UserConfig{{
+			Name:    "alice",
+			SSHKeys: []config.PubKeyConfig{{Type: "hardcoded", Val: strings.TrimSpace(string(ssh.MarshalAuthorizedKey(alice.PublicKey())))}},
+		}},
+	})
+	defer settings.ConfInfo.Set(config.Config{})
+
+	addr := listenSSH(t, tmpDir, map[string]func(string, net.Addr, string, string) (*exec.Cmd, error){})
+
+	dial := func(signer ssh.Signer) error {
+		client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+			User: "git",
+			Auth: []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		})
+		if err == nil {
+			client.Close()
+		}
+		return err
+	}
+	if err := dial(alice); err != nil {
+		t.Fatalf("Cannot connect with the key of alice: %v", err)
+	}
+	if err := dial(unknown); err == nil || !strings.Contains(err.Error(), "unable to authenticate") {
+		t.Errorf("Connection with an unknown key == %v, expected the authentication to fail", err)
+	}
+}
+
+// Starts the SSH server on a free local port with the given commands, and
+// returns its address once it accepts connections
+func listenSSH(t *testing.T, tmpDir string, commands map[string]func(string, net.Addr, string, string) (*exec.Cmd, error)) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+	err = sshooks.Listen(&sshooks.ServerConfig{
+		Host:              "127.0.0.1",
+		Port:              uint(listener.Addr().(*net.TCPAddr).Port),
+		PrivatekeyPath:    filepath.Join(tmpDir, "key.rsa"),
+		KeygenConfig:      sshooks.SSHKeygenConfig{Type: "ed25519", Passphrase: ""},
+		PublicKeyCallback: pubKeyHandler,
+		CommandsCallbacks: commands,
+		ExitCallback:      exitHandler,
+		ConnCallback:      connHandler,
+		Log:               log.Log,
+	})
+	if err != nil {
+		t.Fatalf("sshooks.Listen() == %v", err)
+	}
+	// The server starts listening in the background
+	for i := 0; ; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			return addr
+		}
+		if i == 50 {
+			t.Fatalf("Cannot connect to the SSH server: %v", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// Generates a key pair at path, returns the public key
+func sshKeygen(t *testing.T, path string) string {
+	if out, err := exec.Command("ssh-keygen", "-q", "-t", "ed25519", "-N", "", "-C", "", "-f", path).CombinedOutput(); err != nil {
+		t.Fatalf("ssh-keygen: %v: %s", err, out)
+	}
+	pub, err := ioutil.ReadFile(path + ".pub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSpace(string(pub))
+}
+
+// A push over SSH is replicated to the push mirror of the org, another
+// nanogit server reached over SSH with a key whose path needs quoting
+func TestPushMirrorOverSSH(t *testing.T) {
+	realSSH, err := exec.LookPath("ssh")
+	if err != nil {
+		t.Skip("ssh is not installed")
+	}
+	tmpDir, err := ioutil.TempDir("", "nanogit-server")
+	if err != nil {
+		t.Fatalf("Cannot create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// The host key of the test server is unknown to ssh
+	binDir := filepath.Join(tmpDir, "bin")
+	wrapper := "#!/bin/sh\nexec " + realSSH + " -o StrictHostKeyChecking=no -o UserKnownHostsFile=/dev/null -o LogLevel=ERROR \"$@\"\n"
+	if err := os.MkdirAll(binDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(binDir, "ssh"), []byte(wrapper), 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	keysDir := filepath.Join(tmpDir, "it's keys")
+	if err := os.MkdirAll(keysDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	aliceKey, botKey := filepath.Join(keysDir, "alice"), filepath.Join(keysDir, "mirror bot")
+	alicePub, botPub := sshKeygen(t, aliceKey), sshKeygen(t, botKey)
+
+	dataRoot := filepath.Join(tmpDir, "dataroot")
+	for _, path := range []string{"fixme/foo", "backup/foo"} {
+		if _, err := git.Run("", nil, "init", "--bare", "--quiet", filepath.Join(dataRoot, path)); err != nil {
+			t.Fatalf("Cannot init %s: %v", path, err)
+		}
+	}
+	addr := listenSSH(t, tmpDir, map[string]func(string, net.Addr, string, string) (*exec.Cmd, error){
+		"git-upload-pack":  handleUploadPack,
+		"git-receive-pack": handleReceivePack,
+	})
+	c := config.Config{
+		Server: config.ServerConfig{DataRoot: dataRoot},
+		Orgs: []config.OrgConfig{
+			{
+				Id:          "fixme",
+				Teams:       []config.TeamConfig{{Name: "dev", Role: config.RoleMaintainer}},
+				PushMirrors: []config.PushMirrorConfig{{Name: "dr", Url: "ssh://git@" + addr + "/backup", SSHKey: botKey}},
+			},
+			{Id: "backup", Teams: []config.TeamConfig{{Name: "dr", Role: config.RoleMaintainer}}},
+		},
+		Users: []config.UserConfig{
+			{Name: "alice", SSHKeys: []config.PubKeyConfig{{Type: "hardcoded", Val: alicePub}}, Orgs: []config.UserOrgConfig{{Id: "fixme", Teams: []string{"dev"}}}},
+			{Name: "mirror-bot", SSHKeys: []config.PubKeyConfig{{Type: "hardcoded", Val: botPub}}, Orgs: []config.UserOrgConfig{{Id: "backup", Teams: []string{"dr"}}}},
+		},
+	}
+	if err := c.Validate(); err != nil {
+		t.Fatalf("Validate() == %v", err)
+	}
+	settings.ConfInfo.Set(c)
+	defer settings.ConfInfo.Set(config.Config{})
+
+	pusher, maintainer = mirror.StartPusher(), maintenance.Start()
+	defer func() {
+		pusher.Stop()
+		maintainer.Stop()
+		pusher, maintainer = nil, nil
+	}()
+
+	work := filepath.Join(tmpDir, "work")
+	if _, err := git.Run("", nil, "init", "--quiet", work); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := git.Run(work, nil, "-c", "user.name=alice", "-c", "user.email=alice@localhost", "commit", "--quiet", "--allow-empty", "-m", "first"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := git.Run(work, git.CredentialsEnv(aliceKey, "", ""), "push", "--quiet", "ssh://git@"+addr+"/fixme/foo", "HEAD:refs/heads/master"); err != nil {
+		t.Fatalf("Push over SSH == %v", err)
+	}
+	pushed, err := git.Run(filepath.Join(dataRoot, "fixme", "foo"), nil, "rev-parse", "refs/heads/master")
+	if err != nil {
+		t.Fatalf("Push over SSH didn't update the repo: %v", err)
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		mirrored, _ := git.Run(filepath.Join(dataRoot, "backup", "foo"), nil, "rev-parse", "--verify", "--quiet", "refs/heads/master")
+		if mirrored == pushed {
+			break
+		}
+		if time.Now().After(deadline) {
+			statuses, _ := mirror.PushStatuses()
+			t.Fatalf("Timeout waiting for the push mirror, statuses: %+v", statuses)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// Clients try each of their keys in turn, a connection counts as a single
+// failed authentication, and only if no key is accepted
+func TestPubKeyHandlerFailedAuth(t *testing.T) {
+	dataRoot, err := ioutil.TempDir("", "nanogit-server")
+	if err != nil {
+		t.Fatalf("Cannot create temp directory: %v", err)
+	}
+	defer os.RemoveAll(dataRoot)
+	aliceKey := newKey(t)
+	settings.ConfInfo.Set(config.Config{
+		Server: config.ServerConfig{
+			DataRoot: dataRoot,
+			Limits:   config.LimitsConfig{FailedAuth: config.RateConfig{Every: time.Hour, Burst: 2}},
+		},
+		Users: []config.UserConfig{{
+			Name:    "alice",
+			SSHKeys: []config.PubKeyConfig{{Type: "hardcoded", Val: strings.TrimSpace(string(ssh.MarshalAuthorizedKey(aliceKey)))}},
+		}},
+	})
+	defer settings.ConfInfo.Set(config.Config{})
+	unknownKeys := []ssh.PublicKey{newKey(t), newKey(t), newKey(t)}
+	client := &net.TCPAddr{IP: net.ParseIP("198.51.100.7")}
+
+	// Runs a connection trying keys in turn, returns whether one is accepted
+	connect := func(port int, keys ...ssh.PublicKey) bool {
+		remote := &net.TCPAddr{IP: client.IP, Port: port}
+		release, err := connHandler(remote)
+		if err != nil {
+			t.Fatalf("connHandler() == %v", err)
+		}
+		defer release()
+		conn := connMetadata{remote: remote}
+		for _, key := range keys {
+			if _, err := pubKeyHandler(conn, key); err == nil {
+				return true
+			}
+		}
+		return false
+	}
+
+	for i := 0; i < 3; i++ {
+		if !connect(40000+i, append(unknownKeys, aliceKey)...) {
+			t.Fatalf("#%d: The key of alice was rejected", i)
+		}
+	}
+	if limit.AuthBlocked(client) {
+		t.Errorf("AuthBlocked() == true after connections with an accepted key")
+	}
+
+	if connect(40010, unknownKeys...) {
+		t.Fatalf("An unknown key was accepted")
+	}
+	if limit.AuthBlocked(client) {
+		t.Errorf("AuthBlocked() == true after a single failed connection")
+	}
+	connect(40011, unknownKeys...)
+	if !limit.AuthBlocked(client) {
+		t.Errorf("AuthBlocked() == false after two failed connections")
+	}
+	if _, err := pubKeyHandler(connMetadata{remote: &net.TCPAddr{IP: client.IP, Port: 40012}}, aliceKey); err == nil {
+		t.Errorf("pubKeyHandler() == nil for a blocked address")
+	}
+}
+
+// Deploy keys authenticate whatever their comment, and don't count as failed
+// authentications
+func TestPubKeyHandlerDeployKey(t *testing.T) {
+	dataRoot, err := ioutil.TempDir("", "nanogit-server")
+	if err != nil {
+		t.Fatalf("Cannot create temp directory: %v", err)
+	}
+	defer os.RemoveAll(dataRoot)
+	deployKey := newKey(t)
+	authorized := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(deployKey)))
+	settings.ConfInfo.Set(config.Config{
+		Server: config.ServerConfig{
+			DataRoot: dataRoot,
+			Limits:   config.LimitsConfig{FailedAuth: config.RateConfig{Every: time.Hour, Burst: 1}},
+		},
+		Orgs: []config.OrgConfig{{
+			Id:    "fixme",
+			Repos: []config.RepoConfig{{Name: "website", DeployKeys: []config.DeployKeyConfig{{Name: "ci", Key: authorized + " ci@build"}}}},
+		}},
+	})
+	defer settings.ConfInfo.Set(config.Config{})
+	remote := &net.TCPAddr{IP: net.ParseIP("198.51.100.8"), Port: 40000}
+
+	release, err := connHandler(remote)
+	if err != nil {
+		t.Fatalf("connHandler() == %v", err)
+	}
+	keyId, err := pubKeyHandler(connMetadata{remote: remote}, deployKey)
+	release()
+	if err != nil || keyId != authorized {
+		t.Fatalf("pubKeyHandler(deploy key) == %q, %v, expected the key to be accepted", keyId, err)
+	}
+	if owner := auth.KeyOwner(keyId, remote.String()); owner != "deploy key ci" {
+		t.Errorf("KeyOwner() == %q, expected deploy key ci", owner)
+	}
+	if limit.AuthBlocked(remote) {
+		t.Errorf("AuthBlocked() == true after a connection with a deploy key")
+	}
+}
+
+// A denied address is refused before the handshake, recorded once in the
+// audit log however many keys the client would try
+func TestConnHandlerDeniedAddress(t *testing.T) {
+	dataRoot, err := ioutil.TempDir("", "nanogit-server")
+	if err != nil {
+		t.Fatalf("Cannot create temp directory: %v", err)
+	}
+	defer os.RemoveAll(dataRoot)
+	settings.ConfInfo.Set(config.Config{
+		Server: config.ServerConfig{
+			DataRoot: dataRoot,
+			Network:  config.NetworkConfig{Deny: []string{"203.0.113.0/24"}},
+		},
+	})
+	defer settings.ConfInfo.Set(config.Config{})
+
+	if _, err := connHandler(&net.TCPAddr{IP: net.ParseIP("203.0.113.5"), Port: 40000}); err == nil {
+		t.Errorf("connHandler() == nil for a denied address")
+	}
+	release, err := connHandler(&net.TCPAddr{IP: net.ParseIP("198.51.100.7"), Port: 40001})
+	if err != nil {
+		t.Fatalf("connHandler() == %v for an allowed address", err)
+	}
+	release()
+
+	path, err := store.Path("audit.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Cannot read the audit log: %v", err)
+	}
+	if n := strings.Count(string(data), "network-denied"); n != 1 {
+		t.Errorf("Audit log has %d network-denied entries, expected 1:\n%s", n, data)
+	}
+}
@@ -0,0 +1,220 @@
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/urfave/cli"
+
+	"github.com/dgellow/nanogit/dir"
+	"github.com/dgellow/nanogit/identity"
+	"github.com/dgellow/nanogit/token"
+)
+
+var CmdToken = cli.Command{
+	Name:  "token",
+	Usage: "Manage personal access tokens used for HTTP authentication",
+	Subcommands: []cli.Command{
+		{
+			Name:      "create",
+			Usage:     "Create an access token scoped to one repository",
+			ArgsUsage: "<user> <org/repo>",
+			Action:    runTokenCreate,
+			Flags: []cli.Flag{
+				configFlag,
+				logLevelFlag,
+				cli.BoolFlag{
+					Name:  "write, w",
+					Usage: "Allow push with the token, default is read only",
+				},
+				cli.DurationFlag{
+					Name:  "expires, e",
+					Usage: "Validity of the token, e.g. 720h, default is no expiry",
+				},
+			},
+		},
+		{
+			Name:      "create-web",
+			Usage:     "Create a token to log in to the web UI, showing all repositories the user can read",
+			ArgsUsage: "<user>",
+			Action:    runTokenCreateWeb,
+			Flags: []cli.Flag{
+				configFlag,
+				logLevelFlag,
+				cli.DurationFlag{
+					Name:  "expires, e",
+					Usage: "Validity of the token, e.g. 720h, default is no expiry",
+				},
+			},
+		},
+		{
+			Name:      "create-api",
+			Usage:     "Create a token for a user of the admin API, e.g. an org admin",
+			ArgsUsage: "<user>",
+			Action:    runTokenCreateAPI,
+			Flags: []cli.Flag{
+				configFlag,
+				logLevelFlag,
+				cli.DurationFlag{
+					Name:  "expires, e",
+					Usage: "Validity of the token, e.g. 720h, default is no expiry",
+				},
+			},
+		},
+		{
+			Name:      "create-admin",
+			Usage:     "Create a token for a client of the admin API",
+			ArgsUsage: "<client name>",
+			Action:    runTokenCreateAdmin,
+			Flags: []cli.Flag{
+				configFlag,
+				logLevelFlag,
+				cli.DurationFlag{
+					Name:  "expires, e",
+					Usage: "Validity of the token, e.g. 720h, default is no expiry",
+				},
+			},
+		},
+		{
+			Name:      "revoke",
+			Usage:     "Revoke an access token",
+			ArgsUsage: "<token id>",
+			Action:    runTokenRevoke,
+			Flags: []cli.Flag{
+				configFlag,
+				logLevelFlag,
+			},
+		},
+		{
+			Name:      "list",
+			Usage:     "List access tokens",
+			ArgsUsage: "[user]",
+			Action:    runTokenList,
+			Flags: []cli.Flag{
+				configFlag,
+				logLevelFlag,
+			},
+		},
+	},
+}
+
+func runTokenCreate(c *cli.Context) error {
+	setup(c)
+	if c.NArg() != 2 {
+		return cli.NewExitError("nanogit: usage: nanogit token create <user> <org/repo>", 1)
+	}
+	user := c.Args().Get(0)
+	if _, err := identity.Get().UserByName(user); err != nil {
+		return cli.NewExitError(fmt.Sprintf("nanogit: %v", err), 1)
+	}
+	org, repo, err := dir.ParseRepoPath(c.Args().Get(1))
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("nanogit: %v", err), 1)
+	}
+
+	var expires time.Time
+	if d := c.Duration("expires"); d > 0 {
+		expires = time.Now().UTC().Add(d)
+	}
+	value, t, err := token.Create(user, org, repo, c.Bool("write"), expires)
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("nanogit: cannot create token: %v", err), 1)
+	}
+	fmt.Printf("Created %s token %s for %s on %s\n", t.Access(), t.Id, t.User, t.Scope())
+	fmt.Printf("Token (it won't be shown again): %s\n", value)
+	return nil
+}
+
+func runTokenCreateWeb(c *cli.Context) error {
+	setup(c)
+	if c.NArg() != 1 {
+		return cli.NewExitError("nanogit: usage: nanogit token create-web <user>", 1)
+	}
+	user := c.Args().First()
+	if _, err := identity.Get().UserByName(user); err != nil {
+		return cli.NewExitError(fmt.Sprintf("nanogit: %v", err), 1)
+	}
+	var expires time.Time
+	if d := c.Duration("expires"); d > 0 {
+		expires = time.Now().UTC().Add(d)
+	}
+	value, t, err := token.CreateWeb(user, expires)
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("nanogit: cannot create token: %v", err), 1)
+	}
+	fmt.Printf("Created web token %s for %s\n", t.Id, t.User)
+	fmt.Printf("Token (it won't be shown again): %s\n", value)
+	return nil
+}
+
+func runTokenCreateAPI(c *cli.Context) error {
+	setup(c)
+	if c.NArg() != 1 {
+		return cli.NewExitError("nanogit: usage: nanogit token create-api <user>", 1)
+	}
+	user := c.Args().First()
+	if _, err := identity.Get().UserByName(user); err != nil {
+		return cli.NewExitError(fmt.Sprintf("nanogit: %v", err), 1)
+	}
+	var expires time.Time
+	if d := c.Duration("expires"); d > 0 {
+		expires = time.Now().UTC().Add(d)
+	}
+	value, t, err := token.CreateAPI(user, expires)
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("nanogit: cannot create token: %v", err), 1)
+	}
+	fmt.Printf("Created API token %s for %s\n", t.Id, t.User)
+	fmt.Printf("Token (it won't be shown again): %s\n", value)
+	return nil
+}
+
+func runTokenCreateAdmin(c *cli.Context) error {
+	setup(c)
+	if c.NArg() != 1 {
+		return cli.NewExitError("nanogit: usage: nanogit token create-admin <client name>", 1)
+	}
+	var expires time.Time
+	if d := c.Duration("expires"); d > 0 {
+		expires = time.Now().UTC().Add(d)
+	}
+	value, t, err := token.CreateAdmin(c.Args().First(), expires)
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("nanogit: cannot create token: %v", err), 1)
+	}
+	fmt.Printf("Created admin token %s for %s\n", t.Id, t.User)
+	fmt.Printf("Token (it won't be shown again): %s\n", value)
+	return nil
+}
+
+func runTokenRevoke(c *cli.Context) error {
+	setup(c)
+	if c.NArg() != 1 {
+		return cli.NewExitError("nanogit: usage: nanogit token revoke <token id>", 1)
+	}
+	if err := token.Revoke(c.Args().First()); err != nil {
+		return cli.NewExitError(fmt.Sprintf("nanogit: cannot revoke token: %v", err), 1)
+	}
+	fmt.Printf("Revoked token %s\n", c.Args().First())
+	return nil
+}
+
+func runTokenList(c *cli.Context) error {
+	setup(c)
+	tokens, err := token.List(c.Args().First())
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("nanogit: cannot list tokens: %v", err), 1)
+	}
+	now := time.Now()
+	for _, t := range tokens {
+		expires := "never"
+		if !t.Expires.IsZero() {
+			expires = t.Expires.Format(time.RFC3339)
+		}
+		if t.IsExpired(now) {
+			expires += " (expired)"
+		}
+		fmt.Printf("%s\t%s\t%s\t%s\texpires: %s\n", t.Id, t.User, t.Scope(), t.Access(), expires)
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ByteSize is a size in bytes, written in config with an optional unit:
+// 512K, 100M, 2G or 1T. Units are powers of 1024.
+type ByteSize int64
+
+const (
+	KiB ByteSize = 1 << (10 * (iota + 1))
+	MiB
+	GiB
+	TiB
+)
+
+var byteUnits = []struct {
+	suffix string
+	size   ByteSize
+}{
+	{"T", TiB},
+	{"G", GiB},
+	{"M", MiB},
+	{"K", KiB},
+}
+
+func ParseByteSize(s string) (ByteSize, error) {
+	str := strings.ToUpper(strings.TrimSpace(s))
+	str = strings.TrimSuffix(strings.TrimSuffix(str, "B"), "I")
+	multiplier := ByteSize(1)
+	for _, unit := range byteUnits {
+		if strings.HasSuffix(str, unit.suffix) {
+			str = strings.TrimSuffix(str, unit.suffix)
+			multiplier = unit.size
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(strings.TrimSpace(str), 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("Invalid size: %s", s)
+	}
+	return ByteSize(n * float64(multiplier)), nil
+}
+
+func (bs *ByteSize) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	size, err := ParseByteSize(s)
+	if err != nil {
+		return err
+	}
+	*bs = size
+	return nil
+}
+
+func (bs ByteSize) MarshalYAML() (interface{}, error) {
+	return bs.exact(), nil
+}
+
+func (bs *ByteSize) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		// Sizes without unit can be given as numbers
+		s = string(data)
+	}
+	size, err := ParseByteSize(s)
+	if err != nil {
+		return err
+	}
+	*bs = size
+	return nil
+}
+
+func (bs ByteSize) MarshalJSON() ([]byte, error) {
+	return json.Marshal(bs.exact())
+}
+
+// Size with the largest unit it is a multiple of, unlike String it
+// parses back to the same size
+func (bs ByteSize) exact() string {
+	for _, unit := range byteUnits {
+		if bs != 0 && bs%unit.size == 0 {
+			return strconv.FormatInt(int64(bs/unit.size), 10) + unit.suffix
+		}
+	}
+	return strconv.FormatInt(int64(bs), 10)
+}
+
+func (bs ByteSize) String() string {
+	for _, unit := range byteUnits {
+		if bs >= unit.size {
+			size := strconv.FormatFloat(float64(bs)/float64(unit.size), 'f', 1, 64)
+			return strings.TrimSuffix(size, ".0") + unit.suffix
+		}
+	}
+	return strconv.FormatInt(int64(bs), 10)
+}
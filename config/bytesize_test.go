@@ -0,0 +1,93 @@
+package config
+
+import (
+	"encoding/json"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestParseByteSize(t *testing.T) {
+	var testCases = []struct {
+		in       string
+		expected ByteSize
+		err      bool
+	}{
+		{"1024", 1024, false},
+		{"512K", 512 * KiB, false},
+		{"100M", 100 * MiB, false},
+		{"100MB", 100 * MiB, false},
+		{"100MiB", 100 * MiB, false},
+		{"1.5g", GiB + GiB/2, false},
+		{" 2 T ", 2 * TiB, false},
+		{"", 0, true},
+		{"M", 0, true},
+		{"-1G", 0, true},
+		{"ten", 0, true},
+	}
+
+	for i, tc := range testCases {
+		actual, err := ParseByteSize(tc.in)
+		if tc.err != (err != nil) {
+			t.Errorf("#%d: ParseByteSize(%q) error == %v; expected error: %t", i, tc.in, err, tc.err)
+			continue
+		}
+		if actual != tc.expected {
+			t.Errorf("#%d: ParseByteSize(%q) == %d; expected %d", i, tc.in, actual, tc.expected)
+		}
+	}
+}
+
+func TestByteSizeString(t *testing.T) {
+	var testCases = []struct {
+		in       ByteSize
+		expected string
+	}{
+		{0, "0"},
+		{1000, "1000"},
+		{KiB, "1K"},
+		{GiB + GiB/2, "1.5G"},
+		{3 * TiB, "3T"},
+	}
+
+	for i, tc := range testCases {
+		if actual := tc.in.String(); actual != tc.expected {
+			t.Errorf("#%d: ByteSize(%d).String() == %s; expected %s", i, tc.in, actual, tc.expected)
+		}
+	}
+}
+
+func TestByteSizeEncoding(t *testing.T) {
+	var testCases = []struct {
+		in   ByteSize
+		json string
+	}{
+		{0, `"0"`},
+		{100000, `"100000"`},
+		{1536 * MiB, `"1536M"`},
+		{10 * GiB, `"10G"`},
+	}
+
+	for i, tc := range testCases {
+		data, err := json.Marshal(tc.in)
+		if err != nil || string(data) != tc.json {
+			t.Errorf("#%d: json.Marshal(%d) == %s, %v; expected %s", i, tc.in, data, err, tc.json)
+		}
+		var fromJSON, fromYAML ByteSize
+		if err := json.Unmarshal(data, &fromJSON); err != nil || fromJSON != tc.in {
+			t.Errorf("#%d: json.Unmarshal(%s) == %d, %v; expected %d", i, data, fromJSON, err, tc.in)
+		}
+		data, err = yaml.Marshal(tc.in)
+		if err != nil {
+			t.Errorf("#%d: yaml.Marshal(%d) == %v", i, tc.in, err)
+		}
+		if err := yaml.Unmarshal(data, &fromYAML); err != nil || fromYAML != tc.in {
+			t.Errorf("#%d: yaml.Unmarshal(%q) == %d, %v; expected %d", i, data, fromYAML, err, tc.in)
+		}
+	}
+
+	var size ByteSize
+	if err := json.Unmarshal([]byte("2048"), &size); err != nil || size != 2*KiB {
+		t.Errorf("json.Unmarshal(2048) == %d, %v; expected %d", size, err, 2*KiB)
+	}
+}
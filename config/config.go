@@ -3,6 +3,12 @@ package config
 import (
 	"fmt"
 	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 
 	"gopkg.in/yaml.v2"
 
@@ -11,47 +17,363 @@ import (
 
 type ConfigInfo struct {
 	ConfigFile string
-	Conf       Config
+	// Read through Get and replaced through Set, which rebuilds the index
+	// of users and deploy keys. Assigning or mutating it directly leaves the
+	// index stale.
+	Conf Config
+	// Serializes updates of the config file
+	mutex sync.Mutex
+	// Guards Conf and index
+	confMutex sync.RWMutex
+	index     *index
+}
+
+// CertAuthorityConfig is an SSH certificate authority trusted to sign user
+// certificates, with its revocation list.
+type CertAuthorityConfig struct {
+	Name           string   `yaml:",omitempty" json:"name"`
+	Key            string   `yaml:",omitempty" json:"key"`
+	RevokedSerials []uint64 `yaml:",omitempty" json:"revokedserials"`
+	RevokedKeyIds  []string `yaml:",omitempty" json:"revokedkeyids"`
+	// SHA256 fingerprints of revoked certificate keys
+	RevokedKeys []string `yaml:",omitempty" json:"revokedkeys"`
+}
+
+// MaintenanceConfig schedules the maintenance of repositories. Fields of an
+// org override the ones of the server when set.
+type MaintenanceConfig struct {
+	// Time between two runs on the same repo
+	Interval time.Duration `yaml:",omitempty" json:"interval"`
+	// Run after this number of pushes to the repo, even if not due
+	Pushes int `yaml:",omitempty" json:"pushes"`
+	// Tasks run in order: gc, repack, commit-graph, pack-refs
+	Tasks []string `yaml:",omitempty" json:"tasks"`
+	// Maximum number of repos maintained at the same time, server only
+	Concurrency int `yaml:",omitempty" json:"concurrency"`
+}
+
+// FsckConfig schedules integrity checks of all repositories.
+type FsckConfig struct {
+	// Time between two checks, disabled if zero
+	Interval time.Duration `yaml:",omitempty" json:"interval"`
+}
+
+// MetricsConfig enables the HTTP metrics endpoint.
+type MetricsConfig struct {
+	// Address to listen on, e.g. localhost:9100, disabled if empty
+	Address string `yaml:",omitempty" json:"address"`
+}
+
+// HTTPConfig enables the HTTP server, used by Git LFS, the web UI and the
+// admin API.
+type HTTPConfig struct {
+	// Address to listen on, e.g. localhost:8080, disabled if empty
+	Address string `yaml:",omitempty" json:"address"`
+	// URL clients reach the server at, http://address by default
+	Url string `yaml:",omitempty" json:"url"`
+	// Serve the read-only web UI
+	Web bool `yaml:",omitempty" json:"web"`
+	// Serve the admin API under /api/v1/
+	Admin bool `yaml:",omitempty" json:"admin"`
+}
+
+// LDAPGroupConfig makes the members of an LDAP group members of an org.
+type LDAPGroupConfig struct {
+	Dn    string   `yaml:",omitempty" json:"dn"`
+	Org   string   `yaml:",omitempty" json:"org"`
+	Teams []string `yaml:",omitempty" json:"teams"`
+}
+
+// LDAPConfig reads users, their SSH keys and their memberships from an LDAP
+// directory. Orgs, teams and repos are still declared in the config file.
+type LDAPConfig struct {
+	// ldap:// or ldaps:// URL of the server
+	Url          string `yaml:",omitempty" json:"url"`
+	BindDn       string `yaml:",omitempty" json:"binddn"`
+	BindPassword string `yaml:",omitempty" json:"bindpassword"`
+	// Users are the entries under userbase matching userfilter,
+	// (objectClass=posixAccount) by default
+	UserBase   string `yaml:",omitempty" json:"userbase"`
+	UserFilter string `yaml:",omitempty" json:"userfilter"`
+	// Attribute holding the user name, uid by default
+	NameAttr string `yaml:",omitempty" json:"nameattr"`
+	// Attribute holding the SSH keys, sshPublicKey by default
+	KeyAttr string `yaml:",omitempty" json:"keyattr"`
+	// Attribute of groups listing their members, by DN or by name, member
+	// by default
+	MemberAttr string            `yaml:",omitempty" json:"memberattr"`
+	Groups     []LDAPGroupConfig `yaml:",omitempty" json:"groups"`
+	// How long the directory is cached, 5 minutes by default
+	CacheTTL time.Duration `yaml:",omitempty" json:"cachettl"`
+}
+
+// IdentityConfig selects where users and their memberships come from.
+type IdentityConfig struct {
+	// yaml (the default) or ldap
+	Backend string     `yaml:",omitempty" json:"backend"`
+	LDAP    LDAPConfig `yaml:",omitempty" json:"ldap"`
 }
 
 type ServerConfig struct {
-	DataRoot string
-	User     string
-	Group    string
+	DataRoot    string                `yaml:",omitempty" json:"dataroot"`
+	User        string                `yaml:",omitempty" json:"user"`
+	Group       string                `yaml:",omitempty" json:"group"`
+	UserCAs     []CertAuthorityConfig `yaml:",omitempty" json:"usercas"`
+	Maintenance MaintenanceConfig     `yaml:",omitempty" json:"maintenance"`
+	Fsck        FsckConfig            `yaml:",omitempty" json:"fsck"`
+	Metrics     MetricsConfig         `yaml:",omitempty" json:"metrics"`
+	HTTP        HTTPConfig            `yaml:",omitempty" json:"http"`
+	Identity    IdentityConfig        `yaml:",omitempty" json:"identity"`
+	// Addresses clients can connect from, to any org
+	Network NetworkConfig `yaml:",omitempty" json:"network"`
+	Limits  LimitsConfig  `yaml:",omitempty" json:"limits"`
+	Mirrors MirrorsConfig `yaml:",omitempty" json:"mirrors"`
 }
 
+// MirrorsConfig applies to the urls of all pull and push mirrors.
+type MirrorsConfig struct {
+	// Allow file:// urls, e.g. to mirror repositories of another server
+	// on the same machine. Whoever can edit the config can then read and
+	// overwrite any repository nanogit's user has access to.
+	AllowFile bool `yaml:",omitempty" json:"allowfile"`
+}
+
+// LimitsConfig caps the connections and processes of SSH clients. Every
+// limit is disabled if zero.
+type LimitsConfig struct {
+	// Concurrent connections
+	Connections ConcurrencyConfig `yaml:",omitempty" json:"connections"`
+	// Concurrent git processes and built-in commands
+	Processes ConcurrencyConfig `yaml:",omitempty" json:"processes"`
+	// New connections of each address
+	NewConnections RateConfig `yaml:",omitempty" json:"newconnections"`
+	// Failed authentications of each address, connections from an address
+	// are refused while it has no tokens left
+	FailedAuth RateConfig `yaml:",omitempty" json:"failedauth"`
+	// Clients over a concurrency limit wait for a slot in the queue
+	Queue QueueConfig `yaml:",omitempty" json:"queue"`
+}
+
+// ConcurrencyConfig caps the number of connections or processes running at
+// the same time.
+type ConcurrencyConfig struct {
+	Total   int `yaml:",omitempty" json:"total"`
+	PerUser int `yaml:",omitempty" json:"peruser"`
+	PerIP   int `yaml:",omitempty" json:"perip"`
+}
+
+// RateConfig is a token bucket: a token is added every Every, up to Burst
+// tokens, and each event takes one.
+type RateConfig struct {
+	Every time.Duration `yaml:",omitempty" json:"every"`
+	// 1 if zero
+	Burst int `yaml:",omitempty" json:"burst"`
+}
+
+// QueueConfig lets clients over a concurrency limit wait for a slot.
+type QueueConfig struct {
+	// Maximum number of waiting clients, unlimited if zero
+	Size int `yaml:",omitempty" json:"size"`
+	// Time a client waits before being rejected, clients over a limit are
+	// rejected right away if zero
+	Timeout time.Duration `yaml:",omitempty" json:"timeout"`
+}
+
+// NetworkConfig restricts the addresses clients can connect from, given as
+// CIDR ranges or single addresses.
+type NetworkConfig struct {
+	// Clients must connect from one of these, from anywhere if empty
+	Allow []string `yaml:",omitempty" json:"allow"`
+	// Clients can't connect from these, even if allowed
+	Deny []string `yaml:",omitempty" json:"deny"`
+}
+
+// ParseNetwork parses a CIDR range, or a single address.
+func ParseNetwork(s string) (*net.IPNet, error) {
+	if _, network, err := net.ParseCIDR(s); err == nil {
+		return network, nil
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("Invalid address or CIDR range %s", s)
+	}
+	bits := 8 * net.IPv6len
+	if ip.To4() != nil {
+		ip, bits = ip.To4(), 8*net.IPv4len
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+// Every member of an org is in its team with this name, if it has one
+const DefaultTeam = "default"
+
+// Roles of teams, each one having the capabilities of the previous ones
+const (
+	// Clone and fetch
+	RoleReader = "reader"
+	// Push to branches that aren't protected
+	RoleWriter = "writer"
+	// Push to protected branches, push and delete tags
+	RoleMaintainer = "maintainer"
+	// Create and delete repos, manage the members of teams
+	RoleAdmin = "admin"
+)
+
+// Roles lists the roles of teams, from the least to the most capable.
+var Roles = []string{RoleReader, RoleWriter, RoleMaintainer, RoleAdmin}
+
+// TeamConfig gives access to the repos of an org and its sub-orgs to the
+// members of the team.
 type TeamConfig struct {
-	Name  string
-	Write bool
-	Read  bool
+	Name string `yaml:",omitempty" json:"name"`
+	// One of Roles, no access if empty
+	Role string `yaml:",omitempty" json:"role"`
+	// Access of configs written before roles, migrated to the maintainer
+	// role for write and the reader role for read when the config is read
+	Write bool `yaml:",omitempty" json:"write,omitempty"`
+	Read  bool `yaml:",omitempty" json:"read,omitempty"`
+}
+
+// GetRole returns the role of the team, given by read and write if the
+// team hasn't been migrated.
+func (tc TeamConfig) GetRole() string {
+	switch {
+	case tc.Role != "":
+		return tc.Role
+	case tc.Write:
+		return RoleMaintainer
+	case tc.Read:
+		return RoleReader
+	}
+	return ""
+}
+
+// DenyConfig takes access away from a user or from the members of a team,
+// whatever their teams, shares or ownership give them.
+type DenyConfig struct {
+	// Either a user or a team of the org
+	User string `yaml:",omitempty" json:"user"`
+	Team string `yaml:",omitempty" json:"team"`
+	// Access denied: read (any access, the default) or write
+	Access string `yaml:",omitempty" json:"access"`
+	// Only deny pushes to the refs matching this pattern, e.g.
+	// refs/heads/release/*, where * doesn't match /
+	Refs string `yaml:",omitempty" json:"refs"`
+}
+
+// Denied returns the access denied by the rule: read or write.
+func (dc DenyConfig) Denied() string {
+	if dc.Access == "" && dc.Refs == "" {
+		return "read"
+	}
+	if dc.Access == "" {
+		return "write"
+	}
+	return dc.Access
+}
+
+// DeployKeyConfig is a machine key restricted to a single repository.
+type DeployKeyConfig struct {
+	Name  string `yaml:",omitempty" json:"name"`
+	Key   string `yaml:",omitempty" json:"key"`
+	Write bool   `yaml:",omitempty" json:"write"`
+}
+
+// MirrorConfig is the upstream of a read-only pull mirror.
+type MirrorConfig struct {
+	Url      string        `yaml:",omitempty" json:"url"`
+	Interval time.Duration `yaml:",omitempty" json:"interval"`
+	// Private key used for SSH upstreams
+	SSHKey string `yaml:",omitempty" json:"sshkey"`
+	// Credentials used for HTTP upstreams
+	Username string `yaml:",omitempty" json:"username"`
+	Password string `yaml:",omitempty" json:"password"`
+}
+
+// PushMirrorConfig is a remote every push is replicated to.
+type PushMirrorConfig struct {
+	Name string `yaml:",omitempty" json:"name"`
+	Url  string `yaml:",omitempty" json:"url"`
+	// Private key used for SSH remotes
+	SSHKey string `yaml:",omitempty" json:"sshkey"`
+	// Credentials used for HTTP remotes
+	Username string `yaml:",omitempty" json:"username"`
+	Password string `yaml:",omitempty" json:"password"`
+}
+
+type RepoConfig struct {
+	Name        string             `yaml:",omitempty" json:"name"`
+	DeployKeys  []DeployKeyConfig  `yaml:",omitempty" json:"deploykeys"`
+	Mirror      MirrorConfig       `yaml:",omitempty" json:"mirror"`
+	PushMirrors []PushMirrorConfig `yaml:",omitempty" json:"pushmirrors"`
+	// Maximum size of the repo on disk, no limit if zero
+	Quota ByteSize     `yaml:",omitempty" json:"quota"`
+	Deny  []DenyConfig `yaml:",omitempty" json:"deny"`
+	// Patterns of refs only maintainers can push to, e.g. refs/heads/master
+	Protected []string `yaml:",omitempty" json:"protected"`
+	// Addresses clients can connect to the repo from, in addition to the
+	// restrictions of its orgs
+	Network NetworkConfig `yaml:",omitempty" json:"network"`
+}
+
+func (rc RepoConfig) IsMirror() bool {
+	return rc.Mirror.Url != ""
 }
 
 type OrgConfig struct {
-	Id          string
-	Description string
-	Teams       []TeamConfig
+	Id          string       `yaml:",omitempty" json:"id"`
+	Description string       `yaml:",omitempty" json:"description"`
+	Teams       []TeamConfig `yaml:",omitempty" json:"teams"`
+	Repos       []RepoConfig `yaml:",omitempty" json:"repos"`
+	// Push mirrors of every repo of the org, the url is a prefix the repo
+	// name is appended to
+	PushMirrors []PushMirrorConfig `yaml:",omitempty" json:"pushmirrors"`
+	// Maximum size of all repos of the org and its sub-orgs, no limit
+	// if zero
+	Quota       ByteSize          `yaml:",omitempty" json:"quota"`
+	Maintenance MaintenanceConfig `yaml:",omitempty" json:"maintenance"`
+	// Deny rules of the org apply to its repos and sub-orgs
+	Deny []DenyConfig `yaml:",omitempty" json:"deny"`
+	// Protected refs of every repo of the org and its sub-orgs
+	Protected []string `yaml:",omitempty" json:"protected"`
+	// Addresses clients can connect to the repos of the org and its
+	// sub-orgs from
+	Network NetworkConfig `yaml:",omitempty" json:"network"`
+	// Sub-orgs, their path being parent/child. Teams are inherited from
+	// the parent org and can be overridden by a team with the same name.
+	Orgs []OrgConfig `yaml:",omitempty" json:"orgs"`
 }
 
 type PubKeyConfig struct {
-	Type string
-	Val  string
+	Type string `yaml:",omitempty" json:"type"`
+	Val  string `yaml:",omitempty" json:"val"`
 }
 
 type UserOrgConfig struct {
-	Id    string
-	Teams []string
+	Id    string   `yaml:",omitempty" json:"id"`
+	Teams []string `yaml:",omitempty" json:"teams"`
+}
+
+// ShareConfig gives other users access to repositories of a personal
+// namespace, read only unless write is enabled.
+type ShareConfig struct {
+	// Repo name, * for all repos of the namespace
+	Repo  string   `yaml:",omitempty" json:"repo"`
+	Users []string `yaml:",omitempty" json:"users"`
+	Write bool     `yaml:",omitempty" json:"write"`
 }
 
 type UserConfig struct {
-	Name    string
-	SSHKeys []PubKeyConfig
-	Orgs    []UserOrgConfig
+	Name    string          `yaml:",omitempty" json:"name"`
+	SSHKeys []PubKeyConfig  `yaml:",omitempty" json:"sshkeys"`
+	Orgs    []UserOrgConfig `yaml:",omitempty" json:"orgs"`
+	Shares  []ShareConfig   `yaml:",omitempty" json:"shares"`
 }
 
 type Config struct {
-	Server ServerConfig
-	Orgs   []OrgConfig
-	Users  []UserConfig
+	Server ServerConfig `yaml:",omitempty" json:"server"`
+	Orgs   []OrgConfig  `yaml:",omitempty" json:"orgs"`
+	Users  []UserConfig `yaml:",omitempty" json:"users"`
 }
 
 func (ci *ConfigInfo) ReadFile() {
@@ -60,32 +382,239 @@ func (ci *ConfigInfo) ReadFile() {
 		panic(err)
 	}
 
-	t := Config{}
-	err = yaml.Unmarshal(data, &t)
+	t, err := parse(data)
 	if err != nil {
-		log.Fatal("config: cannot deserialize config file: %s, error: %v", ci.ConfigFile, err)
+		log.Fatal("config: cannot load config file: %s, error: %v", ci.ConfigFile, err)
 	}
+	ci.Set(t)
+}
+
+// Set replaces the config and the index of its users. The config is not
+// validated.
+func (ci *ConfigInfo) Set(t Config) {
+	idx := newIndex(t)
+	ci.confMutex.Lock()
+	defer ci.confMutex.Unlock()
 	ci.Conf = t
+	ci.index = idx
+}
+
+func parse(data []byte) (Config, error) {
+	t := Config{}
+	if err := yaml.Unmarshal(data, &t); err != nil {
+		return Config{}, err
+	}
+	t.migrate()
+	return t, t.Validate()
+}
+
+// Replaces read and write of teams by the equivalent role. Teams having
+// both are left as is, to be rejected by Validate.
+func (c *Config) migrate() {
+	migrateOrgs(c.Orgs)
+}
+
+func migrateOrgs(orgs []OrgConfig) {
+	for i := range orgs {
+		for j, team := range orgs[i].Teams {
+			if team.Role == "" {
+				orgs[i].Teams[j] = TeamConfig{Name: team.Name, Role: team.GetRole()}
+			}
+		}
+		migrateOrgs(orgs[i].Orgs)
+	}
+}
+
+// Get returns the config, consistent with concurrent updates. The config is
+// replaced as a whole by updates, the returned one must not be modified: to
+// change it, give a modified copy to Set.
+func (ci *ConfigInfo) Get() Config {
+	ci.confMutex.RLock()
+	defer ci.confMutex.RUnlock()
+	return ci.Conf
+}
+
+// Header of config files rewritten by Update, which loses their comments
+const updateHeader = "# Rewritten by nanogit, comments of the previous version are in %s.bak\n"
+
+// Update applies fn to the config file and saves it if the result is
+// valid. The file is read again first, not to lose changes made by hand
+// since it was loaded. It is rewritten atomically without its comments,
+// yaml.v2 doesn't keep them, a header says so. The previous version is kept
+// with a .bak suffix.
+func (ci *ConfigInfo) Update(fn func(c *Config) error) error {
+	log.Trace("config: Update, file: %s", ci.ConfigFile)
+	ci.mutex.Lock()
+	defer ci.mutex.Unlock()
+	previous, err := ioutil.ReadFile(ci.ConfigFile)
+	if err != nil {
+		return err
+	}
+	t, err := parse(previous)
+	if err != nil {
+		return fmt.Errorf("Cannot load config file: %v", err)
+	}
+	if err := fn(&t); err != nil {
+		return err
+	}
+	t.migrate()
+	data, err := yaml.Marshal(t)
+	if err != nil {
+		return err
+	}
+	// The saved config is loaded back to be validated as the loader sees it
+	if t, err = parse(data); err != nil {
+		return err
+	}
+
+	if err := writeFile(ci.ConfigFile+".bak", previous); err != nil {
+		return err
+	}
+	header := fmt.Sprintf(updateHeader, filepath.Base(ci.ConfigFile))
+	if err := writeFile(ci.ConfigFile, append([]byte(header), data...)); err != nil {
+		return err
+	}
+	ci.Set(t)
+	return nil
 }
 
+// Writes data to a temporary file renamed to path, keeping the mode of the
+// file it replaces
+func writeFile(path string, data []byte) error {
+	mode := os.FileMode(0600)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode()
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), mode); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// LookupUserByKey returns the user owning the given authorized_keys line,
+// keys being compared by fingerprint.
 func (ci *ConfigInfo) LookupUserByKey(k string) (UserConfig, error) {
 	log.Trace("config: LookupUserByKey")
-	for _, user := range ci.Conf.Users {
-		for _, key := range user.SSHKeys {
-			if key.Val == k {
-				return user, nil
-			}
+	fingerprint, err := Fingerprint(k)
+	if err == nil {
+		if user, ok := ci.lookupIndex().byKey[fingerprint]; ok {
+			return user, nil
 		}
 	}
 	return UserConfig{}, fmt.Errorf("Cannot find given key in config")
 }
 
+// WalkOrgs calls fn for every org and sub-org, with its full path.
+func (ci *ConfigInfo) WalkOrgs(fn func(path string, org OrgConfig)) {
+	walkOrgs(ci.Get().Orgs, fn)
+}
+
+func walkOrgs(orgs []OrgConfig, fn func(path string, org OrgConfig)) {
+	var walk func(parent string, orgs []OrgConfig)
+	walk = func(parent string, orgs []OrgConfig) {
+		for _, org := range orgs {
+			path := strings.ToLower(org.Id)
+			if parent != "" {
+				path = parent + "/" + path
+			}
+			fn(path, org)
+			walk(path, org.Orgs)
+		}
+	}
+	walk("", orgs)
+}
+
+// LookupDeployKey returns the deploy key matching the given authorized_keys
+// line, with the org and repo it is bound to. Keys are compared by
+// fingerprint, like the keys of users.
+func (ci *ConfigInfo) LookupDeployKey(k string) (OrgConfig, RepoConfig, DeployKeyConfig, error) {
+	log.Trace("config: LookupDeployKey")
+	fingerprint, err := Fingerprint(k)
+	if err != nil {
+		return OrgConfig{}, RepoConfig{}, DeployKeyConfig{}, fmt.Errorf("Cannot find given deploy key in config")
+	}
+	dk, ok := ci.lookupIndex().deployKeys[fingerprint]
+	if !ok {
+		return OrgConfig{}, RepoConfig{}, DeployKeyConfig{}, fmt.Errorf("Cannot find given deploy key in config")
+	}
+	org, err := ci.LookupOrgById(dk.orgPath)
+	return org, dk.repo, dk.key, err
+}
+
+func (ci *ConfigInfo) LookupUserByName(name string) (UserConfig, error) {
+	log.Trace("config: LookupUserByName, name: %v", name)
+	if user, ok := ci.lookupIndex().byName[strings.ToLower(name)]; ok {
+		return user, nil
+	}
+	return UserConfig{}, fmt.Errorf("Cannot find user in config: %s", name)
+}
+
+// LookupOrgById returns the org with the given path, sub-orgs being given
+// as parent/child. The returned org has its full path as id and the teams
+// inherited from its parents.
 func (ci *ConfigInfo) LookupOrgById(orgId string) (OrgConfig, error) {
 	log.Trace("config: LookupOrgById, orgId: %v", orgId)
-	for _, org := range ci.Conf.Orgs {
-		if org.Id == orgId {
-			return org, nil
+	orgs := ci.Get().Orgs
+	var org OrgConfig
+	teams := []TeamConfig{}
+	for _, id := range strings.Split(orgId, "/") {
+		found := false
+		for _, o := range orgs {
+			if strings.EqualFold(o.Id, id) {
+				org, orgs, found = o, o.Orgs, true
+				break
+			}
+		}
+		if !found {
+			return OrgConfig{}, fmt.Errorf("Cannot find org in config: %s", orgId)
+		}
+		teams = mergeTeams(teams, org.Teams)
+	}
+	org.Id = strings.ToLower(orgId)
+	org.Teams = teams
+	return org, nil
+}
+
+// Teams of a sub-org override the ones of its parent with the same name
+func mergeTeams(parent []TeamConfig, child []TeamConfig) []TeamConfig {
+	teams := make([]TeamConfig, len(parent))
+	copy(teams, parent)
+	for _, team := range child {
+		overridden := false
+		for i := range teams {
+			if teams[i].Name == team.Name {
+				teams[i] = team
+				overridden = true
+			}
+		}
+		if !overridden {
+			teams = append(teams, team)
+		}
+	}
+	return teams
+}
+
+func (ci *ConfigInfo) LookupRepo(orgId string, repoName string) (RepoConfig, error) {
+	log.Trace("config: LookupRepo, orgId: %v, repoName: %v", orgId, repoName)
+	org, err := ci.LookupOrgById(orgId)
+	if err == nil {
+		for _, repo := range org.Repos {
+			if strings.EqualFold(repo.Name, repoName) {
+				return repo, nil
+			}
 		}
 	}
-	return OrgConfig{}, fmt.Errorf("Cannot find org in config: %s", orgId)
+	return RepoConfig{}, fmt.Errorf("Cannot find repo in config: %s/%s", orgId, repoName)
 }
@@ -0,0 +1,107 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestMigrate(t *testing.T) {
+	c, err := parse([]byte(`
+orgs:
+  - id: qrclabs
+    teams:
+      - {name: default, read: yes}
+      - {name: dev, read: yes, write: yes}
+      - {name: ci, write: yes}
+      - {name: admin, role: admin}
+      - {name: nobody}
+    orgs:
+      - id: infra
+        teams: [{name: dev, read: yes}]
+`))
+	if err != nil {
+		t.Fatalf("parse() == %v", err)
+	}
+	expected := []TeamConfig{
+		{Name: "default", Role: RoleReader},
+		{Name: "dev", Role: RoleMaintainer},
+		{Name: "ci", Role: RoleMaintainer},
+		{Name: "admin", Role: RoleAdmin},
+		{Name: "nobody"},
+	}
+	if teams := c.Orgs[0].Teams; !reflect.DeepEqual(teams, expected) {
+		t.Errorf("Teams of qrclabs == %+v, expected %+v", teams, expected)
+	}
+	if teams := c.Orgs[0].Orgs[0].Teams; len(teams) != 1 || teams[0] != (TeamConfig{Name: "dev", Role: RoleReader}) {
+		t.Errorf("Teams of qrclabs/infra == %+v, expected dev to be a reader", teams)
+	}
+}
+
+// Readers see the config before or after an update, never a partial one
+func TestUpdate(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "nanogit-config")
+	if err != nil {
+		t.Fatalf("Cannot create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	ci := &ConfigInfo{ConfigFile: filepath.Join(tmpDir, "config.yml")}
+	original := "# Users\nusers:\n  - name: alice\n"
+	if err := ioutil.WriteFile(ci.ConfigFile, []byte(original), 0600); err != nil {
+		t.Fatal(err)
+	}
+	ci.ReadFile()
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if users := ci.Get().Users; len(users) == 0 || users[0].Name != "alice" {
+					t.Errorf("Get() == %+v during Update()", users)
+					return
+				}
+				if _, err := ci.LookupUserByName("alice"); err != nil {
+					t.Errorf("LookupUserByName() == %v during Update()", err)
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		if err := ci.Update(func(c *Config) error {
+			c.Users = append(c.Users, UserConfig{Name: "user" + strings.Repeat("x", i+1)})
+			return nil
+		}); err != nil {
+			t.Errorf("Update() == %v", err)
+		}
+	}
+	close(done)
+	wg.Wait()
+
+	if users := ci.Get().Users; len(users) != 11 {
+		t.Errorf("Get() == %+v after Update(), expected 11 users", users)
+	}
+	// Comments are lost, the file says where to find them
+	data, err := ioutil.ReadFile(ci.ConfigFile)
+	if err != nil || !strings.HasPrefix(string(data), "# Rewritten by nanogit, comments of the previous version are in config.yml.bak\n") {
+		t.Errorf("Config file after Update() == %q, %v, expected the header", data, err)
+	}
+	if err := ci.Update(func(c *Config) error { return nil }); err != nil {
+		t.Fatalf("Update() == %v", err)
+	}
+	if backup, err := ioutil.ReadFile(ci.ConfigFile + ".bak"); err != nil || string(backup) != string(data) {
+		t.Errorf("Backup == %q, %v, expected the previous version", backup, err)
+	}
+}
@@ -0,0 +1,89 @@
+package config
+
+import (
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// index finds users by the SHA256 fingerprint of their keys and by name,
+// and deploy keys by fingerprint, instead of scanning every user, repo and
+// key on each lookup.
+type index struct {
+	byKey      map[string]UserConfig
+	byName     map[string]UserConfig
+	deployKeys map[string]indexedDeployKey
+}
+
+// A deploy key with the path of the org and the repo it is bound to
+type indexedDeployKey struct {
+	orgPath string
+	repo    RepoConfig
+	key     DeployKeyConfig
+}
+
+// Fingerprint returns the SHA256 fingerprint of the public key of the
+// given authorized_keys line, ignoring its comment and options.
+func Fingerprint(line string) (string, error) {
+	pubKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+	if err != nil {
+		return "", err
+	}
+	return ssh.FingerprintSHA256(pubKey), nil
+}
+
+// Keys that cannot be parsed, e.g. of type url, are not indexed. Duplicate
+// keys are rejected by Validate, the first user or deploy key wins
+// otherwise.
+func newIndex(c Config) *index {
+	idx := &index{
+		byKey:      map[string]UserConfig{},
+		byName:     map[string]UserConfig{},
+		deployKeys: map[string]indexedDeployKey{},
+	}
+	for _, user := range c.Users {
+		if _, ok := idx.byName[strings.ToLower(user.Name)]; !ok {
+			idx.byName[strings.ToLower(user.Name)] = user
+		}
+		for _, key := range user.SSHKeys {
+			fingerprint, err := Fingerprint(key.Val)
+			if err != nil {
+				continue
+			}
+			if _, ok := idx.byKey[fingerprint]; !ok {
+				idx.byKey[fingerprint] = user
+			}
+		}
+	}
+	walkOrgs(c.Orgs, func(path string, org OrgConfig) {
+		for _, repo := range org.Repos {
+			for _, dk := range repo.DeployKeys {
+				fingerprint, err := Fingerprint(dk.Key)
+				if err != nil {
+					continue
+				}
+				if _, ok := idx.deployKeys[fingerprint]; !ok {
+					idx.deployKeys[fingerprint] = indexedDeployKey{path, repo, dk}
+				}
+			}
+		}
+	})
+	return idx
+}
+
+// Returns the index of the current config. It is replaced by Set, and built
+// on first use when Conf was given without it.
+func (ci *ConfigInfo) lookupIndex() *index {
+	ci.confMutex.RLock()
+	idx := ci.index
+	ci.confMutex.RUnlock()
+	if idx != nil {
+		return idx
+	}
+	ci.confMutex.Lock()
+	defer ci.confMutex.Unlock()
+	if ci.index == nil {
+		ci.index = newIndex(ci.Conf)
+	}
+	return ci.index
+}
@@ -0,0 +1,227 @@
+package config
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// Returns a distinct ed25519 authorized_keys line for each n, the key
+// doesn't need to be a valid point to be parsed
+func testKey(n int) string {
+	key := make([]byte, 32)
+	binary.BigEndian.PutUint64(key, uint64(n))
+	var wire []byte
+	for _, field := range [][]byte{[]byte("ssh-ed25519"), key} {
+		length := make([]byte, 4)
+		binary.BigEndian.PutUint32(length, uint32(len(field)))
+		wire = append(append(wire, length...), field...)
+	}
+	return "ssh-ed25519 " + base64.StdEncoding.EncodeToString(wire)
+}
+
+// Returns n users with two keys each
+func testUsers(n int) []UserConfig {
+	users := make([]UserConfig, n)
+	for i := range users {
+		users[i] = UserConfig{
+			Name: fmt.Sprintf("user%d", i),
+			SSHKeys: []PubKeyConfig{
+				{Type: "hardcoded", Val: testKey(2 * i)},
+				{Type: "hardcoded", Val: testKey(2*i + 1)},
+			},
+		}
+	}
+	return users
+}
+
+func TestLookupUserByKey(t *testing.T) {
+	ci := ConfigInfo{Conf: Config{Users: testUsers(3)}}
+	ci.Conf.Users[0].SSHKeys = append(ci.Conf.Users[0].SSHKeys, PubKeyConfig{Type: "url", Val: "github.com/user0.keys"})
+
+	tests := []struct {
+		key  string
+		user string
+	}{
+		{testKey(0), "user0"},
+		{testKey(5), "user2"},
+		{testKey(3) + " bob@laptop", "user1"},
+		{"  " + testKey(3) + "\n", "user1"},
+		{`no-pty,command="ls" ` + testKey(4), "user2"},
+		{testKey(6), ""},
+		{"github.com/user0.keys", ""},
+		{"", ""},
+	}
+	for i, test := range tests {
+		user, err := ci.LookupUserByKey(test.key)
+		if user.Name != test.user || (err == nil) != (test.user != "") {
+			t.Errorf("#%d: LookupUserByKey(%q) == %s, %v, expected %q", i, test.key, user.Name, err, test.user)
+		}
+	}
+	if user, err := ci.LookupUserByName("USER1"); err != nil || user.Name != "user1" {
+		t.Errorf("LookupUserByName(USER1) == %s, %v", user.Name, err)
+	}
+
+	// Replacing the users rebuilds the index
+	ci.Set(Config{Users: testUsers(4)})
+	if user, err := ci.LookupUserByKey(testKey(6)); err != nil || user.Name != "user3" {
+		t.Errorf("LookupUserByKey() after replacing the users == %s, %v, expected user3", user.Name, err)
+	}
+	// So does setting a modified copy of the same users
+	c := ci.Get()
+	users := make([]UserConfig, len(c.Users))
+	copy(users, c.Users)
+	users[0].SSHKeys = []PubKeyConfig{{Type: "hardcoded", Val: testKey(8)}}
+	c.Users = users
+	ci.Set(c)
+	if user, err := ci.LookupUserByKey(testKey(8)); err != nil || user.Name != "user0" {
+		t.Errorf("LookupUserByKey() after changing the keys == %s, %v, expected user0", user.Name, err)
+	}
+	if _, err := ci.LookupUserByKey(testKey(0)); err == nil {
+		t.Errorf("LookupUserByKey() == nil for a removed key")
+	}
+}
+
+func TestDuplicateKeys(t *testing.T) {
+	users := testUsers(2)
+	// A key listed twice for the same user is harmless
+	users[0].SSHKeys = append(users[0].SSHKeys, PubKeyConfig{Type: "hardcoded", Val: testKey(0) + " again"})
+	if err := (Config{Users: users}).Validate(); err != nil {
+		t.Errorf("Validate() == %v, expected no error", err)
+	}
+	users[1].SSHKeys = append(users[1].SSHKeys, PubKeyConfig{Type: "hardcoded", Val: testKey(1) + " copy"})
+	fingerprint, _ := Fingerprint(testKey(1))
+	expected := fmt.Sprintf("Duplicate SSH key %s of users user0 and user1", fingerprint)
+	if err := (Config{Users: users}).Validate(); err == nil || err.Error() != expected {
+		t.Errorf("Validate() == %v, expected %q", err, expected)
+	}
+
+	// Deploy keys can't be shared with a user or another repo
+	fingerprint, _ = Fingerprint(testKey(2))
+	for i, test := range []struct {
+		repos    []RepoConfig
+		expected string
+	}{
+		{[]RepoConfig{{Name: "a", DeployKeys: []DeployKeyConfig{{Name: "ci", Key: testKey(4)}}}}, ""},
+		{[]RepoConfig{{Name: "a", DeployKeys: []DeployKeyConfig{{Name: "ci", Key: testKey(2) + " ci"}}}},
+			fmt.Sprintf("Duplicate SSH key %s of deploy key ci of fixme/a and user user1", fingerprint)},
+		{[]RepoConfig{
+			{Name: "a", DeployKeys: []DeployKeyConfig{{Name: "ci", Key: testKey(4)}}},
+			{Name: "b", DeployKeys: []DeployKeyConfig{{Name: "deploy", Key: testKey(4)}}},
+		}, "Duplicate SSH key"},
+		{[]RepoConfig{{Name: "a", DeployKeys: []DeployKeyConfig{{Name: "ci", Key: "ssh-ed25519 AAAA"}}}}, "Invalid deploy key ci of fixme/a"},
+	} {
+		c := Config{Users: testUsers(2), Orgs: []OrgConfig{{Id: "fixme", Repos: test.repos}}}
+		err := c.Validate()
+		if (err == nil) != (test.expected == "") || (err != nil && !strings.HasPrefix(err.Error(), test.expected)) {
+			t.Errorf("#%d: Validate() == %v, expected %q", i, err, test.expected)
+		}
+	}
+}
+
+func TestLookupDeployKey(t *testing.T) {
+	ci := ConfigInfo{Conf: Config{Orgs: []OrgConfig{{
+		Id:   "fixme",
+		Orgs: []OrgConfig{{Id: "infra", Repos: []RepoConfig{{Name: "website", DeployKeys: []DeployKeyConfig{{Name: "ci", Key: testKey(0) + " ci@build"}}}}}},
+	}}}}
+
+	tests := []struct {
+		key  string
+		name string
+	}{
+		{testKey(0), "ci"},
+		{testKey(0) + " other comment", "ci"},
+		{`restrict ` + testKey(0) + "\n", "ci"},
+		{testKey(1), ""},
+		{"ci@build", ""},
+		{"", ""},
+	}
+	for i, test := range tests {
+		org, repo, dk, err := ci.LookupDeployKey(test.key)
+		if dk.Name != test.name || (err == nil) != (test.name != "") {
+			t.Errorf("#%d: LookupDeployKey(%q) == %s, %v, expected %q", i, test.key, dk.Name, err, test.name)
+		}
+		if err == nil && (org.Id != "fixme/infra" || repo.Name != "website") {
+			t.Errorf("#%d: LookupDeployKey(%q) bound to %s/%s, expected fixme/infra/website", i, test.key, org.Id, repo.Name)
+		}
+	}
+
+	// Replacing the config rebuilds the index of deploy keys
+	c := ci.Get()
+	c.Orgs = []OrgConfig{{Id: "fixme", Repos: []RepoConfig{{Name: "blog", DeployKeys: []DeployKeyConfig{{Name: "deploy", Key: testKey(1)}}}}}}
+	ci.Set(c)
+	if org, repo, dk, err := ci.LookupDeployKey(testKey(1)); err != nil || org.Id != "fixme" || repo.Name != "blog" || dk.Name != "deploy" {
+		t.Errorf("LookupDeployKey() after replacing the orgs == %s/%s %s, %v, expected deploy of fixme/blog", org.Id, repo.Name, dk.Name, err)
+	}
+	if _, _, _, err := ci.LookupDeployKey(testKey(0)); err == nil {
+		t.Errorf("LookupDeployKey() == nil for a removed key")
+	}
+}
+
+const benchmarkUsers = 25000
+
+func BenchmarkLookupUserByKey(b *testing.B) {
+	ci := ConfigInfo{Conf: Config{Users: testUsers(benchmarkUsers)}}
+	ci.LookupUserByKey(testKey(0))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := ci.LookupUserByKey(testKey(i % (2 * benchmarkUsers))); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkLookupUserByName(b *testing.B) {
+	ci := ConfigInfo{Conf: Config{Users: testUsers(benchmarkUsers)}}
+	ci.LookupUserByName("user0")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := ci.LookupUserByName(fmt.Sprintf("user%d", i%benchmarkUsers)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkLookupDeployKey(b *testing.B) {
+	repos := make([]RepoConfig, benchmarkUsers)
+	for i := range repos {
+		repos[i] = RepoConfig{Name: fmt.Sprintf("repo%d", i), DeployKeys: []DeployKeyConfig{{Name: "ci", Key: testKey(i)}}}
+	}
+	ci := ConfigInfo{Conf: Config{Orgs: []OrgConfig{{Id: "fixme", Repos: repos}}}}
+	ci.LookupDeployKey(testKey(0))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, _, err := ci.LookupDeployKey(testKey(i % benchmarkUsers)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Cost of a reload, paid once per config change
+func BenchmarkUserIndex(b *testing.B) {
+	users := testUsers(benchmarkUsers)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		newIndex(Config{Users: users})
+	}
+}
+
+// Linear scan comparing authorized_keys lines, as done before the index
+func BenchmarkScanUserByKey(b *testing.B) {
+	users := testUsers(benchmarkUsers)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		key := testKey(i % (2 * benchmarkUsers))
+		found := false
+		for _, user := range users {
+			for _, sshKey := range user.SSHKeys {
+				found = found || sshKey.Val == key
+			}
+		}
+		if !found {
+			b.Fatal("Key not found")
+		}
+	}
+}
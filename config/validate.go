@@ -0,0 +1,403 @@
+package config
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const maxNameLength = 100
+
+// Names allowed for orgs, repos and users, after lowercasing
+var nameRegexp = regexp.MustCompile(`^[a-z0-9_][a-z0-9._-]*$`)
+
+// ValidationError is returned when the config breaks one of the rules
+// checked when it is loaded.
+type ValidationError struct {
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	return e.Message
+}
+
+func invalid(format string, args ...interface{}) error {
+	return &ValidationError{fmt.Sprintf(format, args...)}
+}
+
+// ValidateName checks that name can be used as an org, repo or user name,
+// i.e. as a directory of the data root.
+func ValidateName(name string) error {
+	if len(name) > maxNameLength {
+		return fmt.Errorf("Name is too long: %.20s...", name)
+	}
+	if !nameRegexp.MatchString(name) {
+		return fmt.Errorf("Invalid name %q, only letters, digits, '.', '_' and '-' are allowed, not as first character except '_'", name)
+	}
+	if strings.HasSuffix(name, ".lock") || strings.HasSuffix(name, ".git") || strings.Contains(name, "..") {
+		return fmt.Errorf("Reserved name: %s", name)
+	}
+	return nil
+}
+
+// Validate checks that names of orgs, teams, repos and users are valid and
+// unique, and that users only refer to existing orgs and users. Teams of
+// memberships aren't checked, members can be listed before their team is
+// added to the org.
+func (c Config) Validate() error {
+	if err := validateMaintenance(c.Server.Maintenance); err != nil {
+		return invalid("Invalid server maintenance: %v", err)
+	}
+	if err := validateNetwork(c.Server.Network); err != nil {
+		return invalid("Invalid server network: %v", err)
+	}
+	if err := validateLimits(c.Server.Limits); err != nil {
+		return invalid("Invalid server limits: %v", err)
+	}
+	ci := ConfigInfo{Conf: c}
+	if err := validateOrgs("", c.Orgs, c.Server.Mirrors); err != nil {
+		return err
+	}
+	if err := validateIdentity(&ci, c.Server.Identity); err != nil {
+		return invalid("Invalid identity backend: %v", err)
+	}
+	// Users of the directory can be shared with and denied access
+	ldapUsers := c.Server.Identity.Backend == "ldap"
+
+	users := map[string]bool{}
+	for _, user := range c.Users {
+		if err := ValidateName(strings.ToLower(user.Name)); err != nil {
+			return invalid("Invalid user: %v", err)
+		}
+		if users[strings.ToLower(user.Name)] {
+			return invalid("Duplicate user: %s", user.Name)
+		}
+		users[strings.ToLower(user.Name)] = true
+	}
+	// Owners of the keys, by fingerprint. A deploy key can't be used by
+	// another repo or by a user, it would be ambiguous which one connects.
+	keys := map[string]string{}
+	var deployKeyErr error
+	ci.WalkOrgs(func(path string, org OrgConfig) {
+		for _, repo := range org.Repos {
+			for _, dk := range repo.DeployKeys {
+				fingerprint, err := Fingerprint(dk.Key)
+				if err != nil {
+					if deployKeyErr == nil {
+						deployKeyErr = invalid("Invalid deploy key %s of %s/%s: %v", dk.Name, path, repo.Name, err)
+					}
+					continue
+				}
+				owner := fmt.Sprintf("deploy key %s of %s/%s", dk.Name, path, strings.ToLower(repo.Name))
+				if other, ok := keys[fingerprint]; ok && deployKeyErr == nil {
+					deployKeyErr = invalid("Duplicate SSH key %s of %s and %s", fingerprint, other, owner)
+				}
+				keys[fingerprint] = owner
+			}
+		}
+	})
+	if deployKeyErr != nil {
+		return deployKeyErr
+	}
+	for _, user := range c.Users {
+		for _, key := range user.SSHKeys {
+			if key.Val == "" {
+				return invalid("SSH key without value for user %s", user.Name)
+			}
+			fingerprint, err := Fingerprint(key.Val)
+			if err != nil {
+				continue
+			}
+			if owner, ok := keys[fingerprint]; ok && owner != user.Name {
+				if strings.HasPrefix(owner, "deploy key ") {
+					return invalid("Duplicate SSH key %s of %s and user %s", fingerprint, owner, user.Name)
+				}
+				return invalid("Duplicate SSH key %s of users %s and %s", fingerprint, owner, user.Name)
+			}
+			keys[fingerprint] = user.Name
+		}
+		for _, userOrg := range user.Orgs {
+			if _, err := ci.LookupOrgById(strings.ToLower(userOrg.Id)); err != nil {
+				return invalid("Unknown org %s in orgs of user %s", userOrg.Id, user.Name)
+			}
+		}
+		for _, share := range user.Shares {
+			if share.Repo != "*" {
+				if err := ValidateName(strings.ToLower(share.Repo)); err != nil {
+					return invalid("Invalid repo in shares of user %s: %v", user.Name, err)
+				}
+			}
+			for _, name := range share.Users {
+				if !users[strings.ToLower(name)] && !ldapUsers {
+					return invalid("Unknown user %s in shares of user %s", name, user.Name)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func validateIdentity(ci *ConfigInfo, ic IdentityConfig) error {
+	switch ic.Backend {
+	case "", "yaml":
+		return nil
+	case "ldap":
+	default:
+		return fmt.Errorf("Unknown backend %s, expected yaml or ldap", ic.Backend)
+	}
+	if ic.LDAP.Url == "" || ic.LDAP.UserBase == "" {
+		return fmt.Errorf("LDAP needs a url and a userbase")
+	}
+	if ic.LDAP.CacheTTL < 0 {
+		return fmt.Errorf("Negative LDAP cache TTL")
+	}
+	for _, group := range ic.LDAP.Groups {
+		if group.Dn == "" {
+			return fmt.Errorf("LDAP group without dn")
+		}
+		if _, err := ci.LookupOrgById(strings.ToLower(group.Org)); err != nil {
+			return fmt.Errorf("Unknown org %s for LDAP group %s", group.Org, group.Dn)
+		}
+	}
+	return nil
+}
+
+func validateOrgs(parent string, orgs []OrgConfig, mirrors MirrorsConfig) error {
+	ids := map[string]bool{}
+	for _, org := range orgs {
+		path := strings.ToLower(org.Id)
+		if parent != "" {
+			path = parent + "/" + path
+		}
+		if err := ValidateName(strings.ToLower(org.Id)); err != nil {
+			return invalid("Invalid org: %v", err)
+		}
+		// u/ and ~ prefix the paths of personal namespaces
+		if parent == "" && strings.ToLower(org.Id) == "u" {
+			return invalid("Reserved org: %s", org.Id)
+		}
+		if ids[strings.ToLower(org.Id)] {
+			return invalid("Duplicate org: %s", path)
+		}
+		ids[strings.ToLower(org.Id)] = true
+		if err := validateOrg(path, org, mirrors); err != nil {
+			return err
+		}
+		if err := validateOrgs(path, org.Orgs, mirrors); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateOrg(path string, org OrgConfig, mirrors MirrorsConfig) error {
+	teams := map[string]bool{}
+	for _, team := range org.Teams {
+		if team.Name == "" {
+			return invalid("Team without name in org %s", path)
+		}
+		if teams[team.Name] {
+			return invalid("Duplicate team %s in org %s", team.Name, path)
+		}
+		teams[team.Name] = true
+		if team.Role != "" && (team.Read || team.Write) {
+			return invalid("Team %s of org %s has both a role and read or write", team.Name, path)
+		}
+		if err := validateRole(team.Role); err != nil {
+			return invalid("Invalid team %s of org %s: %v", team.Name, path, err)
+		}
+	}
+	// Repos and sub-orgs share the directory of the org
+	subOrgs := map[string]bool{}
+	for _, sub := range org.Orgs {
+		subOrgs[strings.ToLower(sub.Id)] = true
+	}
+	repos := map[string]bool{}
+	for _, repo := range org.Repos {
+		if err := ValidateName(strings.ToLower(repo.Name)); err != nil {
+			return invalid("Invalid repo in org %s: %v", path, err)
+		}
+		if repos[strings.ToLower(repo.Name)] {
+			return invalid("Duplicate repo: %s/%s", path, repo.Name)
+		}
+		if subOrgs[strings.ToLower(repo.Name)] {
+			return invalid("Repo %s/%s has the path of a sub-org", path, repo.Name)
+		}
+		repos[strings.ToLower(repo.Name)] = true
+		deployKeys := map[string]bool{}
+		for _, dk := range repo.DeployKeys {
+			if dk.Name == "" || dk.Key == "" {
+				return invalid("Deploy key of %s/%s needs a name and a key", path, repo.Name)
+			}
+			if deployKeys[dk.Name] {
+				return invalid("Duplicate deploy key %s of %s/%s", dk.Name, path, repo.Name)
+			}
+			deployKeys[dk.Name] = true
+		}
+		if repo.Mirror.Interval < 0 {
+			return invalid("Negative mirror interval for %s/%s", path, repo.Name)
+		}
+		if repo.Mirror.Url != "" {
+			if err := validateRemote(repo.Mirror.Url, repo.Mirror.SSHKey, mirrors); err != nil {
+				return invalid("Invalid mirror of %s/%s: %v", path, repo.Name, err)
+			}
+		}
+		if err := validatePushMirrors(repo.PushMirrors, mirrors); err != nil {
+			return invalid("Invalid push mirror of %s/%s: %v", path, repo.Name, err)
+		}
+		if err := validateDenyRules(repo.Deny); err != nil {
+			return invalid("Invalid deny rule of %s/%s: %v", path, repo.Name, err)
+		}
+		if err := validateRefPatterns(repo.Protected); err != nil {
+			return invalid("Invalid protected refs of %s/%s: %v", path, repo.Name, err)
+		}
+		if err := validateNetwork(repo.Network); err != nil {
+			return invalid("Invalid network of %s/%s: %v", path, repo.Name, err)
+		}
+	}
+	if err := validatePushMirrors(org.PushMirrors, mirrors); err != nil {
+		return invalid("Invalid push mirror of org %s: %v", path, err)
+	}
+	if err := validateMaintenance(org.Maintenance); err != nil {
+		return invalid("Invalid maintenance of org %s: %v", path, err)
+	}
+	if err := validateDenyRules(org.Deny); err != nil {
+		return invalid("Invalid deny rule of org %s: %v", path, err)
+	}
+	if err := validateRefPatterns(org.Protected); err != nil {
+		return invalid("Invalid protected refs of org %s: %v", path, err)
+	}
+	if err := validateNetwork(org.Network); err != nil {
+		return invalid("Invalid network of org %s: %v", path, err)
+	}
+	return nil
+}
+
+func validateLimits(lc LimitsConfig) error {
+	for _, cc := range []ConcurrencyConfig{lc.Connections, lc.Processes} {
+		if cc.Total < 0 || cc.PerUser < 0 || cc.PerIP < 0 {
+			return fmt.Errorf("Negative number of connections or processes")
+		}
+	}
+	for _, rc := range []RateConfig{lc.NewConnections, lc.FailedAuth} {
+		if rc.Every < 0 || rc.Burst < 0 {
+			return fmt.Errorf("Negative rate or burst")
+		}
+	}
+	if lc.Queue.Size < 0 || lc.Queue.Timeout < 0 {
+		return fmt.Errorf("Negative queue size or timeout")
+	}
+	return nil
+}
+
+func validateNetwork(nc NetworkConfig) error {
+	for _, network := range append(append([]string{}, nc.Allow...), nc.Deny...) {
+		if _, err := ParseNetwork(network); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateRole(role string) error {
+	if role == "" {
+		return nil
+	}
+	for _, r := range Roles {
+		if role == r {
+			return nil
+		}
+	}
+	return fmt.Errorf("Unknown role %s, expected one of %s", role, strings.Join(Roles, ", "))
+}
+
+func validateRefPatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if !strings.HasPrefix(pattern, "refs/") {
+			return fmt.Errorf("Pattern %s doesn't start with refs/", pattern)
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("Invalid pattern %s: %v", pattern, err)
+		}
+	}
+	return nil
+}
+
+// Users and teams of deny rules aren't checked, like memberships
+func validateDenyRules(rules []DenyConfig) error {
+	for _, rule := range rules {
+		if (rule.User == "") == (rule.Team == "") {
+			return fmt.Errorf("A deny rule needs either a user or a team")
+		}
+		switch rule.Denied() {
+		case "read":
+			if rule.Refs != "" {
+				return fmt.Errorf("Refs can only be denied write access: %s", rule.Refs)
+			}
+		case "write":
+		default:
+			return fmt.Errorf("Unknown access %s, expected read or write", rule.Access)
+		}
+		if _, err := path.Match(rule.Refs, ""); err != nil {
+			return fmt.Errorf("Invalid refs pattern %s: %v", rule.Refs, err)
+		}
+	}
+	return nil
+}
+
+func validatePushMirrors(pushMirrors []PushMirrorConfig, mirrors MirrorsConfig) error {
+	names := map[string]bool{}
+	for _, mirror := range pushMirrors {
+		if mirror.Name == "" || mirror.Url == "" {
+			return fmt.Errorf("A push mirror needs a name and a url")
+		}
+		if names[mirror.Name] {
+			return fmt.Errorf("Duplicate name: %s", mirror.Name)
+		}
+		names[mirror.Name] = true
+		if err := validateRemote(mirror.Url, mirror.SSHKey, mirrors); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Mirrors only reach remote repositories, local paths would let anyone
+// editing the config read or overwrite the repositories of the server,
+// unless file:// urls are explicitly allowed. Keys are given to ssh as
+// absolute paths.
+func validateRemote(url string, sshKey string, mirrors MirrorsConfig) error {
+	if sshKey != "" && !filepath.IsAbs(sshKey) {
+		return fmt.Errorf("SSH key must be an absolute path: %s", sshKey)
+	}
+	if strings.HasPrefix(url, "-") || strings.Contains(url, "::") {
+		return fmt.Errorf("Invalid url: %s", url)
+	}
+	if i := strings.Index(url, "://"); i >= 0 {
+		switch strings.ToLower(url[:i]) {
+		case "ssh", "git", "http", "https":
+			return nil
+		case "file":
+			if mirrors.AllowFile {
+				return nil
+			}
+			return fmt.Errorf("Unsupported scheme %s, server.mirrors.allowfile is not set", url[:i])
+		}
+		return fmt.Errorf("Unsupported scheme %s, expected ssh, git, http or https", url[:i])
+	}
+	// scp-like syntax of SSH remotes, e.g. git@github.com:qrclabs/website
+	colon, slash := strings.Index(url, ":"), strings.Index(url, "/")
+	if colon > 0 && (slash < 0 || colon < slash) {
+		return nil
+	}
+	return fmt.Errorf("Url %s is not a remote, expected ssh, git, http or https", url)
+}
+
+func validateMaintenance(mc MaintenanceConfig) error {
+	if mc.Interval < 0 || mc.Pushes < 0 || mc.Concurrency < 0 {
+		return fmt.Errorf("Negative interval, pushes or concurrency")
+	}
+	return nil
+}
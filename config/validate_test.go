@@ -0,0 +1,94 @@
+package config
+
+import (
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestValidate(t *testing.T) {
+	var testCases = []struct {
+		config string
+		err    string
+	}{
+		{`
+orgs:
+  - id: fixme
+    teams: [{name: dev, read: yes}]
+    repos: [{name: website}]
+    orgs: [{id: infra, repos: [{name: website}]}]
+users:
+  - name: alice
+    orgs: [{id: fixme/infra, teams: [dev, notyet]}]
+    shares: [{repo: "*", users: [Bob]}]
+  - name: bob
+`, ""},
+		{"orgs: [{id: fixme}, {id: FIXME}]", "Duplicate org: fixme"},
+		{"orgs: [{id: fixme, orgs: [{id: a}, {id: a}]}]", "Duplicate org: fixme/a"},
+		{"orgs: [{id: fix/me}]", "Invalid org"},
+		{"orgs: [{id: U}]", "Reserved org: U"},
+		{"orgs: [{id: '~'}]", "Invalid org"},
+		{"orgs: [{id: fixme, orgs: [{id: u}]}]", ""},
+		{"orgs: [{id: fixme, repos: [{name: Infra}], orgs: [{id: infra}]}]", "Repo fixme/Infra has the path of a sub-org"},
+		{"orgs: [{id: fixme, teams: [{name: dev}, {name: dev}]}]", "Duplicate team dev in org fixme"},
+		{"orgs: [{id: fixme, repos: [{name: a}, {name: A}]}]", "Duplicate repo: fixme/A"},
+		{"orgs: [{id: fixme, repos: [{name: a.lock}]}]", "Reserved name"},
+		{"orgs: [{id: fixme, repos: [{name: a, deploykeys: [{name: ci}]}]}]", "needs a name and a key"},
+		{"orgs: [{id: fixme, pushmirrors: [{name: gh}]}]", "Invalid push mirror of org fixme"},
+		{"orgs: [{id: fixme, pushmirrors: [{name: gh, url: 'git@github.com:fixme', sshkey: /etc/nanogit/id_ed25519}]}]", ""},
+		{"orgs: [{id: fixme, pushmirrors: [{name: gh, url: 'https://github.com/fixme'}, {name: lab, url: 'ssh://git@gitlab.com/fixme'}]}]", ""},
+		{"orgs: [{id: fixme, pushmirrors: [{name: gh, url: /srv/git/fixme}]}]", "Invalid push mirror of org fixme: Url /srv/git/fixme is not a remote"},
+		{"orgs: [{id: fixme, pushmirrors: [{name: gh, url: 'file:///srv/git/fixme'}]}]", "Unsupported scheme file, server.mirrors.allowfile is not set"},
+		{"server: {mirrors: {allowfile: yes}}\norgs: [{id: fixme, pushmirrors: [{name: gh, url: 'file:///srv/git/fixme'}]}]", ""},
+		{"server: {mirrors: {allowfile: yes}}\norgs: [{id: fixme, repos: [{name: a, mirror: {url: 'FILE:///srv/a'}}]}]", ""},
+		{"server: {mirrors: {allowfile: yes}}\norgs: [{id: fixme, repos: [{name: a, mirror: {url: /srv/a}}]}]", "Url /srv/a is not a remote"},
+		{"orgs: [{id: fixme, pushmirrors: [{name: gh, url: 'git@github.com:fixme', sshkey: id_ed25519}]}]", "SSH key must be an absolute path"},
+		{"orgs: [{id: fixme, repos: [{name: a, pushmirrors: [{name: gh, url: '--upload-pack=touch /tmp/x'}]}]}]", "Invalid push mirror of fixme/a: Invalid url"},
+		{"orgs: [{id: fixme, repos: [{name: a, mirror: {url: 'https://github.com/fixme/a'}}]}]", ""},
+		{"orgs: [{id: fixme, repos: [{name: a, mirror: {url: ../../b}}]}]", "Invalid mirror of fixme/a: Url ../../b is not a remote"},
+		{"orgs: [{id: fixme, repos: [{name: a, mirror: {url: 'ext::sh -c touch% /tmp/x'}}]}]", "Invalid mirror of fixme/a: Invalid url"},
+		{"orgs: [{id: fixme, repos: [{name: a, mirror: {url: 'FILE:///srv/a'}}]}]", "Unsupported scheme FILE"},
+		{"orgs: [{id: fixme, maintenance: {pushes: -1}}]", "Invalid maintenance of org fixme"},
+		{"users: [{name: alice}, {name: Alice}]", "Duplicate user: Alice"},
+		{"users: [{name: ''}]", "Invalid user"},
+		{"users: [{name: alice, orgs: [{id: unknown}]}]", "Unknown org unknown"},
+		{"users: [{name: alice, sshkeys: [{type: hardcoded}]}]", "SSH key without value"},
+		{"users: [{name: alice, shares: [{repo: '*', users: [bob]}]}]", "Unknown user bob"},
+		{"orgs: [{id: fixme, deny: [{user: alice, team: dev}]}]", "needs either a user or a team"},
+		{"orgs: [{id: fixme, deny: [{team: dev, access: admin}]}]", "Unknown access admin"},
+		{"orgs: [{id: fixme, repos: [{name: a, deny: [{user: alice, access: read, refs: 'refs/heads/*'}]}]}]", "Invalid deny rule of fixme/a: Refs can only be denied write access"},
+		{"orgs: [{id: fixme, deny: [{user: alice, refs: 'refs/heads/['}]}]", "Invalid refs pattern"},
+		{"orgs: [{id: fixme, teams: [{name: dev, role: owner}]}]", "Invalid team dev of org fixme: Unknown role owner"},
+		{"orgs: [{id: fixme, teams: [{name: dev, role: writer, read: yes}]}]", "Team dev of org fixme has both a role and read or write"},
+		{"orgs: [{id: fixme, protected: [master]}]", "Invalid protected refs of org fixme: Pattern master doesn't start with refs/"},
+		{"orgs: [{id: fixme, repos: [{name: a, protected: ['refs/heads/[']}]}]", "Invalid protected refs of fixme/a"},
+		{"orgs: [{id: fixme, teams: [{name: dev, role: maintainer}], protected: ['refs/heads/release/*']}]", ""},
+		{"server: {network: {allow: [10.0.0.0/8, '::1'], deny: [10.0.0.1]}}", ""},
+		{"server: {network: {allow: [office]}}", "Invalid server network: Invalid address or CIDR range office"},
+		{"orgs: [{id: qrclabs, network: {deny: [10.0.0.0/33]}}]", "Invalid network of org qrclabs"},
+		{"orgs: [{id: qrclabs, repos: [{name: a, network: {allow: [192.168.1.0/24, 'fd00::/8']}}]}]", ""},
+		{"server: {limits: {connections: {total: 100, perip: 10}, newconnections: {every: 100ms, burst: 20}, queue: {size: 50, timeout: 30s}}}", ""},
+		{"server: {limits: {processes: {peruser: -1}}}", "Invalid server limits: Negative number of connections or processes"},
+		{"server: {limits: {failedauth: {every: 1m, burst: -5}}}", "Invalid server limits: Negative rate or burst"},
+		{"server: {limits: {queue: {timeout: -1s}}}", "Invalid server limits: Negative queue size or timeout"},
+		{"server: {identity: {backend: sql}}", "Unknown backend sql"},
+		{"server: {identity: {backend: ldap, ldap: {url: 'ldap://localhost'}}}", "needs a url and a userbase"},
+		{"server: {identity: {backend: ldap, ldap: {url: 'ldap://localhost', userbase: 'dc=org', groups: [{dn: 'cn=dev', org: fixme}]}}}", "Unknown org fixme"},
+		{"server: {identity: {backend: ldap, ldap: {url: 'ldap://localhost', userbase: 'dc=org'}}}\nusers: [{name: alice, shares: [{repo: '*', users: [bob]}]}]", ""},
+	}
+
+	for i, tc := range testCases {
+		c := Config{}
+		if err := yaml.Unmarshal([]byte(tc.config), &c); err != nil {
+			t.Fatalf("#%d: cannot parse config: %v", i, err)
+		}
+		err := c.Validate()
+		switch {
+		case tc.err == "" && err != nil:
+			t.Errorf("#%d: Validate() == %v; expected no error", i, err)
+		case tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)):
+			t.Errorf("#%d: Validate() == %v; expected %q", i, err, tc.err)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package dir
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
@@ -10,31 +11,69 @@ import (
 	"github.com/dgellow/nanogit/settings"
 )
 
+// CleanPath removes quotes from path. Paths sent by git clients are parsed
+// with ParseRepoPath.
 func CleanPath(path string) string {
 	return strings.Replace(path, "'", "", -1)
 }
 
+// Personal namespaces are given as ~username/reponame or u/username/reponame,
+// their org part being ~username.
+const (
+	UserNamespacePrefix = "~"
+	userNamespaceAlias  = "u"
+)
+
+// Directory of personal namespaces under the data root, apart from orgs
+const userNamespaceDir = "~"
+
+func IsUserNamespace(org string) bool {
+	return strings.HasPrefix(org, UserNamespacePrefix)
+}
+
+// UserNamespaceOwner returns the name of the user owning the personal
+// namespace org.
+func UserNamespaceOwner(org string) string {
+	return strings.TrimPrefix(org, UserNamespacePrefix)
+}
+
+// SplitPath splits a repository path into its org and repo parts. Orgs can
+// be nested, the org part being then every segment but the last one.
 func SplitPath(path string) (org string, repo string, err error) {
-	sliceStr := strings.Split(path, "/")
+	sliceStr := strings.Split(strings.Trim(path, "/"), "/")
 	if len(sliceStr) < 2 {
 		return "", "", fmt.Errorf("A path should be: orgname/reponame, got: %s", path)
 	}
-	return strings.ToLower(sliceStr[0]), strings.ToLower(sliceStr[1]), nil
+	for _, segment := range sliceStr {
+		if segment == "" || segment == "." || segment == ".." {
+			return "", "", fmt.Errorf("Invalid segment in path: %s", path)
+		}
+	}
+	if len(sliceStr) == 3 && sliceStr[0] == userNamespaceAlias {
+		sliceStr = []string{UserNamespacePrefix + sliceStr[1], sliceStr[2]}
+	}
+	if strings.HasPrefix(sliceStr[0], UserNamespacePrefix) {
+		if sliceStr[0] == UserNamespacePrefix || len(sliceStr) > 2 {
+			return "", "", fmt.Errorf("A personal namespace should be: ~username/reponame, got: %s", path)
+		}
+	}
+	last := len(sliceStr) - 1
+	return strings.ToLower(strings.Join(sliceStr[:last], "/")), strings.ToLower(sliceStr[last]), nil
 }
 
 func getDataRoot() (string, error) {
-	confDataRoot := settings.ConfInfo.Conf.Server.DataRoot
+	confDataRoot := settings.ConfInfo.Get().Server.DataRoot
 	if confDataRoot == "" {
 		return "", fmt.Errorf("Data root in configuration file is empty")
 	}
 
 	log.Debug("dir: AppPath: %s", settings.AppPath)
-	log.Debug("dir: Server.DataRoot: %s", settings.ConfInfo.Conf.Server.DataRoot)
+	log.Debug("dir: Server.DataRoot: %s", confDataRoot)
 
 	if confDataRoot[0] == '/' {
-		return settings.ConfInfo.Conf.Server.DataRoot, nil
+		return confDataRoot, nil
 	} else {
-		return filepath.Join(settings.AppPath, settings.ConfInfo.Conf.Server.DataRoot), nil
+		return filepath.Join(settings.AppPath, confDataRoot), nil
 	}
 }
 
@@ -43,15 +82,162 @@ func GetOrgDir(org string) (string, error) {
 	if err != nil {
 		return dataRoot, err
 	}
-	return filepath.Join(dataRoot, org), nil
+	orgDir := filepath.Join(dataRoot, org)
+	if IsUserNamespace(org) {
+		orgDir = filepath.Join(dataRoot, userNamespaceDir, UserNamespaceOwner(org))
+	}
+	if err := checkInsideDataRoot(dataRoot, orgDir); err != nil {
+		return "", err
+	}
+	if err := checkOutsideRepos(dataRoot, orgDir); err != nil {
+		return "", err
+	}
+	return orgDir, nil
 }
 
-func GetRepoDir(org string, repo string) (string, error) {
+// Nested orgs share the directories of their parents with repos, an org
+// path must not resolve to a repository or inside one
+func checkOutsideRepos(dataRoot string, orgDir string) error {
+	rel, err := filepath.Rel(dataRoot, orgDir)
+	if err != nil || rel == "." {
+		return err
+	}
+	path := dataRoot
+	for _, segment := range strings.Split(rel, string(filepath.Separator)) {
+		path = filepath.Join(path, segment)
+		if IsBareRepo(path) {
+			return fmt.Errorf("Org path is inside a repository: %s", rel)
+		}
+	}
+	return nil
+}
+
+// GetStoreDir returns the directory used by nanogit to keep its own state
+// (tokens, keys, ...) under the data root.
+func GetStoreDir() (string, error) {
 	dataRoot, err := getDataRoot()
 	if err != nil {
 		return dataRoot, err
 	}
-	return filepath.Join(dataRoot, org, repo), nil
+	return filepath.Join(dataRoot, ".nanogit"), nil
+}
+
+// GetRepoDir returns the directory of org/repo. Repositories created before
+// trailing .git were removed from paths are found with their suffix.
+func GetRepoDir(org string, repo string) (string, error) {
+	orgDir, err := GetOrgDir(org)
+	if err != nil {
+		return orgDir, err
+	}
+	repoDir := filepath.Join(orgDir, repo)
+	if _, err := os.Stat(repoDir); os.IsNotExist(err) && repo != "" {
+		if fi, err := os.Stat(repoDir + ".git"); err == nil && fi.IsDir() {
+			repoDir += ".git"
+		}
+	}
+	dataRoot, _ := getDataRoot()
+	if err := checkInsideDataRoot(dataRoot, repoDir); err != nil {
+		return "", err
+	}
+	return repoDir, nil
+}
+
+// RepoPath is the org and repo names of a repository found on disk.
+type RepoPath struct {
+	Org  string
+	Repo string
+}
+
+func (rp RepoPath) String() string {
+	return rp.Org + "/" + rp.Repo
+}
+
+// ListRepos returns the repositories found under the data root. Orgs are
+// directories, nested for sub-orgs, containing bare repositories. Personal
+// namespaces are listed as ~username orgs. Hidden directories are ignored.
+func ListRepos() ([]RepoPath, error) {
+	log.Trace("dir: ListRepos")
+	dataRoot, err := getDataRoot()
+	if err != nil {
+		return nil, err
+	}
+	orgs, err := listDirs(dataRoot)
+	if err != nil {
+		return nil, err
+	}
+	users, err := listDirs(filepath.Join(dataRoot, userNamespaceDir))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, user := range users {
+		orgs = append(orgs, UserNamespacePrefix+user)
+	}
+
+	repos := []RepoPath{}
+	for _, org := range orgs {
+		if org == userNamespaceDir {
+			continue
+		}
+		orgRepos, err := listOrgRepos(org)
+		if err != nil {
+			return nil, err
+		}
+		repos = append(repos, orgRepos...)
+	}
+	return repos, nil
+}
+
+// Repositories of org and its sub-orgs
+func listOrgRepos(org string) ([]RepoPath, error) {
+	orgDir, err := GetOrgDir(org)
+	if err != nil {
+		return nil, err
+	}
+	names, err := listDirs(orgDir)
+	if err != nil {
+		return nil, err
+	}
+	repos := []RepoPath{}
+	for _, name := range names {
+		if IsBareRepo(filepath.Join(orgDir, name)) {
+			repos = append(repos, RepoPath{org, strings.TrimSuffix(name, ".git")})
+			continue
+		}
+		if IsUserNamespace(org) {
+			continue
+		}
+		subRepos, err := listOrgRepos(org + "/" + name)
+		if err != nil {
+			return nil, err
+		}
+		repos = append(repos, subRepos...)
+	}
+	return repos, nil
+}
+
+// IsBareRepo returns true if path looks like a bare git repository.
+func IsBareRepo(path string) bool {
+	head, err := os.Stat(filepath.Join(path, "HEAD"))
+	if err != nil || head.IsDir() {
+		return false
+	}
+	objects, err := os.Stat(filepath.Join(path, "objects"))
+	return err == nil && objects.IsDir()
+}
+
+// Names of the non hidden directories in path
+func listDirs(path string) ([]string, error) {
+	infos, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	dirs := []string{}
+	for _, fi := range infos {
+		if fi.IsDir() && !strings.HasPrefix(fi.Name(), ".") {
+			dirs = append(dirs, fi.Name())
+		}
+	}
+	return dirs, nil
 }
 
 func IsOrgExist(path string) (bool, error) {
@@ -102,3 +288,23 @@ func IsPathExist(org string, repo string) (bool, error) {
 	}
 	return true, nil
 }
+
+// DiskUsage returns the size in bytes of the regular files under path.
+// Files removed while walking, e.g. by a concurrent gc, are ignored.
+func DiskUsage(path string) (int64, error) {
+	log.Trace("dir: DiskUsage, path: %s", path)
+	var size int64
+	err := filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
@@ -1,8 +1,10 @@
 package dir
 
 import (
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/dgellow/nanogit/settings"
@@ -42,12 +44,25 @@ func TestSplitPath(t *testing.T) {
 	tests := []TestDataSplitPath{
 		{"", "", "", "A path should be: orgname/reponame, got: "},
 		{"foo", "", "", "A path should be: orgname/reponame, got: foo"},
-		{"foobar/", "foobar", "", ""},
-		{"/foobar", "", "foobar", ""},
+		{"foobar/", "", "", "A path should be: orgname/reponame, got: foobar/"},
+		{"/foobar", "", "", "A path should be: orgname/reponame, got: /foobar"},
 		{"foo/bar", "foo", "bar", ""},
-		{"//foobar", "", "", ""},
-		{"///foobar", "", "", ""},
+		{"/foo/bar", "foo", "bar", ""},
+		{"//foobar", "", "", "A path should be: orgname/reponame, got: //foobar"},
+		{"///foobar", "", "", "A path should be: orgname/reponame, got: ///foobar"},
 		{"foo/bar/////", "foo", "bar", ""},
+		{"foo//bar", "", "", "Invalid segment in path: foo//bar"},
+		{"foo/../bar", "", "", "Invalid segment in path: foo/../bar"},
+		{"foo/.", "", "", "Invalid segment in path: foo/."},
+		{"Platform/Infra/Terraform", "platform/infra", "terraform", ""},
+		{"a/b/c/d", "a/b/c", "d", ""},
+		{"~Foo/bar", "~foo", "bar", ""},
+		{"u/foo/bar", "~foo", "bar", ""},
+		{"u/foo", "u", "foo", ""},
+		{"u/foo/", "u", "foo", ""},
+		{"u/foo/bar/baz", "u/foo/bar", "baz", ""},
+		{"~/bar", "", "", "A personal namespace should be: ~username/reponame, got: ~/bar"},
+		{"~foo/bar/baz", "", "", "A personal namespace should be: ~username/reponame, got: ~foo/bar/baz"},
 	}
 
 	for i, test := range tests {
@@ -144,6 +159,8 @@ func TestGetRepoDir(t *testing.T) {
 		{"foo", "bar", "/dataroot/foo/bar", ""},
 		{"", "bar", "/dataroot/bar", ""},
 		{"/foo/bar", "", "/dataroot/foo/bar", ""},
+		{"~foo", "bar", "/dataroot/~/foo/bar", ""},
+		{"platform/infra", "terraform", "/dataroot/platform/infra/terraform", ""},
 	}
 
 	for i, test := range tests {
@@ -157,3 +174,57 @@ func TestGetRepoDir(t *testing.T) {
 		}
 	}
 }
+
+func TestListRepos(t *testing.T) {
+	dataRoot, err := ioutil.TempDir("", "nanogit-dataroot")
+	if err != nil {
+		t.Fatalf("Couldn't create temp directory: %v", err)
+	}
+	defer os.RemoveAll(dataRoot)
+	settings.ConfInfo.Conf.Server.DataRoot = dataRoot
+	defer func() { settings.ConfInfo.Conf.Server.DataRoot = "" }()
+
+	// Bare repositories only need HEAD and objects to be found
+	for _, path := range []string{"fixme/foo", "platform/infra/terraform", "platform/web", "~/dgellow/scratch"} {
+		repoDir := filepath.Join(dataRoot, path)
+		if err := os.MkdirAll(filepath.Join(repoDir, "objects"), 0755); err != nil {
+			t.Fatalf("Couldn't create repo %s: %v", path, err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(repoDir, "HEAD"), []byte("ref: refs/heads/master\n"), 0644); err != nil {
+			t.Fatalf("Couldn't create repo %s: %v", path, err)
+		}
+	}
+	os.MkdirAll(filepath.Join(dataRoot, ".nanogit"), 0755)
+	os.MkdirAll(filepath.Join(dataRoot, "empty", "org"), 0755)
+
+	repos, err := ListRepos()
+	if err != nil {
+		t.Fatalf("ListRepos() == %v", err)
+	}
+	actual := []string{}
+	for _, repo := range repos {
+		actual = append(actual, repo.String())
+	}
+	expected := []string{"fixme/foo", "platform/infra/terraform", "platform/web", "~dgellow/scratch"}
+	if strings.Join(actual, ",") != strings.Join(expected, ",") {
+		t.Errorf("ListRepos() == %v; expected %v", actual, expected)
+	}
+
+	// Orgs can't be nested in repos
+	for i, test := range []struct {
+		org  string
+		repo string
+		err  string
+	}{
+		{"platform", "web", ""},
+		{"platform/web", "", "Org path is inside a repository: platform/web"},
+		{"platform/web", "docs", "Org path is inside a repository: platform/web"},
+		{"platform/web/objects", "docs", "Org path is inside a repository: platform/web/objects"},
+		{"platform/infra", "terraform", ""},
+	} {
+		_, err := GetRepoDir(test.org, test.repo)
+		if (err == nil) != (test.err == "") || (err != nil && err.Error() != test.err) {
+			t.Errorf("#%d: _, err := GetRepoDir(%s, %s) == %v; expected %v", i, test.org, test.repo, err, test.err)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package dir
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/dgellow/nanogit/log"
+)
+
+// RepoLock is an advisory lock on a repository, shared between processes.
+// Pushes hold it shared, backups hold it exclusively while capturing refs.
+// It is released when the process exits.
+type RepoLock struct {
+	file *os.File
+}
+
+// Delay between two attempts to take a busy lock
+var lockRetryDelay = 50 * time.Millisecond
+
+// LockRepo locks given repository, waiting at most timeout for the lock to
+// be available.
+func LockRepo(org string, repo string, exclusive bool, timeout time.Duration) (*RepoLock, error) {
+	log.Trace("dir: LockRepo, repo: %s/%s, exclusive: %t", org, repo, exclusive)
+	storeDir, err := GetStoreDir()
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(storeDir, "locks", RepoPath{Org: org, Repo: repo}.String()+".lock")
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_RDONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		err = syscall.Flock(int(file.Fd()), how|syscall.LOCK_NB)
+		if err != syscall.EWOULDBLOCK || !time.Now().Before(deadline) {
+			break
+		}
+		time.Sleep(lockRetryDelay)
+	}
+	if err == syscall.EWOULDBLOCK {
+		file.Close()
+		return nil, fmt.Errorf("Repository is locked: %s/%s", org, repo)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &RepoLock{file}, nil
+}
+
+// Unlock releases the lock.
+func (rl *RepoLock) Unlock() error {
+	return rl.file.Close()
+}
@@ -0,0 +1,52 @@
+package dir
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/dgellow/nanogit/settings"
+)
+
+func TestLockRepo(t *testing.T) {
+	dataRoot, err := ioutil.TempDir("", "nanogit-dataroot")
+	if err != nil {
+		t.Fatalf("Couldn't create temp directory: %v", err)
+	}
+	defer os.RemoveAll(dataRoot)
+	settings.ConfInfo.Conf.Server.DataRoot = dataRoot
+	defer func() { settings.ConfInfo.Conf.Server.DataRoot = "" }()
+
+	push1, err := LockRepo("fixme", "foo", false, 0)
+	if err != nil {
+		t.Fatalf("LockRepo() shared == %v", err)
+	}
+	push2, err := LockRepo("fixme", "foo", false, 0)
+	if err != nil {
+		t.Fatalf("LockRepo() shared while shared == %v", err)
+	}
+	if _, err := LockRepo("fixme", "foo", true, 100*time.Millisecond); err == nil {
+		t.Errorf("LockRepo() exclusive while shared == nil; expected error")
+	}
+	other, err := LockRepo("fixme", "bar", true, 0)
+	if err != nil {
+		t.Fatalf("LockRepo() exclusive on another repo == %v", err)
+	}
+	other.Unlock()
+
+	// The exclusive lock is taken once the shared ones are released
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		push1.Unlock()
+		push2.Unlock()
+	}()
+	backup, err := LockRepo("fixme", "foo", true, 5*time.Second)
+	if err != nil {
+		t.Fatalf("LockRepo() exclusive after release == %v", err)
+	}
+	if _, err := LockRepo("fixme", "foo", false, 0); err == nil {
+		t.Errorf("LockRepo() shared while exclusive == nil; expected error")
+	}
+	backup.Unlock()
+}
@@ -0,0 +1,133 @@
+package dir
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/dgellow/nanogit/config"
+)
+
+const maxPathDepth = 16
+
+// ParseRepoPath parses the repository path argument sent by git clients,
+// e.g. 'org/repo.git', and returns its org and repo parts. The argument is
+// shell quoted, a trailing .git is removed and every segment is validated.
+func ParseRepoPath(arg string) (org string, repo string, err error) {
+	path, err := unquote(arg)
+	if err != nil {
+		return "", "", err
+	}
+	path = strings.TrimSuffix(strings.TrimRight(path, "/"), ".git")
+	org, repo, err = SplitPath(path)
+	if err != nil {
+		return "", "", err
+	}
+	if err := ValidateRepoPath(org, repo); err != nil {
+		return "", "", err
+	}
+	return org, repo, nil
+}
+
+// ValidateRepoPath checks that every segment of org/repo is an allowed name
+// and that the repository is inside the data root.
+func ValidateRepoPath(org string, repo string) error {
+	segments := strings.Split(org, "/")
+	if IsUserNamespace(org) {
+		segments = []string{UserNamespaceOwner(org)}
+	}
+	segments = append(segments, repo)
+	if len(segments) > maxPathDepth {
+		return fmt.Errorf("Too many segments in path: %s/%s", org, repo)
+	}
+	for _, segment := range segments {
+		if err := validateSegment(segment); err != nil {
+			return err
+		}
+	}
+	_, err := GetRepoDir(org, repo)
+	return err
+}
+
+func validateSegment(segment string) error {
+	return config.ValidateName(segment)
+}
+
+// Remove the POSIX shell quoting used by git for the path argument: single
+// quoted parts and backslash escapes outside of quotes. The argument must
+// be a single word.
+func unquote(arg string) (string, error) {
+	var b bytes.Buffer
+	inQuote := false
+	for i := 0; i < len(arg); i++ {
+		c := arg[i]
+		switch {
+		case c < 0x20 || c == 0x7f:
+			return "", fmt.Errorf("Control character in path: %q", arg)
+		case inQuote:
+			if c == '\'' {
+				inQuote = false
+			} else {
+				b.WriteByte(c)
+			}
+		case c == '\'':
+			inQuote = true
+		case c == '\\':
+			i++
+			if i == len(arg) {
+				return "", fmt.Errorf("Unterminated escape in path: %q", arg)
+			}
+			b.WriteByte(arg[i])
+		case c == ' ':
+			return "", fmt.Errorf("A single path is expected, got: %q", arg)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	if inQuote {
+		return "", fmt.Errorf("Unterminated quote in path: %q", arg)
+	}
+	return b.String(), nil
+}
+
+// Returns an error if path isn't inside the data root, symlinks of the
+// existing part of the path being resolved.
+func checkInsideDataRoot(dataRoot string, path string) error {
+	escapeErr := fmt.Errorf("Path is outside of the data root: %s", path)
+	if !isInside(filepath.Clean(dataRoot), filepath.Clean(path)) {
+		return escapeErr
+	}
+	realRoot, err := filepath.EvalSymlinks(dataRoot)
+	if err != nil {
+		// The data root doesn't exist yet, nothing to resolve
+		return nil
+	}
+	existing := filepath.Clean(path)
+	rest := ""
+	for {
+		if _, err := os.Lstat(existing); err == nil {
+			break
+		}
+		parent := filepath.Dir(existing)
+		if parent == existing {
+			return nil
+		}
+		rest = filepath.Join(filepath.Base(existing), rest)
+		existing = parent
+	}
+	realPath, err := filepath.EvalSymlinks(existing)
+	if err != nil {
+		return escapeErr
+	}
+	if !isInside(realRoot, filepath.Join(realPath, rest)) {
+		return escapeErr
+	}
+	return nil
+}
+
+func isInside(root string, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
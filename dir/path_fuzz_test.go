@@ -0,0 +1,48 @@
+//go:build go1.18
+// +build go1.18
+
+package dir
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dgellow/nanogit/settings"
+)
+
+func FuzzParseRepoPath(f *testing.F) {
+	settings.ConfInfo.Conf.Server.DataRoot = "/dataroot"
+	defer func() { settings.ConfInfo.Conf.Server.DataRoot = "" }()
+
+	for _, seed := range []string{
+		"'fixme/foo.git'", "'/fixme/foo'", "'platform/infra/terraform'", "'~dgellow/scratch'",
+		"'u/dgellow/scratch'", "'fix'\\''me/foo'", "'../etc/passwd'", "'fixme/..'", "fixme\\/foo",
+	} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, arg string) {
+		org, repo, err := ParseRepoPath(arg)
+		if err != nil {
+			return
+		}
+		for _, segment := range strings.Split(strings.TrimPrefix(org, UserNamespacePrefix)+"/"+repo, "/") {
+			if validateSegment(segment) != nil {
+				t.Fatalf("ParseRepoPath(%q) == %q, %q: invalid segment %q", arg, org, repo, segment)
+			}
+		}
+		repoDir, err := GetRepoDir(org, repo)
+		if err != nil {
+			t.Fatalf("GetRepoDir(%q, %q) == %v", org, repo, err)
+		}
+		if !strings.HasPrefix(repoDir, filepath.Clean("/dataroot")+"/") {
+			t.Fatalf("ParseRepoPath(%q) resolves outside of the data root: %s", arg, repoDir)
+		}
+		// Parsing the quoted result gives the same path
+		org2, repo2, err := ParseRepoPath("'" + org + "/" + repo + "'")
+		if err != nil || org2 != org || repo2 != repo {
+			t.Fatalf("ParseRepoPath(%q) == %q, %q; reparsed as %q, %q, %v", arg, org, repo, org2, repo2, err)
+		}
+	})
+}
@@ -0,0 +1,112 @@
+package dir
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dgellow/nanogit/settings"
+)
+
+type TestDataParseRepoPath struct {
+	in   string
+	org  string
+	repo string
+	err  bool
+}
+
+func TestParseRepoPath(t *testing.T) {
+	settings.ConfInfo.Conf.Server.DataRoot = "/dataroot"
+	defer func() { settings.ConfInfo.Conf.Server.DataRoot = "" }()
+
+	tests := []TestDataParseRepoPath{
+		{"'fixme/foo'", "fixme", "foo", false},
+		{"'/fixme/foo'", "fixme", "foo", false},
+		{"fixme/foo", "fixme", "foo", false},
+		{"'fixme/foo.git'", "fixme", "foo", false},
+		{"'fixme/foo.git/'", "fixme", "foo", false},
+		{"'MyOrg/MyProject.git'", "myorg", "myproject", false},
+		{"'platform/infra/terraform.git'", "platform/infra", "terraform", false},
+		{"'~dgellow/scratch'", "~dgellow", "scratch", false},
+		{"'u/dgellow/scratch.git'", "~dgellow", "scratch", false},
+		{"'fix'\\''me/foo'", "", "", true},
+		{"'fixme'/'foo'", "fixme", "foo", false},
+		{"fixme\\/foo", "fixme", "foo", false},
+		{"'fixme/foo", "", "", true},
+		{"fixme/foo\\", "", "", true},
+		{"'fixme/foo' 'other/repo'", "", "", true},
+		{"''", "", "", true},
+		{"'//foobar'", "", "", true},
+		{"'fixme//foo'", "", "", true},
+		{"'fixme/..'", "", "", true},
+		{"'../etc/passwd'", "", "", true},
+		{"'fixme/../../etc'", "", "", true},
+		{"'fixme/foo..bar'", "", "", true},
+		{"'fixme/.nanogit'", "", "", true},
+		{"'.nanogit/tokens.yml'", "", "", true},
+		{"'fixme/-upload-pack=sh'", "", "", true},
+		{"'fixme/foo.lock'", "", "", true},
+		{"'fixme/foo.git.git'", "", "", true},
+		{"'fixme/fo\x00o'", "", "", true},
+		{"'fixme/fo\no'", "", "", true},
+		{"'fixme/fo o'", "", "", true},
+		{"'fixme/f\\oo'", "", "", true},
+		{"'~/foo'", "", "", true},
+		{"'~../foo'", "", "", true},
+		{"'~dgellow/a/b'", "", "", true},
+	}
+
+	for i, test := range tests {
+		org, repo, err := ParseRepoPath(test.in)
+		if test.org != org || test.repo != repo {
+			t.Errorf("#%d: ParseRepoPath(%q) == %q, %q; expected %q, %q", i, test.in, org, repo, test.org, test.repo)
+		}
+		if (err != nil) != test.err {
+			t.Errorf("#%d: _, _, err := ParseRepoPath(%q) == %v; expected error: %t", i, test.in, err, test.err)
+		}
+	}
+}
+
+func TestGetRepoDirInsideDataRoot(t *testing.T) {
+	dataRoot, err := ioutil.TempDir("", "nanogit-dataroot")
+	if err != nil {
+		t.Fatalf("Couldn't create temp directory: %v", err)
+	}
+	defer os.RemoveAll(dataRoot)
+	settings.ConfInfo.Conf.Server.DataRoot = dataRoot
+	defer func() { settings.ConfInfo.Conf.Server.DataRoot = "" }()
+
+	// An org symlinked outside of the data root
+	outside, err := ioutil.TempDir("", "nanogit-outside")
+	if err != nil {
+		t.Fatalf("Couldn't create temp directory: %v", err)
+	}
+	defer os.RemoveAll(outside)
+	if err := os.Symlink(outside, filepath.Join(dataRoot, "escape")); err != nil {
+		t.Fatalf("Couldn't create symlink: %v", err)
+	}
+	// Repositories created with a .git suffix are still found
+	if err := os.MkdirAll(filepath.Join(dataRoot, "fixme", "legacy.git"), 0755); err != nil {
+		t.Fatalf("Couldn't create repo: %v", err)
+	}
+
+	tests := []struct {
+		org  string
+		repo string
+		out  string
+		err  bool
+	}{
+		{"fixme", "foo", filepath.Join(dataRoot, "fixme", "foo"), false},
+		{"fixme", "legacy", filepath.Join(dataRoot, "fixme", "legacy.git"), false},
+		{"fixme", "../../foo", "", true},
+		{"..", "foo", "", true},
+		{"escape", "foo", "", true},
+	}
+	for i, test := range tests {
+		out, err := GetRepoDir(test.org, test.repo)
+		if out != test.out || (err != nil) != test.err {
+			t.Errorf("#%d: GetRepoDir(%s, %s) == %s, %v; expected %s, error: %t", i, test.org, test.repo, out, err, test.out, test.err)
+		}
+	}
+}
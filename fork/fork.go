@@ -0,0 +1,254 @@
+package fork
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/dgellow/nanogit/dir"
+	"github.com/dgellow/nanogit/git"
+	"github.com/dgellow/nanogit/log"
+	"github.com/dgellow/nanogit/store"
+)
+
+// Name of the fork relationships file, under the store directory of the
+// data root.
+const storeName = "forks.yml"
+
+// Relation links a fork to the repository it was forked from. The fork
+// borrows the objects of its source through objects/info/alternates.
+type Relation struct {
+	Source  string
+	Fork    string
+	Created time.Time
+}
+
+// Refs of forks kept in their source by previous versions, removed by
+// Protect as readers of the source could reach them.
+const legacyForkRefs = "refs/forks"
+
+type forkStore struct {
+	Forks []Relation
+}
+
+func load() (forkStore, error) {
+	fs := forkStore{}
+	err := store.Load(storeName, &fs)
+	return fs, err
+}
+
+// List returns every fork relationship.
+func List() ([]Relation, error) {
+	fs, err := load()
+	return fs.Forks, err
+}
+
+// Forks returns the forks of org/repo.
+func Forks(org string, repo string) ([]dir.RepoPath, error) {
+	fs, err := load()
+	if err != nil {
+		return nil, err
+	}
+	source := dir.RepoPath{Org: org, Repo: repo}.String()
+	forks := []dir.RepoPath{}
+	for _, rel := range fs.Forks {
+		if rel.Source != source {
+			continue
+		}
+		if forkOrg, forkRepo, err := dir.SplitPath(rel.Fork); err == nil {
+			forks = append(forks, dir.RepoPath{Org: forkOrg, Repo: forkRepo})
+		}
+	}
+	return forks, nil
+}
+
+// Create forks srcOrg/srcRepo into dstOrg/dstRepo: a new bare repository
+// sharing the objects of the source, with a copy of its branches and tags.
+func Create(srcOrg string, srcRepo string, dstOrg string, dstRepo string) error {
+	log.Trace("fork: Create, source: %s/%s, fork: %s/%s", srcOrg, srcRepo, dstOrg, dstRepo)
+	if exists, _ := dir.IsRepoExist(srcOrg, srcRepo); !exists {
+		return fmt.Errorf("Cannot find source repository: %s/%s", srcOrg, srcRepo)
+	}
+	if exists, _ := dir.IsRepoExist(dstOrg, dstRepo); exists {
+		return fmt.Errorf("Repository already exists: %s/%s", dstOrg, dstRepo)
+	}
+	srcPath, err := dir.GetRepoDir(srcOrg, srcRepo)
+	if err != nil {
+		return err
+	}
+	dstPath, err := dir.GetRepoDir(dstOrg, dstRepo)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dstPath), 0755); err != nil {
+		return err
+	}
+	if _, err := git.Run("", nil, "init", "--bare", "--quiet", dstPath); err != nil {
+		return err
+	}
+	// Relative so that the data root can be moved
+	alternate, err := filepath.Rel(filepath.Join(dstPath, "objects"), filepath.Join(srcPath, "objects"))
+	if err != nil {
+		os.RemoveAll(dstPath)
+		return err
+	}
+	alternatesPath := filepath.Join(dstPath, "objects", "info", "alternates")
+	if err := ioutil.WriteFile(alternatesPath, []byte(alternate+"\n"), 0644); err != nil {
+		os.RemoveAll(dstPath)
+		return err
+	}
+	// Objects are found through alternates, only refs are copied
+	_, err = git.Run(dstPath, nil, "fetch", "--quiet", srcPath,
+		"+refs/heads/*:refs/heads/*", "+refs/tags/*:refs/tags/*")
+	if err != nil {
+		os.RemoveAll(dstPath)
+		return err
+	}
+	if head, err := git.Run(srcPath, nil, "symbolic-ref", "HEAD"); err == nil {
+		git.Run(dstPath, nil, "symbolic-ref", "HEAD", strings.TrimSpace(head))
+	}
+	// A plain git gc in the source must never prune objects used by forks
+	if _, err := git.Run(srcPath, nil, "config", "gc.pruneExpire", "never"); err != nil {
+		log.Error("fork: cannot disable pruning in %s/%s: %v", srcOrg, srcRepo, err)
+	}
+
+	fs := forkStore{}
+	return store.Update(storeName, &fs, func() error {
+		fs.Forks = append(fs.Forks, Relation{
+			Source:  dir.RepoPath{Org: srcOrg, Repo: srcRepo}.String(),
+			Fork:    dir.RepoPath{Org: dstOrg, Repo: dstRepo}.String(),
+			Created: time.Now().UTC(),
+		})
+		return nil
+	})
+}
+
+// Protect copies into the forks of org/repo the objects they borrow from it
+// that it doesn't reference anymore, so that they survive its garbage
+// collection. It has to be run before the source repository is garbage
+// collected. Nothing of the forks is added to the source, which readers of
+// the source could see.
+func Protect(org string, repo string) error {
+	log.Trace("fork: Protect, repo: %s/%s", org, repo)
+	forks, err := Forks(org, repo)
+	if err != nil {
+		return err
+	}
+	srcPath, err := dir.GetRepoDir(org, repo)
+	if err != nil {
+		return err
+	}
+	if err := removeLegacyRefs(srcPath); err != nil {
+		return fmt.Errorf("Cannot remove refs of forks: %v", err)
+	}
+	if len(forks) == 0 {
+		return nil
+	}
+	tips, err := git.Run(srcPath, nil, "for-each-ref", "--format=^%(objectname)")
+	if err != nil {
+		return err
+	}
+	for _, f := range forks {
+		forkPath, err := dir.GetRepoDir(f.Org, f.Repo)
+		if err != nil {
+			return err
+		}
+		if err := copyBorrowed(forkPath, tips); err != nil {
+			return fmt.Errorf("Cannot protect objects of fork %s: %v", f, err)
+		}
+	}
+	return nil
+}
+
+// Packs in the fork at forkPath the objects of its refs not reachable from
+// tips, the refs of its source given as ^<id> lines. The ones it already
+// had are packed again, then dropped by git gc of the fork.
+func copyBorrowed(forkPath string, tips string) error {
+	objects, err := git.RunInput(forkPath, nil, tips, "rev-list", "--objects", "--all", "--stdin")
+	if err != nil || strings.TrimSpace(objects) == "" {
+		return err
+	}
+	if _, err := git.RunInput(forkPath, nil, objects, "pack-objects", "--quiet", filepath.Join("objects", "pack", "pack")); err != nil {
+		return err
+	}
+	_, err = git.Run(forkPath, nil, "prune-packed", "--quiet")
+	return err
+}
+
+// Removes the refs of forks fetched into the repo at path by previous
+// versions, with the setting hiding them
+func removeLegacyRefs(repoPath string) error {
+	refs, err := git.Run(repoPath, nil, "for-each-ref", "--format=delete %(refname)", legacyForkRefs)
+	if err != nil || refs == "" {
+		return err
+	}
+	if _, err := git.RunInput(repoPath, nil, refs, "update-ref", "--stdin"); err != nil {
+		return err
+	}
+	git.Run(repoPath, nil, "config", "--unset-all", "transfer.hideRefs", "^"+legacyForkRefs+"$")
+	return nil
+}
+
+// Dissociate copies into the fork every object it borrows from its source,
+// then removes the link between them.
+func Dissociate(org string, repo string) error {
+	log.Trace("fork: Dissociate, fork: %s/%s", org, repo)
+	forkPath, err := dir.GetRepoDir(org, repo)
+	if err != nil {
+		return err
+	}
+	if _, err := git.Run(forkPath, nil, "repack", "-a", "-d", "--quiet"); err != nil {
+		return err
+	}
+	alternatesPath := filepath.Join(forkPath, "objects", "info", "alternates")
+	if err := os.Remove(alternatesPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return removeRelations(dir.RepoPath{Org: org, Repo: repo}.String())
+}
+
+// Remove the relationships where repo is the fork
+func removeRelations(repo string) error {
+	fs := forkStore{}
+	return store.Update(storeName, &fs, func() error {
+		forks := []Relation{}
+		for _, rel := range fs.Forks {
+			if rel.Fork != repo {
+				forks = append(forks, rel)
+			}
+		}
+		fs.Forks = forks
+		return nil
+	})
+}
+
+// DeleteRepo removes org/repo from the data root. Its forks are dissociated
+// first so that they keep every object they need.
+func DeleteRepo(org string, repo string) error {
+	log.Trace("fork: DeleteRepo, repo: %s/%s", org, repo)
+	if exists, err := dir.IsRepoExist(org, repo); !exists {
+		return fmt.Errorf("Cannot find repository %s/%s: %v", org, repo, err)
+	}
+	forks, err := Forks(org, repo)
+	if err != nil {
+		return err
+	}
+	for _, f := range forks {
+		if err := Dissociate(f.Org, f.Repo); err != nil {
+			return fmt.Errorf("Cannot dissociate fork %s: %v", f, err)
+		}
+	}
+	// The repo may itself be a fork
+	if err := removeRelations(dir.RepoPath{Org: org, Repo: repo}.String()); err != nil {
+		return err
+	}
+	repoPath, err := dir.GetRepoDir(org, repo)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(repoPath)
+}
@@ -0,0 +1,217 @@
+package fork
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dgellow/nanogit/config"
+	"github.com/dgellow/nanogit/git"
+	"github.com/dgellow/nanogit/settings"
+)
+
+func commit(t *testing.T, workPath string, msg string) string {
+	_, err := git.Run(workPath, nil, "-c", "user.name=nanogit", "-c", "user.email=nanogit@localhost",
+		"commit", "--allow-empty", "--quiet", "-m", msg)
+	if err != nil {
+		t.Fatalf("Cannot commit: %v", err)
+	}
+	return revParse(t, workPath, "HEAD")
+}
+
+func revParse(t *testing.T, repoPath string, rev string) string {
+	out, err := git.Run(repoPath, nil, "rev-parse", "--verify", "--quiet", rev)
+	if err != nil {
+		t.Fatalf("Cannot find %s in %s: %v", rev, repoPath, err)
+	}
+	return strings.TrimSpace(out)
+}
+
+// Whether the object can be read from the repo, or from its alternates
+func hasObject(repoPath string, sha string) bool {
+	_, err := git.Run(repoPath, nil, "cat-file", "-e", sha)
+	return err == nil
+}
+
+// Creates the data root with the repo fixme/website, with the branches
+// master and feature, returns the path of the data root
+func setup(t *testing.T) (string, func()) {
+	tmpDir, err := ioutil.TempDir("", "nanogit-fork")
+	if err != nil {
+		t.Fatalf("Cannot create temp directory: %v", err)
+	}
+	dataRoot := filepath.Join(tmpDir, "dataroot")
+	settings.ConfInfo.Set(config.Config{Server: config.ServerConfig{DataRoot: dataRoot}})
+
+	srcPath := filepath.Join(dataRoot, "fixme", "website")
+	workPath := filepath.Join(tmpDir, "work")
+	if _, err := git.Run("", nil, "init", "--bare", "--quiet", srcPath); err != nil {
+		t.Fatalf("Cannot init repo: %v", err)
+	}
+	if _, err := git.Run("", nil, "init", "--quiet", workPath); err != nil {
+		t.Fatalf("Cannot init work tree: %v", err)
+	}
+	commit(t, workPath, "first")
+	if _, err := git.Run(workPath, nil, "push", "--quiet", srcPath, "HEAD:refs/heads/master", "HEAD:refs/tags/v1"); err != nil {
+		t.Fatalf("Cannot push: %v", err)
+	}
+	commit(t, workPath, "feature")
+	if _, err := git.Run(workPath, nil, "push", "--quiet", srcPath, "HEAD:refs/heads/feature"); err != nil {
+		t.Fatalf("Cannot push: %v", err)
+	}
+	return dataRoot, func() {
+		settings.ConfInfo.Set(config.Config{})
+		os.RemoveAll(tmpDir)
+	}
+}
+
+func TestCreate(t *testing.T) {
+	dataRoot, teardown := setup(t)
+	defer teardown()
+	srcPath := filepath.Join(dataRoot, "fixme", "website")
+	forkPath := filepath.Join(dataRoot, "~", "alice", "website")
+
+	if err := Create("fixme", "website", "~alice", "website"); err != nil {
+		t.Fatalf("Create() == %v", err)
+	}
+	for _, ref := range []string{"refs/heads/master", "refs/heads/feature", "refs/tags/v1"} {
+		if src, fork := revParse(t, srcPath, ref), revParse(t, forkPath, ref); src != fork {
+			t.Errorf("%s of fork == %s, expected %s", ref, fork, src)
+		}
+	}
+	// Objects are borrowed through a relative alternate
+	alternates, err := ioutil.ReadFile(filepath.Join(forkPath, "objects", "info", "alternates"))
+	if err != nil || strings.TrimSpace(string(alternates)) != "../../../../fixme/website/objects" {
+		t.Errorf("Alternates of fork == %q, %v", alternates, err)
+	}
+	if out, _ := git.Run(srcPath, nil, "config", "gc.pruneExpire"); strings.TrimSpace(out) != "never" {
+		t.Errorf("gc.pruneExpire of source == %q, expected never", out)
+	}
+	forks, err := Forks("fixme", "website")
+	if err != nil || len(forks) != 1 || forks[0].String() != "~alice/website" {
+		t.Errorf("Forks() == %v, %v, expected ~alice/website", forks, err)
+	}
+
+	for i, test := range []struct {
+		srcOrg  string
+		srcRepo string
+		dstOrg  string
+		dstRepo string
+		err     string
+	}{
+		{"fixme", "missing", "~alice", "other", "Cannot find source repository"},
+		{"fixme", "website", "~alice", "website", "Repository already exists"},
+	} {
+		if err := Create(test.srcOrg, test.srcRepo, test.dstOrg, test.dstRepo); err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("#%d: Create(%s/%s, %s/%s) == %v, expected %q", i, test.srcOrg, test.srcRepo, test.dstOrg, test.dstRepo, err, test.err)
+		}
+	}
+}
+
+func TestProtect(t *testing.T) {
+	dataRoot, teardown := setup(t)
+	defer teardown()
+	srcPath := filepath.Join(dataRoot, "fixme", "website")
+	forkPath := filepath.Join(dataRoot, "~", "alice", "website")
+
+	if err := Create("fixme", "website", "~alice", "website"); err != nil {
+		t.Fatalf("Create() == %v", err)
+	}
+	feature := revParse(t, srcPath, "refs/heads/feature")
+	// The only ref to feature left is the one of the fork
+	if _, err := git.Run(srcPath, nil, "update-ref", "-d", "refs/heads/feature"); err != nil {
+		t.Fatal(err)
+	}
+	// A private commit of the fork
+	workPath := filepath.Join(filepath.Dir(dataRoot), "work")
+	private := commit(t, workPath, "private")
+	if _, err := git.Run(workPath, nil, "push", "--quiet", forkPath, "HEAD:refs/heads/private"); err != nil {
+		t.Fatalf("Cannot push to fork: %v", err)
+	}
+	// Refs of forks fetched into the source by previous versions
+	if _, err := git.Run(srcPath, nil, "update-ref", "refs/forks/u/alice/website/heads/feature", feature); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := git.Run(srcPath, nil, "config", "--add", "transfer.hideRefs", "refs/forks"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Protect("fixme", "website"); err != nil {
+		t.Fatalf("Protect() == %v", err)
+	}
+	// Nothing of the fork is readable from the source, whatever the command
+	if out, _ := git.Run(srcPath, nil, "for-each-ref", "refs/forks"); out != "" {
+		t.Errorf("Refs of forks left in the source:\n%s", out)
+	}
+	if out, _ := git.Run(srcPath, nil, "config", "--get-all", "transfer.hideRefs"); out != "" {
+		t.Errorf("transfer.hideRefs == %q, expected it to be removed", out)
+	}
+	if hasObject(srcPath, private) {
+		t.Errorf("Private commit %s of the fork was copied into the source", private)
+	}
+	for _, treeish := range []string{"refs/forks/u/alice/website/heads/feature", "forks/u/alice/website/heads/private", private} {
+		if _, err := git.Run(workPath, nil, "archive", "--remote="+srcPath, treeish); err == nil {
+			t.Errorf("Archive of %s from the source succeeded, expected it to fail", treeish)
+		}
+	}
+	if advertised, err := git.Run("", nil, "ls-remote", srcPath); err != nil || strings.Contains(advertised, "forks") {
+		t.Errorf("Advertised refs of source == %q, %v", advertised, err)
+	}
+	// Protecting twice is harmless
+	if err := Protect("fixme", "website"); err != nil {
+		t.Fatalf("Protect() == %v", err)
+	}
+
+	// Objects of the fork survive the garbage collection of the source
+	if _, err := git.Run(srcPath, nil, "gc", "--quiet", "--prune=now"); err != nil {
+		t.Fatalf("Cannot gc source: %v", err)
+	}
+	if hasObject(srcPath, feature) {
+		t.Fatalf("Commit %s is still in the source, the test doesn't test anything", feature)
+	}
+	if !hasObject(forkPath, feature) || !hasObject(forkPath, private) {
+		t.Errorf("Commits of the fork were pruned from the source")
+	}
+	if _, err := git.Run(forkPath, nil, "fsck", "--connectivity-only"); err != nil {
+		t.Errorf("Fork is broken after gc of the source: %v", err)
+	}
+}
+
+func TestDeleteRepo(t *testing.T) {
+	dataRoot, teardown := setup(t)
+	defer teardown()
+	srcPath := filepath.Join(dataRoot, "fixme", "website")
+	forkPath := filepath.Join(dataRoot, "~", "alice", "website")
+
+	if err := Create("fixme", "website", "~alice", "website"); err != nil {
+		t.Fatalf("Create() == %v", err)
+	}
+	master := revParse(t, srcPath, "refs/heads/master")
+
+	if err := DeleteRepo("fixme", "website"); err != nil {
+		t.Fatalf("DeleteRepo() == %v", err)
+	}
+	if _, err := os.Stat(srcPath); !os.IsNotExist(err) {
+		t.Errorf("Source still exists after DeleteRepo(): %v", err)
+	}
+	// The fork owns a copy of every object it borrowed
+	if _, err := os.Stat(filepath.Join(forkPath, "objects", "info", "alternates")); !os.IsNotExist(err) {
+		t.Errorf("Fork still has alternates after DeleteRepo(): %v", err)
+	}
+	if !hasObject(forkPath, master) {
+		t.Errorf("Commit %s is missing from the fork", master)
+	}
+	if relations, err := List(); err != nil || len(relations) != 0 {
+		t.Errorf("List() == %v, %v, expected no fork", relations, err)
+	}
+
+	if err := DeleteRepo("fixme", "website"); err == nil {
+		t.Errorf("DeleteRepo() == nil for a missing repo")
+	}
+	// Deleting a fork only removes its relationship
+	if err := DeleteRepo("~alice", "website"); err != nil {
+		t.Errorf("DeleteRepo(fork) == %v", err)
+	}
+}
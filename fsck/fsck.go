@@ -0,0 +1,152 @@
+package fsck
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgellow/nanogit/dir"
+	"github.com/dgellow/nanogit/git"
+	"github.com/dgellow/nanogit/log"
+	"github.com/dgellow/nanogit/metrics"
+	"github.com/dgellow/nanogit/store"
+)
+
+// Name of the fsck result file, under the store directory of the data root.
+const storeName = "fsck.yml"
+
+// Result is the outcome of the last check of a repository.
+type Result struct {
+	LastRun  time.Time
+	Duration time.Duration
+	Ok       bool
+	// Problems reported by git fsck
+	Error string
+}
+
+// Results returns the last check of every repo, keyed by org/repo.
+func Results() (map[string]Result, error) {
+	results := map[string]Result{}
+	if err := store.Load(storeName, &results); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// Check runs git fsck on given repository and records the result. Dangling
+// objects are not reported, they are expected until the next gc.
+func Check(org string, repo string) Result {
+	log.Trace("fsck: Check, repo: %s/%s", org, repo)
+	path := dir.RepoPath{Org: org, Repo: repo}
+	result := Result{LastRun: time.Now(), Ok: true}
+	repoPath, err := dir.GetRepoDir(org, repo)
+	if err == nil {
+		_, err = git.Run(repoPath, nil, "fsck", "--full", "--no-dangling", "--no-progress")
+	}
+	result.Duration = time.Since(result.LastRun)
+	if err != nil {
+		result.Ok = false
+		result.Error = strings.TrimSpace(err.Error())
+		log.Error("fsck: %s is corrupt: %s", path, result.Error)
+	}
+
+	results := map[string]Result{}
+	err = store.Update(storeName, &results, func() error {
+		results[path.String()] = result
+		return nil
+	})
+	if err != nil {
+		log.Error("fsck: cannot save result of %s: %v", path, err)
+	}
+	return result
+}
+
+// CheckAll checks every repository under the data root, results of removed
+// repos are dropped.
+func CheckAll() (map[string]Result, error) {
+	log.Trace("fsck: CheckAll")
+	repos, err := dir.ListRepos()
+	if err != nil {
+		return nil, err
+	}
+	results := map[string]Result{}
+	for _, repo := range repos {
+		results[repo.String()] = Check(repo.Org, repo.Repo)
+	}
+	return results, store.Save(storeName, results)
+}
+
+// Scheduler checks every repository at a fixed interval.
+type Scheduler struct {
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// Start checks every repository now, then at the given interval.
+func Start(interval time.Duration) *Scheduler {
+	s := &Scheduler{stop: make(chan struct{})}
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if _, err := CheckAll(); err != nil {
+				log.Error("fsck: %v", err)
+			}
+			select {
+			case <-ticker.C:
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+	return s
+}
+
+// Stop waits for the running check to finish and stops the scheduler.
+func (s *Scheduler) Stop() {
+	close(s.stop)
+	s.wg.Wait()
+}
+
+func collect(value func(r Result) float64) func() []metrics.Sample {
+	return func() []metrics.Sample {
+		results, err := Results()
+		if err != nil {
+			log.Error("fsck: cannot read results: %v", err)
+			return nil
+		}
+		repos := []string{}
+		for repo := range results {
+			repos = append(repos, repo)
+		}
+		sort.Strings(repos)
+		samples := []metrics.Sample{}
+		for _, repo := range repos {
+			samples = append(samples, metrics.Sample{Labels: map[string]string{"repo": repo}, Value: value(results[repo])})
+		}
+		return samples
+	}
+}
+
+func init() {
+	metrics.Register(metrics.Metric{
+		Name: "nanogit_fsck_failed",
+		Help: "Whether the last git fsck of the repository found problems.",
+		Type: "gauge",
+		Collect: collect(func(r Result) float64 {
+			if r.Ok {
+				return 0
+			}
+			return 1
+		}),
+	})
+	metrics.Register(metrics.Metric{
+		Name:    "nanogit_fsck_last_run_timestamp_seconds",
+		Help:    "Time of the last git fsck of the repository.",
+		Type:    "gauge",
+		Collect: collect(func(r Result) float64 { return float64(r.LastRun.Unix()) }),
+	})
+}
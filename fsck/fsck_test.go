@@ -0,0 +1,83 @@
+package fsck
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dgellow/nanogit/config"
+	"github.com/dgellow/nanogit/git"
+	"github.com/dgellow/nanogit/metrics"
+	"github.com/dgellow/nanogit/settings"
+)
+
+func TestCheckAll(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "nanogit-fsck")
+	if err != nil {
+		t.Fatalf("Cannot create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	settings.ConfInfo.Set(config.Config{
+		Server: config.ServerConfig{DataRoot: tmpDir},
+	})
+	defer func() { settings.ConfInfo.Set(config.Config{}) }()
+
+	for _, repo := range []string{"fixme/good", "fixme/corrupt"} {
+		repoPath := filepath.Join(tmpDir, repo)
+		if _, err := git.Run("", nil, "init", "--bare", "--quiet", repoPath); err != nil {
+			t.Fatalf("Cannot init repo: %v", err)
+		}
+		tree, err := git.Run(repoPath, nil, "mktree")
+		if err != nil {
+			t.Fatalf("Cannot create tree: %v", err)
+		}
+		commit, err := git.Run(repoPath, []string{"GIT_AUTHOR_NAME=nanogit", "GIT_AUTHOR_EMAIL=nanogit@localhost",
+			"GIT_COMMITTER_NAME=nanogit", "GIT_COMMITTER_EMAIL=nanogit@localhost"},
+			"commit-tree", "-m", "commit", strings.TrimSpace(tree))
+		if err != nil {
+			t.Fatalf("Cannot create commit: %v", err)
+		}
+		if _, err := git.Run(repoPath, nil, "update-ref", "refs/heads/master", strings.TrimSpace(commit)); err != nil {
+			t.Fatalf("Cannot update master: %v", err)
+		}
+	}
+
+	// Remove the loose empty tree object the commit points to
+	tree := filepath.Join(tmpDir, "fixme", "corrupt", "objects", "4b", "825dc642cb6eb9a060e54bf8d69288fbee4904")
+	if err := os.Remove(tree); err != nil {
+		t.Fatalf("Cannot remove tree object: %v", err)
+	}
+
+	results, err := CheckAll()
+	if err != nil {
+		t.Fatalf("CheckAll() == %v", err)
+	}
+	if r := results["fixme/good"]; !r.Ok || r.Error != "" {
+		t.Errorf("Result of fixme/good == %+v; expected ok", r)
+	}
+	if r := results["fixme/corrupt"]; r.Ok || r.Error == "" {
+		t.Errorf("Result of fixme/corrupt == %+v; expected failure", r)
+	}
+
+	stored, err := Results()
+	if err != nil {
+		t.Fatalf("Results() == %v", err)
+	}
+	if len(stored) != 2 || stored["fixme/corrupt"].Ok {
+		t.Errorf("Results() == %+v", stored)
+	}
+
+	var buf bytes.Buffer
+	if err := metrics.Write(&buf); err != nil {
+		t.Fatalf("metrics.Write() == %v", err)
+	}
+	for _, line := range []string{`nanogit_fsck_failed{repo="fixme/corrupt"} 1`, `nanogit_fsck_failed{repo="fixme/good"} 0`} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Errorf("Metrics don't contain %s:\n%s", line, buf.String())
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package git
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/dgellow/nanogit/log"
+)
+
+// Run executes git with given args in dir, env being added to the current
+// environment. The returned error contains the stderr output of git.
+func Run(dir string, env []string, args ...string) (string, error) {
+	log.Trace("git: Run, dir: %s, args: %v", dir, args)
+	return run(dir, env, nil, args)
+}
+
+// RunInput is like Run, with input given to git on its standard input.
+func RunInput(dir string, env []string, input string, args ...string) (string, error) {
+	log.Trace("git: RunInput, dir: %s, args: %v", dir, args)
+	return run(dir, env, strings.NewReader(input), args)
+}
+
+func run(dir string, env []string, stdin io.Reader, args []string) (string, error) {
+	bufOut := new(bytes.Buffer)
+	bufErr := new(bytes.Buffer)
+
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdin = stdin
+	cmd.Stdout = bufOut
+	cmd.Stderr = bufErr
+
+	if err := cmd.Run(); err != nil {
+		return bufOut.String(), fmt.Errorf("git %s: %v: %s", args[0], err, strings.TrimSpace(bufErr.String()))
+	}
+	return bufOut.String(), nil
+}
+
+// ConfigEnv returns the environment setting the given git config values for
+// a single git command, without exposing them in the command line.
+func ConfigEnv(values map[string]string) []string {
+	env := []string{}
+	i := 0
+	for key, value := range values {
+		env = append(env,
+			fmt.Sprintf("GIT_CONFIG_KEY_%d=%s", i, key),
+			fmt.Sprintf("GIT_CONFIG_VALUE_%d=%s", i, value))
+		i++
+	}
+	return append(env, fmt.Sprintf("GIT_CONFIG_COUNT=%d", i))
+}
+
+// CredentialsEnv returns the environment giving git the credentials used to
+// reach a remote: a private key for SSH remotes or a username and password
+// for HTTP remotes. git never prompts for missing credentials.
+func CredentialsEnv(sshKey string, username string, password string) []string {
+	env := []string{}
+	if sshKey != "" {
+		env = append(env, "GIT_SSH_COMMAND=ssh -i "+ShellQuote(sshKey)+" -o IdentitiesOnly=yes -o BatchMode=yes")
+	}
+	if username != "" || password != "" {
+		basic := base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+		env = append(env, ConfigEnv(map[string]string{
+			"http.extraHeader": "Authorization: Basic " + basic,
+		})...)
+	}
+	return append(env, "GIT_TERMINAL_PROMPT=0")
+}
+
+// ShellQuote single quotes arg for a shell, such as the one running
+// GIT_SSH_COMMAND or a hook
+func ShellQuote(arg string) string {
+	return "'" + strings.Replace(arg, "'", `'\''`, -1) + "'"
+}
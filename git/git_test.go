@@ -0,0 +1,30 @@
+package git
+
+import (
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+// The key of GIT_SSH_COMMAND is a single argument of ssh, whatever it
+// contains
+func TestCredentialsEnv(t *testing.T) {
+	for i, key := range []string{
+		"/etc/nanogit/id_ed25519",
+		"/etc/nanogit/my key",
+		"/tmp/x; touch /tmp/pwned",
+		"/tmp/it's $(id) `id`",
+	} {
+		env := CredentialsEnv(key, "", "")
+		command := strings.TrimPrefix(env[0], "GIT_SSH_COMMAND=")
+		// Replaces ssh by printf, printing each argument on a line
+		out, err := exec.Command("sh", "-c", "printf '%s\\n' "+strings.TrimPrefix(command, "ssh ")).Output()
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		args := strings.Split(strings.TrimSuffix(string(out), "\n"), "\n")
+		if len(args) != 6 || args[0] != "-i" || args[1] != key {
+			t.Errorf("#%d: GIT_SSH_COMMAND %q is run with %q, expected key %q", i, command, args, key)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package hooks
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/dgellow/nanogit/git"
+	"github.com/dgellow/nanogit/log"
+	"github.com/dgellow/nanogit/settings"
+	"github.com/dgellow/nanogit/store"
+)
+
+// Environment variable giving the pushed repo to the pre-receive hook
+const RepoEnv = "NANOGIT_REPO"
+
+// Hooks git-receive-pack runs besides pre-receive, installed to run the
+// ones of the repo
+var chainedHooks = []string{"update", "post-receive", "post-update", "reference-transaction", "push-to-checkout"}
+
+// Install writes the hooks enforcing quotas and deny rules and returns
+// their directory. Receive-pack is pointed at it with core.hooksPath for
+// repos with a quota or ref rules, which replaces the hooks of the repo:
+// every installed hook runs the hook of the same name of the repo, the
+// pre-receive hook once the push is accepted by nanogit.
+func Install() (string, error) {
+	log.Trace("hooks: Install")
+	configFile, err := filepath.Abs(settings.ConfInfo.ConfigFile)
+	if err != nil {
+		return "", err
+	}
+	hooksDir, err := store.Path("hooks")
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(hooksDir, 0700); err != nil {
+		return "", err
+	}
+	// Hooks run in the repo, with GIT_DIR set
+	script := fmt.Sprintf(`#!/bin/sh
+input=$(cat)
+printf '%%s\n' "$input" | %s hook --config %s pre-receive || exit 1
+hook="${GIT_DIR:-.}/hooks/pre-receive"
+if [ -x "$hook" ]; then
+	printf '%%s\n' "$input" | "$hook" "$@"
+fi
+`, git.ShellQuote(settings.ExecPath), git.ShellQuote(configFile))
+	if err := store.WriteFile(filepath.Join(hooksDir, "pre-receive"), []byte(script), 0700); err != nil {
+		return "", err
+	}
+	for _, name := range chainedHooks {
+		script := fmt.Sprintf(`#!/bin/sh
+hook="${GIT_DIR:-.}/hooks/%s"
+if [ -x "$hook" ]; then
+	exec "$hook" "$@"
+fi
+`, name)
+		if err := store.WriteFile(filepath.Join(hooksDir, name), []byte(script), 0700); err != nil {
+			return "", err
+		}
+	}
+	return hooksDir, nil
+}
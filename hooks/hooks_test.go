@@ -0,0 +1,83 @@
+package hooks
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dgellow/nanogit/config"
+	"github.com/dgellow/nanogit/git"
+	"github.com/dgellow/nanogit/settings"
+)
+
+// The installed hooks run the hooks of the repo, the pre-receive one only
+// when nanogit accepts the push
+func TestInstall(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "nanogit-hooks")
+	if err != nil {
+		t.Fatalf("Cannot create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	settings.ConfInfo.Set(config.Config{Server: config.ServerConfig{DataRoot: filepath.Join(tmpDir, "dataroot")}})
+	defer func() { settings.ConfInfo.Set(config.Config{}) }()
+	defer func(execPath string) { settings.ExecPath = execPath }(settings.ExecPath)
+
+	repoPath := filepath.Join(tmpDir, "repo")
+	workPath := filepath.Join(tmpDir, "work")
+	if _, err := git.Run("", nil, "init", "--bare", "--quiet", repoPath); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := git.Run("", nil, "init", "--quiet", workPath); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := git.Run(workPath, nil, "-c", "user.name=nanogit", "-c", "user.email=nanogit@localhost",
+		"commit", "--allow-empty", "--quiet", "-m", "first"); err != nil {
+		t.Fatal(err)
+	}
+	// Hooks of the repo log their name and input
+	logPath := filepath.Join(tmpDir, "hooks.log")
+	for _, name := range []string{"pre-receive", "update", "post-receive"} {
+		script := "#!/bin/sh\necho " + name + " \"$@\" >> " + logPath + "\ncat >> " + logPath + "\n"
+		if err := ioutil.WriteFile(filepath.Join(repoPath, "hooks", name), []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i, test := range []struct {
+		// Stands in for nanogit, accepting or rejecting the push
+		execPath string
+		pushed   bool
+		hooks    []string
+	}{
+		{"false", false, nil},
+		{"true", true, []string{"pre-receive", "update refs/heads/master", "post-receive"}},
+	} {
+		settings.ExecPath = test.execPath
+		hooksDir, err := Install()
+		if err != nil {
+			t.Fatalf("#%d: Install() == %v", i, err)
+		}
+		os.Remove(logPath)
+		_, err = git.Run(workPath, nil, "push", "--quiet", "--receive-pack=git -c core.hooksPath="+hooksDir+" receive-pack",
+			repoPath, "HEAD:refs/heads/master")
+		if (err == nil) != test.pushed {
+			t.Errorf("#%d: push == %v, expected pushed %v", i, err, test.pushed)
+		}
+		data, _ := ioutil.ReadFile(logPath)
+		logged := string(data)
+		for _, hook := range test.hooks {
+			if !strings.Contains(logged, hook) {
+				t.Errorf("#%d: hook %q of the repo wasn't run:\n%s", i, hook, logged)
+			}
+		}
+		if test.hooks == nil && logged != "" {
+			t.Errorf("#%d: hooks of the repo were run for a rejected push:\n%s", i, logged)
+		}
+		// pre-receive and post-receive are given the updated refs
+		if test.pushed && strings.Count(logged, " refs/heads/master\n") != 2 {
+			t.Errorf("#%d: hooks of the repo weren't given the updated refs:\n%s", i, logged)
+		}
+	}
+}
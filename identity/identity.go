@@ -0,0 +1,84 @@
+// Package identity resolves users, orgs, teams and memberships, from the
+// config file or from an LDAP directory depending on the identity backend
+// of the server.
+package identity
+
+import (
+	"reflect"
+	"sync"
+
+	"github.com/dgellow/nanogit/config"
+	"github.com/dgellow/nanogit/settings"
+)
+
+// Store is a source of users and of the orgs they are members of.
+type Store interface {
+	// UserByKey returns the user owning the given public key, in
+	// authorized_keys format without comment.
+	UserByKey(key string) (config.UserConfig, error)
+	UserByName(name string) (config.UserConfig, error)
+	Users() ([]config.UserConfig, error)
+	// Org returns the org with the given path, with the teams inherited
+	// from its parents.
+	Org(path string) (config.OrgConfig, error)
+	Teams(orgPath string) ([]config.TeamConfig, error)
+	// Memberships returns the orgs the user is a member of, with the
+	// user's teams in each of them.
+	Memberships(user string) ([]config.UserOrgConfig, error)
+}
+
+var (
+	mutex   sync.Mutex
+	current *ldapStore
+)
+
+// Get returns the store of the identity backend of the running config. The
+// LDAP store and its cache are kept as long as its config doesn't change.
+func Get() Store {
+	ic := settings.ConfInfo.Get().Server.Identity
+	local := NewYAML(&settings.ConfInfo)
+	if ic.Backend != "ldap" {
+		return local
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if current == nil || !reflect.DeepEqual(current.conf, ic.LDAP) {
+		current = newLDAPStore(ic.LDAP, local)
+	}
+	return current
+}
+
+// NewYAML returns the store reading users and orgs from the given config.
+func NewYAML(ci *config.ConfigInfo) Store {
+	return yamlStore{ci}
+}
+
+type yamlStore struct {
+	ci *config.ConfigInfo
+}
+
+func (s yamlStore) UserByKey(key string) (config.UserConfig, error) {
+	return s.ci.LookupUserByKey(key)
+}
+
+func (s yamlStore) UserByName(name string) (config.UserConfig, error) {
+	return s.ci.LookupUserByName(name)
+}
+
+func (s yamlStore) Users() ([]config.UserConfig, error) {
+	return s.ci.Get().Users, nil
+}
+
+func (s yamlStore) Org(path string) (config.OrgConfig, error) {
+	return s.ci.LookupOrgById(path)
+}
+
+func (s yamlStore) Teams(orgPath string) ([]config.TeamConfig, error) {
+	org, err := s.ci.LookupOrgById(orgPath)
+	return org.Teams, err
+}
+
+func (s yamlStore) Memberships(user string) ([]config.UserOrgConfig, error) {
+	userConfig, err := s.ci.LookupUserByName(user)
+	return userConfig.Orgs, err
+}
@@ -0,0 +1,408 @@
+package identity
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dgellow/nanogit/config"
+	"github.com/dgellow/nanogit/ldap"
+	"github.com/dgellow/nanogit/settings"
+)
+
+const (
+	aliceKey  = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIJy3dGq8YXe/SMhgWlBZTYSoWsaBS7XE7OXFa5AusxMK"
+	ciKey     = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIHXkXo1D6v9n8d0e1Fh5vB5FQ0lW8F3h5k0ZGkZQ8Q1x"
+	daveKey   = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAINXaikuGMLEDkCJmxsFqkAtxfwtjyJ3zyvXGIeKIu6iw"
+	sharedKey = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIPE2+mf52OisyrMiHMqxLdvPYuH5UAmT3aBqPj8R5Kz9"
+	deployKey = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIAxtK9KrJllWeQEiUGIhilsvqbtCuEoK0bctb4W1Ebi3"
+)
+
+// fakeDirectory replaces the LDAP server, it serves simple binds and
+// searches filtered by a single (attribute=value) or (attribute=*).
+type fakeDirectory struct {
+	bindDN   string
+	password string
+
+	mutex    sync.Mutex
+	entries  []ldap.Entry
+	dials    int
+	searches int
+	down     bool
+	// Connections wait until it is closed, if not nil
+	block chan struct{}
+}
+
+func newFakeDirectory(bindDN string, password string, entries []ldap.Entry) *fakeDirectory {
+	return &fakeDirectory{bindDN: bindDN, password: password, entries: entries}
+}
+
+func (d *fakeDirectory) dial(url string) (conn, error) {
+	d.mutex.Lock()
+	d.dials++
+	down, block := d.down, d.block
+	d.mutex.Unlock()
+	if block != nil {
+		<-block
+	}
+	if down {
+		return nil, fmt.Errorf("dial tcp: connection refused")
+	}
+	return &fakeConn{d: d}, nil
+}
+
+func (d *fakeDirectory) dialCount() int {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.dials
+}
+
+func (d *fakeDirectory) setEntries(entries []ldap.Entry) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.entries = entries
+}
+
+func (d *fakeDirectory) setDown(down bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.down = down
+}
+
+func (d *fakeDirectory) searchCount() int {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.searches
+}
+
+type fakeConn struct {
+	d     *fakeDirectory
+	bound bool
+}
+
+func (c *fakeConn) Bind(dn string, password string) error {
+	if !ldap.EqualDN(dn, c.d.bindDN) || password != c.d.password {
+		return &ldap.Error{Code: ldap.ResultInvalidCredentials}
+	}
+	c.bound = true
+	return nil
+}
+
+func (c *fakeConn) Search(base string, filter string, attrs []string) ([]ldap.Entry, error) {
+	if !c.bound {
+		return nil, &ldap.Error{Code: ldap.ResultInsufficientAccessRights}
+	}
+	parts := strings.SplitN(strings.Trim(filter, "()"), "=", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("Unsupported filter %s", filter)
+	}
+	c.d.mutex.Lock()
+	defer c.d.mutex.Unlock()
+	c.d.searches++
+	found := []ldap.Entry{}
+	for _, entry := range c.d.entries {
+		if !ldap.IsDescendant(entry.DN, base) {
+			continue
+		}
+		for _, value := range entry.Get(parts[0]) {
+			if parts[1] == "*" || strings.EqualFold(value, parts[1]) {
+				found = append(found, entry)
+				break
+			}
+		}
+	}
+	return found, nil
+}
+
+func (c *fakeConn) Close() error {
+	return nil
+}
+
+// Returns an entry with the given DN and attributes, given as name, value
+// pairs. The RDN is an attribute of the entry too.
+func newEntry(dn string, attrs ...string) ldap.Entry {
+	e := ldap.Entry{DN: dn, Attributes: map[string][]string{}}
+	for i := 0; i+1 < len(attrs); i += 2 {
+		e.Attributes[attrs[i]] = append(e.Attributes[attrs[i]], attrs[i+1])
+	}
+	if rdn := strings.SplitN(strings.SplitN(dn, ",", 2)[0], "=", 2); len(rdn) == 2 && len(e.Get(rdn[0])) == 0 {
+		e.Attributes[rdn[0]] = []string{rdn[1]}
+	}
+	return e
+}
+
+func directoryEntries() []ldap.Entry {
+	return []ldap.Entry{
+		newEntry("uid=alice,ou=people,dc=example,dc=org", "objectClass", "posixAccount", "sshPublicKey", aliceKey+" alice@laptop", "sshPublicKey", "not a key"),
+		newEntry("uid=bob,ou=people,dc=example,dc=org", "objectClass", "posixAccount"),
+		newEntry("uid=Carol Smith,ou=people,dc=example,dc=org", "objectClass", "posixAccount"),
+		newEntry("cn=nanogit,ou=services,dc=example,dc=org", "objectClass", "account"),
+		newEntry("cn=dev,ou=groups,dc=example,dc=org", "objectClass", "groupOfNames", "member", "uid=alice, ou=people, dc=example, dc=org", "member", "bob"),
+		newEntry("cn=ops,ou=groups,dc=example,dc=org", "objectClass", "groupOfNames", "member", "UID=alice,ou=people,dc=example,dc=org"),
+	}
+}
+
+func TestLDAP(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "nanogit-identity")
+	if err != nil {
+		t.Fatalf("Cannot create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	server := newFakeDirectory("cn=nanogit,ou=services,dc=example,dc=org", "secret", directoryEntries())
+	defer func(previous func(string) (conn, error)) { dial = previous }(dial)
+	dial = server.dial
+	// Get keeps the store while the config doesn't change
+	defer func() { current = nil }()
+
+	ldapConfig := config.LDAPConfig{
+		Url:          "ldap://ldap.example.org",
+		BindDn:       "cn=nanogit,ou=services,dc=example,dc=org",
+		BindPassword: "secret",
+		UserBase:     "ou=people,dc=example,dc=org",
+		Groups: []config.LDAPGroupConfig{
+			{Dn: "cn=dev,ou=groups,dc=example,dc=org", Org: "fixme", Teams: []string{"dev"}},
+			{Dn: "cn=ops,ou=groups,dc=example,dc=org", Org: "fixme", Teams: []string{"ops"}},
+			{Dn: "cn=missing,ou=groups,dc=example,dc=org", Org: "fixme", Teams: []string{"dev"}},
+		},
+		CacheTTL: time.Hour,
+	}
+	settings.ConfInfo.Set(config.Config{
+		Server: config.ServerConfig{
+			DataRoot: tmpDir,
+			Identity: config.IdentityConfig{Backend: "ldap", LDAP: ldapConfig},
+		},
+		Orgs: []config.OrgConfig{
+			{Id: "fixme", Teams: []config.TeamConfig{{Name: "dev", Read: true}, {Name: "ops", Read: true, Write: true}}},
+		},
+		Users: []config.UserConfig{{Name: "ci", SSHKeys: []config.PubKeyConfig{{Type: "hardcoded", Val: ciKey}}}},
+	})
+	defer func() { settings.ConfInfo.Set(config.Config{}) }()
+
+	store := Get()
+	if store != Get() {
+		t.Errorf("Get() should return the same store while the config doesn't change")
+	}
+
+	tests := []struct {
+		name  string
+		fn    func() (config.UserConfig, error)
+		user  string
+		orgs  []config.UserOrgConfig
+		found bool
+	}{
+		{"UserByKey(alice)", func() (config.UserConfig, error) { return store.UserByKey(aliceKey) }, "alice", []config.UserOrgConfig{{Id: "fixme", Teams: []string{"dev", "ops"}}}, true},
+		{"UserByName(ALICE)", func() (config.UserConfig, error) { return store.UserByName("ALICE") }, "alice", []config.UserOrgConfig{{Id: "fixme", Teams: []string{"dev", "ops"}}}, true},
+		{"UserByName(bob)", func() (config.UserConfig, error) { return store.UserByName("bob") }, "bob", []config.UserOrgConfig{{Id: "fixme", Teams: []string{"dev"}}}, true},
+		{"UserByName(carol smith)", func() (config.UserConfig, error) { return store.UserByName("carol smith") }, "", nil, false},
+		{"UserByName(nanogit)", func() (config.UserConfig, error) { return store.UserByName("nanogit") }, "", nil, false},
+		{"UserByKey(ci)", func() (config.UserConfig, error) { return store.UserByKey(ciKey) }, "ci", nil, true},
+		{"UserByKey(comment)", func() (config.UserConfig, error) { return store.UserByKey(aliceKey + " alice@laptop") }, "alice", []config.UserOrgConfig{{Id: "fixme", Teams: []string{"dev", "ops"}}}, true},
+	}
+	for i, test := range tests {
+		user, err := test.fn()
+		if (err == nil) != test.found || user.Name != test.user || !reflect.DeepEqual(user.Orgs, test.orgs) {
+			t.Errorf("#%d: %s == %+v, %v, expected %s in %+v", i, test.name, user, err, test.user, test.orgs)
+		}
+	}
+	if alice, _ := store.UserByName("alice"); len(alice.SSHKeys) != 1 || alice.SSHKeys[0].Val != aliceKey {
+		t.Errorf("Keys of alice == %+v, expected only %s without comment", alice.SSHKeys, aliceKey)
+	}
+	users, err := store.Users()
+	if err != nil || len(users) != 3 {
+		t.Errorf("Users() == %+v, %v, expected alice, bob and ci", users, err)
+	}
+	if teams, err := store.Teams("fixme"); err != nil || len(teams) != 2 {
+		t.Errorf("Teams(fixme) == %+v, %v", teams, err)
+	}
+	if memberships, err := store.Memberships("bob"); err != nil || len(memberships) != 1 || memberships[0].Id != "fixme" {
+		t.Errorf("Memberships(bob) == %+v, %v", memberships, err)
+	}
+
+	// The directory is searched once per TTL: the users, then each group
+	searches := server.searchCount()
+	if searches != 4 {
+		t.Errorf("LDAP searches == %d, expected 4", searches)
+	}
+	// Other processes share the cache saved in the store
+	if _, err := newLDAPStore(ldapConfig, NewYAML(&settings.ConfInfo)).UserByName("alice"); err != nil || server.searchCount() != searches {
+		t.Errorf("A new store should use the saved cache, %d searches, %v", server.searchCount()-searches, err)
+	}
+
+	// Changes of the directory are seen once the cache expires
+	server.setEntries(directoryEntries()[1:])
+	ldapConfig.CacheTTL = time.Nanosecond
+	expired := newLDAPStore(ldapConfig, NewYAML(&settings.ConfInfo))
+	if _, err := expired.UserByName("alice"); err == nil {
+		t.Errorf("Users removed from the directory should be unknown once the cache expires")
+	}
+	if _, err := expired.UserByName("bob"); err != nil {
+		t.Errorf("UserByName(bob) == %v", err)
+	}
+
+	// The last users read are used while the directory is down, and it is
+	// not read again before retryDelay
+	server.setDown(true)
+	dials := server.dialCount()
+	if _, err := expired.UserByName("bob"); err != nil {
+		t.Errorf("UserByName(bob) with the directory down == %v, expected the last users read", err)
+	}
+	if users, err := expired.Users(); err != nil || len(users) != 2 {
+		t.Errorf("Users() with the directory down == %+v, %v, expected bob and ci", users, err)
+	}
+	if server.dialCount() != dials+1 {
+		t.Errorf("Directory dialed %d times after a failure, expected once", server.dialCount()-dials)
+	}
+
+	// Without users read before, only users of the config file are known
+	ldapConfig.UserBase = "ou=staff,dc=example,dc=org"
+	unread := newLDAPStore(ldapConfig, NewYAML(&settings.ConfInfo))
+	if _, err := unread.UserByName("bob"); err == nil {
+		t.Errorf("Users of the directory should be unknown when it was never read")
+	}
+	if _, err := unread.UserByKey(ciKey); err != nil {
+		t.Errorf("UserByKey(ci) with the directory down == %v", err)
+	}
+	if _, err := unread.Users(); err == nil {
+		t.Errorf("Users() with the directory never read should fail")
+	}
+
+	// The default backend is the config file
+	settings.ConfInfo.Conf.Server.Identity = config.IdentityConfig{}
+	if _, ok := Get().(yamlStore); !ok {
+		t.Errorf("Get() == %T, expected the YAML store", Get())
+	}
+}
+
+// Lookups don't wait for the directory while it is read again, they get the
+// last users read
+func TestLDAPSlowDirectory(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "nanogit-identity")
+	if err != nil {
+		t.Fatalf("Cannot create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	server := newFakeDirectory("cn=nanogit,ou=services,dc=example,dc=org", "secret", directoryEntries())
+	defer func(previous func(string) (conn, error)) { dial = previous }(dial)
+	dial = server.dial
+	settings.ConfInfo.Set(config.Config{Server: config.ServerConfig{DataRoot: tmpDir}})
+	defer func() { settings.ConfInfo.Set(config.Config{}) }()
+
+	store := newLDAPStore(config.LDAPConfig{
+		Url:          "ldap://ldap.example.org",
+		BindDn:       "cn=nanogit,ou=services,dc=example,dc=org",
+		BindPassword: "secret",
+		UserBase:     "ou=people,dc=example,dc=org",
+		CacheTTL:     time.Nanosecond,
+	}, NewYAML(&settings.ConfInfo))
+	if _, err := store.UserByName("bob"); err != nil {
+		t.Fatalf("UserByName(bob) == %v", err)
+	}
+
+	block := make(chan struct{})
+	server.mutex.Lock()
+	server.block = block
+	server.mutex.Unlock()
+	dials := server.dialCount()
+	done := make(chan error)
+	go func() {
+		_, err := store.UserByName("alice")
+		done <- err
+	}()
+	for server.dialCount() == dials {
+		time.Sleep(time.Millisecond)
+	}
+
+	found := make(chan error)
+	go func() {
+		_, err := store.UserByName("bob")
+		found <- err
+	}()
+	select {
+	case err := <-found:
+		if err != nil {
+			t.Errorf("UserByName(bob) while the directory is read == %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("UserByName(bob) waits for the directory being read")
+	}
+	close(block)
+	if err := <-done; err != nil {
+		t.Errorf("UserByName(alice) == %v", err)
+	}
+	if server.dialCount() != dials+1 {
+		t.Errorf("Directory dialed %d times, expected once", server.dialCount()-dials)
+	}
+}
+
+// Users of the config file win over directory users of the same name, and
+// keys of several users or used as deploy keys are refused
+func TestLDAPDuplicates(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "nanogit-identity")
+	if err != nil {
+		t.Fatalf("Cannot create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	server := newFakeDirectory("cn=nanogit,ou=services,dc=example,dc=org", "secret", []ldap.Entry{
+		newEntry("uid=CI,ou=people,dc=example,dc=org", "objectClass", "posixAccount", "sshPublicKey", daveKey),
+		newEntry("uid=eve,ou=people,dc=example,dc=org", "objectClass", "posixAccount", "sshPublicKey", sharedKey),
+		newEntry("uid=frank,ou=people,dc=example,dc=org", "objectClass", "posixAccount", "sshPublicKey", sharedKey),
+		newEntry("uid=gina,ou=people,dc=example,dc=org", "objectClass", "posixAccount", "sshPublicKey", ciKey),
+		newEntry("uid=hank,ou=people,dc=example,dc=org", "objectClass", "posixAccount", "sshPublicKey", deployKey, "sshPublicKey", aliceKey),
+		newEntry("cn=dev,ou=groups,dc=example,dc=org", "objectClass", "groupOfNames", "member", "uid=CI,ou=people,dc=example,dc=org"),
+	})
+	defer func(previous func(string) (conn, error)) { dial = previous }(dial)
+	dial = server.dial
+	settings.ConfInfo.Set(config.Config{
+		Server: config.ServerConfig{DataRoot: tmpDir},
+		Orgs: []config.OrgConfig{{
+			Id:    "fixme",
+			Teams: []config.TeamConfig{{Name: "dev", Read: true}},
+			Repos: []config.RepoConfig{{Name: "website", DeployKeys: []config.DeployKeyConfig{{Name: "ci", Key: deployKey}}}},
+		}},
+		Users: []config.UserConfig{{Name: "ci", SSHKeys: []config.PubKeyConfig{{Type: "hardcoded", Val: ciKey}}}},
+	})
+	defer func() { settings.ConfInfo.Set(config.Config{}) }()
+	store := newLDAPStore(config.LDAPConfig{
+		Url:          "ldap://ldap.example.org",
+		BindDn:       "cn=nanogit,ou=services,dc=example,dc=org",
+		BindPassword: "secret",
+		UserBase:     "ou=people,dc=example,dc=org",
+		Groups:       []config.LDAPGroupConfig{{Dn: "cn=dev,ou=groups,dc=example,dc=org", Org: "fixme", Teams: []string{"dev"}}},
+	}, NewYAML(&settings.ConfInfo))
+
+	if ci, err := store.UserByName("ci"); err != nil || len(ci.Orgs) != 0 || len(ci.SSHKeys) != 1 || ci.SSHKeys[0].Val != ciKey {
+		t.Errorf("UserByName(ci) == %+v, %v, expected the user of the config file", ci, err)
+	}
+	tests := []struct {
+		key  string
+		user string
+	}{
+		// Key of the directory user shadowed by ci
+		{daveKey, ""},
+		{sharedKey, ""},
+		// Key of ci and of gina
+		{ciKey, ""},
+		{deployKey, ""},
+		{aliceKey, "hank"},
+	}
+	for i, test := range tests {
+		user, err := store.UserByKey(test.key)
+		if (err == nil) != (test.user != "") || user.Name != test.user {
+			t.Errorf("#%d: UserByKey(%s) == %+v, %v, expected %q", i, test.key, user, err, test.user)
+		}
+	}
+	users, err := store.Users()
+	names := []string{}
+	for _, user := range users {
+		names = append(names, user.Name)
+	}
+	if expected := []string{"ci", "eve", "frank", "gina", "hank"}; err != nil || !reflect.DeepEqual(names, expected) {
+		t.Errorf("Users() == %v, %v, expected %v", names, err, expected)
+	}
+}
@@ -0,0 +1,369 @@
+package identity
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/yaml.v2"
+
+	"github.com/dgellow/nanogit/config"
+	"github.com/dgellow/nanogit/ldap"
+	"github.com/dgellow/nanogit/log"
+	"github.com/dgellow/nanogit/settings"
+	"github.com/dgellow/nanogit/store"
+)
+
+const (
+	defaultUserFilter = "(objectClass=posixAccount)"
+	defaultNameAttr   = "uid"
+	defaultKeyAttr    = "sshPublicKey"
+	defaultMemberAttr = "member"
+	defaultCacheTTL   = 5 * time.Minute
+	// Delay before reading the directory again after a failure
+	retryDelay = 30 * time.Second
+)
+
+// Name of the cache file, under the store directory of the data root.
+// Commands run over SSH are separate processes, they share the directory
+// loaded by one of them through this file.
+const cacheName = "ldap.yml"
+
+// conn is a connection to the directory, an *ldap.Conn outside of tests.
+type conn interface {
+	Bind(dn string, password string) error
+	Search(base string, filter string, attrs []string) ([]ldap.Entry, error)
+	Close() error
+}
+
+// dial connects to the directory at the given URL.
+var dial = func(url string) (conn, error) {
+	c, err := ldap.Dial(url)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Users read from the directory
+type directory struct {
+	// Hash of the config the directory was loaded with
+	Key    string
+	Loaded time.Time
+	Users  []config.UserConfig
+}
+
+// ldapStore reads users from the directory, orgs and teams from the config
+// file. Users of the config file are still known, e.g. for local service
+// accounts, and directory users of the same name are ignored. Keys owned by
+// several users or used as deploy keys authenticate none of them, as
+// Validate rejects them in the config file.
+type ldapStore struct {
+	conf  config.LDAPConfig
+	key   string
+	local Store
+
+	mutex sync.Mutex
+	// Last users read, still used once expired while the directory cannot
+	// be read
+	dir directory
+	// Users of dir by the fingerprints of their keys, without the keys of
+	// several users
+	byKey map[string]config.UserConfig
+	// Closed once the directory being read is loaded, nil when it isn't
+	loading chan struct{}
+	// Last failure to read the directory, and when it happened
+	failure error
+	failed  time.Time
+}
+
+func newLDAPStore(conf config.LDAPConfig, local Store) *ldapStore {
+	data, _ := yaml.Marshal(conf)
+	sum := sha256.Sum256(data)
+	return &ldapStore{conf: conf, key: hex.EncodeToString(sum[:]), local: local}
+}
+
+func orDefault(value string, def string) string {
+	if value == "" {
+		return def
+	}
+	return value
+}
+
+func (s *ldapStore) ttl() time.Duration {
+	if s.conf.CacheTTL == 0 {
+		return defaultCacheTTL
+	}
+	return s.conf.CacheTTL
+}
+
+func (s *ldapStore) fresh(dir directory) bool {
+	age := time.Since(dir.Loaded)
+	return dir.Key == s.key && age >= 0 && age < s.ttl()
+}
+
+// Returns the users of the directory, indexed by key, loaded from the
+// cache if it is recent enough. The directory is read without holding the
+// mutex: meanwhile, and for retryDelay after a failure, the last users read
+// are returned.
+func (s *ldapStore) users() ([]config.UserConfig, map[string]config.UserConfig, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for !s.fresh(s.dir) {
+		if s.loading != nil {
+			if s.dir.Key == s.key {
+				return s.dir.Users, s.byKey, nil
+			}
+			loading := s.loading
+			s.mutex.Unlock()
+			<-loading
+			s.mutex.Lock()
+			continue
+		}
+		cached := directory{}
+		if err := store.Load(cacheName, &cached); err != nil {
+			log.Error("identity: cannot load LDAP cache: %v", err)
+		} else if cached.Key == s.key && cached.Loaded.After(s.dir.Loaded) {
+			s.setDirectory(cached)
+			continue
+		}
+		if time.Since(s.failed) < retryDelay {
+			return s.stale()
+		}
+
+		loading := make(chan struct{})
+		s.loading = loading
+		s.mutex.Unlock()
+		users, err := s.load()
+		s.mutex.Lock()
+		s.loading = nil
+		close(loading)
+		if err != nil {
+			s.failure, s.failed = fmt.Errorf("Cannot read users from %s: %v", s.conf.Url, err), time.Now()
+			return s.stale()
+		}
+		s.failure, s.failed = nil, time.Time{}
+		s.setDirectory(directory{Key: s.key, Loaded: time.Now().UTC(), Users: users})
+		if err := store.Save(cacheName, s.dir); err != nil {
+			log.Error("identity: cannot save LDAP cache: %v", err)
+		}
+		break
+	}
+	return s.dir.Users, s.byKey, nil
+}
+
+// Returns the last users read from the directory, or the last failure to
+// read it when there are none
+func (s *ldapStore) stale() ([]config.UserConfig, map[string]config.UserConfig, error) {
+	if s.dir.Key != s.key {
+		return nil, nil, s.failure
+	}
+	log.Error("identity: %v, using the users read at %s", s.failure, s.dir.Loaded.Format(time.RFC3339))
+	return s.dir.Users, s.byKey, nil
+}
+
+func (s *ldapStore) setDirectory(dir directory) {
+	s.dir = dir
+	s.byKey = map[string]config.UserConfig{}
+	duplicates := map[string]bool{}
+	for _, user := range dir.Users {
+		for _, key := range user.SSHKeys {
+			fingerprint, err := config.Fingerprint(key.Val)
+			if err != nil {
+				continue
+			}
+			if other, ok := s.byKey[fingerprint]; ok && !strings.EqualFold(other.Name, user.Name) {
+				log.Error("identity: ignoring duplicate SSH key %s of LDAP users %s and %s", fingerprint, other.Name, user.Name)
+				duplicates[fingerprint] = true
+			}
+			s.byKey[fingerprint] = user
+		}
+	}
+	for fingerprint := range duplicates {
+		delete(s.byKey, fingerprint)
+	}
+}
+
+// Returns whether a user of the config file has the name of the given
+// directory user, which is then ignored
+func (s *ldapStore) shadowed(user config.UserConfig) bool {
+	local, err := s.local.UserByName(user.Name)
+	if err != nil {
+		return false
+	}
+	log.Error("identity: ignoring LDAP user %s, user %s of the config file has the same name", user.Name, local.Name)
+	return true
+}
+
+// Reads users and the members of groups from the directory
+func (s *ldapStore) load() ([]config.UserConfig, error) {
+	log.Trace("identity: load, url: %s", s.conf.Url)
+	conn, err := dial(s.conf.Url)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if s.conf.BindDn != "" {
+		if err := conn.Bind(s.conf.BindDn, s.conf.BindPassword); err != nil {
+			return nil, err
+		}
+	}
+
+	nameAttr := orDefault(s.conf.NameAttr, defaultNameAttr)
+	keyAttr := orDefault(s.conf.KeyAttr, defaultKeyAttr)
+	entries, err := conn.Search(s.conf.UserBase, orDefault(s.conf.UserFilter, defaultUserFilter), []string{nameAttr, keyAttr})
+	if err != nil {
+		return nil, err
+	}
+	users := []config.UserConfig{}
+	byDN := map[string]int{}
+	byName := map[string]int{}
+	for _, entry := range entries {
+		names := entry.Get(nameAttr)
+		if len(names) == 0 {
+			continue
+		}
+		name := names[0]
+		if err := config.ValidateName(strings.ToLower(name)); err != nil {
+			log.Error("identity: ignoring LDAP user %s: %v", entry.DN, err)
+			continue
+		}
+		if _, ok := byName[strings.ToLower(name)]; ok {
+			log.Error("identity: ignoring LDAP user %s: duplicate name %s", entry.DN, name)
+			continue
+		}
+		user := config.UserConfig{Name: name}
+		for _, value := range entry.Get(keyAttr) {
+			pubKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(value))
+			if err != nil {
+				log.Error("identity: ignoring key of LDAP user %s: %v", name, err)
+				continue
+			}
+			user.SSHKeys = append(user.SSHKeys, config.PubKeyConfig{
+				Type: "ldap",
+				Val:  strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pubKey))),
+			})
+		}
+		byDN[ldap.NormalizeDN(entry.DN)] = len(users)
+		byName[strings.ToLower(name)] = len(users)
+		users = append(users, user)
+	}
+
+	memberAttr := orDefault(s.conf.MemberAttr, defaultMemberAttr)
+	for _, group := range s.conf.Groups {
+		entries, err := conn.Search(group.Dn, "(objectClass=*)", []string{memberAttr})
+		if e, ok := err.(*ldap.Error); ok && e.Code == ldap.ResultNoSuchObject {
+			log.Error("identity: cannot find LDAP group %s", group.Dn)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if !ldap.EqualDN(entry.DN, group.Dn) {
+				continue
+			}
+			// Members are given by DN, or by name for posixGroup's memberUid
+			for _, member := range entry.Get(memberAttr) {
+				i, ok := byDN[ldap.NormalizeDN(member)]
+				if !ok {
+					i, ok = byName[strings.ToLower(member)]
+				}
+				if ok {
+					users[i].Orgs = addMembership(users[i].Orgs, group.Org, group.Teams)
+				}
+			}
+		}
+	}
+	return users, nil
+}
+
+// Several groups can give teams of the same org
+func addMembership(orgs []config.UserOrgConfig, org string, teams []string) []config.UserOrgConfig {
+	for i := range orgs {
+		if strings.EqualFold(orgs[i].Id, org) {
+			orgs[i].Teams = append(orgs[i].Teams, teams...)
+			return orgs
+		}
+	}
+	return append(orgs, config.UserOrgConfig{Id: org, Teams: append([]string{}, teams...)})
+}
+
+func (s *ldapStore) UserByKey(key string) (config.UserConfig, error) {
+	log.Trace("identity: UserByKey")
+	_, byKey, err := s.users()
+	if err != nil {
+		log.Error("identity: %v", err)
+	}
+	local, localErr := s.local.UserByKey(key)
+	fingerprint, err := config.Fingerprint(key)
+	if err != nil {
+		return local, localErr
+	}
+	user, ok := byKey[fingerprint]
+	if !ok || s.shadowed(user) {
+		return local, localErr
+	}
+	if localErr == nil {
+		log.Error("identity: refusing SSH key %s of LDAP user %s and user %s of the config file", fingerprint, user.Name, local.Name)
+		return config.UserConfig{}, fmt.Errorf("Duplicate SSH key %s", fingerprint)
+	}
+	if _, _, deployKey, err := settings.ConfInfo.LookupDeployKey(key); err == nil {
+		log.Error("identity: refusing SSH key %s of LDAP user %s and deploy key %s", fingerprint, user.Name, deployKey.Name)
+		return config.UserConfig{}, fmt.Errorf("Duplicate SSH key %s", fingerprint)
+	}
+	return user, nil
+}
+
+func (s *ldapStore) UserByName(name string) (config.UserConfig, error) {
+	log.Trace("identity: UserByName, name: %s", name)
+	local, localErr := s.local.UserByName(name)
+	if localErr == nil {
+		return local, nil
+	}
+	users, _, err := s.users()
+	if err != nil {
+		log.Error("identity: %v", err)
+	}
+	for _, user := range users {
+		if strings.EqualFold(user.Name, name) {
+			return user, nil
+		}
+	}
+	return local, localErr
+}
+
+func (s *ldapStore) Users() ([]config.UserConfig, error) {
+	users, _, err := s.users()
+	if err != nil {
+		return nil, err
+	}
+	local, err := s.local.Users()
+	if err != nil {
+		return nil, err
+	}
+	all := append([]config.UserConfig{}, local...)
+	for _, user := range users {
+		if !s.shadowed(user) {
+			all = append(all, user)
+		}
+	}
+	return all, nil
+}
+
+func (s *ldapStore) Org(path string) (config.OrgConfig, error) {
+	return s.local.Org(path)
+}
+
+func (s *ldapStore) Teams(orgPath string) ([]config.TeamConfig, error) {
+	return s.local.Teams(orgPath)
+}
+
+func (s *ldapStore) Memberships(user string) ([]config.UserOrgConfig, error) {
+	userConfig, err := s.UserByName(user)
+	return userConfig.Orgs, err
+}
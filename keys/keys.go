@@ -0,0 +1,185 @@
+package keys
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/dgellow/nanogit/config"
+	"github.com/dgellow/nanogit/identity"
+	"github.com/dgellow/nanogit/log"
+	"github.com/dgellow/nanogit/settings"
+	"github.com/dgellow/nanogit/store"
+)
+
+// Name of the key store file, under the store directory of the data root.
+const storeName = "keys.yml"
+
+// Key is an SSH public key of a user. Keys added by users themselves are
+// kept in the key store, in addition to the keys from the config file.
+type Key struct {
+	User        string
+	Key         string
+	Fingerprint string
+	Added       time.Time
+	// True for keys declared in the config file, not saved in the store
+	FromConfig bool `yaml:"-"`
+}
+
+type keyStore struct {
+	Keys []Key
+}
+
+// Parse the given authorized_keys line, returning its canonical form
+// without comment.
+func parse(line string) (ssh.PublicKey, string, error) {
+	pubKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+	if err != nil {
+		return nil, "", fmt.Errorf("Invalid public key: %v", err)
+	}
+	return pubKey, strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pubKey))), nil
+}
+
+func sameKey(pubKey ssh.PublicKey, line string) bool {
+	other, _, err := parse(line)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(pubKey.Marshal(), other.Marshal())
+}
+
+func load() (keyStore, error) {
+	ks := keyStore{}
+	err := store.Load(storeName, &ks)
+	return ks, err
+}
+
+// LookupUser returns the user owning the given key, from the identity
+// backend or from the key store.
+func LookupUser(k string) (config.UserConfig, error) {
+	userConfig, err := identity.Get().UserByKey(k)
+	if err == nil {
+		return userConfig, nil
+	}
+	pubKey, _, parseErr := parse(k)
+	if parseErr != nil {
+		return config.UserConfig{}, err
+	}
+	ks, loadErr := load()
+	if loadErr != nil {
+		log.Error("keys: cannot load key store: %v", loadErr)
+		return config.UserConfig{}, err
+	}
+	fingerprint := ssh.FingerprintSHA256(pubKey)
+	for _, key := range ks.Keys {
+		if key.Fingerprint == fingerprint {
+			return identity.Get().UserByName(key.User)
+		}
+	}
+	return config.UserConfig{}, err
+}
+
+// List returns the keys of the given user, from both the config file and
+// the key store.
+func List(user string) ([]Key, error) {
+	log.Trace("keys: List, user: %s", user)
+	keys := []Key{}
+	userConfig, err := identity.Get().UserByName(user)
+	if err != nil {
+		return nil, err
+	}
+	for _, sshKey := range userConfig.SSHKeys {
+		pubKey, line, err := parse(sshKey.Val)
+		if err != nil {
+			continue
+		}
+		keys = append(keys, Key{
+			User:        user,
+			Key:         line,
+			Fingerprint: ssh.FingerprintSHA256(pubKey),
+			FromConfig:  true,
+		})
+	}
+
+	ks, err := load()
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range ks.Keys {
+		if key.User == user {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// Add saves the given key for user in the key store. A key can only be
+// registered once, across all users.
+func Add(user string, line string) (Key, error) {
+	log.Trace("keys: Add, user: %s", user)
+	pubKey, canonical, err := parse(line)
+	if err != nil {
+		return Key{}, err
+	}
+	if _, ok := pubKey.(*ssh.Certificate); ok {
+		return Key{}, fmt.Errorf("Certificates cannot be added as keys")
+	}
+	users, err := identity.Get().Users()
+	if err != nil {
+		return Key{}, err
+	}
+	for _, userConfig := range users {
+		for _, sshKey := range userConfig.SSHKeys {
+			if sameKey(pubKey, sshKey.Val) {
+				return Key{}, alreadyRegistered(user, userConfig.Name)
+			}
+		}
+	}
+	if _, _, _, err := settings.ConfInfo.LookupDeployKey(canonical); err == nil {
+		return Key{}, fmt.Errorf("Key is already registered as a deploy key")
+	}
+
+	key := Key{
+		User:        user,
+		Key:         canonical,
+		Fingerprint: ssh.FingerprintSHA256(pubKey),
+		Added:       time.Now().UTC(),
+	}
+	ks := keyStore{}
+	err = store.Update(storeName, &ks, func() error {
+		for _, other := range ks.Keys {
+			if sameKey(pubKey, other.Key) {
+				return alreadyRegistered(user, other.User)
+			}
+		}
+		ks.Keys = append(ks.Keys, key)
+		return nil
+	})
+	return key, err
+}
+
+func alreadyRegistered(user string, owner string) error {
+	if owner == user {
+		return fmt.Errorf("Key is already registered")
+	}
+	return fmt.Errorf("Key is already registered to another user")
+}
+
+// Remove deletes the key with the given fingerprint of user from the key
+// store. Keys from the config file cannot be removed.
+func Remove(user string, fingerprint string) error {
+	log.Trace("keys: Remove, user: %s, fingerprint: %s", user, fingerprint)
+	ks := keyStore{}
+	return store.Update(storeName, &ks, func() error {
+		for i, key := range ks.Keys {
+			if key.User == user && key.Fingerprint == fingerprint {
+				ks.Keys = append(ks.Keys[:i], ks.Keys[i+1:]...)
+				return nil
+			}
+		}
+		return fmt.Errorf("Cannot find key %s, keys from the config file cannot be removed", fingerprint)
+	})
+}
@@ -0,0 +1,144 @@
+package keys
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/dgellow/nanogit/config"
+	"github.com/dgellow/nanogit/settings"
+)
+
+const (
+	configKey = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIMfTMN8b5/k2T5WPVGAChUBEMXMEuUAiiG94QPjDVQ0S"
+	laptopKey = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIG6GlHSCzxXZkJwFlfsHXGCfehEgQHUYVAoPN/M78cYN"
+	deployKey = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIHPxkP6FH+XRg5fIsJY76ufM46KzjJWPaAQRahPn197z"
+)
+
+func setup(t *testing.T) func() {
+	dataRoot, err := ioutil.TempDir("", "nanogit-keys")
+	if err != nil {
+		t.Fatalf("Cannot create temp directory: %v", err)
+	}
+	settings.ConfInfo.Set(config.Config{
+		Server: config.ServerConfig{DataRoot: dataRoot},
+		Orgs: []config.OrgConfig{{
+			Id:    "fixme",
+			Repos: []config.RepoConfig{{Name: "website", DeployKeys: []config.DeployKeyConfig{{Name: "ci", Key: deployKey}}}},
+		}},
+		Users: []config.UserConfig{
+			{Name: "alice", SSHKeys: []config.PubKeyConfig{{Type: "hardcoded", Val: configKey + " alice@desktop"}}},
+			{Name: "bob"},
+		},
+	})
+	return func() {
+		settings.ConfInfo.Set(config.Config{})
+		os.RemoveAll(dataRoot)
+	}
+}
+
+func TestAdd(t *testing.T) {
+	defer setup(t)()
+
+	key, err := Add("bob", "  "+laptopKey+" bob@laptop\n")
+	if err != nil {
+		t.Fatalf("Add() == %v", err)
+	}
+	// Keys are saved without comment
+	if key.User != "bob" || key.Key != laptopKey || !strings.HasPrefix(key.Fingerprint, "SHA256:") || key.Added.IsZero() {
+		t.Errorf("Add() == %+v", key)
+	}
+	if userConfig, err := LookupUser(laptopKey + " other comment"); err != nil || userConfig.Name != "bob" {
+		t.Errorf("LookupUser() == %s, %v, expected bob", userConfig.Name, err)
+	}
+
+	tests := []struct {
+		user string
+		key  string
+		err  string
+	}{
+		{"bob", laptopKey, "Key is already registered"},
+		// A key has a single owner, whether it is in the config file or
+		// in the key store
+		{"alice", laptopKey + " copy", "Key is already registered to another user"},
+		{"bob", configKey, "Key is already registered to another user"},
+		{"alice", configKey, "Key is already registered"},
+		{"bob", deployKey, "Key is already registered as a deploy key"},
+		{"bob", "ssh-ed25519 AAAA", "Invalid public key"},
+		{"bob", "", "Invalid public key"},
+	}
+	for i, test := range tests {
+		if _, err := Add(test.user, test.key); err == nil || err.Error() != test.err && !strings.HasPrefix(err.Error(), test.err+":") {
+			t.Errorf("#%d: Add(%s, %.30s...) == %v, expected %q", i, test.user, test.key, err, test.err)
+		}
+	}
+}
+
+func TestListRemove(t *testing.T) {
+	defer setup(t)()
+
+	added, err := Add("alice", laptopKey)
+	if err != nil {
+		t.Fatalf("Add() == %v", err)
+	}
+	keys, err := List("alice")
+	if err != nil || len(keys) != 2 {
+		t.Fatalf("List() == %v, %v, expected two keys", keys, err)
+	}
+	if !keys[0].FromConfig || keys[0].Key != configKey || keys[1].FromConfig || keys[1].Fingerprint != added.Fingerprint {
+		t.Errorf("List() == %+v, expected the key of the config file then the added key", keys)
+	}
+	if keys, err := List("bob"); err != nil || len(keys) != 0 {
+		t.Errorf("List(bob) == %v, %v, expected no key", keys, err)
+	}
+	if _, err := List("carol"); err == nil {
+		t.Errorf("List(carol) == nil, expected an unknown user")
+	}
+
+	// Only the owner can remove a key, keys of the config file can't be
+	if err := Remove("bob", added.Fingerprint); err == nil {
+		t.Errorf("Remove(bob) == nil, expected an error")
+	}
+	if err := Remove("alice", keys[0].Fingerprint); err == nil || !strings.Contains(err.Error(), "keys from the config file cannot be removed") {
+		t.Errorf("Remove(config key) == %v, expected an error", err)
+	}
+	if err := Remove("alice", added.Fingerprint); err != nil {
+		t.Errorf("Remove() == %v", err)
+	}
+	if _, err := LookupUser(laptopKey); err == nil {
+		t.Errorf("LookupUser() == nil after Remove()")
+	}
+	if keys, _ := List("alice"); len(keys) != 1 {
+		t.Errorf("List() == %v after Remove(), expected the key of the config file", keys)
+	}
+}
+
+// Concurrent additions of the same key by two users keep a single owner
+func TestAddConcurrent(t *testing.T) {
+	defer setup(t)()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 2)
+	for _, user := range []string{"alice", "bob"} {
+		wg.Add(1)
+		go func(user string) {
+			defer wg.Done()
+			_, err := Add(user, laptopKey)
+			errs <- err
+		}(user)
+	}
+	wg.Wait()
+	close(errs)
+	failed := 0
+	for err := range errs {
+		if err != nil {
+			failed++
+		}
+	}
+	ks, err := load()
+	if err != nil || failed != 1 || len(ks.Keys) != 1 {
+		t.Errorf("%d additions failed, store has %v, %v, expected a single key", failed, ks.Keys, err)
+	}
+}
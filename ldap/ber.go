@@ -0,0 +1,176 @@
+package ldap
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+)
+
+// Subset of the BER encoding used by LDAPv3 (RFC 4511), definite lengths only
+
+const (
+	tagBoolean     = 0x01
+	tagInteger     = 0x02
+	tagOctetString = 0x04
+	tagEnumerated  = 0x0a
+	tagSequence    = 0x30
+	tagSet         = 0x31
+
+	appBindRequest  = 0x60
+	appBindResponse = 0x61
+	appUnbind       = 0x42
+	appSearch       = 0x63
+	appSearchEntry  = 0x64
+	appSearchDone   = 0x65
+	appSearchRef    = 0x73
+
+	authSimple = 0x80
+)
+
+// Messages larger than this are rejected
+const maxPacketSize = 16 << 20
+
+// packet is a decoded TLV, value being the content octets
+type packet struct {
+	tag   byte
+	value []byte
+}
+
+func encodeLength(n int) []byte {
+	if n < 0x80 {
+		return []byte{byte(n)}
+	}
+	var b []byte
+	for ; n > 0; n >>= 8 {
+		b = append([]byte{byte(n)}, b...)
+	}
+	return append([]byte{0x80 | byte(len(b))}, b...)
+}
+
+// encode returns the TLV with the given tag, its content being the
+// concatenation of parts
+func encode(tag byte, parts ...[]byte) []byte {
+	n := 0
+	for _, part := range parts {
+		n += len(part)
+	}
+	b := append([]byte{tag}, encodeLength(n)...)
+	for _, part := range parts {
+		b = append(b, part...)
+	}
+	return b
+}
+
+func encodeString(tag byte, s string) []byte {
+	return encode(tag, []byte(s))
+}
+
+func encodeInt(tag byte, n int64) []byte {
+	b := []byte{byte(n)}
+	for n > 127 || n < -128 {
+		n >>= 8
+		b = append([]byte{byte(n)}, b...)
+	}
+	return encode(tag, b)
+}
+
+func encodeBool(b bool) []byte {
+	if b {
+		return encode(tagBoolean, []byte{0xff})
+	}
+	return encode(tagBoolean, []byte{0})
+}
+
+// readPacket reads the next TLV from r
+func readPacket(r *bufio.Reader) (packet, error) {
+	tag, err := r.ReadByte()
+	if err != nil {
+		return packet{}, err
+	}
+	first, err := r.ReadByte()
+	if err != nil {
+		return packet{}, unexpectedEOF(err)
+	}
+	n := int(first)
+	if first&0x80 != 0 {
+		size := int(first & 0x7f)
+		if size == 0 || size > 4 {
+			return packet{}, fmt.Errorf("Unsupported BER length")
+		}
+		n = 0
+		for i := 0; i < size; i++ {
+			b, err := r.ReadByte()
+			if err != nil {
+				return packet{}, unexpectedEOF(err)
+			}
+			n = n<<8 | int(b)
+		}
+	}
+	if n > maxPacketSize {
+		return packet{}, fmt.Errorf("BER packet too large: %d bytes", n)
+	}
+	value := make([]byte, n)
+	if _, err := io.ReadFull(r, value); err != nil {
+		return packet{}, unexpectedEOF(err)
+	}
+	return packet{tag: tag, value: value}, nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// children decodes the content of a constructed packet
+func (p packet) children() ([]packet, error) {
+	packets := []packet{}
+	data := p.value
+	for len(data) > 0 {
+		if len(data) < 2 {
+			return nil, fmt.Errorf("Truncated BER packet")
+		}
+		tag, n, offset := data[0], int(data[1]), 2
+		if data[1]&0x80 != 0 {
+			size := int(data[1] & 0x7f)
+			if size == 0 || size > 4 || len(data) < 2+size {
+				return nil, fmt.Errorf("Invalid BER length")
+			}
+			n = 0
+			for _, b := range data[2 : 2+size] {
+				n = n<<8 | int(b)
+			}
+			offset += size
+		}
+		if n < 0 || n > len(data)-offset {
+			return nil, fmt.Errorf("Truncated BER packet")
+		}
+		packets = append(packets, packet{tag: tag, value: data[offset : offset+n]})
+		data = data[offset+n:]
+	}
+	return packets, nil
+}
+
+// childrenOf checks the tag of p and that it has at least n children
+func (p packet) childrenOf(tag byte, n int) ([]packet, error) {
+	if p.tag != tag {
+		return nil, fmt.Errorf("Unexpected BER tag 0x%02x, expected 0x%02x", p.tag, tag)
+	}
+	children, err := p.children()
+	if err == nil && len(children) < n {
+		err = fmt.Errorf("Expected %d BER elements in 0x%02x, got %d", n, tag, len(children))
+	}
+	return children, err
+}
+
+func (p packet) int() (int64, error) {
+	if len(p.value) == 0 || len(p.value) > 8 {
+		return 0, fmt.Errorf("Invalid BER integer")
+	}
+	n := int64(int8(p.value[0]))
+	for _, b := range p.value[1:] {
+		n = n<<8 | int64(b)
+	}
+	return n, nil
+}
@@ -0,0 +1,141 @@
+package ldap
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+const (
+	filterAnd      = 0xa0
+	filterOr       = 0xa1
+	filterNot      = 0xa2
+	filterEquality = 0xa3
+	filterPresent  = 0x87
+)
+
+// filter is a search filter (RFC 4515) limited to &, |, !, equality and
+// presence, e.g. (&(objectClass=posixAccount)(sshPublicKey=*))
+type filter struct {
+	op       byte
+	attr     string
+	value    string
+	children []filter
+}
+
+func parseFilter(s string) (filter, error) {
+	f, rest, err := parseFilterAt(s)
+	if err == nil && rest != "" {
+		err = fmt.Errorf("Unexpected %q after filter", rest)
+	}
+	if err != nil {
+		return filter{}, fmt.Errorf("Invalid LDAP filter %s: %v", s, err)
+	}
+	return f, nil
+}
+
+// Parses the filter at the beginning of s, returning what follows it
+func parseFilterAt(s string) (filter, string, error) {
+	if !strings.HasPrefix(s, "(") {
+		return filter{}, "", fmt.Errorf("Expected '('")
+	}
+	s = s[1:]
+	if s == "" {
+		return filter{}, "", fmt.Errorf("Unexpected end of filter")
+	}
+	var f filter
+	switch s[0] {
+	case '&', '|', '!':
+		f.op = map[byte]byte{'&': filterAnd, '|': filterOr, '!': filterNot}[s[0]]
+		s = s[1:]
+		for strings.HasPrefix(s, "(") {
+			child, rest, err := parseFilterAt(s)
+			if err != nil {
+				return filter{}, "", err
+			}
+			f.children = append(f.children, child)
+			s = rest
+		}
+		if f.op == filterNot && len(f.children) != 1 {
+			return filter{}, "", fmt.Errorf("'!' takes a single filter")
+		}
+	default:
+		end := strings.Index(s, ")")
+		if end < 0 {
+			return filter{}, "", fmt.Errorf("Expected ')'")
+		}
+		item := s[:end]
+		s = s[end:]
+		eq := strings.Index(item, "=")
+		if eq <= 0 {
+			return filter{}, "", fmt.Errorf("Expected attribute=value in %q", item)
+		}
+		f.attr = item[:eq]
+		value := item[eq+1:]
+		if value == "*" {
+			f.op = filterPresent
+			break
+		}
+		if strings.Contains(value, "*") {
+			return filter{}, "", fmt.Errorf("Substring filters are not supported")
+		}
+		var err error
+		if f.value, err = unescapeValue(value); err != nil {
+			return filter{}, "", err
+		}
+		f.op = filterEquality
+	}
+	if !strings.HasPrefix(s, ")") {
+		return filter{}, "", fmt.Errorf("Expected ')'")
+	}
+	return f, s[1:], nil
+}
+
+// Values escape special characters as \XX
+func unescapeValue(s string) (string, error) {
+	var b []byte
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b = append(b, s[i])
+			continue
+		}
+		if i+2 >= len(s) {
+			return "", fmt.Errorf("Invalid escape in %q", s)
+		}
+		decoded, err := hex.DecodeString(s[i+1 : i+3])
+		if err != nil {
+			return "", fmt.Errorf("Invalid escape in %q", s)
+		}
+		b = append(b, decoded...)
+		i += 2
+	}
+	return string(b), nil
+}
+
+// EscapeFilter escapes s to be used as a value in a search filter.
+func EscapeFilter(s string) string {
+	var b []byte
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '*', '(', ')', '\\', 0:
+			b = append(b, fmt.Sprintf("\\%02x", c)...)
+		default:
+			b = append(b, c)
+		}
+	}
+	return string(b)
+}
+
+func (f filter) encode() []byte {
+	switch f.op {
+	case filterPresent:
+		return encodeString(filterPresent, f.attr)
+	case filterEquality:
+		return encode(filterEquality, encodeString(tagOctetString, f.attr), encodeString(tagOctetString, f.value))
+	}
+	children := [][]byte{}
+	for _, child := range f.children {
+		children = append(children, child.encode())
+	}
+	return encode(f.op, children...)
+}
@@ -0,0 +1,280 @@
+// Package ldap is a minimal LDAPv3 client, supporting simple binds and
+// searches, which is all nanogit needs to read users from a directory.
+package ldap
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/dgellow/nanogit/log"
+)
+
+// Timeout of each operation, including the connection
+const Timeout = 10 * time.Second
+
+const (
+	ResultSuccess                  = 0
+	ResultNoSuchObject             = 32
+	ResultInvalidCredentials       = 49
+	ResultInsufficientAccessRights = 50
+	ResultUnwillingToPerform       = 53
+)
+
+// Error is a result code other than success returned by the server.
+type Error struct {
+	Code    int
+	Message string
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("LDAP result code %d", e.Code)
+	}
+	return fmt.Sprintf("LDAP result code %d: %s", e.Code, e.Message)
+}
+
+// Entry is an object returned by a search.
+type Entry struct {
+	DN         string
+	Attributes map[string][]string
+}
+
+// Get returns the values of the given attribute, whose name is case
+// insensitive.
+func (e Entry) Get(attr string) []string {
+	for name, values := range e.Attributes {
+		if strings.EqualFold(name, attr) {
+			return values
+		}
+	}
+	return nil
+}
+
+// Conn is a connection to an LDAP server.
+type Conn struct {
+	conn      net.Conn
+	r         *bufio.Reader
+	messageId int64
+}
+
+// Dial connects to the server at the given ldap:// or ldaps:// URL.
+func Dial(rawurl string) (*Conn, error) {
+	log.Trace("ldap: Dial, url: %s", rawurl)
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{Timeout: Timeout}
+	var conn net.Conn
+	switch u.Scheme {
+	case "ldap":
+		conn, err = dialer.Dial("tcp", hostPort(u.Host, "389"))
+	case "ldaps":
+		addr := hostPort(u.Host, "636")
+		host, _, _ := net.SplitHostPort(addr)
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{ServerName: host})
+	default:
+		return nil, fmt.Errorf("Unsupported LDAP URL %s, expected ldap:// or ldaps://", rawurl)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Conn{conn: conn, r: bufio.NewReader(conn)}, nil
+}
+
+func hostPort(host string, port string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), port)
+}
+
+// Close sends an unbind request and closes the connection.
+func (c *Conn) Close() error {
+	c.send(encode(appUnbind))
+	return c.conn.Close()
+}
+
+// Bind authenticates with the given DN and password.
+func (c *Conn) Bind(dn string, password string) error {
+	log.Trace("ldap: Bind, dn: %s", dn)
+	err := c.send(encode(appBindRequest,
+		encodeInt(tagInteger, 3),
+		encodeString(tagOctetString, dn),
+		encodeString(authSimple, password)))
+	if err != nil {
+		return err
+	}
+	p, err := c.receive()
+	if err != nil {
+		return err
+	}
+	return resultError(p, appBindResponse)
+}
+
+// Search returns the entries of the subtree of base matching filter, with
+// the given attributes only, or all of them if attrs is empty.
+func (c *Conn) Search(base string, filter string, attrs []string) ([]Entry, error) {
+	log.Trace("ldap: Search, base: %s, filter: %s", base, filter)
+	f, err := parseFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	attrList := [][]byte{}
+	for _, attr := range attrs {
+		attrList = append(attrList, encodeString(tagOctetString, attr))
+	}
+	err = c.send(encode(appSearch,
+		encodeString(tagOctetString, base),
+		// Whole subtree, never dereference aliases, no size or time limit
+		encodeInt(tagEnumerated, 2),
+		encodeInt(tagEnumerated, 0),
+		encodeInt(tagInteger, 0),
+		encodeInt(tagInteger, 0),
+		encodeBool(false),
+		f.encode(),
+		encode(tagSequence, attrList...)))
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []Entry{}
+	for {
+		p, err := c.receive()
+		if err != nil {
+			return nil, err
+		}
+		switch p.tag {
+		case appSearchEntry:
+			entry, err := decodeEntry(p)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, entry)
+		case appSearchRef:
+			// Referrals to other servers are not followed
+		default:
+			return entries, resultError(p, appSearchDone)
+		}
+	}
+}
+
+func (c *Conn) send(op []byte) error {
+	c.messageId++
+	c.conn.SetDeadline(time.Now().Add(Timeout))
+	_, err := c.conn.Write(encode(tagSequence, encodeInt(tagInteger, c.messageId), op))
+	return err
+}
+
+// Returns the protocol operation of the next response to the last request
+func (c *Conn) receive() (packet, error) {
+	for {
+		msg, err := readMessage(c.r)
+		if err != nil {
+			return packet{}, err
+		}
+		if msg.id == c.messageId {
+			return msg.op, nil
+		}
+		// Unsolicited notifications, e.g. notice of disconnection
+		if msg.id == 0 {
+			if err := resultError(msg.op, msg.op.tag); err != nil {
+				return packet{}, err
+			}
+		}
+	}
+}
+
+type message struct {
+	id int64
+	op packet
+}
+
+func readMessage(r *bufio.Reader) (message, error) {
+	p, err := readPacket(r)
+	if err != nil {
+		return message{}, err
+	}
+	children, err := p.childrenOf(tagSequence, 2)
+	if err != nil {
+		return message{}, err
+	}
+	id, err := children[0].int()
+	if err != nil {
+		return message{}, err
+	}
+	return message{id: id, op: children[1]}, nil
+}
+
+// Returns the error of an LDAPResult, nil on success
+func resultError(p packet, tag byte) error {
+	children, err := p.childrenOf(tag, 3)
+	if err != nil {
+		return err
+	}
+	code, err := children[0].int()
+	if err != nil {
+		return err
+	}
+	if code == ResultSuccess {
+		return nil
+	}
+	return &Error{Code: int(code), Message: string(children[2].value)}
+}
+
+func decodeEntry(p packet) (Entry, error) {
+	children, err := p.childrenOf(appSearchEntry, 2)
+	if err != nil {
+		return Entry{}, err
+	}
+	entry := Entry{DN: string(children[0].value), Attributes: map[string][]string{}}
+	attrs, err := children[1].childrenOf(tagSequence, 0)
+	if err != nil {
+		return Entry{}, err
+	}
+	for _, attr := range attrs {
+		parts, err := attr.childrenOf(tagSequence, 2)
+		if err != nil {
+			return Entry{}, err
+		}
+		values, err := parts[1].childrenOf(tagSet, 0)
+		if err != nil {
+			return Entry{}, err
+		}
+		name := string(parts[0].value)
+		for _, value := range values {
+			entry.Attributes[name] = append(entry.Attributes[name], string(value.value))
+		}
+	}
+	return entry, nil
+}
+
+// IsDescendant returns whether dn is base or one of its descendants.
+func IsDescendant(dn string, base string) bool {
+	dn, base = NormalizeDN(dn), NormalizeDN(base)
+	return base == "" || dn == base || strings.HasSuffix(dn, ","+base)
+}
+
+// NormalizeDN lowercases dn and removes spaces around its separators.
+func NormalizeDN(dn string) string {
+	parts := strings.Split(strings.ToLower(dn), ",")
+	for i, part := range parts {
+		rdn := strings.SplitN(part, "=", 2)
+		for j := range rdn {
+			rdn[j] = strings.TrimSpace(rdn[j])
+		}
+		parts[i] = strings.Join(rdn, "=")
+	}
+	return strings.Join(parts, ",")
+}
+
+// EqualDN returns whether both DNs are the same, ignoring case and spaces
+// around separators.
+func EqualDN(a string, b string) bool {
+	return NormalizeDN(a) == NormalizeDN(b)
+}
@@ -0,0 +1,122 @@
+package ldap
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestParseFilter(t *testing.T) {
+	alice := NewEntry("uid=alice,ou=people,dc=example,dc=org", "objectClass", "posixAccount", "cn", "Alice (admin)")
+	tests := []struct {
+		filter string
+		err    bool
+		match  bool
+	}{
+		{"(objectClass=posixAccount)", false, true},
+		{"(objectclass=POSIXACCOUNT)", false, true},
+		{"(uid=*)", false, true},
+		{"(sshPublicKey=*)", false, false},
+		{"(&(objectClass=posixAccount)(uid=alice))", false, true},
+		{"(&(objectClass=posixAccount)(uid=bob))", false, false},
+		{"(|(uid=bob)(uid=alice))", false, true},
+		{"(!(uid=alice))", false, false},
+		{`(cn=Alice \28admin\29)`, false, true},
+		{"(cn=" + EscapeFilter("Alice (admin)") + ")", false, true},
+		{"(uid=al*)", true, false},
+		{"(!(uid=a)(uid=b))", true, false},
+		{"(uid=alice", true, false},
+		{"uid=alice", true, false},
+		{"(uid=alice))", true, false},
+		{`(cn=\2)`, true, false},
+	}
+	for i, test := range tests {
+		f, err := parseFilter(test.filter)
+		if (err != nil) != test.err {
+			t.Errorf("#%d: parseFilter(%q) == %v", i, test.filter, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		encoded, err := packet{value: f.encode()}.children()
+		if err != nil || len(encoded) != 1 {
+			t.Fatalf("#%d: cannot decode BER of %q: %v", i, test.filter, err)
+		}
+		decoded, err := decodeFilter(encoded[0])
+		if err != nil || !reflect.DeepEqual(decoded, f) {
+			t.Errorf("#%d: decodeFilter(%q) == %+v, %v, expected %+v", i, test.filter, decoded, err, f)
+		}
+		if match := f.match(alice); match != test.match {
+			t.Errorf("#%d: %s matches %v, expected %v", i, test.filter, match, test.match)
+		}
+	}
+}
+
+func TestSearch(t *testing.T) {
+	entries := []Entry{
+		NewEntry("dc=example,dc=org", "objectClass", "domain"),
+		NewEntry("uid=alice,ou=people,dc=example,dc=org", "objectClass", "posixAccount", "sshPublicKey", "ssh-ed25519 AAAAalice", "sshPublicKey", "ssh-ed25519 AAAAlaptop"),
+		NewEntry("uid=bob,ou=people,dc=example,dc=org", "objectClass", "posixAccount"),
+		NewEntry("cn=dev,ou=groups,dc=example,dc=org", "objectClass", "groupOfNames", "member", "uid=alice,ou=people,dc=example,dc=org"),
+	}
+	server, err := NewServer("cn=nanogit,dc=example,dc=org", "secret", entries)
+	if err != nil {
+		t.Fatalf("NewServer() == %v", err)
+	}
+	defer server.Close()
+
+	conn, err := Dial(server.URL)
+	if err != nil {
+		t.Fatalf("Dial() == %v", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Search("dc=example,dc=org", "(objectClass=*)", nil); err == nil {
+		t.Errorf("Search() without bind should fail")
+	}
+	if err := conn.Bind("cn=nanogit,dc=example,dc=org", "wrong"); err == nil || err.(*Error).Code != ResultInvalidCredentials {
+		t.Errorf("Bind() with a wrong password == %v, expected code %d", err, ResultInvalidCredentials)
+	}
+	if err := conn.Bind("CN=nanogit, dc=example, dc=org", "secret"); err != nil {
+		t.Fatalf("Bind() == %v", err)
+	}
+
+	tests := []struct {
+		base   string
+		filter string
+		attrs  []string
+		dns    []string
+	}{
+		{"ou=people,dc=example,dc=org", "(objectClass=posixAccount)", nil, []string{"uid=alice,ou=people,dc=example,dc=org", "uid=bob,ou=people,dc=example,dc=org"}},
+		{"dc=example,dc=org", "(sshPublicKey=*)", nil, []string{"uid=alice,ou=people,dc=example,dc=org"}},
+		{"ou=groups,dc=example,dc=org", "(member=UID=alice,ou=people,dc=example,dc=org)", nil, []string{"cn=dev,ou=groups,dc=example,dc=org"}},
+		{"ou=nobody,dc=example,dc=org", "(objectClass=*)", nil, []string{}},
+	}
+	for i, test := range tests {
+		found, err := conn.Search(test.base, test.filter, test.attrs)
+		if err != nil {
+			t.Errorf("#%d: Search(%s, %s) == %v", i, test.base, test.filter, err)
+			continue
+		}
+		dns := []string{}
+		for _, entry := range found {
+			dns = append(dns, entry.DN)
+		}
+		sort.Strings(dns)
+		if !reflect.DeepEqual(dns, test.dns) {
+			t.Errorf("#%d: Search(%s, %s) == %v, expected %v", i, test.base, test.filter, dns, test.dns)
+		}
+	}
+
+	found, err := conn.Search("ou=people,dc=example,dc=org", "(uid=alice)", []string{"sshPublicKey"})
+	if err != nil || len(found) != 1 {
+		t.Fatalf("Search(uid=alice) == %v, %v", found, err)
+	}
+	expected := map[string][]string{"sshPublicKey": {"ssh-ed25519 AAAAalice", "ssh-ed25519 AAAAlaptop"}}
+	if !reflect.DeepEqual(found[0].Attributes, expected) {
+		t.Errorf("Attributes of alice == %v, expected only %v", found[0].Attributes, expected)
+	}
+	if server.Searches() != 5 {
+		t.Errorf("Server.Searches() == %d, expected 5", server.Searches())
+	}
+}
@@ -0,0 +1,271 @@
+package ldap
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+// Server is an in-memory directory answering simple binds and searches, a
+// local stand-in for a real LDAP server.
+type Server struct {
+	// ldap:// URL the server listens on
+	URL      string
+	bindDN   string
+	password string
+	listener net.Listener
+
+	mutex    sync.Mutex
+	entries  []Entry
+	searches int
+}
+
+// NewServer starts a server on a random local port with the given
+// entries. Searches require a bind with bindDN and password, unless both
+// are empty.
+func NewServer(bindDN string, password string, entries []Entry) (*Server, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		URL:      "ldap://" + listener.Addr().String(),
+		bindDN:   bindDN,
+		password: password,
+		listener: listener,
+		entries:  entries,
+	}
+	go s.serve()
+	return s, nil
+}
+
+// SetEntries replaces the entries of the directory.
+func (s *Server) SetEntries(entries []Entry) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.entries = entries
+}
+
+// Searches returns the number of searches served so far.
+func (s *Server) Searches() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.searches
+}
+
+// Close stops accepting connections.
+func (s *Server) Close() error {
+	return s.listener.Close()
+}
+
+func (s *Server) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *Server) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	bound := s.bindDN == "" && s.password == ""
+	for {
+		msg, err := readMessage(r)
+		if err != nil {
+			return
+		}
+		reply := func(op []byte) error {
+			_, err := conn.Write(encode(tagSequence, encodeInt(tagInteger, msg.id), op))
+			return err
+		}
+		switch msg.op.tag {
+		case appBindRequest:
+			code := ResultInvalidCredentials
+			if s.checkBind(msg.op) {
+				code, bound = ResultSuccess, true
+			}
+			err = reply(encodeResult(appBindResponse, code, ""))
+		case appSearch:
+			if !bound {
+				err = reply(encodeResult(appSearchDone, ResultInsufficientAccessRights, "Bind required"))
+				break
+			}
+			entries, attrs, searchErr := s.search(msg.op)
+			if searchErr != nil {
+				err = reply(encodeResult(appSearchDone, ResultUnwillingToPerform, searchErr.Error()))
+				break
+			}
+			for _, entry := range entries {
+				if err = reply(encodeEntry(entry, attrs)); err != nil {
+					return
+				}
+			}
+			err = reply(encodeResult(appSearchDone, ResultSuccess, ""))
+		default:
+			// Unbind and unsupported operations end the connection
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (s *Server) checkBind(op packet) bool {
+	children, err := op.childrenOf(appBindRequest, 3)
+	if err != nil || children[2].tag != authSimple {
+		return false
+	}
+	return EqualDN(string(children[1].value), s.bindDN) && string(children[2].value) == s.password
+}
+
+// Returns the entries matching the search request, with the requested
+// attributes
+func (s *Server) search(op packet) ([]Entry, []string, error) {
+	children, err := op.childrenOf(appSearch, 8)
+	if err != nil {
+		return nil, nil, err
+	}
+	base := string(children[0].value)
+	f, err := decodeFilter(children[6])
+	if err != nil {
+		return nil, nil, err
+	}
+	attrList, err := children[7].childrenOf(tagSequence, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	attrs := []string{}
+	for _, attr := range attrList {
+		attrs = append(attrs, string(attr.value))
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.searches++
+	entries := []Entry{}
+	for _, entry := range s.entries {
+		if IsDescendant(entry.DN, base) && f.match(entry) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, attrs, nil
+}
+
+// NewEntry returns an entry with the given DN and attributes, given as
+// name, value pairs, e.g. NewEntry("uid=alice,ou=people", "uid", "alice").
+func NewEntry(dn string, attrs ...string) Entry {
+	e := Entry{DN: dn, Attributes: map[string][]string{}}
+	for i := 0; i+1 < len(attrs); i += 2 {
+		e.Attributes[attrs[i]] = append(e.Attributes[attrs[i]], attrs[i+1])
+	}
+	// The RDN is an attribute of the entry too
+	if rdn := strings.SplitN(strings.SplitN(dn, ",", 2)[0], "=", 2); len(rdn) == 2 && len(e.Get(rdn[0])) == 0 {
+		e.Attributes[rdn[0]] = []string{rdn[1]}
+	}
+	return e
+}
+
+func encodeResult(tag byte, code int, message string) []byte {
+	return encode(tag,
+		encodeInt(tagEnumerated, int64(code)),
+		encodeString(tagOctetString, ""),
+		encodeString(tagOctetString, message))
+}
+
+func encodeEntry(e Entry, attrs []string) []byte {
+	attrList := [][]byte{}
+	for name, values := range e.Attributes {
+		if !selected(name, attrs) {
+			continue
+		}
+		valueList := [][]byte{}
+		for _, value := range values {
+			valueList = append(valueList, encodeString(tagOctetString, value))
+		}
+		attrList = append(attrList, encode(tagSequence, encodeString(tagOctetString, name), encode(tagSet, valueList...)))
+	}
+	return encode(appSearchEntry, encodeString(tagOctetString, e.DN), encode(tagSequence, attrList...))
+}
+
+func selected(name string, attrs []string) bool {
+	if len(attrs) == 0 {
+		return true
+	}
+	for _, attr := range attrs {
+		if attr == "*" || strings.EqualFold(attr, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func decodeFilter(p packet) (filter, error) {
+	f := filter{op: p.tag}
+	switch p.tag {
+	case filterPresent:
+		f.attr = string(p.value)
+	case filterEquality:
+		children, err := p.childrenOf(filterEquality, 2)
+		if err != nil {
+			return filter{}, err
+		}
+		f.attr, f.value = string(children[0].value), string(children[1].value)
+	case filterAnd, filterOr, filterNot:
+		children, err := p.children()
+		if err != nil {
+			return filter{}, err
+		}
+		for _, child := range children {
+			c, err := decodeFilter(child)
+			if err != nil {
+				return filter{}, err
+			}
+			f.children = append(f.children, c)
+		}
+		if p.tag == filterNot && len(f.children) != 1 {
+			return filter{}, fmt.Errorf("'!' takes a single filter")
+		}
+	default:
+		return filter{}, fmt.Errorf("Unsupported filter 0x%02x", p.tag)
+	}
+	return f, nil
+}
+
+// match compares attribute names and values case-insensitively, as most
+// directory attributes do
+func (f filter) match(e Entry) bool {
+	switch f.op {
+	case filterPresent:
+		return len(e.Get(f.attr)) > 0
+	case filterEquality:
+		for _, v := range e.Get(f.attr) {
+			if strings.EqualFold(v, f.value) {
+				return true
+			}
+		}
+		return false
+	case filterAnd:
+		for _, child := range f.children {
+			if !child.match(e) {
+				return false
+			}
+		}
+		return true
+	case filterOr:
+		for _, child := range f.children {
+			if child.match(e) {
+				return true
+			}
+		}
+		return false
+	case filterNot:
+		return !f.children[0].match(e)
+	}
+	return false
+}
@@ -0,0 +1,251 @@
+package lfs
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/dgellow/nanogit/dir"
+	"github.com/dgellow/nanogit/log"
+	"github.com/dgellow/nanogit/settings"
+)
+
+// Operations of the batch API
+const (
+	Download = "download"
+	Upload   = "upload"
+)
+
+// How long the credentials given by git-lfs-authenticate are valid
+var TokenExpiry = time.Hour
+
+var oidRegexp = regexp.MustCompile("^[0-9a-f]{64}$")
+
+// ValidOid returns whether oid is a SHA256 object id.
+func ValidOid(oid string) bool {
+	return oidRegexp.MatchString(oid)
+}
+
+// Objects of a repo are stored by id under the store directory of the data
+// root, e.g. lfs/org/repo/objects/ab/cd/abcd...
+func objectsDir(org string, repo string) (string, error) {
+	storeDir, err := dir.GetStoreDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(storeDir, "lfs", dir.RepoPath{Org: org, Repo: repo}.String(), "objects"), nil
+}
+
+func objectPath(org string, repo string, oid string) (string, error) {
+	if !ValidOid(oid) {
+		return "", fmt.Errorf("Invalid object id: %s", oid)
+	}
+	objects, err := objectsDir(org, repo)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(objects, oid[0:2], oid[2:4], oid), nil
+}
+
+// Stat returns the size of the object, or an error if it doesn't exist.
+func Stat(org string, repo string, oid string) (int64, error) {
+	path, err := objectPath(org, repo, oid)
+	if err != nil {
+		return 0, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// Open opens the object for reading.
+func Open(org string, repo string, oid string) (*os.File, error) {
+	path, err := objectPath(org, repo, oid)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(path)
+}
+
+// Store writes the object read from r. It is only added to the store if its
+// content matches its id.
+func Store(org string, repo string, oid string, r io.Reader) error {
+	log.Trace("lfs: Store, repo: %s/%s, oid: %s", org, repo, oid)
+	path, err := objectPath(org, repo, oid)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+oid)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmp, hash), r)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if actual := hex.EncodeToString(hash.Sum(nil)); actual != oid {
+		return fmt.Errorf("Object content doesn't match its id: %s", oid)
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Claims of the credentials given by git-lfs-authenticate
+type claims struct {
+	Key       string `json:"key"`
+	Repo      string `json:"repo"`
+	Operation string `json:"op"`
+	Expires   int64  `json:"exp"`
+}
+
+// Returns the key signing credentials, created on first use
+func secret() ([]byte, error) {
+	storeDir, err := dir.GetStoreDir()
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(storeDir, "lfs.key")
+	if data, err := ioutil.ReadFile(path); err == nil {
+		return hex.DecodeString(strings.TrimSpace(string(data)))
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(storeDir, 0700); err != nil {
+		return nil, err
+	}
+	tmp, err := ioutil.TempFile(storeDir, ".lfs.key")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.WriteString(hex.EncodeToString(key) + "\n")
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Linking fails if another process created the key meanwhile
+	if err := os.Link(tmp.Name(), path); os.IsExist(err) {
+		return secret()
+	} else if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func sign(payload string) (string, error) {
+	key, err := secret()
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// NewToken returns credentials allowing the holder of key to run the given
+// operation on org/repo, its access being checked on each request.
+func NewToken(key string, org string, repo string, operation string, expires time.Time) (string, error) {
+	data, err := json.Marshal(claims{
+		Key:       key,
+		Repo:      dir.RepoPath{Org: org, Repo: repo}.String(),
+		Operation: operation,
+		Expires:   expires.Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	signature, err := sign(payload)
+	return payload + "." + signature, err
+}
+
+// VerifyToken checks credentials given for org/repo and returns the key and
+// operation they were issued for.
+func VerifyToken(value string, org string, repo string) (key string, operation string, err error) {
+	parts := strings.SplitN(value, ".", 2)
+	if len(parts) != 2 {
+		return "", "", fmt.Errorf("Malformed LFS token")
+	}
+	signature, err := sign(parts[0])
+	if err != nil {
+		return "", "", err
+	}
+	if !hmac.Equal([]byte(signature), []byte(parts[1])) {
+		return "", "", fmt.Errorf("Invalid LFS token signature")
+	}
+	data, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", "", err
+	}
+	c := claims{}
+	if err := json.Unmarshal(data, &c); err != nil {
+		return "", "", err
+	}
+	if c.Repo != (dir.RepoPath{Org: org, Repo: repo}).String() {
+		return "", "", fmt.Errorf("LFS token is not valid for %s/%s", org, repo)
+	}
+	if time.Now().Unix() > c.Expires {
+		return "", "", fmt.Errorf("LFS token has expired")
+	}
+	return c.Key, c.Operation, nil
+}
+
+// BaseURL returns the URL of the HTTP server.
+func BaseURL() string {
+	httpConfig := settings.ConfInfo.Get().Server.HTTP
+	if httpConfig.Url != "" {
+		return strings.TrimSuffix(httpConfig.Url, "/")
+	}
+	return "http://" + httpConfig.Address
+}
+
+// Endpoint returns the URL of the LFS API of org/repo.
+func Endpoint(org string, repo string) string {
+	return fmt.Sprintf("%s/%s/%s.git/info/lfs", BaseURL(), org, repo)
+}
+
+// Authentication is the response of git-lfs-authenticate.
+type Authentication struct {
+	Href      string            `json:"href"`
+	Header    map[string]string `json:"header"`
+	ExpiresIn int64             `json:"expires_in"`
+}
+
+// Authenticate returns the response of git-lfs-authenticate for the holder
+// of key.
+func Authenticate(key string, org string, repo string, operation string) (Authentication, error) {
+	log.Trace("lfs: Authenticate, repo: %s/%s, operation: %s", org, repo, operation)
+	token, err := NewToken(key, org, repo, operation, time.Now().Add(TokenExpiry))
+	if err != nil {
+		return Authentication{}, err
+	}
+	return Authentication{
+		Href:      Endpoint(org, repo),
+		Header:    map[string]string{"Authorization": "Bearer " + token},
+		ExpiresIn: int64(TokenExpiry / time.Second),
+	}, nil
+}
@@ -0,0 +1,284 @@
+package lfs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgellow/nanogit/config"
+	"github.com/dgellow/nanogit/settings"
+	"github.com/dgellow/nanogit/token"
+)
+
+const (
+	writerKey = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIIvG863zzsAWqcjtjnFkH9QbuHavffRrupt6WNEompIh"
+	readerKey = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOZX6ypROWV6JWWLz370Sm9a5LyqNH1Mqnmg5I5FpPrz"
+)
+
+type client struct {
+	t      *testing.T
+	server *httptest.Server
+	header string
+	user   string
+	pass   string
+}
+
+func (c client) do(method string, path string, body []byte) (int, []byte) {
+	req, err := http.NewRequest(method, c.server.URL+path, bytes.NewReader(body))
+	if err != nil {
+		c.t.Fatalf("Cannot create request: %v", err)
+	}
+	if c.header != "" {
+		req.Header.Set("Authorization", c.header)
+	}
+	if c.user != "" {
+		req.SetBasicAuth(c.user, c.pass)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		c.t.Fatalf("%s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		c.t.Fatalf("%s %s: cannot read body: %v", method, path, err)
+	}
+	return resp.StatusCode, data
+}
+
+func bearer(t *testing.T, key string, op string, expires time.Time) string {
+	value, err := NewToken(key, "fixme", "foo", op, expires)
+	if err != nil {
+		t.Fatalf("NewToken() == %v", err)
+	}
+	return "Bearer " + value
+}
+
+func TestServer(t *testing.T) {
+	dataRoot, err := ioutil.TempDir("", "nanogit-lfs")
+	if err != nil {
+		t.Fatalf("Cannot create temp directory: %v", err)
+	}
+	defer os.RemoveAll(dataRoot)
+	for _, path := range []string{"fixme/foo", "fixme/bar"} {
+		if err := os.MkdirAll(filepath.Join(dataRoot, path), 0755); err != nil {
+			t.Fatalf("Cannot create repo %s: %v", path, err)
+		}
+	}
+
+	server := httptest.NewServer(Handler())
+	defer server.Close()
+	settings.ConfInfo.Set(config.Config{
+		Server: config.ServerConfig{DataRoot: dataRoot, HTTP: config.HTTPConfig{Url: server.URL}},
+		Orgs: []config.OrgConfig{{
+			Id: "fixme",
+			Repos: []config.RepoConfig{{Name: "foo", DeployKeys: []config.DeployKeyConfig{
+				{Name: "ci", Key: writerKey, Write: true},
+				{Name: "docs", Key: readerKey},
+			}}},
+		}},
+	})
+	defer func() { settings.ConfInfo.Set(config.Config{}) }()
+
+	content := []byte("large binary content")
+	sum := sha256.Sum256(content)
+	oid := hex.EncodeToString(sum[:])
+	batch := func(op string) []byte {
+		return []byte(`{"operation":"` + op + `","transfers":["basic"],"objects":[{"oid":"` + oid + `","size":20}]}`)
+	}
+	api := "/fixme/foo.git/info/lfs/"
+
+	writer := client{t: t, server: server, header: bearer(t, writerKey, Upload, time.Now().Add(time.Hour))}
+	readerUpload := client{t: t, server: server, header: bearer(t, readerKey, Upload, time.Now().Add(time.Hour))}
+	writerDownload := client{t: t, server: server, header: bearer(t, writerKey, Download, time.Now().Add(time.Hour))}
+	expired := client{t: t, server: server, header: bearer(t, writerKey, Upload, time.Now().Add(-time.Minute))}
+	anonymous := client{t: t, server: server}
+
+	// Access checks
+	tests := []struct {
+		c      client
+		method string
+		path   string
+		body   []byte
+		status int
+	}{
+		{anonymous, "POST", api + "objects/batch", batch(Download), http.StatusUnauthorized},
+		{expired, "POST", api + "objects/batch", batch(Download), http.StatusUnauthorized},
+		{writer, "POST", "/fixme/bar.git/info/lfs/objects/batch", batch(Download), http.StatusUnauthorized},
+		{writer, "POST", "/fixme/missing.git/info/lfs/objects/batch", batch(Download), http.StatusNotFound},
+		{readerUpload, "POST", api + "objects/batch", batch(Upload), http.StatusForbidden},
+		{writerDownload, "POST", api + "objects/batch", batch(Upload), http.StatusForbidden},
+		{readerUpload, "PUT", api + "objects/" + oid, content, http.StatusForbidden},
+		{writer, "PUT", api + "objects/" + oid, []byte("tampered content"), http.StatusUnprocessableEntity},
+		{writer, "POST", api + "objects/batch", []byte(`{"operation":"delete"}`), http.StatusUnprocessableEntity},
+		{writer, "GET", api + "objects/" + oid, nil, http.StatusNotFound},
+		{writer, "DELETE", api + "objects/" + oid, nil, http.StatusNotFound},
+	}
+	for i, test := range tests {
+		if status, body := test.c.do(test.method, test.path, test.body); status != test.status {
+			t.Errorf("#%d: %s %s == %d (%s), expected %d", i, test.method, test.path, status, body, test.status)
+		}
+	}
+
+	// Upload, then download
+	status, body := writer.do("POST", api+"objects/batch", batch(Upload))
+	resp := batchResponse{}
+	if err := json.Unmarshal(body, &resp); status != http.StatusOK || err != nil {
+		t.Fatalf("Upload batch == %d (%s)", status, body)
+	}
+	if len(resp.Objects) != 1 || resp.Objects[0].Actions[Upload].Href != server.URL+api+"objects/"+oid {
+		t.Fatalf("Upload batch returned %s", body)
+	}
+	if status, body := writer.do("PUT", api+"objects/"+oid, content); status != http.StatusOK {
+		t.Fatalf("PUT object == %d (%s)", status, body)
+	}
+	status, body = writer.do("POST", api+"objects/batch", batch(Upload))
+	resp = batchResponse{}
+	if err := json.Unmarshal(body, &resp); status != http.StatusOK || err != nil || resp.Objects[0].Actions != nil {
+		t.Errorf("Stored objects should not be uploaded again, batch returned %s", body)
+	}
+	status, body = readerUpload.do("POST", api+"objects/batch", batch(Download))
+	resp = batchResponse{}
+	if err := json.Unmarshal(body, &resp); status != http.StatusOK || err != nil || resp.Objects[0].Actions[Download].Href == "" {
+		t.Fatalf("Download batch == %d (%s)", status, body)
+	}
+	if status, body := readerUpload.do("GET", api+"objects/"+oid, nil); status != http.StatusOK || !bytes.Equal(body, content) {
+		t.Errorf("GET object == %d (%q), expected %q", status, body, content)
+	}
+	if _, err := Stat("fixme", "bar", oid); err == nil {
+		t.Errorf("Objects should be stored per repository")
+	}
+
+	// Access tokens
+	value, _, err := token.Create("alice", "fixme", "foo", false, time.Time{})
+	if err != nil {
+		t.Fatalf("token.Create() == %v", err)
+	}
+	if status, body := (client{t: t, server: server, user: "alice", pass: "wrong"}).do("POST", api+"objects/batch", batch(Download)); status != http.StatusUnauthorized {
+		t.Errorf("Invalid access token: batch == %d (%s), expected %d", status, body, http.StatusUnauthorized)
+	}
+	// alice isn't a member of fixme
+	if status, body := (client{t: t, server: server, user: "alice", pass: value}).do("POST", api+"objects/batch", batch(Download)); status != http.StatusForbidden {
+		t.Errorf("Access token without access: batch == %d (%s), expected %d", status, body, http.StatusForbidden)
+	}
+}
+
+func TestLocks(t *testing.T) {
+	dataRoot, err := ioutil.TempDir("", "nanogit-lfs")
+	if err != nil {
+		t.Fatalf("Cannot create temp directory: %v", err)
+	}
+	defer os.RemoveAll(dataRoot)
+	if err := os.MkdirAll(filepath.Join(dataRoot, "fixme", "foo"), 0755); err != nil {
+		t.Fatalf("Cannot create repo: %v", err)
+	}
+
+	server := httptest.NewServer(Handler())
+	defer server.Close()
+	settings.ConfInfo.Set(config.Config{
+		Server: config.ServerConfig{DataRoot: dataRoot, HTTP: config.HTTPConfig{Url: server.URL}},
+		Orgs: []config.OrgConfig{{
+			Id: "fixme",
+			Repos: []config.RepoConfig{{Name: "foo", DeployKeys: []config.DeployKeyConfig{
+				{Name: "ci", Key: writerKey, Write: true},
+				{Name: "release", Key: readerKey, Write: true},
+			}}},
+		}},
+	})
+	defer func() { settings.ConfInfo.Set(config.Config{}) }()
+
+	api := "/fixme/foo.git/info/lfs/"
+	ci := client{t: t, server: server, header: bearer(t, writerKey, Upload, time.Now().Add(time.Hour))}
+	release := client{t: t, server: server, header: bearer(t, readerKey, Upload, time.Now().Add(time.Hour))}
+	ciDownload := client{t: t, server: server, header: bearer(t, writerKey, Download, time.Now().Add(time.Hour))}
+
+	created := map[string]Lock{}
+	for _, path := range []string{"a.psd", "b.psd", "c.psd"} {
+		status, body := ci.do("POST", api+"locks", []byte(`{"path":"`+path+`"}`))
+		resp := map[string]Lock{}
+		if err := json.Unmarshal(body, &resp); status != http.StatusCreated || err != nil {
+			t.Fatalf("Lock %s == %d (%s)", path, status, body)
+		}
+		if resp["lock"].Owner.Name != "deploy key ci" {
+			t.Errorf("Lock %s owner == %q, expected %q", path, resp["lock"].Owner.Name, "deploy key ci")
+		}
+		created[path] = resp["lock"]
+	}
+
+	if status, body := release.do("POST", api+"locks", []byte(`{"path":"a.psd"}`)); status != http.StatusConflict || !strings.Contains(string(body), created["a.psd"].Id) {
+		t.Errorf("Locking a locked path == %d (%s), expected %d with the existing lock", status, body, http.StatusConflict)
+	}
+	if status, body := ciDownload.do("POST", api+"locks", []byte(`{"path":"d.psd"}`)); status != http.StatusForbidden {
+		t.Errorf("Locking with download credentials == %d (%s), expected %d", status, body, http.StatusForbidden)
+	}
+
+	// List with filters and pagination
+	listTests := []struct {
+		query string
+		paths []string
+		next  string
+	}{
+		{"", []string{"a.psd", "b.psd", "c.psd"}, ""},
+		{"?path=b.psd", []string{"b.psd"}, ""},
+		{"?id=" + created["c.psd"].Id, []string{"c.psd"}, ""},
+		{"?limit=2", []string{"a.psd", "b.psd"}, created["c.psd"].Id},
+		{"?limit=2&cursor=" + created["c.psd"].Id, []string{"c.psd"}, ""},
+	}
+	for i, test := range listTests {
+		status, body := ciDownload.do("GET", api+"locks"+test.query, nil)
+		list := lockList{}
+		if err := json.Unmarshal(body, &list); status != http.StatusOK || err != nil {
+			t.Errorf("#%d: GET locks%s == %d (%s)", i, test.query, status, body)
+			continue
+		}
+		paths := []string{}
+		for _, l := range list.Locks {
+			paths = append(paths, l.Path)
+		}
+		if strings.Join(paths, ",") != strings.Join(test.paths, ",") || list.NextCursor != test.next {
+			t.Errorf("#%d: GET locks%s == %v, next %q, expected %v, next %q", i, test.query, paths, list.NextCursor, test.paths, test.next)
+		}
+	}
+	if status, _ := ciDownload.do("GET", api+"locks?cursor=unknown", nil); status != http.StatusUnprocessableEntity {
+		t.Errorf("Invalid cursor == %d, expected %d", status, http.StatusUnprocessableEntity)
+	}
+
+	status, body := release.do("POST", api+"locks/verify", []byte(`{}`))
+	verify := lockVerifyList{}
+	if err := json.Unmarshal(body, &verify); status != http.StatusOK || err != nil || len(verify.Ours) != 0 || len(verify.Theirs) != 3 {
+		t.Errorf("Verify locks == %d (%s), expected no lock of ours and 3 of theirs", status, body)
+	}
+
+	// Unlock
+	unlockTests := []struct {
+		c      client
+		id     string
+		body   string
+		status int
+	}{
+		{release, created["a.psd"].Id, `{}`, http.StatusForbidden},
+		{ciDownload, created["a.psd"].Id, `{}`, http.StatusForbidden},
+		{ci, "unknown", `{}`, http.StatusNotFound},
+		{ci, created["a.psd"].Id, `{}`, http.StatusOK},
+		{ci, created["a.psd"].Id, `{}`, http.StatusNotFound},
+		{release, created["b.psd"].Id, `{"force":true}`, http.StatusOK},
+	}
+	for i, test := range unlockTests {
+		if status, body := test.c.do("POST", api+"locks/"+test.id+"/unlock", []byte(test.body)); status != test.status {
+			t.Errorf("#%d: unlock %s == %d (%s), expected %d", i, test.id, status, body, test.status)
+		}
+	}
+	locks, err := Locks("fixme", "foo")
+	if err != nil || len(locks) != 1 || locks[0].Path != "c.psd" {
+		t.Errorf("Locks() == %v, %v, expected only the lock of c.psd", locks, err)
+	}
+}
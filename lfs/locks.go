@@ -0,0 +1,115 @@
+package lfs
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/dgellow/nanogit/dir"
+	"github.com/dgellow/nanogit/log"
+	"github.com/dgellow/nanogit/store"
+)
+
+// Name of the LFS lock file, under the store directory of the data root.
+const locksStoreName = "lfs-locks.yml"
+
+// Lock prevents other users from pushing changes to a file.
+type Lock struct {
+	Id       string    `json:"id"`
+	Path     string    `json:"path"`
+	LockedAt time.Time `json:"locked_at"`
+	Owner    LockOwner `json:"owner"`
+}
+
+type LockOwner struct {
+	Name string `json:"name"`
+}
+
+// ErrLockExists is returned when locking a path already locked.
+type ErrLockExists struct {
+	Lock Lock
+}
+
+func (e ErrLockExists) Error() string {
+	return fmt.Sprintf("Path is already locked by %s: %s", e.Lock.Owner.Name, e.Lock.Path)
+}
+
+// ErrLockOwned is returned when deleting the lock of another user without
+// forcing it.
+type ErrLockOwned struct {
+	Lock Lock
+}
+
+func (e ErrLockOwned) Error() string {
+	return fmt.Sprintf("Lock is owned by %s: %s", e.Lock.Owner.Name, e.Lock.Path)
+}
+
+// Locks of every repo, keyed by org/repo, in creation order
+type lockStore map[string][]Lock
+
+// Locks returns the locks of org/repo, in creation order.
+func Locks(org string, repo string) ([]Lock, error) {
+	ls := lockStore{}
+	if err := store.Load(locksStoreName, &ls); err != nil {
+		return nil, err
+	}
+	return ls[dir.RepoPath{Org: org, Repo: repo}.String()], nil
+}
+
+// CreateLock locks path of org/repo for owner.
+func CreateLock(org string, repo string, path string, owner string) (Lock, error) {
+	log.Trace("lfs: CreateLock, repo: %s/%s, path: %s, owner: %s", org, repo, path, owner)
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return Lock{}, err
+	}
+	lock := Lock{
+		Id:       hex.EncodeToString(id),
+		Path:     path,
+		LockedAt: time.Now().UTC().Truncate(time.Second),
+		Owner:    LockOwner{owner},
+	}
+	key := dir.RepoPath{Org: org, Repo: repo}.String()
+	ls := lockStore{}
+	err := store.Update(locksStoreName, &ls, func() error {
+		for _, l := range ls[key] {
+			if l.Path == path {
+				return ErrLockExists{l}
+			}
+		}
+		ls[key] = append(ls[key], lock)
+		return nil
+	})
+	return lock, err
+}
+
+// DeleteLock removes the lock with the given id from org/repo. Locks of
+// other users are only removed if force is set.
+func DeleteLock(org string, repo string, id string, user string, force bool) (Lock, error) {
+	log.Trace("lfs: DeleteLock, repo: %s/%s, id: %s, user: %s, force: %t", org, repo, id, user, force)
+	key := dir.RepoPath{Org: org, Repo: repo}.String()
+	var deleted Lock
+	ls := lockStore{}
+	err := store.Update(locksStoreName, &ls, func() error {
+		for i, l := range ls[key] {
+			if l.Id != id {
+				continue
+			}
+			if l.Owner.Name != user && !force {
+				return ErrLockOwned{l}
+			}
+			deleted = l
+			ls[key] = append(ls[key][:i], ls[key][i+1:]...)
+			if len(ls[key]) == 0 {
+				delete(ls, key)
+			}
+			return nil
+		}
+		return ErrLockNotFound
+	})
+	return deleted, err
+}
+
+// ErrLockNotFound is returned when deleting a lock that doesn't exist.
+var ErrLockNotFound = fmt.Errorf("Lock not found")
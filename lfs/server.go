@@ -0,0 +1,391 @@
+package lfs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/dgellow/nanogit/auth"
+	"github.com/dgellow/nanogit/dir"
+	"github.com/dgellow/nanogit/log"
+	"github.com/dgellow/nanogit/token"
+)
+
+const contentType = "application/vnd.git-lfs+json"
+
+// Prefix of the LFS API, after the repository path
+const apiPath = ".git/info/lfs/"
+
+// Maximum number of locks returned by a list request
+const maxLocksLimit = 100
+
+// IsRequest returns whether r is a request to the LFS API.
+func IsRequest(r *http.Request) bool {
+	return strings.Contains(r.URL.Path, apiPath)
+}
+
+// Handler serves the LFS batch, basic transfer and lock APIs of every
+// repository, under /org/repo.git/info/lfs/.
+func Handler() http.Handler {
+	return http.HandlerFunc(serve)
+}
+
+// Requester of an LFS API call and its access to the repo
+type requester struct {
+	name  string
+	read  bool
+	write bool
+	// Authorization header, given back in transfer actions
+	authorization string
+}
+
+type apiError struct {
+	status  int
+	message string
+}
+
+// Identifies the requester, with either credentials given by
+// git-lfs-authenticate or an access token
+func authenticate(r *http.Request, org string, repo string) (requester, *apiError) {
+	header := r.Header.Get("Authorization")
+	if strings.HasPrefix(header, "Bearer ") {
+		key, operation, err := VerifyToken(strings.TrimPrefix(header, "Bearer "), org, repo)
+		if err != nil {
+			return requester{}, &apiError{http.StatusUnauthorized, err.Error()}
+		}
+		read, write := auth.CheckAuth(key, r.RemoteAddr, org, repo)
+		return requester{auth.KeyOwner(key, r.RemoteAddr), read, write && operation == Upload, header}, nil
+	}
+	if _, _, ok := r.BasicAuth(); ok {
+		t, err := token.BasicAuth(r)
+		if err != nil {
+			return requester{}, &apiError{http.StatusUnauthorized, err.Error()}
+		}
+		read, write := auth.CheckTokenAuth(t, r.RemoteAddr, org, repo)
+		return requester{t.User, read, write, header}, nil
+	}
+	return requester{}, &apiError{http.StatusUnauthorized, "Credentials needed"}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Error("lfs: cannot write response: %v", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, e *apiError) {
+	if e.status == http.StatusUnauthorized {
+		w.Header().Set("LFS-Authenticate", `Basic realm="nanogit"`)
+	}
+	writeJSON(w, e.status, map[string]string{"message": e.message})
+}
+
+func serve(w http.ResponseWriter, r *http.Request) {
+	log.Trace("lfs: %s %s", r.Method, r.URL.Path)
+	i := strings.Index(r.URL.Path, apiPath)
+	if i < 0 {
+		writeError(w, &apiError{http.StatusNotFound, "Not found"})
+		return
+	}
+	org, repo, err := dir.ParseRepoPath(r.URL.Path[:i])
+	if err != nil {
+		writeError(w, &apiError{http.StatusNotFound, err.Error()})
+		return
+	}
+	if exists, _ := dir.IsRepoExist(org, repo); !exists {
+		writeError(w, &apiError{http.StatusNotFound, "Repository not found"})
+		return
+	}
+	req, e := authenticate(r, org, repo)
+	if e == nil && !req.read {
+		e = &apiError{http.StatusForbidden, "Unauthorized read access"}
+	}
+	if e != nil {
+		log.Error("lfs: %s %s: %s", r.Method, r.URL.Path, e.message)
+		writeError(w, e)
+		return
+	}
+
+	route := strings.Split(r.URL.Path[i+len(apiPath):], "/")
+	switch {
+	case r.Method == "POST" && len(route) == 2 && route[0] == "objects" && route[1] == "batch":
+		e = batch(w, r, req, org, repo)
+	case r.Method == "GET" && len(route) == 2 && route[0] == "objects":
+		e = download(w, r, org, repo, route[1])
+	case r.Method == "PUT" && len(route) == 2 && route[0] == "objects":
+		e = upload(w, r, req, org, repo, route[1])
+	case r.Method == "GET" && len(route) == 1 && route[0] == "locks":
+		e = listLocks(w, r, org, repo)
+	case r.Method == "POST" && len(route) == 1 && route[0] == "locks":
+		e = createLock(w, r, req, org, repo)
+	case r.Method == "POST" && len(route) == 2 && route[0] == "locks" && route[1] == "verify":
+		e = verifyLocks(w, r, req, org, repo)
+	case r.Method == "POST" && len(route) == 3 && route[0] == "locks" && route[2] == "unlock":
+		e = unlock(w, r, req, org, repo, route[1])
+	default:
+		e = &apiError{http.StatusNotFound, "Not found"}
+	}
+	if e != nil {
+		log.Error("lfs: %s %s: %s", r.Method, r.URL.Path, e.message)
+		writeError(w, e)
+	}
+}
+
+func decode(r *http.Request, v interface{}) *apiError {
+	if err := json.NewDecoder(io.LimitReader(r.Body, 10<<20)).Decode(v); err != nil {
+		return &apiError{http.StatusUnprocessableEntity, fmt.Sprintf("Invalid request: %v", err)}
+	}
+	return nil
+}
+
+type batchRequest struct {
+	Operation string        `json:"operation"`
+	Transfers []string      `json:"transfers"`
+	Objects   []batchObject `json:"objects"`
+}
+
+type batchObject struct {
+	Oid           string            `json:"oid"`
+	Size          int64             `json:"size"`
+	Authenticated bool              `json:"authenticated,omitempty"`
+	Actions       map[string]action `json:"actions,omitempty"`
+	Error         *objectError      `json:"error,omitempty"`
+}
+
+type action struct {
+	Href   string            `json:"href"`
+	Header map[string]string `json:"header,omitempty"`
+}
+
+type objectError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type batchResponse struct {
+	Transfer string        `json:"transfer"`
+	Objects  []batchObject `json:"objects"`
+}
+
+func batch(w http.ResponseWriter, r *http.Request, req requester, org string, repo string) *apiError {
+	br := batchRequest{}
+	if e := decode(r, &br); e != nil {
+		return e
+	}
+	if br.Operation != Download && br.Operation != Upload {
+		return &apiError{http.StatusUnprocessableEntity, "Unknown operation: " + br.Operation}
+	}
+	if br.Operation == Upload && !req.write {
+		return &apiError{http.StatusForbidden, "Unauthorized write access"}
+	}
+	if len(br.Transfers) > 0 && !contains(br.Transfers, "basic") {
+		return &apiError{http.StatusUnprocessableEntity, "Only the basic transfer adapter is supported"}
+	}
+
+	header := map[string]string{"Authorization": req.authorization}
+	resp := batchResponse{Transfer: "basic", Objects: []batchObject{}}
+	for _, o := range br.Objects {
+		obj := batchObject{Oid: o.Oid, Size: o.Size}
+		href := fmt.Sprintf("%s/objects/%s", Endpoint(org, repo), o.Oid)
+		size, err := Stat(org, repo, o.Oid)
+		switch {
+		case !ValidOid(o.Oid) || o.Size < 0:
+			obj.Error = &objectError{http.StatusUnprocessableEntity, "Invalid object"}
+		case br.Operation == Download && err != nil:
+			obj.Error = &objectError{http.StatusNotFound, "Object does not exist"}
+		case br.Operation == Download && size != o.Size:
+			obj.Error = &objectError{http.StatusUnprocessableEntity, "Object size doesn't match"}
+		case br.Operation == Download:
+			obj.Authenticated = true
+			obj.Actions = map[string]action{Download: {href, header}}
+		case err != nil:
+			// Objects already stored are not uploaded again
+			obj.Authenticated = true
+			obj.Actions = map[string]action{Upload: {href, header}}
+		}
+		resp.Objects = append(resp.Objects, obj)
+	}
+	writeJSON(w, http.StatusOK, resp)
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func download(w http.ResponseWriter, r *http.Request, org string, repo string, oid string) *apiError {
+	file, err := Open(org, repo, oid)
+	if err != nil {
+		return &apiError{http.StatusNotFound, "Object does not exist"}
+	}
+	defer file.Close()
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if info, err := file.Stat(); err == nil {
+		w.Header().Set("Content-Length", strconv.FormatInt(info.Size(), 10))
+	}
+	if _, err := io.Copy(w, file); err != nil {
+		log.Error("lfs: cannot send object %s: %v", oid, err)
+	}
+	return nil
+}
+
+func upload(w http.ResponseWriter, r *http.Request, req requester, org string, repo string, oid string) *apiError {
+	if !req.write {
+		return &apiError{http.StatusForbidden, "Unauthorized write access"}
+	}
+	if !ValidOid(oid) {
+		return &apiError{http.StatusUnprocessableEntity, "Invalid object id"}
+	}
+	if err := Store(org, repo, oid, r.Body); err != nil {
+		return &apiError{http.StatusUnprocessableEntity, err.Error()}
+	}
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+type lockRequest struct {
+	Path  string `json:"path"`
+	Force bool   `json:"force"`
+	Limit int    `json:"limit"`
+	// Position in the list of locks
+	Cursor string `json:"cursor"`
+}
+
+type lockList struct {
+	Locks      []Lock `json:"locks"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+type lockVerifyList struct {
+	Ours       []Lock `json:"ours"`
+	Theirs     []Lock `json:"theirs"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// Returns the page of locks starting at cursor, and the next cursor
+func page(locks []Lock, cursor string, limit int) ([]Lock, string, *apiError) {
+	if limit <= 0 || limit > maxLocksLimit {
+		limit = maxLocksLimit
+	}
+	start := 0
+	if cursor != "" {
+		start = -1
+		for i, l := range locks {
+			if l.Id == cursor {
+				start = i
+			}
+		}
+		if start < 0 {
+			return nil, "", &apiError{http.StatusUnprocessableEntity, "Invalid cursor"}
+		}
+	}
+	end := start + limit
+	if end >= len(locks) {
+		return locks[start:], "", nil
+	}
+	return locks[start:end], locks[end].Id, nil
+}
+
+func listLocks(w http.ResponseWriter, r *http.Request, org string, repo string) *apiError {
+	locks, err := Locks(org, repo)
+	if err != nil {
+		return &apiError{http.StatusInternalServerError, err.Error()}
+	}
+	query := r.URL.Query()
+	filtered := []Lock{}
+	for _, l := range locks {
+		if (query.Get("path") == "" || l.Path == query.Get("path")) && (query.Get("id") == "" || l.Id == query.Get("id")) {
+			filtered = append(filtered, l)
+		}
+	}
+	limit, _ := strconv.Atoi(query.Get("limit"))
+	result, next, e := page(filtered, query.Get("cursor"), limit)
+	if e != nil {
+		return e
+	}
+	writeJSON(w, http.StatusOK, lockList{result, next})
+	return nil
+}
+
+func createLock(w http.ResponseWriter, r *http.Request, req requester, org string, repo string) *apiError {
+	if !req.write {
+		return &apiError{http.StatusForbidden, "Unauthorized write access"}
+	}
+	lr := lockRequest{}
+	if e := decode(r, &lr); e != nil {
+		return e
+	}
+	if lr.Path == "" {
+		return &apiError{http.StatusUnprocessableEntity, "Missing path"}
+	}
+	lock, err := CreateLock(org, repo, lr.Path, req.name)
+	if exists, ok := err.(ErrLockExists); ok {
+		writeJSON(w, http.StatusConflict, map[string]interface{}{"lock": exists.Lock, "message": err.Error()})
+		return nil
+	}
+	if err != nil {
+		return &apiError{http.StatusInternalServerError, err.Error()}
+	}
+	writeJSON(w, http.StatusCreated, map[string]Lock{"lock": lock})
+	return nil
+}
+
+func verifyLocks(w http.ResponseWriter, r *http.Request, req requester, org string, repo string) *apiError {
+	if !req.write {
+		return &apiError{http.StatusForbidden, "Unauthorized write access"}
+	}
+	lr := lockRequest{}
+	if e := decode(r, &lr); e != nil {
+		return e
+	}
+	locks, err := Locks(org, repo)
+	if err != nil {
+		return &apiError{http.StatusInternalServerError, err.Error()}
+	}
+	result, next, e := page(locks, lr.Cursor, lr.Limit)
+	if e != nil {
+		return e
+	}
+	resp := lockVerifyList{Ours: []Lock{}, Theirs: []Lock{}, NextCursor: next}
+	for _, l := range result {
+		if l.Owner.Name == req.name {
+			resp.Ours = append(resp.Ours, l)
+		} else {
+			resp.Theirs = append(resp.Theirs, l)
+		}
+	}
+	writeJSON(w, http.StatusOK, resp)
+	return nil
+}
+
+func unlock(w http.ResponseWriter, r *http.Request, req requester, org string, repo string, id string) *apiError {
+	if !req.write {
+		return &apiError{http.StatusForbidden, "Unauthorized write access"}
+	}
+	lr := lockRequest{}
+	if e := decode(r, &lr); e != nil {
+		return e
+	}
+	lock, err := DeleteLock(org, repo, id, req.name, lr.Force)
+	if err == ErrLockNotFound {
+		return &apiError{http.StatusNotFound, err.Error()}
+	}
+	if _, ok := err.(ErrLockOwned); ok {
+		return &apiError{http.StatusForbidden, err.Error()}
+	}
+	if err != nil {
+		return &apiError{http.StatusInternalServerError, err.Error()}
+	}
+	writeJSON(w, http.StatusOK, map[string]Lock{"lock": lock})
+	return nil
+}
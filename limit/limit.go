@@ -0,0 +1,328 @@
+package limit
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/dgellow/nanogit/config"
+	"github.com/dgellow/nanogit/log"
+	"github.com/dgellow/nanogit/metrics"
+	"github.com/dgellow/nanogit/settings"
+)
+
+// Kinds of slots, and names of the limits in metrics
+const (
+	Connections    = "connections"
+	Processes      = "processes"
+	NewConnections = "newconnections"
+	FailedAuth     = "failedauth"
+)
+
+// Scope of the total limits
+const serverScope = "the server"
+
+// Buckets of addresses are dropped once full, when there are more than this
+const maxBuckets = 4096
+
+// Clock of the token buckets, replaced by tests
+var now = time.Now
+
+var (
+	mutex sync.Mutex
+	// Slots in use by kind, then by scope: the server, a user or an address
+	used = map[string]map[string]int{Connections: {}, Processes: {}}
+	// Clients waiting for a slot
+	queued int
+	// Closed and replaced each time a slot is released, to wake up the
+	// clients waiting for one
+	released = make(chan struct{})
+	// Token buckets by address
+	connectionBuckets = map[string]*bucket{}
+	failureBuckets    = map[string]*bucket{}
+	// Rejected clients by limit
+	rejected = map[string]float64{}
+)
+
+type slot struct {
+	scope string
+	limit int
+}
+
+// Accept is called for each new connection, before the handshake. It takes
+// a token of the new connections of the address, then a connection slot of
+// the server and of the address, waiting in the queue if needed. Addresses
+// with too many failed authentications are refused. The returned function
+// releases the slot, once the connection is closed.
+func Accept(remote net.Addr) (func(), error) {
+	lc := settings.ConfInfo.Get().Server.Limits
+	address := host(remote)
+	log.Trace("limit: Accept, address: %s", address)
+	if err := checkRates(lc, address); err != nil {
+		return nil, err
+	}
+	return acquire(Connections, slot{serverScope, lc.Connections.Total}, slot{"address " + address, lc.Connections.PerIP})
+}
+
+func checkRates(lc config.LimitsConfig, address string) error {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if blocked(failureBuckets, lc.FailedAuth, address) {
+		return reject(FailedAuth, "Too many failed authentications from %s, try again later", address)
+	}
+	if !take(connectionBuckets, lc.NewConnections, address) {
+		return reject(NewConnections, "Too many new connections from %s, try again later", address)
+	}
+	return nil
+}
+
+// StartSession is called once a client is authenticated as user, a user or
+// a deploy key. It takes a connection slot of the user, released by the
+// returned function once the connection is closed.
+func StartSession(user string) (func(), error) {
+	log.Trace("limit: StartSession, user: %s", user)
+	lc := settings.ConfInfo.Get().Server.Limits
+	return acquire(Connections, slot{userScope(user), lc.Connections.PerUser})
+}
+
+// StartProcess is called before running a command for user connected from
+// remote. It takes a process slot of the server, the user and the address,
+// released by the returned function once the command exits.
+func StartProcess(user string, remote net.Addr) (func(), error) {
+	address := host(remote)
+	log.Trace("limit: StartProcess, user: %s, address: %s", user, address)
+	pc := settings.ConfInfo.Get().Server.Limits.Processes
+	return acquire(Processes, slot{serverScope, pc.Total}, slot{userScope(user), pc.PerUser}, slot{"address " + address, pc.PerIP})
+}
+
+// AuthFailed takes a token of the failed authentications of the address.
+func AuthFailed(remote net.Addr) {
+	rc := settings.ConfInfo.Get().Server.Limits.FailedAuth
+	mutex.Lock()
+	defer mutex.Unlock()
+	take(failureBuckets, rc, host(remote))
+}
+
+// AuthBlocked returns whether the address has no failed authentications
+// left, its authentications are then refused.
+func AuthBlocked(remote net.Addr) bool {
+	rc := settings.ConfInfo.Get().Server.Limits.FailedAuth
+	mutex.Lock()
+	defer mutex.Unlock()
+	if blocked(failureBuckets, rc, host(remote)) {
+		rejected[FailedAuth]++
+		return true
+	}
+	return false
+}
+
+// Takes a slot of each scope, waiting in the queue until all of them are
+// free or the timeout of the queue expires
+func acquire(kind string, slots ...slot) (func(), error) {
+	qc := settings.ConfInfo.Get().Server.Limits.Queue
+	mutex.Lock()
+	defer mutex.Unlock()
+	var timeout <-chan time.Time
+	for {
+		full := fullSlot(kind, slots)
+		if full == nil {
+			break
+		}
+		if timeout == nil {
+			if qc.Timeout <= 0 || (qc.Size > 0 && queued >= qc.Size) {
+				return nil, rejectSlot(kind, *full)
+			}
+			timer := time.NewTimer(qc.Timeout)
+			defer timer.Stop()
+			timeout = timer.C
+			queued++
+			defer func() { queued-- }()
+		}
+		wake := released
+		mutex.Unlock()
+		select {
+		case <-wake:
+			mutex.Lock()
+		case <-timeout:
+			mutex.Lock()
+			return nil, rejectSlot(kind, *full)
+		}
+	}
+
+	for _, s := range slots {
+		if s.scope != "" {
+			used[kind][s.scope]++
+		}
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			mutex.Lock()
+			defer mutex.Unlock()
+			for _, s := range slots {
+				if s.scope == "" {
+					continue
+				}
+				if used[kind][s.scope]--; used[kind][s.scope] <= 0 {
+					delete(used[kind], s.scope)
+				}
+			}
+			close(released)
+			released = make(chan struct{})
+		})
+	}, nil
+}
+
+// Returns the first slot of slots with no free slot left, or nil
+func fullSlot(kind string, slots []slot) *slot {
+	for i, s := range slots {
+		if s.scope != "" && s.limit > 0 && used[kind][s.scope] >= s.limit {
+			return &slots[i]
+		}
+	}
+	return nil
+}
+
+func rejectSlot(kind string, s slot) error {
+	return reject(kind, "Limit of %d concurrent %s of %s reached, try again later", s.limit, kind, s.scope)
+}
+
+// Counts and logs a rejected client, mutex must be held
+func reject(limit string, format string, v ...interface{}) error {
+	rejected[limit]++
+	err := fmt.Errorf(format, v...)
+	log.Warn("limit: %v", err)
+	return err
+}
+
+func userScope(user string) string {
+	if user == "" {
+		return ""
+	}
+	return "user " + user
+}
+
+// Address of remote, without its port
+func host(remote net.Addr) string {
+	if tcpAddr, ok := remote.(*net.TCPAddr); ok {
+		return tcpAddr.IP.String()
+	}
+	if h, _, err := net.SplitHostPort(remote.String()); err == nil {
+		return h
+	}
+	return remote.String()
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Returns the bucket of key, refilled for the time elapsed since it was last
+// used. New buckets are full.
+func refill(buckets map[string]*bucket, rc config.RateConfig, key string) *bucket {
+	burst := math.Max(1, float64(rc.Burst))
+	t := now()
+	b, ok := buckets[key]
+	if !ok {
+		if len(buckets) >= maxBuckets {
+			for k, other := range buckets {
+				if other.tokens+float64(t.Sub(other.last))/float64(rc.Every) >= burst {
+					delete(buckets, k)
+				}
+			}
+		}
+		b = &bucket{burst, t}
+		buckets[key] = b
+		return b
+	}
+	b.tokens = math.Min(burst, b.tokens+float64(t.Sub(b.last))/float64(rc.Every))
+	b.last = t
+	return b
+}
+
+// Takes a token of the bucket of key, returns false if it is empty
+func take(buckets map[string]*bucket, rc config.RateConfig, key string) bool {
+	if rc.Every <= 0 {
+		return true
+	}
+	b := refill(buckets, rc, key)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func blocked(buckets map[string]*bucket, rc config.RateConfig, key string) bool {
+	return rc.Every > 0 && refill(buckets, rc, key).tokens < 1
+}
+
+func init() {
+	kinds := []string{Connections, Processes}
+	metrics.Register(metrics.Metric{
+		Name: "nanogit_limit_in_use",
+		Help: "Concurrent SSH connections and git processes.",
+		Type: "gauge",
+		Collect: func() []metrics.Sample {
+			mutex.Lock()
+			defer mutex.Unlock()
+			samples := []metrics.Sample{}
+			for _, kind := range kinds {
+				samples = append(samples, metrics.Sample{Labels: map[string]string{"kind": kind}, Value: float64(used[kind][serverScope])})
+			}
+			return samples
+		},
+	})
+	metrics.Register(metrics.Metric{
+		Name: "nanogit_limit_max",
+		Help: "Configured limit of concurrent SSH connections and git processes, 0 if unlimited.",
+		Type: "gauge",
+		Collect: func() []metrics.Sample {
+			lc := settings.ConfInfo.Get().Server.Limits
+			samples := []metrics.Sample{}
+			for _, kind := range kinds {
+				cc := lc.Connections
+				if kind == Processes {
+					cc = lc.Processes
+				}
+				for _, scope := range []struct {
+					name  string
+					limit int
+				}{{"total", cc.Total}, {"peruser", cc.PerUser}, {"perip", cc.PerIP}} {
+					samples = append(samples, metrics.Sample{
+						Labels: map[string]string{"kind": kind, "scope": scope.name},
+						Value:  float64(scope.limit),
+					})
+				}
+			}
+			return samples
+		},
+	})
+	metrics.Register(metrics.Metric{
+		Name: "nanogit_limit_queued",
+		Help: "SSH clients waiting for a connection or process slot.",
+		Type: "gauge",
+		Collect: func() []metrics.Sample {
+			mutex.Lock()
+			defer mutex.Unlock()
+			return []metrics.Sample{{Value: float64(queued)}}
+		},
+	})
+	metrics.Register(metrics.Metric{
+		Name: "nanogit_limit_rejected_total",
+		Help: "SSH clients rejected by a limit.",
+		Type: "counter",
+		Collect: func() []metrics.Sample {
+			mutex.Lock()
+			defer mutex.Unlock()
+			samples := []metrics.Sample{}
+			for _, limit := range []string{Connections, Processes, NewConnections, FailedAuth} {
+				samples = append(samples, metrics.Sample{Labels: map[string]string{"limit": limit}, Value: rejected[limit]})
+			}
+			return samples
+		},
+	})
+}
@@ -0,0 +1,212 @@
+package limit
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgellow/nanogit/config"
+	"github.com/dgellow/nanogit/metrics"
+	"github.com/dgellow/nanogit/settings"
+)
+
+func setup(lc config.LimitsConfig) {
+	settings.ConfInfo.Set(config.Config{Server: config.ServerConfig{Limits: lc}})
+	used = map[string]map[string]int{Connections: {}, Processes: {}}
+	queued = 0
+	connectionBuckets = map[string]*bucket{}
+	failureBuckets = map[string]*bucket{}
+	rejected = map[string]float64{}
+}
+
+func addr(ip string) net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP(ip), Port: 52100}
+}
+
+func TestConcurrency(t *testing.T) {
+	setup(config.LimitsConfig{
+		Connections: config.ConcurrencyConfig{Total: 3, PerIP: 2, PerUser: 1},
+		Processes:   config.ConcurrencyConfig{Total: 2, PerUser: 1},
+	})
+	defer setup(config.LimitsConfig{})
+
+	releases := []func(){}
+	for i, test := range []struct {
+		ip    string
+		error string
+	}{
+		{"10.0.0.1", ""},
+		{"10.0.0.1", ""},
+		{"10.0.0.1", "Limit of 2 concurrent connections of address 10.0.0.1 reached"},
+		{"10.0.0.2", ""},
+		{"10.0.0.3", "Limit of 3 concurrent connections of the server reached"},
+	} {
+		release, err := Accept(addr(test.ip))
+		if test.error == "" && err != nil || test.error != "" && (err == nil || !strings.Contains(err.Error(), test.error)) {
+			t.Errorf("#%d: Accept(%s) == %v, expected %q", i, test.ip, err, test.error)
+		}
+		if err == nil {
+			releases = append(releases, release)
+		}
+	}
+	// Releasing twice frees a single slot
+	releases[0]()
+	releases[0]()
+	if _, err := Accept(addr("10.0.0.3")); err != nil {
+		t.Errorf("Accept(10.0.0.3) == %v after a release", err)
+	}
+	if _, err := Accept(addr("10.0.0.4")); err == nil {
+		t.Errorf("Accept(10.0.0.4) == nil, expected the server to be full")
+	}
+
+	if _, err := StartSession("alice"); err != nil {
+		t.Errorf("StartSession(alice) == %v", err)
+	}
+	if _, err := StartSession("alice"); err == nil || !strings.Contains(err.Error(), "of user alice") {
+		t.Errorf("StartSession(alice) == %v, expected the limit of alice", err)
+	}
+	if _, err := StartSession("bob"); err != nil {
+		t.Errorf("StartSession(bob) == %v", err)
+	}
+
+	release, err := StartProcess("alice", addr("10.0.0.1"))
+	if err != nil {
+		t.Fatalf("StartProcess(alice) == %v", err)
+	}
+	if _, err := StartProcess("alice", addr("10.0.0.2")); err == nil {
+		t.Errorf("StartProcess(alice) == nil, expected the limit of alice")
+	}
+	if _, err := StartProcess("bob", addr("10.0.0.1")); err != nil {
+		t.Errorf("StartProcess(bob) == %v", err)
+	}
+	if _, err := StartProcess("carol", addr("10.0.0.1")); err == nil {
+		t.Errorf("StartProcess(carol) == nil, expected the server to be full")
+	}
+	release()
+	if _, err := StartProcess("carol", addr("10.0.0.1")); err != nil {
+		t.Errorf("StartProcess(carol) == %v after a release", err)
+	}
+
+	var buf bytes.Buffer
+	if err := metrics.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		`nanogit_limit_in_use{kind="connections"} 3`,
+		`nanogit_limit_in_use{kind="processes"} 2`,
+		`nanogit_limit_max{kind="connections",scope="perip"} 2`,
+		`nanogit_limit_rejected_total{limit="connections"} 4`,
+		`nanogit_limit_rejected_total{limit="processes"} 2`,
+	} {
+		if !strings.Contains(buf.String(), expected) {
+			t.Errorf("Metrics don't contain %s:\n%s", expected, buf.String())
+		}
+	}
+}
+
+func TestQueue(t *testing.T) {
+	setup(config.LimitsConfig{
+		Processes: config.ConcurrencyConfig{Total: 1},
+		Queue:     config.QueueConfig{Size: 1, Timeout: time.Minute},
+	})
+	defer setup(config.LimitsConfig{})
+
+	release, err := StartProcess("alice", addr("10.0.0.1"))
+	if err != nil {
+		t.Fatalf("StartProcess() == %v", err)
+	}
+	acquired := make(chan error)
+	go func() {
+		_, err := StartProcess("bob", addr("10.0.0.2"))
+		acquired <- err
+	}()
+	// Wait for bob to be queued
+	for {
+		mutex.Lock()
+		n := queued
+		mutex.Unlock()
+		if n == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := StartProcess("carol", addr("10.0.0.3")); err == nil {
+		t.Errorf("StartProcess(carol) == nil, expected the queue to be full")
+	}
+	release()
+	if err := <-acquired; err != nil {
+		t.Errorf("StartProcess(bob) == %v, expected to get the released slot", err)
+	}
+
+	settings.ConfInfo.Conf.Server.Limits.Queue.Timeout = 10 * time.Millisecond
+	start := time.Now()
+	if _, err := StartProcess("carol", addr("10.0.0.3")); err == nil || time.Since(start) < 10*time.Millisecond {
+		t.Errorf("StartProcess(carol) == %v after %v, expected to time out", err, time.Since(start))
+	}
+	if queued != 0 {
+		t.Errorf("%d clients left in the queue", queued)
+	}
+}
+
+func TestRates(t *testing.T) {
+	setup(config.LimitsConfig{
+		NewConnections: config.RateConfig{Every: time.Second, Burst: 2},
+		FailedAuth:     config.RateConfig{Every: time.Minute, Burst: 2},
+	})
+	defer setup(config.LimitsConfig{})
+	clock := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	now = func() time.Time { return clock }
+	defer func() { now = time.Now }()
+
+	accept := func(ip string) error {
+		release, err := Accept(addr(ip))
+		if err == nil {
+			release()
+		}
+		return err
+	}
+	for i := 0; i < 2; i++ {
+		if err := accept("10.0.0.1"); err != nil {
+			t.Errorf("#%d: Accept() == %v", i, err)
+		}
+	}
+	if err := accept("10.0.0.1"); err == nil || !strings.Contains(err.Error(), "Too many new connections from 10.0.0.1") {
+		t.Errorf("Accept() == %v, expected the bucket to be empty", err)
+	}
+	// Buckets are per address
+	if err := accept("10.0.0.2"); err != nil {
+		t.Errorf("Accept(10.0.0.2) == %v", err)
+	}
+	clock = clock.Add(time.Second)
+	if err := accept("10.0.0.1"); err != nil {
+		t.Errorf("Accept() == %v, expected a token a second later", err)
+	}
+	clock = clock.Add(time.Hour)
+
+	AuthFailed(addr("10.0.0.3"))
+	if AuthBlocked(addr("10.0.0.3")) {
+		t.Errorf("AuthBlocked() == true after a single failure")
+	}
+	AuthFailed(addr("10.0.0.3"))
+	if !AuthBlocked(addr("10.0.0.3")) {
+		t.Errorf("AuthBlocked() == false after two failures")
+	}
+	if err := accept("10.0.0.3"); err == nil || !strings.Contains(err.Error(), "Too many failed authentications") {
+		t.Errorf("Accept() == %v, expected the address to be blocked", err)
+	}
+	clock = clock.Add(time.Minute)
+	if AuthBlocked(addr("10.0.0.3")) {
+		t.Errorf("AuthBlocked() == true a minute later")
+	}
+
+	// Disabled rates never block
+	settings.ConfInfo.Conf.Server.Limits = config.LimitsConfig{}
+	for i := 0; i < 10; i++ {
+		AuthFailed(addr("10.0.0.4"))
+		if err := accept("10.0.0.4"); err != nil {
+			t.Errorf("#%d: Accept() == %v without limits", i, err)
+		}
+	}
+}
@@ -10,6 +10,7 @@ type Brush func(string) string
 
 func init() {
 	Register("console", NewConsole)
+	Register("stderr", NewStderrConsole)
 }
 
 func NewBrush(color string) Brush {
@@ -53,3 +54,11 @@ func (cw *ConsoleWriter) Write(l *Logger, msg string, level int) error {
 	}
 	return nil
 }
+
+// create ConsoleWriter writing to stderr, used when stdout is reserved for
+// the output of a command.
+func NewStderrConsole() LogProvider {
+	return &ConsoleWriter{
+		Log: log.New(os.Stderr, "", log.Ldate|log.Ltime),
+	}
+}
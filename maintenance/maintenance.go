@@ -0,0 +1,281 @@
+package maintenance
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgellow/nanogit/config"
+	"github.com/dgellow/nanogit/dir"
+	"github.com/dgellow/nanogit/fork"
+	"github.com/dgellow/nanogit/git"
+	"github.com/dgellow/nanogit/log"
+	"github.com/dgellow/nanogit/quota"
+	"github.com/dgellow/nanogit/settings"
+	"github.com/dgellow/nanogit/store"
+)
+
+// Name of the maintenance status file, under the store directory of the
+// data root.
+const storeName = "maintenance.yml"
+
+const (
+	DefaultInterval    = 24 * time.Hour
+	DefaultPushes      = 100
+	DefaultConcurrency = 2
+)
+
+var DefaultTasks = []string{"gc", "commit-graph"}
+
+// Git commands of the maintenance tasks. Objects borrowed from the source
+// of a fork are left out of its packs.
+var tasks = map[string][]string{
+	"gc":           {"gc", "--quiet"},
+	"repack":       {"repack", "-a", "-d", "-l", "-q"},
+	"commit-graph": {"commit-graph", "write", "--reachable"},
+	"pack-refs":    {"pack-refs", "--all", "--prune"},
+}
+
+// How often the scheduler looks for repos due for maintenance
+var CheckInterval = time.Minute
+
+// Status is the result of the last maintenance run of a repository.
+type Status struct {
+	LastRun     time.Time
+	LastSuccess time.Time
+	Duration    time.Duration
+	// What started the run: schedule, pushes or manual
+	Trigger string
+	Error   string
+}
+
+// Config returns the maintenance settings of given org, the ones of the
+// server overridden by the ones of the org and its parents.
+func Config(org string) config.MaintenanceConfig {
+	mc := settings.ConfInfo.Get().Server.Maintenance
+	segments := strings.Split(org, "/")
+	for i := 1; i <= len(segments); i++ {
+		orgConfig, err := settings.ConfInfo.LookupOrgById(strings.Join(segments[:i], "/"))
+		if err != nil {
+			break
+		}
+		if orgConfig.Maintenance.Interval > 0 {
+			mc.Interval = orgConfig.Maintenance.Interval
+		}
+		if orgConfig.Maintenance.Pushes > 0 {
+			mc.Pushes = orgConfig.Maintenance.Pushes
+		}
+		if len(orgConfig.Maintenance.Tasks) > 0 {
+			mc.Tasks = orgConfig.Maintenance.Tasks
+		}
+	}
+	if mc.Interval <= 0 {
+		mc.Interval = DefaultInterval
+	}
+	if mc.Pushes <= 0 {
+		mc.Pushes = DefaultPushes
+	}
+	if len(mc.Tasks) == 0 {
+		mc.Tasks = DefaultTasks
+	}
+	if mc.Concurrency <= 0 {
+		mc.Concurrency = DefaultConcurrency
+	}
+	return mc
+}
+
+// Statuses returns the result of the last maintenance run of every repo,
+// keyed by org/repo.
+func Statuses() (map[string]Status, error) {
+	statuses := map[string]Status{}
+	if err := store.Load(storeName, &statuses); err != nil {
+		return nil, err
+	}
+	return statuses, nil
+}
+
+func saveStatus(repo dir.RepoPath, status Status) {
+	statuses := map[string]Status{}
+	err := store.Update(storeName, &statuses, func() error {
+		if status.Error != "" {
+			status.LastSuccess = statuses[repo.String()].LastSuccess
+		}
+		statuses[repo.String()] = status
+		return nil
+	})
+	if err != nil {
+		log.Error("maintenance: cannot save status of %s: %v", repo, err)
+	}
+}
+
+// Run runs the maintenance tasks of given repository and records the
+// result. Objects only referenced by forks are protected first.
+func Run(org string, repo string, trigger string) error {
+	log.Trace("maintenance: Run, repo: %s/%s, trigger: %s", org, repo, trigger)
+	path := dir.RepoPath{Org: org, Repo: repo}
+	start := time.Now()
+	err := run(org, repo)
+	status := Status{LastRun: start, LastSuccess: start, Duration: time.Since(start), Trigger: trigger}
+	if err != nil {
+		log.Error("maintenance: %s: %v", path, err)
+		status.Error = err.Error()
+	}
+	saveStatus(path, status)
+	return err
+}
+
+func run(org string, repo string) error {
+	repoPath, err := dir.GetRepoDir(org, repo)
+	if err != nil {
+		return err
+	}
+	for _, task := range Config(org).Tasks {
+		if _, present := tasks[task]; !present {
+			return fmt.Errorf("Unknown maintenance task: %s", task)
+		}
+	}
+	if err := fork.Protect(org, repo); err != nil {
+		return err
+	}
+	for _, task := range Config(org).Tasks {
+		if _, err := git.Run(repoPath, nil, tasks[task]...); err != nil {
+			return fmt.Errorf("Task %s failed: %v", task, err)
+		}
+	}
+	if _, err := quota.Refresh(org, repo); err != nil {
+		return fmt.Errorf("Cannot compute size: %v", err)
+	}
+	return nil
+}
+
+// Scheduler maintains repositories at their interval and after a number of
+// pushes, a limited number at a time. Repos with an active push are
+// skipped until the push is done.
+type Scheduler struct {
+	mutex   sync.Mutex
+	active  map[string]int
+	pushes  map[string]int
+	running map[string]bool
+	slots   chan struct{}
+	stop    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// Start starts maintaining the repositories under the data root.
+func Start() *Scheduler {
+	s := &Scheduler{
+		active:  map[string]int{},
+		pushes:  map[string]int{},
+		running: map[string]bool{},
+		slots:   make(chan struct{}, Config("").Concurrency),
+		stop:    make(chan struct{}),
+	}
+	s.wg.Add(1)
+	go s.loop()
+	return s
+}
+
+func (s *Scheduler) loop() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(CheckInterval)
+	defer ticker.Stop()
+	for {
+		s.schedule()
+		select {
+		case <-ticker.C:
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// Starts the repos due for maintenance
+func (s *Scheduler) schedule() {
+	repos, err := dir.ListRepos()
+	if err != nil {
+		log.Error("maintenance: cannot list repos: %v", err)
+		return
+	}
+	statuses, err := Statuses()
+	if err != nil {
+		log.Error("maintenance: cannot read status: %v", err)
+		return
+	}
+	now := time.Now()
+	for _, repo := range repos {
+		if now.Sub(statuses[repo.String()].LastRun) >= Config(repo.Org).Interval {
+			s.start(repo, "schedule")
+		}
+	}
+}
+
+// Runs maintenance of repo in the background, unless it is already running
+// or being pushed to. Returns whether it was started.
+func (s *Scheduler) start(repo dir.RepoPath, trigger string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	key := repo.String()
+	if s.running[key] || s.active[key] > 0 {
+		return false
+	}
+	s.running[key] = true
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		select {
+		case s.slots <- struct{}{}:
+		case <-s.stop:
+			s.done(key)
+			return
+		}
+		// A push may have started while waiting for a slot
+		s.mutex.Lock()
+		pushing := s.active[key] > 0
+		s.mutex.Unlock()
+		if !pushing {
+			Run(repo.Org, repo.Repo, trigger)
+		}
+		<-s.slots
+		s.done(key)
+	}()
+	return true
+}
+
+func (s *Scheduler) done(key string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.running, key)
+}
+
+// PushStarted marks given repo as being pushed to.
+func (s *Scheduler) PushStarted(org string, repo string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.active[dir.RepoPath{Org: org, Repo: repo}.String()]++
+}
+
+// PushDone counts a push to given repo, maintenance is started once enough
+// pushes were received.
+func (s *Scheduler) PushDone(org string, repo string) {
+	path := dir.RepoPath{Org: org, Repo: repo}
+	s.mutex.Lock()
+	s.active[path.String()]--
+	if s.active[path.String()] <= 0 {
+		delete(s.active, path.String())
+	}
+	s.pushes[path.String()]++
+	due := s.pushes[path.String()] >= Config(org).Pushes
+	s.mutex.Unlock()
+	if due && s.start(path, "pushes") {
+		s.mutex.Lock()
+		delete(s.pushes, path.String())
+		s.mutex.Unlock()
+	}
+}
+
+// Stop waits for running maintenance to finish and stops the scheduler.
+func (s *Scheduler) Stop() {
+	close(s.stop)
+	s.wg.Wait()
+}
@@ -0,0 +1,128 @@
+package maintenance
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgellow/nanogit/config"
+	"github.com/dgellow/nanogit/git"
+	"github.com/dgellow/nanogit/settings"
+)
+
+// Returns the number of loose objects of the repo
+func looseObjects(t *testing.T, repoPath string) string {
+	out, err := git.Run(repoPath, nil, "count-objects", "-v")
+	if err != nil {
+		t.Fatalf("Cannot count objects of %s: %v", repoPath, err)
+	}
+	return strings.Fields(out)[1]
+}
+
+func waitStatus(t *testing.T, key string, cond func(s Status) bool) Status {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		statuses, err := Statuses()
+		if err != nil {
+			t.Fatalf("Statuses() == %v", err)
+		}
+		if s, ok := statuses[key]; ok && cond(s) {
+			return s
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("Timeout waiting for maintenance status of %s", key)
+	return Status{}
+}
+
+func TestMaintenance(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "nanogit-maintenance")
+	if err != nil {
+		t.Fatalf("Cannot create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	settings.ConfInfo.Set(config.Config{
+		Server: config.ServerConfig{
+			DataRoot:    filepath.Join(tmpDir, "dataroot"),
+			Maintenance: config.MaintenanceConfig{Concurrency: 1},
+		},
+		Orgs: []config.OrgConfig{{
+			Id:          "fixme",
+			Maintenance: config.MaintenanceConfig{Pushes: 2, Tasks: []string{"gc", "pack-refs"}},
+		}},
+	})
+	defer func() { settings.ConfInfo.Set(config.Config{}) }()
+
+	if mc := Config("fixme"); mc.Interval != DefaultInterval || mc.Pushes != 2 || len(mc.Tasks) != 2 || mc.Concurrency != 1 {
+		t.Errorf("Config(fixme) == %+v", mc)
+	}
+	if mc := Config("qrclabs"); mc.Pushes != DefaultPushes || len(mc.Tasks) != len(DefaultTasks) {
+		t.Errorf("Config(qrclabs) == %+v", mc)
+	}
+
+	repoPath := filepath.Join(tmpDir, "dataroot", "fixme", "foo")
+	workPath := filepath.Join(tmpDir, "work")
+	if _, err := git.Run("", nil, "init", "--bare", "--quiet", repoPath); err != nil {
+		t.Fatalf("Cannot init repo: %v", err)
+	}
+	if _, err := git.Run("", nil, "init", "--quiet", workPath); err != nil {
+		t.Fatalf("Cannot init work tree: %v", err)
+	}
+	push := func() {
+		_, err := git.Run(workPath, nil, "-c", "user.name=nanogit", "-c", "user.email=nanogit@localhost",
+			"commit", "--allow-empty", "--quiet", "-m", "commit")
+		if err != nil {
+			t.Fatalf("Cannot commit: %v", err)
+		}
+		if _, err := git.Run(workPath, nil, "push", "--quiet", repoPath, "HEAD:refs/heads/master"); err != nil {
+			t.Fatalf("Cannot push to repo: %v", err)
+		}
+	}
+
+	push()
+	if looseObjects(t, repoPath) == "0" {
+		t.Fatalf("Expected loose objects after push")
+	}
+	if err := Run("fixme", "foo", "manual"); err != nil {
+		t.Fatalf("Run() == %v", err)
+	}
+	if count := looseObjects(t, repoPath); count != "0" {
+		t.Errorf("Loose objects after Run() == %s; expected 0", count)
+	}
+	manual := waitStatus(t, "fixme/foo", func(s Status) bool { return true })
+	if manual.Trigger != "manual" || manual.Error != "" || !manual.LastSuccess.Equal(manual.LastRun) {
+		t.Errorf("Status after Run() == %+v", manual)
+	}
+
+	// The repo isn't due, maintenance is triggered by pushes once the last
+	// active one is done
+	s := Start()
+	s.PushStarted("fixme", "foo")
+	s.PushStarted("fixme", "foo")
+	push()
+	s.PushDone("fixme", "foo")
+	push()
+	s.PushDone("fixme", "foo")
+	pushes := waitStatus(t, "fixme/foo", func(s Status) bool { return s.LastRun.After(manual.LastRun) })
+	if pushes.Trigger != "pushes" {
+		t.Errorf("Status after pushes == %+v", pushes)
+	}
+	if count := looseObjects(t, repoPath); count != "0" {
+		t.Errorf("Loose objects after pushes == %s; expected 0", count)
+	}
+	s.Stop()
+
+	// Failed runs keep the last success
+	settings.ConfInfo.Conf.Orgs[0].Maintenance.Tasks = []string{"unknown"}
+	if err := Run("fixme", "foo", "manual"); err == nil {
+		t.Errorf("Run() with unknown task == nil; expected error")
+	}
+	failed := waitStatus(t, "fixme/foo", func(s Status) bool { return s.Error != "" })
+	if !failed.LastSuccess.Equal(pushes.LastSuccess) {
+		t.Errorf("Status after failure == %+v; expected last success %v", failed, pushes.LastSuccess)
+	}
+}
@@ -0,0 +1,106 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/dgellow/nanogit/log"
+)
+
+// Sample is a value of a metric, identified by its labels.
+type Sample struct {
+	Labels map[string]string
+	Value  float64
+}
+
+// Metric is collected on each scrape of the endpoint.
+type Metric struct {
+	Name string
+	Help string
+	// gauge or counter
+	Type    string
+	Collect func() []Sample
+}
+
+var (
+	mutex    sync.Mutex
+	registry []Metric
+)
+
+// Register adds a metric to the endpoint.
+func Register(m Metric) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	registry = append(registry, m)
+}
+
+// Write writes every registered metric to w, in the Prometheus text format.
+func Write(w io.Writer) error {
+	mutex.Lock()
+	metrics := make([]Metric, len(registry))
+	copy(metrics, registry)
+	mutex.Unlock()
+
+	for _, m := range metrics {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.Name, m.Help, m.Name, m.Type); err != nil {
+			return err
+		}
+		for _, sample := range m.Collect() {
+			if _, err := fmt.Fprintf(w, "%s%s %s\n", m.Name, formatLabels(sample.Labels),
+				strconv.FormatFloat(sample.Value, 'f', -1, 64)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func formatLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	names := []string{}
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	pairs := []string{}
+	for _, name := range names {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", name, escaper.Replace(labels[name])))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// Label values are quoted with backslash, double quote and line feed escaped
+var escaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func handler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if err := Write(w); err != nil {
+		log.Error("metrics: cannot write metrics: %v", err)
+	}
+}
+
+// Listen serves the metrics on /metrics at the given address in the
+// background.
+func Listen(address string) error {
+	log.Trace("metrics: Listen, address: %s", address)
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", handler)
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			log.Error("metrics: %v", err)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,45 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestWrite(t *testing.T) {
+	defer func(r []Metric) { registry = r }(registry)
+	registry = nil
+
+	Register(Metric{
+		Name: "nanogit_test_failed",
+		Help: "Test metric.",
+		Type: "gauge",
+		Collect: func() []Sample {
+			return []Sample{
+				{Labels: map[string]string{"repo": "fixme/foo", "org": "fixme"}, Value: 1},
+				{Labels: map[string]string{"repo": "odd\"name\\\n"}, Value: 0.5},
+			}
+		},
+	})
+	Register(Metric{
+		Name:    "nanogit_test_total",
+		Help:    "Test counter.",
+		Type:    "counter",
+		Collect: func() []Sample { return []Sample{{Value: 42}} },
+	})
+
+	var buf bytes.Buffer
+	if err := Write(&buf); err != nil {
+		t.Fatalf("Write() == %v", err)
+	}
+	expected := `# HELP nanogit_test_failed Test metric.
+# TYPE nanogit_test_failed gauge
+nanogit_test_failed{org="fixme",repo="fixme/foo"} 1
+nanogit_test_failed{repo="odd\"name\\\n"} 0.5
+# HELP nanogit_test_total Test counter.
+# TYPE nanogit_test_total counter
+nanogit_test_total 42
+`
+	if buf.String() != expected {
+		t.Errorf("Write() wrote:\n%s\nexpected:\n%s", buf.String(), expected)
+	}
+}
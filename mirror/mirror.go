@@ -0,0 +1,236 @@
+package mirror
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgellow/nanogit/config"
+	"github.com/dgellow/nanogit/dir"
+	"github.com/dgellow/nanogit/git"
+	"github.com/dgellow/nanogit/log"
+	"github.com/dgellow/nanogit/settings"
+	"github.com/dgellow/nanogit/store"
+)
+
+// Name of the mirror status file, under the store directory of the data root.
+const storeName = "mirrors.yml"
+
+// Interval used when none is set in config
+const DefaultInterval = time.Hour
+
+// Status of the last sync of a mirror
+type Status struct {
+	Url         string
+	LastSync    time.Time
+	LastSuccess time.Time
+	Error       string
+}
+
+type statusStore struct {
+	Mirrors map[string]Status
+}
+
+// Mirror is a repository configured as a pull mirror.
+type Mirror struct {
+	Org    string
+	Repo   string
+	Config config.MirrorConfig
+}
+
+func (m Mirror) Path() string {
+	return m.Org + "/" + m.Repo
+}
+
+func (m Mirror) interval() time.Duration {
+	if m.Config.Interval <= 0 {
+		return DefaultInterval
+	}
+	return m.Config.Interval
+}
+
+// List returns the pull mirrors declared in config.
+func List() []Mirror {
+	mirrors := []Mirror{}
+	settings.ConfInfo.WalkOrgs(func(path string, org config.OrgConfig) {
+		for _, repo := range org.Repos {
+			if repo.IsMirror() {
+				mirrors = append(mirrors, Mirror{
+					Org:    path,
+					Repo:   strings.ToLower(repo.Name),
+					Config: repo.Mirror,
+				})
+			}
+		}
+	})
+	return mirrors
+}
+
+// IsMirror returns true if org/repo is a read-only pull mirror.
+func IsMirror(org string, repo string) bool {
+	repoConfig, err := settings.ConfInfo.LookupRepo(org, repo)
+	return err == nil && repoConfig.IsMirror()
+}
+
+// Statuses returns the status of the last sync of each mirror.
+func Statuses() (map[string]Status, error) {
+	ss := statusStore{}
+	if err := store.Load(storeName, &ss); err != nil {
+		return nil, err
+	}
+	if ss.Mirrors == nil {
+		ss.Mirrors = map[string]Status{}
+	}
+	return ss.Mirrors, nil
+}
+
+func saveStatus(m Mirror, status Status) {
+	ss := statusStore{}
+	err := store.Update(storeName, &ss, func() error {
+		if ss.Mirrors == nil {
+			ss.Mirrors = map[string]Status{}
+		}
+		ss.Mirrors[m.Path()] = status
+		return nil
+	})
+	if err != nil {
+		log.Error("mirror: cannot save status of %s: %v", m.Path(), err)
+	}
+}
+
+// Sync fetches the upstream of the mirror into its bare repository, which
+// is created on first sync. The status of the sync is recorded.
+func Sync(m Mirror) error {
+	log.Trace("mirror: Sync, repo: %s", m.Path())
+	status := Status{Url: m.Config.Url, LastSync: time.Now().UTC()}
+	if previous, err := Statuses(); err == nil {
+		status.LastSuccess = previous[m.Path()].LastSuccess
+	}
+
+	err := fetch(m)
+	if err != nil {
+		status.Error = err.Error()
+		log.Error("mirror: sync of %s failed: %v", m.Path(), err)
+	} else {
+		status.LastSuccess = status.LastSync
+		log.Info("mirror: synced %s from %s", m.Path(), m.Config.Url)
+	}
+	saveStatus(m, status)
+	return err
+}
+
+func fetch(m Mirror) error {
+	repoPath, err := dir.GetRepoDir(m.Org, m.Repo)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(repoPath); os.IsNotExist(err) {
+		if err := os.MkdirAll(filepath.Dir(repoPath), 0755); err != nil {
+			return err
+		}
+		if _, err := git.Run("", nil, "init", "--bare", "--quiet", repoPath); err != nil {
+			return err
+		}
+	}
+	env := git.CredentialsEnv(m.Config.SSHKey, m.Config.Username, m.Config.Password)
+	_, err = git.Run(repoPath, env,
+		"fetch", "--prune", "--quiet", "--", m.Config.Url,
+		"+refs/heads/*:refs/heads/*", "+refs/tags/*:refs/tags/*")
+	return err
+}
+
+// CheckInterval is how often the scheduler reads the mirrors of the config,
+// mirrors added or changed since the last check are synced right away.
+var CheckInterval = time.Minute
+
+// Scheduler syncs every mirror declared in config at its interval.
+type Scheduler struct {
+	stop chan struct{}
+	wg   sync.WaitGroup
+
+	mutex sync.Mutex
+	// Mirrors of the last check, by path
+	mirrors map[string]*scheduled
+}
+
+type scheduled struct {
+	url     string
+	next    time.Time
+	running bool
+}
+
+// Start syncs every mirror of the config, then each of them at its
+// interval, until Stop is called. The config is read again at every check.
+func Start() *Scheduler {
+	s := &Scheduler{stop: make(chan struct{}), mirrors: map[string]*scheduled{}}
+	s.wg.Add(1)
+	go s.run()
+	return s
+}
+
+func (s *Scheduler) run() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(CheckInterval)
+	defer ticker.Stop()
+	for {
+		s.check(time.Now())
+		select {
+		case <-ticker.C:
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// Starts the sync of the mirrors of the current config which are due, new
+// or whose url changed, unless they are still syncing
+func (s *Scheduler) check(now time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	current := map[string]bool{}
+	for _, m := range List() {
+		current[m.Path()] = true
+		sm, ok := s.mirrors[m.Path()]
+		if !ok {
+			log.Trace("mirror: scheduling %s every %v", m.Path(), m.interval())
+			sm = &scheduled{}
+			s.mirrors[m.Path()] = sm
+		}
+		if sm.running || (sm.url == m.Config.Url && now.Before(sm.next)) {
+			continue
+		}
+		sm.url, sm.next, sm.running = m.Config.Url, now.Add(m.interval()), true
+		s.wg.Add(1)
+		go func(m Mirror, sm *scheduled) {
+			defer s.wg.Done()
+			Sync(m)
+			s.mutex.Lock()
+			sm.running = false
+			s.mutex.Unlock()
+		}(m, sm)
+	}
+	for path := range s.mirrors {
+		if !current[path] {
+			delete(s.mirrors, path)
+		}
+	}
+}
+
+// Stop waits for running syncs to finish and stops the scheduler.
+func (s *Scheduler) Stop() {
+	close(s.stop)
+	s.wg.Wait()
+}
+
+// Lookup returns the mirror with the given org/repo path.
+func Lookup(org string, repo string) (Mirror, error) {
+	for _, m := range List() {
+		if m.Org == strings.ToLower(org) && m.Repo == strings.ToLower(repo) {
+			return m, nil
+		}
+	}
+	return Mirror{}, fmt.Errorf("Repository is not a mirror: %s/%s", org, repo)
+}
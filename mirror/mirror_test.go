@@ -0,0 +1,169 @@
+package mirror
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgellow/nanogit/config"
+	"github.com/dgellow/nanogit/git"
+	"github.com/dgellow/nanogit/settings"
+)
+
+func commit(t *testing.T, repoPath string, msg string) {
+	_, err := git.Run(repoPath, nil, "-c", "user.name=nanogit", "-c", "user.email=nanogit@localhost",
+		"commit", "--allow-empty", "--quiet", "-m", msg)
+	if err != nil {
+		t.Fatalf("Cannot commit in upstream: %v", err)
+	}
+}
+
+// Sets the config after validating it, as the config file and the admin
+// API do
+func setConfig(t *testing.T, c config.Config) {
+	if err := c.Validate(); err != nil {
+		t.Fatalf("Validate() == %v", err)
+	}
+	settings.ConfInfo.Set(c)
+}
+
+func refs(t *testing.T, repoPath string) string {
+	out, err := git.Run(repoPath, nil, "for-each-ref", "--format=%(refname)")
+	if err != nil {
+		t.Fatalf("Cannot list refs of %s: %v", repoPath, err)
+	}
+	return strings.TrimSpace(out)
+}
+
+func TestSync(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "nanogit-mirror")
+	if err != nil {
+		t.Fatalf("Cannot create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	upstream := filepath.Join(tmpDir, "upstream")
+	if _, err := git.Run("", nil, "init", "--quiet", upstream); err != nil {
+		t.Fatalf("Cannot init upstream: %v", err)
+	}
+	if _, err := git.Run(upstream, nil, "symbolic-ref", "HEAD", "refs/heads/master"); err != nil {
+		t.Fatalf("Cannot set upstream HEAD: %v", err)
+	}
+	commit(t, upstream, "first")
+	if _, err := git.Run(upstream, nil, "branch", "feature"); err != nil {
+		t.Fatalf("Cannot create branch in upstream: %v", err)
+	}
+
+	setConfig(t, config.Config{
+		Server: config.ServerConfig{
+			DataRoot: filepath.Join(tmpDir, "dataroot"),
+			Mirrors:  config.MirrorsConfig{AllowFile: true},
+		},
+		Orgs: []config.OrgConfig{{
+			Id: "vendor",
+			Repos: []config.RepoConfig{
+				{Name: "lib", Mirror: config.MirrorConfig{Url: "file://" + upstream}},
+				{Name: "app"},
+			},
+		}},
+	})
+	defer func() { settings.ConfInfo.Set(config.Config{}) }()
+
+	if !IsMirror("vendor", "lib") || IsMirror("vendor", "app") {
+		t.Errorf("IsMirror: only vendor/lib should be a mirror")
+	}
+	m, err := Lookup("vendor", "lib")
+	if err != nil {
+		t.Fatalf("Lookup(vendor, lib) == %v", err)
+	}
+
+	// First sync creates the bare repository
+	if err := Sync(m); err != nil {
+		t.Fatalf("First Sync == %v", err)
+	}
+	mirrorPath := filepath.Join(tmpDir, "dataroot", "vendor", "lib")
+	expected := "refs/heads/feature\nrefs/heads/master"
+	if actual := refs(t, mirrorPath); actual != expected {
+		t.Errorf("Refs after first sync == %q; expected %q", actual, expected)
+	}
+
+	// Deleted upstream branches are pruned
+	if _, err := git.Run(upstream, nil, "branch", "-D", "feature"); err != nil {
+		t.Fatalf("Cannot delete branch in upstream: %v", err)
+	}
+	if err := Sync(m); err != nil {
+		t.Fatalf("Second Sync == %v", err)
+	}
+	if actual := refs(t, mirrorPath); strings.Contains(actual, "feature") {
+		t.Errorf("Refs after second sync == %q; expected feature to be pruned", actual)
+	}
+
+	statuses, err := Statuses()
+	if err != nil {
+		t.Fatalf("Statuses() == %v", err)
+	}
+	status := statuses["vendor/lib"]
+	if status.Error != "" || status.LastSuccess.IsZero() || !status.LastSuccess.Equal(status.LastSync) {
+		t.Errorf("Status after successful sync == %+v", status)
+	}
+
+	// A failed sync is recorded, keeping the time of the last success
+	m.Config.Url = "file://" + filepath.Join(tmpDir, "missing")
+	if err := Sync(m); err == nil {
+		t.Errorf("Sync from missing upstream should fail")
+	}
+	statuses, _ = Statuses()
+	failed := statuses["vendor/lib"]
+	if failed.Error == "" || !failed.LastSuccess.Equal(status.LastSuccess) {
+		t.Errorf("Status after failed sync == %+v", failed)
+	}
+}
+
+// Mirrors added to the config after the scheduler started are synced at
+// its next check
+func TestScheduler(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "nanogit-mirror")
+	if err != nil {
+		t.Fatalf("Cannot create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	upstream := filepath.Join(tmpDir, "upstream")
+	if _, err := git.Run("", nil, "init", "--quiet", upstream); err != nil {
+		t.Fatalf("Cannot init upstream: %v", err)
+	}
+	commit(t, upstream, "first")
+
+	server := config.ServerConfig{
+		DataRoot: filepath.Join(tmpDir, "dataroot"),
+		Mirrors:  config.MirrorsConfig{AllowFile: true},
+	}
+	setConfig(t, config.Config{Server: server, Orgs: []config.OrgConfig{{Id: "vendor"}}})
+	defer func() { settings.ConfInfo.Set(config.Config{}) }()
+	defer func(interval time.Duration) { CheckInterval = interval }(CheckInterval)
+	CheckInterval = 20 * time.Millisecond
+
+	scheduler := Start()
+	defer scheduler.Stop()
+	setConfig(t, config.Config{Server: server, Orgs: []config.OrgConfig{{
+		Id:    "vendor",
+		Repos: []config.RepoConfig{{Name: "lib", Mirror: config.MirrorConfig{Url: "file://" + upstream}}},
+	}}})
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if statuses, err := Statuses(); err == nil && !statuses["vendor/lib"].LastSuccess.IsZero() {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Timeout waiting for the sync of a mirror added to the config")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if actual := refs(t, filepath.Join(tmpDir, "dataroot", "vendor", "lib")); !strings.Contains(actual, "refs/heads/") {
+		t.Errorf("Refs of the mirror == %q, expected the branch of upstream", actual)
+	}
+}
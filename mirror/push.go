@@ -0,0 +1,251 @@
+package mirror
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgellow/nanogit/config"
+	"github.com/dgellow/nanogit/dir"
+	"github.com/dgellow/nanogit/git"
+	"github.com/dgellow/nanogit/log"
+	"github.com/dgellow/nanogit/settings"
+	"github.com/dgellow/nanogit/store"
+)
+
+// Name of the push mirror status file, under the store directory of the
+// data root.
+const pushStoreName = "pushmirrors.yml"
+
+// Delays between retries of a failed push, doubled after each failure
+var (
+	RetryBackoff    = 10 * time.Second
+	MaxRetryBackoff = 30 * time.Minute
+)
+
+// PushTarget is a remote a repository is replicated to.
+type PushTarget struct {
+	Org    string
+	Repo   string
+	Config config.PushMirrorConfig
+}
+
+func (pt PushTarget) Path() string {
+	return pt.Org + "/" + pt.Repo
+}
+
+// Key identifying the target in the status store
+func (pt PushTarget) key() string {
+	return pt.Path() + " -> " + pt.Config.Name
+}
+
+// PushStatus is the replication state of a push target. PendingSince is
+// the time of the oldest push not replicated yet, zero when up to date.
+type PushStatus struct {
+	Repo         string
+	Name         string
+	Url          string
+	PendingSince time.Time
+	LastReceived time.Time
+	LastPush     time.Time
+	LastSuccess  time.Time
+	Failures     int
+	Error        string
+}
+
+// Lag returns how long the target has been behind the repository.
+func (ps PushStatus) Lag(now time.Time) time.Duration {
+	if ps.PendingSince.IsZero() {
+		return 0
+	}
+	return now.Sub(ps.PendingSince)
+}
+
+type pushStatusStore struct {
+	Targets map[string]PushStatus
+}
+
+// PushTargets returns the push mirrors of org/repo, from the repo config and
+// the org config.
+func PushTargets(org string, repo string) []PushTarget {
+	org, repo = strings.ToLower(org), strings.ToLower(repo)
+	targets := []PushTarget{}
+	orgConfig, err := settings.ConfInfo.LookupOrgById(org)
+	if err != nil {
+		return targets
+	}
+	for _, pm := range orgConfig.PushMirrors {
+		pm.Url = strings.TrimSuffix(pm.Url, "/") + "/" + repo
+		targets = append(targets, PushTarget{org, repo, pm})
+	}
+	if repoConfig, err := settings.ConfInfo.LookupRepo(org, repo); err == nil {
+		for _, pm := range repoConfig.PushMirrors {
+			targets = append(targets, PushTarget{org, repo, pm})
+		}
+	}
+	return targets
+}
+
+// PushStatuses returns the replication state of every push target.
+func PushStatuses() (map[string]PushStatus, error) {
+	ss := pushStatusStore{}
+	if err := store.Load(pushStoreName, &ss); err != nil {
+		return nil, err
+	}
+	if ss.Targets == nil {
+		ss.Targets = map[string]PushStatus{}
+	}
+	return ss.Targets, nil
+}
+
+func updatePushStatus(pt PushTarget, fn func(ps *PushStatus)) {
+	ss := pushStatusStore{}
+	err := store.Update(pushStoreName, &ss, func() error {
+		if ss.Targets == nil {
+			ss.Targets = map[string]PushStatus{}
+		}
+		ps := ss.Targets[pt.key()]
+		ps.Repo, ps.Name, ps.Url = pt.Path(), pt.Config.Name, pt.Config.Url
+		fn(&ps)
+		ss.Targets[pt.key()] = ps
+		return nil
+	})
+	if err != nil {
+		log.Error("mirror: cannot save push status of %s: %v", pt.key(), err)
+	}
+}
+
+// Refs replicated to push mirrors. Not --mirror, which would also push the
+// refs of forks kept in the repo.
+var pushRefspecs = []string{"+refs/heads/*:refs/heads/*", "+refs/tags/*:refs/tags/*", "+refs/notes/*:refs/notes/*"}
+
+// Push replicates the branches, tags and notes of the repository to the
+// target, deleting the ones removed from the repository.
+func Push(pt PushTarget) error {
+	log.Trace("mirror: Push, target: %s", pt.key())
+	repoPath, err := dir.GetRepoDir(pt.Org, pt.Repo)
+	if err != nil {
+		return err
+	}
+	env := git.CredentialsEnv(pt.Config.SSHKey, pt.Config.Username, pt.Config.Password)
+	args := append([]string{"push", "--prune", "--quiet", "--", pt.Config.Url}, pushRefspecs...)
+	_, err = git.Run(repoPath, env, args...)
+	return err
+}
+
+// Pusher replicates pushed repositories to their push mirrors in the
+// background, retrying failed pushes with backoff.
+type Pusher struct {
+	mutex   sync.Mutex
+	workers map[string]chan struct{}
+	stop    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// StartPusher starts replicating, pushes left pending by a previous run are
+// resumed.
+func StartPusher() *Pusher {
+	p := &Pusher{
+		workers: map[string]chan struct{}{},
+		stop:    make(chan struct{}),
+	}
+	statuses, err := PushStatuses()
+	if err != nil {
+		log.Error("mirror: cannot read push status: %v", err)
+		return p
+	}
+	for _, ps := range statuses {
+		if ps.PendingSince.IsZero() {
+			continue
+		}
+		if org, repo, err := dir.SplitPath(ps.Repo); err == nil {
+			p.Enqueue(org, repo)
+		}
+	}
+	return p
+}
+
+// Enqueue schedules the replication of org/repo to each of its push mirrors.
+func (p *Pusher) Enqueue(org string, repo string) {
+	now := time.Now().UTC()
+	for _, pt := range PushTargets(org, repo) {
+		log.Trace("mirror: Enqueue, target: %s", pt.key())
+		updatePushStatus(pt, func(ps *PushStatus) {
+			if ps.PendingSince.IsZero() {
+				ps.PendingSince = now
+			}
+			ps.LastReceived = now
+		})
+
+		p.mutex.Lock()
+		notify, present := p.workers[pt.key()]
+		if !present {
+			notify = make(chan struct{}, 1)
+			p.workers[pt.key()] = notify
+			p.wg.Add(1)
+			go p.run(pt, notify)
+		}
+		p.mutex.Unlock()
+
+		// Pushes arriving while the worker is busy are coalesced
+		select {
+		case notify <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (p *Pusher) run(pt PushTarget, notify chan struct{}) {
+	defer p.wg.Done()
+	for {
+		select {
+		case <-notify:
+		case <-p.stop:
+			return
+		}
+
+		backoff := RetryBackoff
+		for {
+			start := time.Now().UTC()
+			err := Push(pt)
+			updatePushStatus(pt, func(ps *PushStatus) {
+				ps.LastPush = start
+				if err != nil {
+					ps.Failures++
+					ps.Error = err.Error()
+					return
+				}
+				ps.LastSuccess = start
+				ps.Failures = 0
+				ps.Error = ""
+				// Pushes received during this one are still pending
+				if ps.LastReceived.After(start) {
+					ps.PendingSince = ps.LastReceived
+				} else {
+					ps.PendingSince = time.Time{}
+				}
+			})
+			if err == nil {
+				log.Info("mirror: pushed %s to %s", pt.Path(), pt.Config.Name)
+				break
+			}
+
+			log.Error("mirror: push of %s to %s failed, retry in %v: %v", pt.Path(), pt.Config.Name, backoff, err)
+			select {
+			case <-time.After(backoff):
+			case <-p.stop:
+				return
+			}
+			backoff *= 2
+			if backoff > MaxRetryBackoff {
+				backoff = MaxRetryBackoff
+			}
+		}
+	}
+}
+
+// Stop waits for running pushes to finish and stops the pusher.
+func (p *Pusher) Stop() {
+	close(p.stop)
+	p.wg.Wait()
+}
@@ -0,0 +1,112 @@
+package mirror
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dgellow/nanogit/config"
+	"github.com/dgellow/nanogit/git"
+	"github.com/dgellow/nanogit/settings"
+)
+
+// Wait for the push status of the target to satisfy cond
+func waitPushStatus(t *testing.T, key string, cond func(ps PushStatus) bool) PushStatus {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		statuses, err := PushStatuses()
+		if err != nil {
+			t.Fatalf("PushStatuses() == %v", err)
+		}
+		if ps, ok := statuses[key]; ok && cond(ps) {
+			return ps
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("Timeout waiting for push status of %s", key)
+	return PushStatus{}
+}
+
+func TestPusher(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "nanogit-pushmirror")
+	if err != nil {
+		t.Fatalf("Cannot create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	backupRoot := filepath.Join(tmpDir, "backup")
+	setConfig(t, config.Config{
+		Server: config.ServerConfig{
+			DataRoot: filepath.Join(tmpDir, "dataroot"),
+			Mirrors:  config.MirrorsConfig{AllowFile: true},
+		},
+		Orgs: []config.OrgConfig{{
+			Id:          "fixme",
+			PushMirrors: []config.PushMirrorConfig{{Name: "backup", Url: "file://" + backupRoot}},
+		}},
+	})
+	defer func() { settings.ConfInfo.Set(config.Config{}) }()
+
+	defer func(backoff time.Duration) { RetryBackoff = backoff }(RetryBackoff)
+	RetryBackoff = 50 * time.Millisecond
+
+	// Repository receiving pushes, through a work tree
+	repoPath := filepath.Join(tmpDir, "dataroot", "fixme", "foo")
+	workPath := filepath.Join(tmpDir, "work")
+	if _, err := git.Run("", nil, "init", "--bare", "--quiet", repoPath); err != nil {
+		t.Fatalf("Cannot init repo: %v", err)
+	}
+	if _, err := git.Run("", nil, "init", "--quiet", workPath); err != nil {
+		t.Fatalf("Cannot init work tree: %v", err)
+	}
+	push := func(msg string) {
+		commit(t, workPath, msg)
+		if _, err := git.Run(workPath, nil, "push", "--quiet", repoPath, "HEAD:refs/heads/master"); err != nil {
+			t.Fatalf("Cannot push to repo: %v", err)
+		}
+	}
+
+	targets := PushTargets("fixme", "foo")
+	if len(targets) != 1 || targets[0].Config.Url != "file://"+backupRoot+"/foo" {
+		t.Fatalf("PushTargets(fixme, foo) == %+v", targets)
+	}
+	key := targets[0].key()
+
+	pusher := StartPusher()
+	defer pusher.Stop()
+
+	// The mirror doesn't exist yet, pushes fail and are retried
+	push("first")
+	pusher.Enqueue("fixme", "foo")
+	failed := waitPushStatus(t, key, func(ps PushStatus) bool { return ps.Failures > 0 })
+	if failed.PendingSince.IsZero() || failed.Error == "" {
+		t.Errorf("Status after failed push == %+v", failed)
+	}
+
+	if _, err := git.Run("", nil, "init", "--bare", "--quiet", filepath.Join(backupRoot, "foo")); err != nil {
+		t.Fatalf("Cannot init mirror: %v", err)
+	}
+	ps := waitPushStatus(t, key, func(ps PushStatus) bool { return ps.Failures == 0 })
+	if ps.Lag(time.Now()) != 0 || ps.LastSuccess.IsZero() {
+		t.Errorf("Status after retried push == %+v", ps)
+	}
+
+	// Next pushes are replicated, except refs other than branches, tags
+	// and notes, e.g. refs of forks kept in the repo by previous versions
+	push("second")
+	if _, err := git.Run(repoPath, nil, "update-ref", "refs/forks/fixme/bar/heads/master", "master"); err != nil {
+		t.Fatalf("Cannot create ref of fork: %v", err)
+	}
+	pusher.Enqueue("fixme", "foo")
+	waitPushStatus(t, key, func(s PushStatus) bool { return s.LastSuccess.After(ps.LastSuccess) && s.PendingSince.IsZero() })
+	if expected, actual := "refs/heads/master", refs(t, filepath.Join(backupRoot, "foo")); expected != actual {
+		t.Errorf("Mirror refs == %q; expected %q", actual, expected)
+	}
+	source, _ := git.Run(repoPath, nil, "rev-parse", "master")
+	mirrored, _ := git.Run(filepath.Join(backupRoot, "foo"), nil, "rev-parse", "master")
+	if source != mirrored {
+		t.Errorf("Mirror master == %s; expected %s", mirrored, source)
+	}
+}
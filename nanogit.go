@@ -19,6 +19,18 @@ func main() {
 
 	app.Commands = []cli.Command{
 		cmd.CmdServer,
+		cmd.CmdToken,
+		cmd.CmdAuth,
+		cmd.CmdServ,
+		cmd.CmdMirror,
+		cmd.CmdFork,
+		cmd.CmdRepo,
+		cmd.CmdQuota,
+		cmd.CmdMaintenance,
+		cmd.CmdFsck,
+		cmd.CmdBackup,
+		cmd.CmdRestore,
+		cmd.CmdHook,
 	}
 
 	sort.Sort(cli.FlagsByName(app.Flags))
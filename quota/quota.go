@@ -0,0 +1,187 @@
+package quota
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/dgellow/nanogit/config"
+	"github.com/dgellow/nanogit/dir"
+	"github.com/dgellow/nanogit/log"
+	"github.com/dgellow/nanogit/settings"
+	"github.com/dgellow/nanogit/store"
+)
+
+// Sizes of repos are cached, computing them means walking the repo. They
+// are refreshed after each push and maintenance run.
+const sizesStore = "sizes.yml"
+
+type Size struct {
+	Bytes   int64
+	Updated time.Time
+}
+
+// Limit is a quota applying to a repo, either its own or the one of an org
+// it belongs to.
+type Limit struct {
+	// org/repo for a repo quota, org for an org quota
+	Path  string
+	Quota config.ByteSize
+	// Size of the repo or sum of the sizes of the repos of the org
+	Used int64
+	repo bool
+}
+
+func (l Limit) String() string {
+	return fmt.Sprintf("%s: %s used of %s", l.Path, config.ByteSize(l.Used), l.Quota)
+}
+
+// Limits returns the quotas applying to given repo: its own and the ones of
+// its org and parent orgs.
+func Limits(org string, repo string) []Limit {
+	log.Trace("quota: Limits, org: %s, repo: %s", org, repo)
+	limits := []Limit{}
+	if repoConfig, err := settings.ConfInfo.LookupRepo(org, repo); err == nil && repoConfig.Quota > 0 {
+		limits = append(limits, Limit{Path: org + "/" + repo, Quota: repoConfig.Quota, repo: true})
+	}
+	segments := strings.Split(org, "/")
+	for i := len(segments); i > 0; i-- {
+		path := strings.Join(segments[:i], "/")
+		orgConfig, err := settings.ConfInfo.LookupOrgById(path)
+		if err == nil && orgConfig.Quota > 0 {
+			limits = append(limits, Limit{Path: path, Quota: orgConfig.Quota})
+		}
+	}
+	return limits
+}
+
+// All returns every quota of the config.
+func All() []Limit {
+	limits := []Limit{}
+	settings.ConfInfo.WalkOrgs(func(path string, org config.OrgConfig) {
+		if org.Quota > 0 {
+			limits = append(limits, Limit{Path: path, Quota: org.Quota})
+		}
+		for _, repo := range org.Repos {
+			if repo.Quota > 0 {
+				limits = append(limits, Limit{Path: path + "/" + strings.ToLower(repo.Name), Quota: repo.Quota, repo: true})
+			}
+		}
+	})
+	return limits
+}
+
+// Usage fills the used size of the given limits, from the cached sizes.
+func Usage(limits []Limit) ([]Limit, error) {
+	log.Trace("quota: Usage")
+	repos, err := dir.ListRepos()
+	if err != nil {
+		return nil, err
+	}
+	sizes, err := Sizes(repos)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]Limit, len(limits))
+	for i, limit := range limits {
+		limit.Used = 0
+		for _, repo := range repos {
+			path := repo.String()
+			if path == limit.Path || (!limit.repo && strings.HasPrefix(path, limit.Path+"/")) {
+				limit.Used += sizes[path]
+			}
+		}
+		result[i] = limit
+	}
+	return result, nil
+}
+
+// Check returns an error if adding incoming bytes to given repo would exceed
+// one of its quotas. Pushes not adding anything are always accepted, so
+// that refs can be deleted from a repo over quota.
+func Check(org string, repo string, incoming int64) error {
+	log.Trace("quota: Check, org: %s, repo: %s, incoming: %d", org, repo, incoming)
+	if incoming <= 0 {
+		return nil
+	}
+	limits, err := Usage(Limits(org, repo))
+	if err != nil {
+		return err
+	}
+	for _, limit := range limits {
+		if limit.Used+incoming > int64(limit.Quota) {
+			return fmt.Errorf("Quota of %s exceeded: %s used, %s incoming, %s allowed",
+				limit.Path, config.ByteSize(limit.Used), config.ByteSize(incoming), limit.Quota)
+		}
+	}
+	return nil
+}
+
+// Sizes returns the sizes of given repos, keyed by org/repo. Sizes missing
+// from the cache are computed.
+func Sizes(repos []dir.RepoPath) (map[string]int64, error) {
+	log.Trace("quota: Sizes")
+	cache := map[string]Size{}
+	if err := store.Load(sizesStore, &cache); err != nil {
+		return nil, err
+	}
+	result := map[string]int64{}
+	missing := []dir.RepoPath{}
+	for _, repo := range repos {
+		if size, ok := cache[repo.String()]; ok {
+			result[repo.String()] = size.Bytes
+		} else {
+			missing = append(missing, repo)
+		}
+	}
+	for _, repo := range missing {
+		size, err := Refresh(repo.Org, repo.Repo)
+		if err != nil {
+			return nil, err
+		}
+		result[repo.String()] = size
+	}
+	return result, nil
+}
+
+// Refresh computes the size of given repo and caches it.
+func Refresh(org string, repo string) (int64, error) {
+	log.Trace("quota: Refresh, org: %s, repo: %s", org, repo)
+	repoDir, err := dir.GetRepoDir(org, repo)
+	if err != nil {
+		return 0, err
+	}
+	size, err := dir.DiskUsage(repoDir)
+	if err != nil {
+		return 0, err
+	}
+	cache := map[string]Size{}
+	err = store.Update(sizesStore, &cache, func() error {
+		cache[dir.RepoPath{Org: org, Repo: repo}.String()] = Size{Bytes: size, Updated: time.Now()}
+		return nil
+	})
+	return size, err
+}
+
+// RefreshAll computes the sizes of all repos, dropping the ones of removed
+// repos from the cache.
+func RefreshAll() error {
+	log.Trace("quota: RefreshAll")
+	repos, err := dir.ListRepos()
+	if err != nil {
+		return err
+	}
+	cache := map[string]Size{}
+	for _, repo := range repos {
+		repoDir, err := dir.GetRepoDir(repo.Org, repo.Repo)
+		if err != nil {
+			return err
+		}
+		size, err := dir.DiskUsage(repoDir)
+		if err != nil {
+			return err
+		}
+		cache[repo.String()] = Size{Bytes: size, Updated: time.Now()}
+	}
+	return store.Save(sizesStore, cache)
+}
@@ -0,0 +1,87 @@
+package quota
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dgellow/nanogit/config"
+	"github.com/dgellow/nanogit/settings"
+)
+
+func TestCheck(t *testing.T) {
+	dataRoot, err := ioutil.TempDir("", "nanogit-quota")
+	if err != nil {
+		t.Fatalf("Cannot create temp directory: %v", err)
+	}
+	defer os.RemoveAll(dataRoot)
+
+	settings.ConfInfo.Set(config.Config{
+		Server: config.ServerConfig{DataRoot: dataRoot},
+		Orgs: []config.OrgConfig{
+			{
+				Id:    "fixme",
+				Quota: 10 * config.KiB,
+				Repos: []config.RepoConfig{{Name: "website", Quota: 4 * config.KiB}},
+				Orgs:  []config.OrgConfig{{Id: "infra", Quota: 5 * config.KiB}},
+			},
+			{Id: "free"},
+		},
+	})
+	defer func() { settings.ConfInfo.Set(config.Config{}) }()
+
+	// Each repo holds a single 2K object
+	for _, path := range []string{"fixme/website", "fixme/api", "fixme/infra/terraform", "free/big"} {
+		repoDir := filepath.Join(dataRoot, path)
+		if err := os.MkdirAll(filepath.Join(repoDir, "objects"), 0755); err != nil {
+			t.Fatalf("Cannot create repo %s: %v", path, err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(repoDir, "HEAD"), nil, 0644); err != nil {
+			t.Fatalf("Cannot create repo %s: %v", path, err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(repoDir, "objects", "pack"), make([]byte, 2048), 0644); err != nil {
+			t.Fatalf("Cannot create repo %s: %v", path, err)
+		}
+	}
+
+	var testCases = []struct {
+		org      string
+		repo     string
+		incoming int64
+		err      bool
+	}{
+		// fixme uses 6K of 10K, website 2K of 4K
+		{"fixme", "website", 2048, false},
+		{"fixme", "website", 2049, true},
+		{"fixme", "api", 4096, false},
+		{"fixme", "api", 4097, true},
+		// fixme/infra uses 2K of 5K
+		{"fixme/infra", "terraform", 3072, false},
+		{"fixme/infra", "terraform", 3073, true},
+		{"fixme/infra", "new", 3073, true},
+		// Deleting refs is always allowed
+		{"fixme", "website", 0, false},
+		{"free", "big", 1 << 30, false},
+		{"~dgellow", "scratch", 1 << 30, false},
+	}
+
+	for i, tc := range testCases {
+		err := Check(tc.org, tc.repo, tc.incoming)
+		if tc.err != (err != nil) {
+			t.Errorf("#%d: Check(%s, %s, %d) == %v; expected error: %t", i, tc.org, tc.repo, tc.incoming, err, tc.err)
+		}
+	}
+
+	// Sizes are cached until refreshed
+	ioutil.WriteFile(filepath.Join(dataRoot, "fixme", "api", "objects", "pack"), make([]byte, 8192), 0644)
+	if err := Check("fixme", "website", 2048); err != nil {
+		t.Errorf("Check() with cached sizes == %v; expected nil", err)
+	}
+	if _, err := Refresh("fixme", "api"); err != nil {
+		t.Fatalf("Refresh() == %v", err)
+	}
+	if err := Check("fixme", "website", 2048); err == nil {
+		t.Errorf("Check() after refresh == nil; expected quota of fixme to be exceeded")
+	}
+}
@@ -9,3 +9,4 @@ var ErrEmptyPrivKeyPath = errors.New("empty PrivateKeyPath in server config")
 var ErrInvalidEnvArgs = errors.New("invalid env arguments")
 var ErrNoSessionChannel = errors.New("no session channel")
 var ErrNotSessionChannel = errors.New("terminal requires session channel")
+var ErrUnknownCommand = errors.New("unknown command")
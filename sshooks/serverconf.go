@@ -0,0 +1,64 @@
+package sshooks
+
+import (
+	"net"
+	"os/exec"
+
+	"github.com/dgellow/nanogit/sshooks/errors"
+	"github.com/dgellow/nanogit/sshooks/log"
+	"golang.org/x/crypto/ssh"
+)
+
+type SSHKeygenConfig struct {
+	// Default to rsa
+	Type string
+	// Default to no password (empty string)
+	Passphrase string
+}
+
+type ServerConfig struct {
+	// Default to localhost
+	Host              string
+	Port              uint
+	PrivatekeyPath    string
+	PublicKeyCallback func(conn ssh.ConnMetadata, key ssh.PublicKey) (keyId string, err error)
+	KeygenConfig      SSHKeygenConfig
+	// Handlers of commands by name, called with the key id returned by
+	// PublicKeyCallback and the address of the client
+	CommandsCallbacks map[string]func(keyId string, remote net.Addr, cmd string, args string) (*exec.Cmd, error)
+	// Called when a command returned by CommandsCallbacks exits or fails
+	// to start, err is nil if it was successful
+	ExitCallback func(keyId string, remote net.Addr, cmd string, args string, err error)
+	// Called for each accepted connection before the handshake, the
+	// connection is closed if it returns an error. release is called once
+	// the connection is closed.
+	ConnCallback func(remote net.Addr) (release func(), err error)
+	// Called once the client is authenticated, the commands of the
+	// connection fail with the error it returns. release is called once
+	// the connection is closed.
+	SessionCallback func(keyId string, remote net.Addr) (release func(), err error)
+	// Command from CommandsCallbacks run when a shell is requested,
+	// shell requests are rejected if empty
+	ShellCommand string
+	// Logger based on the interface defined in sshooks/log
+	Log log.Log
+}
+
+func (sc *ServerConfig) Validate() error {
+	if sc.PublicKeyCallback == nil {
+		return errors.ErrNoPubKeyCallback
+	}
+	if sc.CommandsCallbacks == nil {
+		return errors.ErrNoCmdsCallbacks
+	}
+	if sc.PrivatekeyPath == "" {
+		return errors.ErrEmptyPrivKeyPath
+	}
+	if sc.KeygenConfig.Type == "" {
+		sc.KeygenConfig.Passphrase = "rsa"
+	}
+	if sc.Host == "" {
+		sc.Host = "localhost"
+	}
+	return nil
+}
@@ -1,13 +1,16 @@
 package sshooks
 
 import (
+	"encoding/binary"
 	"fmt"
 	"io"
 	"net"
 	"os/exec"
 	"strings"
+	"sync"
+	"syscall"
 
-	"github.com/dgellow/sshooks/errors"
+	"github.com/dgellow/nanogit/sshooks/errors"
 	"golang.org/x/crypto/ssh"
 )
 
@@ -22,6 +25,9 @@ type Session struct {
 	sshConfig *ssh.ServerConfig
 	channels  <-chan ssh.NewChannel
 	requests  <-chan *ssh.Request
+	// Error of SessionCallback, reported to the client instead of running
+	// its commands
+	rejected error
 }
 
 func newSession(config *ServerConfig, sshConfig *ssh.ServerConfig, conn net.Conn) (*Session, error) {
@@ -29,7 +35,7 @@ func newSession(config *ServerConfig, sshConfig *ssh.ServerConfig, conn net.Conn
 	if err != nil {
 		return nil, err
 	}
-	return &Session{conn, sshConn, config, sshConfig, channels, requests}, nil
+	return &Session{conn, sshConn, config, sshConfig, channels, requests, nil}, nil
 }
 
 func (s *Session) Run() {
@@ -46,10 +52,23 @@ func cleanCommand(cmd string) string {
 	return cmd[i:]
 }
 
+// The payload of an exec request is an SSH string: a uint32 length followed
+// by the command
+func execPayload(payload []byte) string {
+	if len(payload) < 4 {
+		return ""
+	}
+	length := binary.BigEndian.Uint32(payload)
+	if uint64(length) > uint64(len(payload)-4) {
+		return ""
+	}
+	return string(payload[4 : 4+length])
+}
+
 func parseCommand(cmd string) (exec string, args string) {
-	ss := strings.SplitN(cmd, " ", 2)
+	ss := strings.SplitN(strings.TrimSpace(cmd), " ", 2)
 	if len(ss) != 2 {
-		return "", ""
+		return ss[0], ""
 	}
 	return ss[0], strings.Replace(ss[1], "'/", "'", 1)
 }
@@ -62,9 +81,15 @@ func (s *Session) handleCommand(keyId string, payload string) (*exec.Cmd, error)
 	if !present {
 		s.config.Log.Trace(s.formatLog("No handler for command: %s, args: %v"),
 			execName, args)
-		return exec.Command(""), nil
+		return nil, fmt.Errorf("%v: %s", errors.ErrUnknownCommand, execName)
 	}
-	return cmdHandler(keyId, cmdName, args)
+	return cmdHandler(keyId, s.conn.RemoteAddr(), cmdName, args)
+}
+
+func sendExitStatus(ch ssh.Channel, status uint32) {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, status)
+	ch.SendRequest("exit-status", false, payload)
 }
 
 func (s *Session) envRequest(payload string) error {
@@ -85,42 +110,91 @@ func (s *Session) envRequest(payload string) error {
 	return nil
 }
 
+// Calls ExitCallback once the command of payload is done, err is nil if it
+// was successful
+func (s *Session) exited(keyId string, payload string, err error) {
+	if s.config.ExitCallback != nil {
+		cmdName := strings.TrimLeft(payload, "'()")
+		execName, args := parseCommand(cmdName)
+		s.config.ExitCallback(keyId, s.conn.RemoteAddr(), execName, args, err)
+	}
+}
+
 func (s *Session) execRequest(keyId string, payload string, ch ssh.Channel, req *ssh.Request) error {
 	s.config.Log.Trace(s.formatLog("execRequest"))
 	s.config.Log.Trace(s.formatLog("payload: %s"), payload)
-	cmd, err := s.handleCommand(keyId, payload)
-	if cmd == nil {
-		s.config.Log.Trace(s.formatLog("Cmd object returned by handleCommand is nil"))
-		return nil
+	var cmd *exec.Cmd
+	err := s.rejected
+	if err == nil {
+		cmd, err = s.handleCommand(keyId, payload)
 	}
 	if err != nil {
+		// Report the error to the client instead of silently closing
+		req.Reply(true, nil)
+		fmt.Fprintf(ch.Stderr(), "%v\n", err)
+		sendExitStatus(ch, 1)
 		return err
 	}
+	if cmd == nil {
+		s.config.Log.Trace(s.formatLog("Cmd object returned by handleCommand is nil"))
+		req.Reply(false, nil)
+		return nil
+	}
 
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
+		s.exited(keyId, payload, err)
 		return err
 	}
 	stderr, err := cmd.StderrPipe()
 	if err != nil {
+		s.exited(keyId, payload, err)
 		return err
 	}
 	stdin, err := cmd.StdinPipe()
 	if err != nil {
+		s.exited(keyId, payload, err)
 		return err
 	}
 
 	// FIXME: check timeout
 	if err = cmd.Start(); err != nil {
+		req.Reply(false, nil)
+		s.exited(keyId, payload, err)
 		return err
 	}
 
 	req.Reply(true, nil)
-	go io.Copy(stdin, ch)
-	io.Copy(ch, stdout)
-	io.Copy(ch.Stderr(), stderr)
+	go func() {
+		io.Copy(stdin, ch)
+		stdin.Close()
+	}()
+
+	// Both outputs have to be drained before waiting for the command
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		io.Copy(ch, stdout)
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(ch.Stderr(), stderr)
+	}()
+	wg.Wait()
 
-	ch.SendRequest("exit-status", false, []byte{0, 0, 0, 0})
+	var status uint32
+	err = cmd.Wait()
+	s.exited(keyId, payload, err)
+	if err != nil {
+		status = 1
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+				status = uint32(ws.ExitStatus())
+			}
+		}
+	}
+	sendExitStatus(ch, status)
 	return nil
 }
 
@@ -147,24 +221,39 @@ func (s *Session) handleChannels() error {
 func (s *Session) handleRequests(ch ssh.Channel, reqs <-chan *ssh.Request) {
 	s.config.Log.Trace(s.formatLog("handleRequests"))
 	keyId := s.sshConn.Permissions.Extensions["key-id"]
-	defer ch.Close()
 
 	go func(in <-chan *ssh.Request) {
+		// A session channel runs a single command, then is closed
+		defer ch.Close()
 		for req := range in {
 			s.config.Log.Trace(s.formatLog("Request: type : %s, payload: "),
 				req.Type, string(req.Payload))
-			payload := cleanCommand(string(req.Payload))
 			switch req.Type {
 			case "env":
-				err := s.envRequest(payload)
+				err := s.envRequest(cleanCommand(string(req.Payload)))
 				if err != nil {
 					s.config.Log.Error(s.formatLog("%v"), err)
 				}
 			case "exec":
-				err := s.execRequest(keyId, payload, ch, req)
+				err := s.execRequest(keyId, execPayload(req.Payload), ch, req)
+				if err != nil {
+					s.config.Log.Error(s.formatLog("%v"), err)
+				}
+				return
+			case "shell":
+				if s.config.ShellCommand == "" {
+					req.Reply(false, nil)
+					continue
+				}
+				err := s.execRequest(keyId, s.config.ShellCommand, ch, req)
 				if err != nil {
 					s.config.Log.Error(s.formatLog("%v"), err)
 				}
+				return
+			default:
+				if req.WantReply {
+					req.Reply(false, nil)
+				}
 			}
 		}
 	}(reqs)
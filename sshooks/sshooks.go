@@ -1,3 +1,8 @@
+// Package sshooks is an SSH server running commands given by callbacks. It
+// is a fork of github.com/dgellow/sshooks at 6791d540db54 maintained with
+// nanogit: keys refused by PublicKeyCallback fail the authentication, and
+// callbacks are called on exits, connections and sessions with the address
+// of the client.
 package sshooks
 
 import (
@@ -55,6 +60,7 @@ func Listen(config *ServerConfig) error {
 			keyId, err := config.PublicKeyCallback(conn, key)
 			if err != nil {
 				config.Log.Error(formatLog("Error while handling public key: %v"), err)
+				return nil, err
 			}
 			return &ssh.Permissions{Extensions: map[string]string{"key-id": keyId}}, nil
 		},
@@ -98,13 +104,32 @@ func serve(config *ServerConfig, sshConfig *ssh.ServerConfig) error {
 		// user could easily block entire loop. For example, user could
 		// be asked to trust server key fingerprint and hangs.
 		go func() {
+			defer conn.Close()
+			if config.ConnCallback != nil {
+				release, err := config.ConnCallback(conn.RemoteAddr())
+				if err != nil {
+					config.Log.Error(formatLog("[%s] Connection refused: %v"), conn.RemoteAddr(), err)
+					return
+				}
+				defer release()
+			}
 			config.Log.Trace(formatLog("[%s] Handshaking"), conn.RemoteAddr())
 			session, err := newSession(config, sshConfig, conn)
 			if err != nil {
 				config.Log.Error(formatLog("%v"), err)
 				return
 			}
+			if config.SessionCallback != nil {
+				keyId := session.sshConn.Permissions.Extensions["key-id"]
+				release, err := config.SessionCallback(keyId, conn.RemoteAddr())
+				if err != nil {
+					session.rejected = err
+				} else {
+					defer release()
+				}
+			}
 			session.Run()
+			session.sshConn.Wait()
 		}()
 	}
 }
@@ -79,7 +79,7 @@ func TestExecCmd(t *testing.T) {
 	}
 
 	tests := []TestDataExecCmd{
-		{"", []string{}, "", "", "fork/exec : no such file or directory"},
+		{"sshooks-missing-command", []string{}, "", "", `exec: "sshooks-missing-command": executable file not found in $PATH`},
 		{"echo", []string{"hello", "you"}, "hello you\n", "", ""},
 		{"sh", []string{"failScript.sh"}, "", "my awesome error\n", "exit status 1"},
 	}
@@ -0,0 +1,129 @@
+package store
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/dgellow/nanogit/dir"
+	"github.com/dgellow/nanogit/log"
+)
+
+// Serialize writes made by this process, files are replaced atomically so
+// readers never see a partial store. Writes of other processes, e.g. of
+// serv commands, are serialized by a lock file next to the store file.
+var mutex sync.Mutex
+
+// Path returns the absolute path of the store file with the given name.
+func Path(name string) (string, error) {
+	storeDir, err := dir.GetStoreDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(storeDir, name), nil
+}
+
+// Load deserializes the store file with the given name into v. A missing
+// file is not an error, v is then left untouched.
+func Load(name string, v interface{}) error {
+	log.Trace("store: Load, name: %s", name)
+	path, err := Path(name)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return yaml.Unmarshal(data, v)
+}
+
+// Save serializes v into the store file with the given name.
+func Save(name string, v interface{}) error {
+	log.Trace("store: Save, name: %s", name)
+	path, err := Path(name)
+	if err != nil {
+		return err
+	}
+	data, err := yaml.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return WriteFile(path, data, 0600)
+}
+
+// Update loads the store file with the given name into v, calls fn, then
+// saves v if fn didn't return an error. Concurrent updates, of this process
+// or of others, wait for each other.
+func Update(name string, v interface{}, fn func() error) error {
+	mutex.Lock()
+	defer mutex.Unlock()
+	unlock, err := lock(name)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := Load(name, v); err != nil {
+		return err
+	}
+	if err := fn(); err != nil {
+		return err
+	}
+	return Save(name, v)
+}
+
+// Takes an exclusive lock on the store file with the given name, released
+// by the returned function. The store file itself is replaced on each save,
+// so the lock is taken on a separate hidden file, not copied by backups.
+func lock(name string) (func(), error) {
+	path, err := Path(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(filepath.Join(filepath.Dir(path), "."+name+".lock"), os.O_RDONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return func() { file.Close() }, nil
+}
+
+// WriteFile atomically replaces the file at path with data.
+func WriteFile(path string, data []byte, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,47 @@
+package store
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/dgellow/nanogit/config"
+	"github.com/dgellow/nanogit/settings"
+)
+
+// Updates wait for the lock of the store file, which is also taken by other
+// processes
+func TestUpdateLock(t *testing.T) {
+	dataRoot, err := ioutil.TempDir("", "nanogit-store")
+	if err != nil {
+		t.Fatalf("Cannot create temp directory: %v", err)
+	}
+	defer os.RemoveAll(dataRoot)
+	settings.ConfInfo.Set(config.Config{Server: config.ServerConfig{DataRoot: dataRoot}})
+	defer func() { settings.ConfInfo.Set(config.Config{}) }()
+
+	// Taken as another process would, without the mutex
+	unlock, err := lock("test.yml")
+	if err != nil {
+		t.Fatalf("lock() == %v", err)
+	}
+	done := make(chan error)
+	go func() {
+		var n int
+		done <- Update("test.yml", &n, func() error { n++; return nil })
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("Update() == %v while the store is locked", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlock()
+	if err := <-done; err != nil {
+		t.Errorf("Update() == %v", err)
+	}
+	var n int
+	if err := Load("test.yml", &n); err != nil || n != 1 {
+		t.Errorf("Load() == %d, %v, expected 1", n, err)
+	}
+}
@@ -0,0 +1,305 @@
+package token
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/dgellow/nanogit/log"
+	"github.com/dgellow/nanogit/store"
+)
+
+// Name of the token store file, under the store directory of the data root.
+const storeName = "tokens.yml"
+
+// Token is a personal access token, scoped to one org/repo. Only a salted
+// hash of the secret is stored.
+type Token struct {
+	Id      string
+	User    string
+	Org     string
+	Repo    string
+	Write   bool
+	Salt    string
+	Hash    string
+	Created time.Time
+	// Zero value means the token never expires
+	Expires time.Time
+	// Admin tokens authenticate clients of the admin API, User being the
+	// name of the client. They give no access to repositories.
+	Admin bool `yaml:",omitempty"`
+	// Web tokens only log in to the web UI, where they show every repo
+	// their user can read. They give no access with git nor to the API.
+	Web bool `yaml:",omitempty"`
+	// API tokens only authenticate their user to the admin API, with the
+	// capabilities of their roles, e.g. org admins.
+	API bool `yaml:",omitempty"`
+}
+
+type tokenStore struct {
+	Tokens []Token
+}
+
+// Scope returns the org/repo the token is restricted to.
+func (t Token) Scope() string {
+	switch {
+	case t.Admin:
+		return "admin"
+	case t.Web:
+		return "web"
+	case t.API:
+		return "api"
+	}
+	return t.Org + "/" + t.Repo
+}
+
+// Access returns "write" or "read".
+func (t Token) Access() string {
+	if t.Write {
+		return "write"
+	}
+	return "read"
+}
+
+func (t Token) IsExpired(now time.Time) bool {
+	return !t.Expires.IsZero() && now.After(t.Expires)
+}
+
+// InScope returns whether the token gives access to org/repo. Web tokens
+// give access to every repo, they are only accepted by the web UI.
+func (t Token) InScope(org string, repo string) bool {
+	if t.Admin || t.API {
+		return false
+	}
+	if t.Web {
+		return true
+	}
+	return strings.ToLower(t.Org) == strings.ToLower(org) &&
+		strings.ToLower(t.Repo) == strings.ToLower(repo)
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func hashSecret(salt string, secret string) string {
+	sum := sha256.Sum256([]byte(salt + secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// Create generates a new token for the given user and saves it in the token
+// store. The returned string is the only time the full token is available.
+func Create(user string, org string, repo string, write bool, expires time.Time) (string, Token, error) {
+	log.Trace("token: Create, user: %s, org: %s, repo: %s", user, org, repo)
+	if user == "" || org == "" || repo == "" || org == "*" || repo == "*" {
+		return "", Token{}, fmt.Errorf("A token needs a user and an org/repo scope")
+	}
+	return create(Token{
+		User:    user,
+		Org:     strings.ToLower(org),
+		Repo:    strings.ToLower(repo),
+		Write:   write,
+		Expires: expires,
+	})
+}
+
+// CreateWeb generates a new token logging user in to the web UI, read only.
+func CreateWeb(user string, expires time.Time) (string, Token, error) {
+	log.Trace("token: CreateWeb, user: %s", user)
+	if user == "" {
+		return "", Token{}, fmt.Errorf("A web token needs a user")
+	}
+	return create(Token{User: user, Web: true, Expires: expires})
+}
+
+// CreateAPI generates a new token authenticating user to the admin API.
+func CreateAPI(user string, expires time.Time) (string, Token, error) {
+	log.Trace("token: CreateAPI, user: %s", user)
+	if user == "" {
+		return "", Token{}, fmt.Errorf("An API token needs a user")
+	}
+	return create(Token{User: user, API: true, Expires: expires})
+}
+
+// CreateAdmin generates a new token for a client of the admin API.
+func CreateAdmin(name string, expires time.Time) (string, Token, error) {
+	log.Trace("token: CreateAdmin, name: %s", name)
+	if name == "" {
+		return "", Token{}, fmt.Errorf("An admin token needs a name")
+	}
+	return create(Token{User: name, Admin: true, Expires: expires})
+}
+
+func create(t Token) (string, Token, error) {
+	id, err := randomHex(8)
+	if err != nil {
+		return "", Token{}, err
+	}
+	secret, err := randomHex(20)
+	if err != nil {
+		return "", Token{}, err
+	}
+	salt, err := randomHex(16)
+	if err != nil {
+		return "", Token{}, err
+	}
+
+	t.Id = id
+	t.Salt = salt
+	t.Hash = hashSecret(salt, secret)
+	t.Created = time.Now().UTC()
+	ts := tokenStore{}
+	err = store.Update(storeName, &ts, func() error {
+		ts.Tokens = append(ts.Tokens, t)
+		return nil
+	})
+	if err != nil {
+		return "", Token{}, err
+	}
+	return id + "." + secret, t, nil
+}
+
+// Revoke removes the token with the given id from the token store.
+func Revoke(id string) error {
+	log.Trace("token: Revoke, id: %s", id)
+	ts := tokenStore{}
+	return store.Update(storeName, &ts, func() error {
+		for i, t := range ts.Tokens {
+			if t.Id == id {
+				ts.Tokens = append(ts.Tokens[:i], ts.Tokens[i+1:]...)
+				return nil
+			}
+		}
+		return fmt.Errorf("Cannot find token: %s", id)
+	})
+}
+
+// List returns the tokens of the given user, or all tokens if user is empty.
+func List(user string) ([]Token, error) {
+	log.Trace("token: List, user: %s", user)
+	ts := tokenStore{}
+	if err := store.Load(storeName, &ts); err != nil {
+		return nil, err
+	}
+	tokens := []Token{}
+	for _, t := range ts.Tokens {
+		if user == "" || t.User == user {
+			tokens = append(tokens, t)
+		}
+	}
+	return tokens, nil
+}
+
+// Authenticate validates the access token given by user and returns it.
+func Authenticate(user string, value string) (Token, error) {
+	log.Trace("token: Authenticate, user: %s", user)
+	t, err := lookup(value)
+	if err != nil || !t.isAccess() || t.User != user {
+		return Token{}, fmt.Errorf("Invalid access token for user: %s", user)
+	}
+	if t.IsExpired(time.Now()) {
+		return Token{}, fmt.Errorf("Access token has expired: %s", t.Id)
+	}
+	return t, nil
+}
+
+// Whether t is an access token to a repo, not a token of another kind
+func (t Token) isAccess() bool {
+	return !t.Admin && !t.Web && !t.API
+}
+
+// AuthenticateAny validates an access token given without user name, e.g.
+// as a bearer token, and returns it.
+func AuthenticateAny(value string) (Token, error) {
+	log.Trace("token: AuthenticateAny")
+	t, err := lookup(value)
+	if err != nil || !t.isAccess() {
+		return Token{}, fmt.Errorf("Invalid access token")
+	}
+	if t.IsExpired(time.Now()) {
+		return Token{}, fmt.Errorf("Access token has expired: %s", t.Id)
+	}
+	return t, nil
+}
+
+// AuthenticateWeb validates the token given by user to log in to the web
+// UI, an access token or a web token, and returns it.
+func AuthenticateWeb(user string, value string) (Token, error) {
+	log.Trace("token: AuthenticateWeb, user: %s", user)
+	t, err := lookup(value)
+	if err != nil || !(t.isAccess() || t.Web) || t.User != user {
+		return Token{}, fmt.Errorf("Invalid access token for user: %s", user)
+	}
+	if t.IsExpired(time.Now()) {
+		return Token{}, fmt.Errorf("Access token has expired: %s", t.Id)
+	}
+	return t, nil
+}
+
+// AuthenticateAPI validates the API token of a user and returns it.
+func AuthenticateAPI(value string) (Token, error) {
+	log.Trace("token: AuthenticateAPI")
+	t, err := lookup(value)
+	if err != nil || !t.API {
+		return Token{}, fmt.Errorf("Invalid API token")
+	}
+	if t.IsExpired(time.Now()) {
+		return Token{}, fmt.Errorf("API token has expired: %s", t.Id)
+	}
+	return t, nil
+}
+
+// AuthenticateAdmin validates an admin token and returns it.
+func AuthenticateAdmin(value string) (Token, error) {
+	log.Trace("token: AuthenticateAdmin")
+	t, err := lookup(value)
+	if err != nil || !t.Admin {
+		return Token{}, fmt.Errorf("Invalid admin token")
+	}
+	if t.IsExpired(time.Now()) {
+		return Token{}, fmt.Errorf("Admin token has expired: %s", t.Id)
+	}
+	return t, nil
+}
+
+// Returns the token matching the id and secret of value
+func lookup(value string) (Token, error) {
+	parts := strings.SplitN(value, ".", 2)
+	if len(parts) != 2 {
+		return Token{}, fmt.Errorf("Malformed access token")
+	}
+	ts := tokenStore{}
+	if err := store.Load(storeName, &ts); err != nil {
+		return Token{}, err
+	}
+	for _, t := range ts.Tokens {
+		if t.Id != parts[0] {
+			continue
+		}
+		hash := hashSecret(t.Salt, parts[1])
+		if subtle.ConstantTimeCompare([]byte(hash), []byte(t.Hash)) != 1 {
+			break
+		}
+		return t, nil
+	}
+	return Token{}, fmt.Errorf("Invalid access token")
+}
+
+// BasicAuth validates the access token sent via HTTP Basic auth, the user
+// name as username and the token as password.
+func BasicAuth(r *http.Request) (Token, error) {
+	user, value, ok := r.BasicAuth()
+	if !ok {
+		return Token{}, fmt.Errorf("Missing HTTP Basic auth credentials")
+	}
+	return Authenticate(user, value)
+}
@@ -0,0 +1,335 @@
+package token
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgellow/nanogit/config"
+	"github.com/dgellow/nanogit/settings"
+	"github.com/dgellow/nanogit/store"
+)
+
+func setupStore(t *testing.T) func() {
+	dataRoot, err := ioutil.TempDir("", "nanogit-token")
+	if err != nil {
+		t.Fatalf("Cannot create temp directory: %v", err)
+	}
+	settings.ConfInfo.Set(config.Config{Server: config.ServerConfig{DataRoot: dataRoot}})
+	return func() {
+		settings.ConfInfo.Set(config.Config{})
+		os.RemoveAll(dataRoot)
+	}
+}
+
+func TestCreate(t *testing.T) {
+	defer setupStore(t)()
+
+	value, created, err := Create("alice", "Fixme", "Website", true, time.Time{})
+	if err != nil {
+		t.Fatalf("Create() == %v", err)
+	}
+	parts := strings.Split(value, ".")
+	if len(parts) != 2 || parts[0] != created.Id || len(parts[1]) != 40 {
+		t.Errorf("Create() == %q, expected <id>.<secret>", value)
+	}
+	// Only a salted hash of the secret is stored
+	if created.Salt == "" || created.Hash != hashSecret(created.Salt, parts[1]) || created.Hash == hashSecret("", parts[1]) {
+		t.Errorf("Create() stored salt %q and hash %q", created.Salt, created.Hash)
+	}
+	if created.Org != "fixme" || created.Repo != "website" || created.Scope() != "fixme/website" || created.Access() != "write" {
+		t.Errorf("Create() == %+v, expected a write token on fixme/website", created)
+	}
+	data, err := ioutil.ReadFile(settings.ConfInfo.Conf.Server.DataRoot + "/.nanogit/" + storeName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), parts[1]) {
+		t.Errorf("Token store contains the secret:\n%s", data)
+	}
+
+	// Two tokens never share a secret or a salt
+	other, otherToken, err := Create("alice", "fixme", "website", true, time.Time{})
+	if err != nil {
+		t.Fatalf("Create() == %v", err)
+	}
+	if other == value || otherToken.Salt == created.Salt || otherToken.Id == created.Id {
+		t.Errorf("Create() returned the same token twice: %s, %+v", other, otherToken)
+	}
+
+	for i, test := range []struct {
+		user string
+		org  string
+		repo string
+	}{
+		{"", "fixme", "website"},
+		{"alice", "", "website"},
+		{"alice", "fixme", ""},
+		{"alice", "*", "*"},
+	} {
+		if _, _, err := Create(test.user, test.org, test.repo, false, time.Time{}); err == nil {
+			t.Errorf("#%d: Create(%q, %q, %q) == nil, expected an error", i, test.user, test.org, test.repo)
+		}
+	}
+}
+
+// Hashes are the SHA-256 of the salt followed by the secret
+func TestHashSecret(t *testing.T) {
+	tests := []struct {
+		salt   string
+		secret string
+		hash   string
+	}{
+		{"", "abc", "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"},
+		{"a", "bc", "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"},
+		{"salt", "abc", "3681099918be28c95b81e27e7e5c2e4c6a6dea566d2d10e7f49139ebb779eb6f"},
+	}
+	for i, test := range tests {
+		if hash := hashSecret(test.salt, test.secret); hash != test.hash {
+			t.Errorf("#%d: hashSecret(%q, %q) == %s, expected %s", i, test.salt, test.secret, hash, test.hash)
+		}
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	defer setupStore(t)()
+
+	valid, _, err := Create("alice", "fixme", "website", false, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, _, err := Create("alice", "fixme", "website", false, time.Now().Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin, _, err := CreateAdmin("ci", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := strings.Split(valid, ".")[0]
+
+	tests := []struct {
+		user  string
+		value string
+		err   string
+	}{
+		{"alice", valid, ""},
+		{"bob", valid, "Invalid access token for user: bob"},
+		{"alice", expired, "Access token has expired"},
+		{"alice", id + ".wrongsecret", "Invalid access token for user: alice"},
+		{"alice", id, "Invalid access token for user: alice"},
+		{"alice", "", "Invalid access token for user: alice"},
+		// Admin tokens don't give access to repositories
+		{"ci", admin, "Invalid access token for user: ci"},
+	}
+	for i, test := range tests {
+		_, err := Authenticate(test.user, test.value)
+		if (err == nil) != (test.err == "") || (err != nil && !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("#%d: Authenticate(%s, %q) == %v, expected %q", i, test.user, test.value, err, test.err)
+		}
+	}
+
+	if _, err := AuthenticateAny(valid); err != nil {
+		t.Errorf("AuthenticateAny() == %v", err)
+	}
+	if _, err := AuthenticateAny(admin); err == nil {
+		t.Errorf("AuthenticateAny(admin token) == nil, expected an error")
+	}
+	if _, err := AuthenticateAdmin(admin); err != nil {
+		t.Errorf("AuthenticateAdmin() == %v", err)
+	}
+	if _, err := AuthenticateAdmin(valid); err == nil {
+		t.Errorf("AuthenticateAdmin(access token) == nil, expected an error")
+	}
+
+	// Revoked tokens are rejected
+	if err := Revoke(id); err != nil {
+		t.Fatalf("Revoke() == %v", err)
+	}
+	if _, err := Authenticate("alice", valid); err == nil {
+		t.Errorf("Authenticate() == nil after Revoke()")
+	}
+	if err := Revoke(id); err == nil {
+		t.Errorf("Revoke() == nil for an unknown token")
+	}
+	tokens, err := List("alice")
+	if err != nil || len(tokens) != 1 {
+		t.Errorf("List(alice) == %v, %v, expected the expired token only", tokens, err)
+	}
+	if tokens, _ := List(""); len(tokens) != 2 {
+		t.Errorf("List() == %v, expected every token", tokens)
+	}
+}
+
+// Only the secret of a token authenticates it: not the secret of another
+// token, nor its own once the stored hash is altered
+func TestAuthenticateSecret(t *testing.T) {
+	defer setupStore(t)()
+
+	value, created, err := Create("alice", "fixme", "website", false, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _, err := Create("alice", "fixme", "website", false, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, otherSecret := strings.Split(value, ".")[1], strings.Split(other, ".")[1]
+
+	for i, value := range []string{
+		created.Id + "." + otherSecret,
+		created.Id + "." + strings.ToUpper(secret),
+		created.Id + "." + secret + "0",
+		created.Id + "." + created.Hash,
+		"." + secret,
+		secret,
+	} {
+		if _, err := Authenticate("alice", value); err == nil {
+			t.Errorf("#%d: Authenticate(alice, %q) == nil, expected an error", i, value)
+		}
+	}
+
+	ts := tokenStore{}
+	err = store.Update(storeName, &ts, func() error {
+		for i := range ts.Tokens {
+			if ts.Tokens[i].Id == created.Id {
+				ts.Tokens[i].Hash = hashSecret(ts.Tokens[i].Salt, otherSecret)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Authenticate("alice", value); err == nil {
+		t.Errorf("Authenticate() == nil after the stored hash changed")
+	}
+	if _, err := Authenticate("alice", created.Id+"."+otherSecret); err != nil {
+		t.Errorf("Authenticate() == %v, expected the secret matching the stored hash to be accepted", err)
+	}
+}
+
+// Web tokens only log in to the web UI, API tokens only to the admin API
+func TestAuthenticateKinds(t *testing.T) {
+	defer setupStore(t)()
+
+	access, _, err := Create("alice", "fixme", "website", true, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	web, webToken, err := CreateWeb("alice", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	api, apiToken, err := CreateAPI("alice", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin, _, err := CreateAdmin("ci", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if webToken.Scope() != "web" || webToken.Write || apiToken.Scope() != "api" {
+		t.Errorf("Created %+v and %+v, expected a read only web token and an API token", webToken, apiToken)
+	}
+	if _, _, err := CreateWeb("", time.Time{}); err == nil {
+		t.Errorf("CreateWeb() == nil without user")
+	}
+	if _, _, err := CreateAPI("", time.Time{}); err == nil {
+		t.Errorf("CreateAPI() == nil without user")
+	}
+
+	authenticate := map[string]func(string) error{
+		"Authenticate":    func(v string) error { _, err := Authenticate("alice", v); return err },
+		"AuthenticateAny": func(v string) error { _, err := AuthenticateAny(v); return err },
+		"AuthenticateWeb": func(v string) error { _, err := AuthenticateWeb("alice", v); return err },
+		"AuthenticateAPI": func(v string) error { _, err := AuthenticateAPI(v); return err },
+	}
+	tests := []struct {
+		function string
+		value    string
+		ok       bool
+	}{
+		{"Authenticate", access, true},
+		{"Authenticate", web, false},
+		{"Authenticate", api, false},
+		{"AuthenticateAny", access, true},
+		{"AuthenticateAny", web, false},
+		{"AuthenticateAny", api, false},
+		{"AuthenticateWeb", access, true},
+		{"AuthenticateWeb", web, true},
+		{"AuthenticateWeb", api, false},
+		{"AuthenticateWeb", admin, false},
+		{"AuthenticateAPI", api, true},
+		{"AuthenticateAPI", access, false},
+		{"AuthenticateAPI", web, false},
+		{"AuthenticateAPI", admin, false},
+	}
+	for i, test := range tests {
+		if err := authenticate[test.function](test.value); (err == nil) != test.ok {
+			t.Errorf("#%d: %s() == %v, expected ok %v", i, test.function, err, test.ok)
+		}
+	}
+}
+
+func TestBasicAuth(t *testing.T) {
+	defer setupStore(t)()
+
+	value, _, err := Create("alice", "fixme", "website", false, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	web, _, err := CreateWeb("alice", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		user     string
+		password string
+		ok       bool
+	}{
+		{"alice", value, true},
+		{"bob", value, false},
+		{"alice", "", false},
+		{"alice", web, false},
+	}
+	for i, test := range tests {
+		r, _ := http.NewRequest("GET", "/", nil)
+		r.SetBasicAuth(test.user, test.password)
+		tok, err := BasicAuth(r)
+		if (err == nil) != test.ok {
+			t.Errorf("#%d: BasicAuth(%s) == %v, expected ok %v", i, test.user, err, test.ok)
+		}
+		if test.ok && (!tok.InScope("fixme", "website") || tok.Write) {
+			t.Errorf("#%d: BasicAuth(%s) == %+v, expected a read token on fixme/website", i, test.user, tok)
+		}
+	}
+	r, _ := http.NewRequest("GET", "/", nil)
+	if _, err := BasicAuth(r); err == nil {
+		t.Errorf("BasicAuth() == nil without credentials")
+	}
+}
+
+func TestInScope(t *testing.T) {
+	tests := []struct {
+		token    Token
+		org      string
+		repo     string
+		expected bool
+	}{
+		{Token{Org: "fixme", Repo: "website"}, "Fixme", "WEBSITE", true},
+		{Token{Org: "fixme", Repo: "website"}, "fixme", "blog", false},
+		{Token{Org: "*", Repo: "*"}, "qrclabs", "blog", false},
+		{Token{Web: true}, "qrclabs", "blog", true},
+		{Token{API: true}, "qrclabs", "blog", false},
+		{Token{Admin: true}, "qrclabs", "blog", false},
+	}
+	for i, test := range tests {
+		if actual := test.token.InScope(test.org, test.repo); actual != test.expected {
+			t.Errorf("#%d: InScope(%s, %s) == %v, expected %v", i, test.org, test.repo, actual, test.expected)
+		}
+	}
+}
@@ -0,0 +1,274 @@
+package web
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/dgellow/nanogit/git"
+)
+
+// Id of the empty tree, the base of the diff of root commits
+const emptyTree = "4b825dc642cb6eb9a060e54bf8d69288fbee4904"
+
+// Files bigger than this are only available raw
+const maxBlobSize = 1 << 20
+
+// Diffs are truncated after this size
+const maxDiffSize = 1 << 20
+
+// A git object the request asked for doesn't exist
+var errNotFound = fmt.Errorf("Not found")
+
+type ref struct {
+	Name    string
+	Commit  string
+	Date    string
+	Subject string
+}
+
+type commit struct {
+	Id      string
+	ShortId string
+	Author  string
+	Email   string
+	Date    string
+	Subject string
+	Parents []string
+	Body    string
+}
+
+type entry struct {
+	Mode string
+	Type string
+	Name string
+	Path string
+	Size string
+}
+
+type blob struct {
+	Size     int64
+	Binary   bool
+	TooLarge bool
+	Lines    []string
+}
+
+type diffLine struct {
+	Class string
+	Text  string
+}
+
+// Bare repository browsed by the UI
+type repository struct {
+	path string
+}
+
+// Returns the commit id of ref, HEAD if empty. Refs looking like options are
+// refused as git would parse them as such.
+func (r repository) resolve(ref string) (string, error) {
+	if ref == "" {
+		ref = "HEAD"
+	}
+	if strings.HasPrefix(ref, "-") {
+		return "", errNotFound
+	}
+	out, err := git.Run(r.path, nil, "rev-parse", "--verify", "--quiet", ref+"^{commit}")
+	if err != nil {
+		return "", errNotFound
+	}
+	return strings.TrimSpace(out), nil
+}
+
+// Refs under prefix, e.g. refs/heads, the most recent first
+func (r repository) refs(prefix string) ([]ref, error) {
+	out, err := git.Run(r.path, nil, "for-each-ref", "--sort=-creatordate",
+		"--format=%(refname:short)%00%(objectname)%00%(creatordate:short)%00%(subject)", prefix)
+	if err != nil {
+		return nil, err
+	}
+	refs := []ref{}
+	for _, line := range lines(out) {
+		fields := strings.SplitN(line, "\x00", 4)
+		if len(fields) != 4 {
+			continue
+		}
+		refs = append(refs, ref{Name: fields[0], Commit: fields[1], Date: fields[2], Subject: fields[3]})
+	}
+	return refs, nil
+}
+
+const commitFormat = "--format=%H%x00%h%x00%an%x00%ae%x00%ai%x00%s%x00%P"
+
+func parseCommit(record string) (commit, bool) {
+	fields := strings.SplitN(record, "\x00", 8)
+	if len(fields) < 7 {
+		return commit{}, false
+	}
+	c := commit{
+		Id:      fields[0],
+		ShortId: fields[1],
+		Author:  fields[2],
+		Email:   fields[3],
+		Date:    fields[4],
+		Subject: fields[5],
+		Parents: strings.Fields(fields[6]),
+	}
+	if len(fields) == 8 {
+		c.Body = strings.TrimSpace(fields[7])
+	}
+	return c, true
+}
+
+// Returns at most n commits reachable from id touching path, after skipping
+// the first ones, and whether more commits follow
+func (r repository) log(id string, path string, skip int, n int) ([]commit, bool, error) {
+	args := []string{"log", commitFormat,
+		"--skip=" + strconv.Itoa(skip), "--max-count=" + strconv.Itoa(n+1), id, "--"}
+	if path != "" {
+		args = append(args, path)
+	}
+	out, err := git.Run(r.path, nil, args...)
+	if err != nil {
+		return nil, false, err
+	}
+	commits := []commit{}
+	for _, line := range lines(out) {
+		if c, ok := parseCommit(line); ok {
+			commits = append(commits, c)
+		}
+	}
+	if len(commits) > n {
+		return commits[:n], true, nil
+	}
+	return commits, false, nil
+}
+
+func (r repository) commit(id string) (commit, error) {
+	out, err := git.Run(r.path, nil, "show", "--no-patch", commitFormat+"%x00%b", id)
+	if err != nil {
+		return commit{}, err
+	}
+	c, ok := parseCommit(strings.TrimRight(out, "\n"))
+	if !ok {
+		return commit{}, errNotFound
+	}
+	return c, nil
+}
+
+// Changes of the commit, compared to its first parent
+func (r repository) diff(c commit) ([]diffLine, bool, error) {
+	base := emptyTree
+	if len(c.Parents) > 0 {
+		base = c.Parents[0]
+	}
+	out, err := git.Run(r.path, nil, "diff", "--no-color", "--no-ext-diff", "-M", base, c.Id)
+	if err != nil {
+		return nil, false, err
+	}
+	truncated := len(out) > maxDiffSize
+	if truncated {
+		out = out[:maxDiffSize]
+	}
+	diff := []diffLine{}
+	for _, line := range lines(out) {
+		class := ""
+		switch {
+		case strings.HasPrefix(line, "diff --git "):
+			class = "file"
+		case strings.HasPrefix(line, "+++ "), strings.HasPrefix(line, "--- "):
+			class = "meta"
+		case strings.HasPrefix(line, "@@"):
+			class = "hunk"
+		case strings.HasPrefix(line, "+"):
+			class = "add"
+		case strings.HasPrefix(line, "-"):
+			class = "del"
+		}
+		diff = append(diff, diffLine{class, line})
+	}
+	return diff, truncated, nil
+}
+
+// Entries of the directory at path, directories first
+func (r repository) tree(id string, path string) ([]entry, error) {
+	spec := id + "^{tree}"
+	if path != "" {
+		spec = id + ":" + path
+	}
+	out, err := git.Run(r.path, nil, "ls-tree", "-z", "-l", spec)
+	if err != nil {
+		return nil, errNotFound
+	}
+	dirs, files := []entry{}, []entry{}
+	for _, record := range strings.Split(out, "\x00") {
+		tab := strings.Index(record, "\t")
+		if tab < 0 {
+			continue
+		}
+		fields := strings.Fields(record[:tab])
+		if len(fields) != 4 {
+			continue
+		}
+		e := entry{Mode: fields[0], Type: fields[1], Name: record[tab+1:], Size: fields[3]}
+		e.Path = e.Name
+		if path != "" {
+			e.Path = path + "/" + e.Name
+		}
+		if e.Type == "tree" {
+			dirs = append(dirs, e)
+		} else {
+			files = append(files, e)
+		}
+	}
+	return append(dirs, files...), nil
+}
+
+// Content of the file at path, split in lines unless binary or too large
+func (r repository) blob(id string, path string) (blob, error) {
+	spec := id + ":" + path
+	if out, err := git.Run(r.path, nil, "cat-file", "-t", spec); err != nil || strings.TrimSpace(out) != "blob" {
+		return blob{}, errNotFound
+	}
+	out, err := git.Run(r.path, nil, "cat-file", "-s", spec)
+	if err != nil {
+		return blob{}, err
+	}
+	b := blob{}
+	if b.Size, err = strconv.ParseInt(strings.TrimSpace(out), 10, 64); err != nil {
+		return blob{}, err
+	}
+	if b.Size > maxBlobSize {
+		b.TooLarge = true
+		return b, nil
+	}
+	content, err := git.Run(r.path, nil, "cat-file", "blob", spec)
+	if err != nil {
+		return blob{}, err
+	}
+	head := content
+	if len(head) > 8000 {
+		head = head[:8000]
+	}
+	if strings.IndexByte(head, 0) >= 0 {
+		b.Binary = true
+		return b, nil
+	}
+	b.Lines = lines(content)
+	return b, nil
+}
+
+// Command writing the content of the file at path to its stdout
+func (r repository) rawCommand(id string, path string) *exec.Cmd {
+	cmd := exec.Command("git", "cat-file", "blob", id+":"+path)
+	cmd.Dir = r.path
+	return cmd
+}
+
+func lines(out string) []string {
+	out = strings.TrimSuffix(out, "\n")
+	if out == "" {
+		return nil
+	}
+	return strings.Split(out, "\n")
+}
@@ -0,0 +1,130 @@
+package web
+
+import (
+	"html/template"
+)
+
+// Templates are compiled in, the binary is all the UI needs
+const layoutTemplate = `{{define "layout"}}<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}} - nanogit</title>
+<style>
+body { margin: 0; font-family: sans-serif; color: #222; }
+header { background: #2d2d2d; color: #eee; padding: 8px 16px; display: flex; justify-content: space-between; }
+header a { color: #fff; font-weight: bold; text-decoration: none; }
+header form { margin: 0; }
+main { padding: 8px 16px; }
+a { color: #0550ae; }
+nav a { margin-right: 12px; }
+table { border-collapse: collapse; }
+td, th { padding: 2px 12px 2px 0; text-align: left; vertical-align: top; }
+.muted { color: #777; }
+.error { color: #b00; }
+.code { font-family: monospace; white-space: pre; }
+.code td { padding: 0 8px; }
+.num { color: #999; text-align: right; user-select: none; }
+.add { background: #e6ffec; }
+.del { background: #ffebe9; }
+.hunk { color: #777; background: #f0f4ff; }
+.file, .meta { font-weight: bold; }
+</style>
+</head>
+<body>
+<header><a href="/">nanogit</a>{{if .User}}<form method="post" action="/logout">{{.User}} <button>Log out</button></form>{{end}}</header>
+<main>
+{{if .Repo}}<h2><a href="/">{{.Repo.Org}}</a> / <a href="{{.Repo.URL}}">{{.Repo.Name}}</a>{{if .Ref}} <span class="muted">@ {{.Ref}}</span>{{end}}</h2>
+<nav>
+<a href="{{.Repo.URL}}/-/tree?ref={{.Ref}}">Files</a>
+<a href="{{.Repo.URL}}/-/commits?ref={{.Ref}}">Commits</a>
+<a href="{{.Repo.URL}}/-/branches">Branches</a>
+<a href="{{.Repo.URL}}/-/tags">Tags</a>
+</nav>
+{{end}}
+{{template "content" .}}
+</main>
+</body>
+</html>
+{{end}}
+{{define "crumbs"}}<p><a href="{{.Repo.URL}}/-/tree?ref={{.Ref}}">{{.Repo.Name}}</a>{{range .Data.Crumbs}} / <a href="{{$.Repo.URL}}/-/tree?ref={{$.Ref}}&amp;path={{.Path}}">{{.Name}}</a>{{end}}</p>{{end}}`
+
+var pageTemplates = map[string]string{
+	"error": `{{define "content"}}<p class="error">{{.Data}}</p>{{end}}`,
+
+	"login": `{{define "content"}}<h2>Log in</h2>
+{{if .Data.Error}}<p class="error">{{.Data.Error}}</p>{{end}}
+<form method="post" action="/login">
+<input type="hidden" name="next" value="{{.Data.Next}}">
+<p><label>User<br><input name="user" value="{{.Data.User}}" autofocus></label></p>
+<p><label>Access token<br><input name="token" type="password"></label></p>
+<p><button>Log in</button></p>
+</form>
+<p class="muted">Create a token with: nanogit token create &lt;user&gt; '*'</p>{{end}}`,
+
+	"index": `{{define "content"}}{{range .Data}}<h3>{{.Name}}</h3>{{if .Description}}<p class="muted">{{.Description}}</p>{{end}}
+<ul>{{range .Repos}}<li><a href="{{.URL}}">{{.Name}}</a></li>{{end}}</ul>
+{{else}}<p>No repository to show.</p>{{end}}{{end}}`,
+
+	"tree": `{{define "content"}}{{template "crumbs" .}}
+{{if .Data.Empty}}<p>This repository is empty.</p>{{else}}<table>
+{{range .Data.Entries}}<tr>
+<td>{{if eq .Type "tree"}}<a href="{{$.Repo.URL}}/-/tree?ref={{$.Ref}}&amp;path={{.Path}}">{{.Name}}/</a>{{else if eq .Type "blob"}}<a href="{{$.Repo.URL}}/-/blob?ref={{$.Ref}}&amp;path={{.Path}}">{{.Name}}</a>{{else}}{{.Name}} <span class="muted">(submodule)</span>{{end}}</td>
+<td class="muted">{{if eq .Type "blob"}}{{.Size}}{{end}}</td>
+</tr>{{end}}
+</table>{{end}}{{end}}`,
+
+	"blob": `{{define "content"}}{{template "crumbs" .}}
+<p class="muted">{{.Data.Blob.Size}} bytes - <a href="{{.Repo.URL}}/-/raw?ref={{.Ref}}&amp;path={{.Data.Path}}">Raw</a> - <a href="{{.Repo.URL}}/-/commits?ref={{.Ref}}&amp;path={{.Data.Path}}">History</a></p>
+{{if .Data.Blob.Binary}}<p>Binary file not shown.</p>{{else if .Data.Blob.TooLarge}}<p>File too large to display.</p>{{else}}<table class="code">
+{{range $i, $line := .Data.Blob.Lines}}<tr id="L{{inc $i}}"><td class="num"><a href="#L{{inc $i}}">{{inc $i}}</a></td><td>{{$line}}</td></tr>
+{{end}}</table>{{end}}{{end}}`,
+
+	"commits": `{{define "content"}}{{if .Data.Path}}<p>History of {{.Data.Path}}</p>{{end}}
+<table>
+{{range .Data.Commits}}<tr>
+<td><a class="code" href="{{$.Repo.URL}}/-/commit?id={{.Id}}">{{.ShortId}}</a></td>
+<td>{{.Subject}}</td>
+<td class="muted">{{.Author}}</td>
+<td class="muted">{{.Date}}</td>
+</tr>{{else}}<tr><td>No commits.</td></tr>{{end}}
+</table>
+<p>{{if ge .Data.Prev 0}}<a href="{{.Repo.URL}}/-/commits?ref={{.Ref}}&amp;path={{.Data.Path}}&amp;skip={{.Data.Prev}}">Newer</a> {{end}}{{if .Data.Next}}<a href="{{.Repo.URL}}/-/commits?ref={{.Ref}}&amp;path={{.Data.Path}}&amp;skip={{.Data.Next}}">Older</a>{{end}}</p>{{end}}`,
+
+	"commit": `{{define "content"}}{{with .Data.Commit}}<h3>{{.Subject}}</h3>
+{{if .Body}}<p class="code">{{.Body}}</p>{{end}}
+<table>
+<tr><th>Commit</th><td class="code">{{.Id}}</td></tr>
+<tr><th>Author</th><td>{{.Author}} &lt;{{.Email}}&gt;</td></tr>
+<tr><th>Date</th><td>{{.Date}}</td></tr>
+{{range .Parents}}<tr><th>Parent</th><td><a class="code" href="{{$.Repo.URL}}/-/commit?id={{.}}">{{.}}</a></td></tr>{{end}}
+<tr><th>Files</th><td><a href="{{$.Repo.URL}}/-/tree?ref={{.Id}}">Browse</a></td></tr>
+</table>{{end}}
+<table class="code">
+{{range .Data.Diff}}<tr><td class="{{.Class}}">{{.Text}}</td></tr>
+{{end}}</table>
+{{if .Data.Truncated}}<p class="muted">Diff truncated.</p>{{end}}{{end}}`,
+
+	"refs": `{{define "content"}}<table>
+{{range .Data}}<tr>
+<td><a href="{{$.Repo.URL}}/-/tree?ref={{.Name}}">{{.Name}}</a></td>
+<td>{{.Subject}}</td>
+<td class="muted">{{.Date}}</td>
+<td><a class="code" href="{{$.Repo.URL}}/-/commit?id={{.Commit}}">{{printf "%.7s" .Commit}}</a></td>
+</tr>{{else}}<tr><td>None.</td></tr>{{end}}
+</table>{{end}}`,
+}
+
+var funcs = template.FuncMap{
+	"inc": func(i int) int { return i + 1 },
+}
+
+var templates = map[string]*template.Template{}
+
+func init() {
+	layout := template.Must(template.New("layout").Funcs(funcs).Parse(layoutTemplate))
+	for name, content := range pageTemplates {
+		templates[name] = template.Must(template.Must(layout.Clone()).Parse(content))
+	}
+}
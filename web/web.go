@@ -0,0 +1,450 @@
+package web
+
+import (
+	"bytes"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/dgellow/nanogit/auth"
+	"github.com/dgellow/nanogit/dir"
+	"github.com/dgellow/nanogit/log"
+	"github.com/dgellow/nanogit/settings"
+	"github.com/dgellow/nanogit/token"
+)
+
+// Cookie holding the credentials of the logged in user
+const cookieName = "nanogit_session"
+
+// Number of commits per page of the log
+const commitsPerPage = 50
+
+// Separates the repository path from the view in URLs, as org paths can be
+// nested, e.g. /org/sub/repo/-/commits
+const viewSeparator = "/-/"
+
+// Data of every page
+type page struct {
+	Title string
+	User  string
+	// Repository browsed, nil outside of repositories
+	Repo *repoLink
+	// Ref browsed, as given by the user
+	Ref  string
+	Data interface{}
+}
+
+type repoLink struct {
+	Org  string
+	Name string
+	URL  string
+}
+
+func newRepoLink(org string, repo string) *repoLink {
+	return &repoLink{Org: org, Name: repo, URL: "/" + org + "/" + repo}
+}
+
+type orgRepos struct {
+	Name        string
+	Description string
+	Repos       []*repoLink
+}
+
+type crumb struct {
+	Name string
+	Path string
+}
+
+// Handler serves the read-only web UI. Users log in with an access token,
+// they only see the repositories the token gives read access to, or with a
+// web token, showing every repository they can read.
+func Handler() http.Handler {
+	return http.HandlerFunc(serve)
+}
+
+func render(w http.ResponseWriter, status int, name string, p page) {
+	buf := new(bytes.Buffer)
+	if err := templates[name].ExecuteTemplate(buf, "layout", p); err != nil {
+		log.Error("web: cannot render %s: %v", name, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(buf.Bytes())
+}
+
+func renderError(w http.ResponseWriter, status int, user string, message string) {
+	render(w, status, "error", page{Title: http.StatusText(status), User: user, Data: message})
+}
+
+// Identifies the user, with the access token of the session cookie or sent
+// via HTTP Basic auth
+func authenticate(r *http.Request) (token.Token, bool) {
+	if cookie, err := r.Cookie(cookieName); err == nil {
+		if parts := strings.SplitN(cookie.Value, ":", 2); len(parts) == 2 {
+			user, err := url.QueryUnescape(parts[0])
+			if err == nil {
+				if t, err := token.AuthenticateWeb(user, parts[1]); err == nil {
+					return t, true
+				}
+			}
+		}
+	}
+	if user, value, ok := r.BasicAuth(); ok {
+		if t, err := token.AuthenticateWeb(user, value); err == nil {
+			return t, true
+		}
+	}
+	return token.Token{}, false
+}
+
+func serve(w http.ResponseWriter, r *http.Request) {
+	log.Trace("web: %s %s", r.Method, r.URL.Path)
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; form-action 'self'")
+
+	switch r.URL.Path {
+	case "/login":
+		login(w, r)
+		return
+	case "/logout":
+		logout(w, r)
+		return
+	}
+	if r.Method != "GET" && r.Method != "HEAD" {
+		renderError(w, http.StatusMethodNotAllowed, "", "Method not allowed")
+		return
+	}
+	t, ok := authenticate(r)
+	if !ok {
+		http.Redirect(w, r, "/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+		return
+	}
+	if r.URL.Path == "/" {
+		index(w, r, t)
+		return
+	}
+
+	repoPath, view := r.URL.Path, ""
+	if i := strings.Index(r.URL.Path, viewSeparator); i >= 0 {
+		repoPath, view = r.URL.Path[:i], r.URL.Path[i+len(viewSeparator):]
+	}
+	org, repo, err := dir.ParseRepoPath(repoPath)
+	if err != nil {
+		renderError(w, http.StatusNotFound, t.User, "Repository not found")
+		return
+	}
+	// Repositories the user can't read are reported as not found, not to
+	// reveal they exist
+	read, _ := auth.CheckTokenAuth(t, r.RemoteAddr, org, repo)
+	exists, _ := dir.IsRepoExist(org, repo)
+	if !read || !exists {
+		renderError(w, http.StatusNotFound, t.User, "Repository not found")
+		return
+	}
+	repoDir, err := dir.GetRepoDir(org, repo)
+	if err != nil {
+		renderError(w, http.StatusNotFound, t.User, "Repository not found")
+		return
+	}
+
+	p := page{Title: org + "/" + repo, User: t.User, Repo: newRepoLink(org, repo), Ref: r.URL.Query().Get("ref")}
+	rp := repository{repoDir}
+	switch view {
+	case "", "tree":
+		err = showTree(w, r, rp, p)
+	case "blob":
+		err = showBlob(w, r, rp, p)
+	case "raw":
+		err = showRaw(w, r, rp)
+	case "commits":
+		err = showCommits(w, r, rp, p)
+	case "commit":
+		err = showCommit(w, r, rp, p)
+	case "branches":
+		err = showRefs(w, rp, p, "Branches", "refs/heads")
+	case "tags":
+		err = showRefs(w, rp, p, "Tags", "refs/tags")
+	default:
+		err = errNotFound
+	}
+	if err == errNotFound {
+		renderError(w, http.StatusNotFound, t.User, "Not found")
+	} else if err != nil {
+		log.Error("web: %s: %v", r.URL.Path, err)
+		renderError(w, http.StatusInternalServerError, t.User, "Internal server error")
+	}
+}
+
+type loginForm struct {
+	User  string
+	Next  string
+	Error string
+}
+
+// Only local paths are followed after login
+func safeNext(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return next
+}
+
+func login(w http.ResponseWriter, r *http.Request) {
+	form := loginForm{Next: safeNext(r.FormValue("next"))}
+	if r.Method != "POST" {
+		render(w, http.StatusOK, "login", page{Title: "Log in", Data: form})
+		return
+	}
+	form.User = r.PostFormValue("user")
+	value := r.PostFormValue("token")
+	t, err := token.AuthenticateWeb(form.User, value)
+	if err != nil {
+		log.Error("web: login of %s: %v", form.User, err)
+		form.Error = "Invalid user or access token"
+		render(w, http.StatusUnauthorized, "login", page{Title: "Log in", Data: form})
+		return
+	}
+	cookie := &http.Cookie{
+		Name:     cookieName,
+		Value:    url.QueryEscape(t.User) + ":" + value,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+	}
+	if !t.Expires.IsZero() {
+		cookie.Expires = t.Expires
+	}
+	http.SetCookie(w, cookie)
+	http.Redirect(w, r, form.Next, http.StatusSeeOther)
+}
+
+func logout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		renderError(w, http.StatusMethodNotAllowed, "", "Method not allowed")
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: cookieName, Path: "/", MaxAge: -1, HttpOnly: true})
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
+// Lists the repositories the user can read, by org
+func index(w http.ResponseWriter, r *http.Request, t token.Token) {
+	repos, err := dir.ListRepos()
+	if err != nil {
+		log.Error("web: cannot list repositories: %v", err)
+		renderError(w, http.StatusInternalServerError, t.User, "Internal server error")
+		return
+	}
+	orgs := []*orgRepos{}
+	byOrg := map[string]*orgRepos{}
+	for _, repo := range repos {
+		if allowed, _ := auth.AddressAllowed(r.RemoteAddr, repo.Org, repo.Repo); !allowed {
+			continue
+		}
+		if read, _ := auth.CheckTokenAuth(t, r.RemoteAddr, repo.Org, repo.Repo); !read {
+			continue
+		}
+		org, ok := byOrg[repo.Org]
+		if !ok {
+			org = &orgRepos{Name: repo.Org}
+			if orgConfig, err := settings.ConfInfo.LookupOrgById(repo.Org); err == nil {
+				org.Description = orgConfig.Description
+			}
+			byOrg[repo.Org] = org
+			orgs = append(orgs, org)
+		}
+		org.Repos = append(org.Repos, newRepoLink(repo.Org, repo.Repo))
+	}
+	render(w, http.StatusOK, "index", page{Title: "Repositories", User: t.User, Data: orgs})
+}
+
+// Returns the path of a file or directory given in the query, paths going
+// up or relative to the working directory are refused
+func queryPath(r *http.Request) (string, error) {
+	path := strings.Trim(r.URL.Query().Get("path"), "/")
+	if path == "" {
+		return "", nil
+	}
+	for _, segment := range strings.Split(path, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return "", errNotFound
+		}
+	}
+	return path, nil
+}
+
+func crumbs(path string) []crumb {
+	if path == "" {
+		return nil
+	}
+	result := []crumb{}
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		result = append(result, crumb{segment, strings.Join(segments[:i+1], "/")})
+	}
+	return result
+}
+
+type treeView struct {
+	Crumbs  []crumb
+	Entries []entry
+	Empty   bool
+}
+
+func showTree(w http.ResponseWriter, r *http.Request, rp repository, p page) error {
+	path, err := queryPath(r)
+	if err != nil {
+		return err
+	}
+	id, err := rp.resolve(p.Ref)
+	if err != nil && p.Ref == "" && path == "" {
+		// HEAD doesn't resolve until the first push
+		render(w, http.StatusOK, "tree", page{Title: p.Title, User: p.User, Repo: p.Repo, Data: treeView{Empty: true}})
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	entries, err := rp.tree(id, path)
+	if err != nil {
+		return err
+	}
+	p.Data = treeView{Crumbs: crumbs(path), Entries: entries}
+	render(w, http.StatusOK, "tree", p)
+	return nil
+}
+
+type blobView struct {
+	Crumbs []crumb
+	Path   string
+	Blob   blob
+}
+
+func showBlob(w http.ResponseWriter, r *http.Request, rp repository, p page) error {
+	path, err := queryPath(r)
+	if err != nil || path == "" {
+		return errNotFound
+	}
+	id, err := rp.resolve(p.Ref)
+	if err != nil {
+		return err
+	}
+	b, err := rp.blob(id, path)
+	if err != nil {
+		return err
+	}
+	p.Title = path + " - " + p.Title
+	p.Data = blobView{Crumbs: crumbs(path), Path: path, Blob: b}
+	render(w, http.StatusOK, "blob", p)
+	return nil
+}
+
+// Sends the file as is, text files are shown as plain text by browsers
+func showRaw(w http.ResponseWriter, r *http.Request, rp repository) error {
+	path, err := queryPath(r)
+	if err != nil || path == "" {
+		return errNotFound
+	}
+	id, err := rp.resolve(r.URL.Query().Get("ref"))
+	if err != nil {
+		return err
+	}
+	b, err := rp.blob(id, path)
+	if err != nil {
+		return err
+	}
+	if b.Binary || b.TooLarge {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", "attachment")
+	} else {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	w.Header().Set("Content-Length", strconv.FormatInt(b.Size, 10))
+	cmd := rp.rawCommand(id, path)
+	cmd.Stdout = w
+	if err := cmd.Run(); err != nil {
+		log.Error("web: cannot send %s: %v", path, err)
+	}
+	return nil
+}
+
+type commitsView struct {
+	Path    string
+	Commits []commit
+	// Skip values of the newer and older pages, -1 and 0 if none
+	Prev int
+	Next int
+}
+
+func showCommits(w http.ResponseWriter, r *http.Request, rp repository, p page) error {
+	path, err := queryPath(r)
+	if err != nil {
+		return err
+	}
+	id, err := rp.resolve(p.Ref)
+	if err != nil {
+		return err
+	}
+	skip, _ := strconv.Atoi(r.URL.Query().Get("skip"))
+	if skip < 0 {
+		skip = 0
+	}
+	commits, more, err := rp.log(id, path, skip, commitsPerPage)
+	if err != nil {
+		return err
+	}
+	view := commitsView{Path: path, Commits: commits, Prev: -1}
+	if skip > 0 {
+		view.Prev = skip - commitsPerPage
+		if view.Prev < 0 {
+			view.Prev = 0
+		}
+	}
+	if more {
+		view.Next = skip + commitsPerPage
+	}
+	p.Title = "Commits - " + p.Title
+	p.Data = view
+	render(w, http.StatusOK, "commits", p)
+	return nil
+}
+
+type commitView struct {
+	Commit    commit
+	Diff      []diffLine
+	Truncated bool
+}
+
+func showCommit(w http.ResponseWriter, r *http.Request, rp repository, p page) error {
+	id, err := rp.resolve(r.URL.Query().Get("id"))
+	if err != nil || r.URL.Query().Get("id") == "" {
+		return errNotFound
+	}
+	c, err := rp.commit(id)
+	if err != nil {
+		return err
+	}
+	diff, truncated, err := rp.diff(c)
+	if err != nil {
+		return err
+	}
+	p.Title = c.Subject + " - " + p.Title
+	p.Data = commitView{c, diff, truncated}
+	render(w, http.StatusOK, "commit", p)
+	return nil
+}
+
+func showRefs(w http.ResponseWriter, rp repository, p page, title string, prefix string) error {
+	refs, err := rp.refs(prefix)
+	if err != nil {
+		return err
+	}
+	p.Title = title + " - " + p.Title
+	p.Data = refs
+	render(w, http.StatusOK, "refs", p)
+	return nil
+}
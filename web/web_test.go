@@ -0,0 +1,251 @@
+package web
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgellow/nanogit/config"
+	"github.com/dgellow/nanogit/fork"
+	"github.com/dgellow/nanogit/git"
+	"github.com/dgellow/nanogit/settings"
+	"github.com/dgellow/nanogit/token"
+)
+
+func run(t *testing.T, dir string, args ...string) {
+	args = append([]string{"-c", "user.name=nanogit", "-c", "user.email=nanogit@localhost"}, args...)
+	if _, err := git.Run(dir, nil, args...); err != nil {
+		t.Fatalf("Cannot run git %v: %v", args, err)
+	}
+}
+
+func writeFile(t *testing.T, path string, content string) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatalf("Cannot create directory of %s: %v", path, err)
+	}
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("Cannot write %s: %v", path, err)
+	}
+}
+
+// Client keeping the session cookie, not following redirects
+type client struct {
+	t      *testing.T
+	server *httptest.Server
+	cookie *http.Cookie
+}
+
+func (c *client) do(method string, path string, form url.Values) (*http.Response, string) {
+	var req *http.Request
+	var err error
+	if form != nil {
+		req, err = http.NewRequest(method, c.server.URL+path, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		req, err = http.NewRequest(method, c.server.URL+path, nil)
+	}
+	if err != nil {
+		c.t.Fatalf("Cannot create request: %v", err)
+	}
+	if c.cookie != nil {
+		req.AddCookie(c.cookie)
+	}
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		c.t.Fatalf("%s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		c.t.Fatalf("%s %s: cannot read body: %v", method, path, err)
+	}
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == cookieName {
+			c.cookie = cookie
+		}
+	}
+	return resp, string(body)
+}
+
+func (c *client) login(user string, value string) int {
+	resp, _ := c.do("POST", "/login", url.Values{"user": {user}, "token": {value}, "next": {"/"}})
+	return resp.StatusCode
+}
+
+func TestUI(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "nanogit-web")
+	if err != nil {
+		t.Fatalf("Cannot create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	work := filepath.Join(tmpDir, "work")
+	run(t, "", "init", "--quiet", work)
+	run(t, work, "symbolic-ref", "HEAD", "refs/heads/master")
+	writeFile(t, filepath.Join(work, "README"), "Hello <b>world</b>\nsecond line\n")
+	writeFile(t, filepath.Join(work, "src", "main.go"), "package main\n")
+	run(t, work, "add", ".")
+	run(t, work, "commit", "--quiet", "-m", "Initial commit")
+	run(t, work, "tag", "-a", "-m", "First release", "v1")
+	writeFile(t, filepath.Join(work, "README"), "Hello <b>world</b>\nchanged line\n")
+	writeFile(t, filepath.Join(work, "logo.png"), "\x89PNG\x00\x01")
+	run(t, work, "add", ".")
+	run(t, work, "commit", "--quiet", "-m", "Update readme", "-m", "With a logo")
+	run(t, work, "branch", "feature/login")
+
+	dataRoot := filepath.Join(tmpDir, "dataroot")
+	for _, path := range []string{"fixme/foo", "fixme/bar"} {
+		run(t, "", "clone", "--quiet", "--bare", work, filepath.Join(dataRoot, path))
+	}
+	run(t, "", "init", "--quiet", "--bare", filepath.Join(dataRoot, "fixme", "empty"))
+
+	settings.ConfInfo.Set(config.Config{
+		Server: config.ServerConfig{DataRoot: dataRoot},
+		Orgs: []config.OrgConfig{
+			{Id: "fixme", Description: "FIXME Hackerspace", Teams: []config.TeamConfig{{Name: "dev", Read: true}}},
+		},
+		Users: []config.UserConfig{{Name: "alice", Orgs: []config.UserOrgConfig{{Id: "fixme", Teams: []string{"dev"}}}}},
+	})
+	defer func() { settings.ConfInfo.Set(config.Config{}) }()
+
+	web, _, err := token.CreateWeb("alice", time.Time{})
+	if err != nil {
+		t.Fatalf("token.CreateWeb() == %v", err)
+	}
+	fooOnly, fooToken, err := token.Create("alice", "fixme", "foo", false, time.Time{})
+	if err != nil {
+		t.Fatalf("token.Create() == %v", err)
+	}
+
+	server := httptest.NewServer(Handler())
+	defer server.Close()
+
+	anonymous := &client{t: t, server: server}
+	if resp, _ := anonymous.do("GET", "/fixme/foo", nil); resp.StatusCode != http.StatusSeeOther || resp.Header.Get("Location") != "/login?next=%2Ffixme%2Ffoo" {
+		t.Errorf("Anonymous request == %d to %q, expected a redirect to the login page", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	if status := anonymous.login("alice", "wrong.token"); status != http.StatusUnauthorized || anonymous.cookie != nil {
+		t.Errorf("Login with an invalid token == %d, expected %d without session", status, http.StatusUnauthorized)
+	}
+
+	c := &client{t: t, server: server}
+	if status := c.login("alice", web); status != http.StatusSeeOther || c.cookie == nil {
+		t.Fatalf("Login == %d, expected %d with a session", status, http.StatusSeeOther)
+	}
+
+	tests := []struct {
+		path     string
+		status   int
+		contains []string
+		excludes []string
+	}{
+		{"/", http.StatusOK, []string{`href="/fixme/foo"`, `href="/fixme/bar"`, "FIXME Hackerspace"}, nil},
+		{"/fixme/missing", http.StatusNotFound, nil, nil},
+		{"/fixme/foo", http.StatusOK, []string{"README", "src/", "logo.png"}, nil},
+		{"/fixme/foo.git/-/tree?path=src", http.StatusOK, []string{"main.go"}, []string{"README"}},
+		{"/fixme/foo/-/tree?ref=v1", http.StatusOK, []string{"README"}, []string{"logo.png"}},
+		{"/fixme/foo/-/tree?ref=feature/login", http.StatusOK, []string{"logo.png"}, nil},
+		{"/fixme/foo/-/tree?ref=--output=/tmp/x", http.StatusNotFound, nil, nil},
+		{"/fixme/foo/-/tree?path=../bar", http.StatusNotFound, nil, nil},
+		{"/fixme/empty", http.StatusOK, []string{"This repository is empty."}, nil},
+		{"/fixme/foo/-/blob?path=README", http.StatusOK, []string{"Hello &lt;b&gt;world&lt;/b&gt;", `id="L2"`, "changed line"}, []string{"<b>"}},
+		{"/fixme/foo/-/blob?path=README&ref=v1", http.StatusOK, []string{"second line"}, nil},
+		{"/fixme/foo/-/blob?path=logo.png", http.StatusOK, []string{"Binary file not shown."}, nil},
+		{"/fixme/foo/-/blob?path=src", http.StatusNotFound, nil, nil},
+		{"/fixme/foo/-/raw?path=README", http.StatusOK, []string{"Hello <b>world</b>\nchanged line\n"}, nil},
+		{"/fixme/foo/-/commits", http.StatusOK, []string{"Update readme", "Initial commit"}, nil},
+		{"/fixme/foo/-/commits?path=src", http.StatusOK, []string{"Initial commit"}, []string{"Update readme"}},
+		{"/fixme/foo/-/commit?id=master", http.StatusOK, []string{"With a logo", `class="del">-second line`, `class="add">&#43;changed line`}, nil},
+		{"/fixme/foo/-/commit?id=v1", http.StatusOK, []string{"Initial commit", `class="add">&#43;package main`}, nil},
+		{"/fixme/foo/-/commit", http.StatusNotFound, nil, nil},
+		{"/fixme/foo/-/branches", http.StatusOK, []string{"master", "feature/login"}, nil},
+		{"/fixme/foo/-/tags", http.StatusOK, []string{"v1", "First release"}, nil},
+		{"/fixme/foo/-/unknown", http.StatusNotFound, nil, nil},
+	}
+	for i, test := range tests {
+		resp, body := c.do("GET", test.path, nil)
+		if resp.StatusCode != test.status {
+			t.Errorf("#%d: GET %s == %d, expected %d", i, test.path, resp.StatusCode, test.status)
+			continue
+		}
+		for _, s := range test.contains {
+			if !strings.Contains(body, s) {
+				t.Errorf("#%d: GET %s doesn't contain %q", i, test.path, s)
+			}
+		}
+		for _, s := range test.excludes {
+			if strings.Contains(body, s) {
+				t.Errorf("#%d: GET %s contains %q", i, test.path, s)
+			}
+		}
+	}
+
+	// Nothing of a fork is readable from its source
+	if err := fork.Create("fixme", "foo", "~alice", "foo"); err != nil {
+		t.Fatalf("fork.Create() == %v", err)
+	}
+	run(t, work, "commit", "--quiet", "--allow-empty", "-m", "Private change")
+	run(t, work, "push", "--quiet", filepath.Join(dataRoot, "~", "alice", "foo"), "HEAD:refs/heads/private")
+	private, err := git.Run(work, nil, "rev-parse", "HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fork.Protect("fixme", "foo"); err != nil {
+		t.Fatalf("fork.Protect() == %v", err)
+	}
+	for _, path := range []string{
+		"/fixme/foo/-/tree?ref=refs/forks/u/alice/foo/heads/private",
+		"/fixme/foo/-/tree?ref=forks/u/alice/foo/heads/private",
+		"/fixme/foo/-/commit?id=" + strings.TrimSpace(private),
+	} {
+		if resp, _ := c.do("GET", path, nil); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("GET %s == %d, expected %d", path, resp.StatusCode, http.StatusNotFound)
+		}
+	}
+
+	// A token scoped to a repository only shows that repository
+	scoped := &client{t: t, server: server}
+	scoped.login("alice", fooOnly)
+	if _, body := scoped.do("GET", "/", nil); !strings.Contains(body, `href="/fixme/foo"`) || strings.Contains(body, `href="/fixme/bar"`) {
+		t.Errorf("Repositories of a scoped token == %s, expected only fixme/foo", body)
+	}
+	if resp, _ := scoped.do("GET", "/fixme/bar", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("GET /fixme/bar with a scoped token == %d, expected %d", resp.StatusCode, http.StatusNotFound)
+	}
+
+	// Revoking the token ends the session
+	if err := token.Revoke(fooToken.Id); err != nil {
+		t.Fatalf("token.Revoke() == %v", err)
+	}
+	if resp, _ := scoped.do("GET", "/fixme/foo", nil); resp.StatusCode != http.StatusSeeOther {
+		t.Errorf("GET /fixme/foo with a revoked token == %d, expected %d", resp.StatusCode, http.StatusSeeOther)
+	}
+
+	if resp, _ := c.do("POST", "/logout", url.Values{}); resp.StatusCode != http.StatusSeeOther || c.cookie.MaxAge >= 0 {
+		t.Errorf("Logout == %d, expected the session cookie to be removed", resp.StatusCode)
+	}
+}
+
+func TestSafeNext(t *testing.T) {
+	tests := []struct {
+		next     string
+		expected string
+	}{
+		{"/fixme/foo/-/commits?ref=master", "/fixme/foo/-/commits?ref=master"},
+		{"", "/"},
+		{"https://example.com/", "/"},
+		{"//example.com/", "/"},
+		{"/\\example.com/", "/"},
+	}
+	for i, test := range tests {
+		if actual := safeNext(test.next); actual != test.expected {
+			t.Errorf("#%d: safeNext(%q) == %q, expected %q", i, test.next, actual, test.expected)
+		}
+	}
+}